@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deejross/dep-registry/util"
+)
+
+var (
+	// ErrAccessTokenAlreadyExists indicates a personal access token with the same ID already exists.
+	ErrAccessTokenAlreadyExists = errors.New("Access token already exists")
+
+	// ErrAccessTokenDoesNotExist indicates the given personal access token does not exist.
+	ErrAccessTokenDoesNotExist = errors.New("Access token does not exist")
+
+	// ErrAccessTokenInvalid indicates a personal access token is malformed, revoked, expired or does not match.
+	ErrAccessTokenInvalid = errors.New("Invalid access token")
+
+	// ErrAccessTokenNameEmpty indicates the given personal access token name was empty.
+	ErrAccessTokenNameEmpty = errors.New("Access token name cannot be empty")
+
+	// ErrInvalidScope indicates a personal access token was given no scope or an unknown one.
+	ErrInvalidScope = errors.New("Scopes must be one or more of read, publish and admin")
+
+	// ErrNotSupported indicates the backend cannot store what was given to it.
+	ErrNotSupported = errors.New("Not supported by this auth backend")
+)
+
+// AccessTokenPrefix starts every personal access token, telling them apart from login tokens.
+const AccessTokenPrefix = "goreg_"
+
+// Scope is a permission granted to a personal access token.
+type Scope string
+
+const (
+	// ScopeRead allows downloading.
+	ScopeRead Scope = "read"
+
+	// ScopePublish allows publishing, it includes ScopeRead.
+	ScopePublish Scope = "publish"
+
+	// ScopeAdmin allows everything the user may do, it includes ScopePublish.
+	ScopeAdmin Scope = "admin"
+)
+
+// scopeLevels orders the scopes, each includes those below it.
+var scopeLevels = map[Scope]int{
+	ScopeRead:    1,
+	ScopePublish: 2,
+	ScopeAdmin:   3,
+}
+
+// AccessToken is a personal access token, a long-lived credential for a user limited to its scopes and,
+// if Prefix is set, to the Imports below it. Only a hash of the token is stored.
+type AccessToken struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash,omitempty"`
+	Scopes    []Scope   `json:"scopes"`
+	Prefix    string    `json:"prefix,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// NewAccessToken creates an AccessToken for a user, returning it along with the token to give to
+// them, which cannot be recovered later. A zero expiresAt never expires.
+func NewAccessToken(username, name string, scopes []Scope, prefix string, expiresAt time.Time) (*AccessToken, string, error) {
+	if len(username) == 0 {
+		return nil, "", ErrUsernameEmpty
+	}
+	if len(name) == 0 {
+		return nil, "", ErrAccessTokenNameEmpty
+	}
+	if len(scopes) == 0 {
+		return nil, "", ErrInvalidScope
+	}
+	for _, s := range scopes {
+		if scopeLevels[s] == 0 {
+			return nil, "", ErrInvalidScope
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+
+	t := &AccessToken{
+		ID:        util.UUID4(),
+		Username:  username,
+		Name:      name,
+		Scopes:    scopes,
+		Prefix:    strings.TrimSuffix(prefix, "/"),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt.UTC(),
+	}
+	token := AccessTokenPrefix + t.ID + "_" + base64.RawURLEncoding.EncodeToString(b)
+	t.Hash = hashAccessToken(token)
+
+	return t, token, nil
+}
+
+// AccessTokenID returns the ID of a personal access token, or false if the token is not one.
+func AccessTokenID(token string) (string, bool) {
+	if !strings.HasPrefix(token, AccessTokenPrefix) {
+		return "", false
+	}
+
+	parts := strings.SplitN(token[len(AccessTokenPrefix):], "_", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// Check returns nil if token is this AccessToken and it has not expired.
+func (t *AccessToken) Check(token string) error {
+	if subtle.ConstantTimeCompare([]byte(hashAccessToken(token)), []byte(t.Hash)) != 1 {
+		return ErrAccessTokenInvalid
+	}
+	if !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt) {
+		return ErrAccessTokenInvalid
+	}
+	return nil
+}
+
+// Allows reports whether the AccessToken grants scope on the Import with the given URL.
+// An empty URL is for actions on the whole registry, which prefixed tokens are not allowed.
+func (t *AccessToken) Allows(scope Scope, importURL string) bool {
+	if len(t.Prefix) > 0 && importURL != t.Prefix && !strings.HasPrefix(importURL, t.Prefix+"/") {
+		return false
+	}
+
+	for _, s := range t.Scopes {
+		if scopeLevels[s] >= scopeLevels[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAccessToken hashes a token for storage. Tokens are random, so a fast hash is enough.
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clone returns a copy of the AccessToken that shares nothing with it.
+func (t *AccessToken) clone() *AccessToken {
+	c := *t
+	c.Scopes = append([]Scope(nil), t.Scopes...)
+	return &c
+}
+
+// sortAccessTokens sorts tokens by creation time, then ID.
+func sortAccessTokens(tokens []*AccessToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+}
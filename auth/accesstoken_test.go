@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessToken(t *testing.T) {
+	token, secret, err := NewAccessToken("username", "ci", []Scope{ScopePublish}, "example.com/team/", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, ok := AccessTokenID(secret); !ok || id != token.ID {
+		t.Fatal("Expected the ID of the token, got", id, ok)
+	}
+	if _, ok := AccessTokenID("eyJhbGciOiJIUzI1NiJ9.e30.signature"); ok {
+		t.Fatal("Expected a login token not to be an access token")
+	}
+
+	if err := token.Check(secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := token.Check(secret + "x"); err != ErrAccessTokenInvalid {
+		t.Fatal("Expected ErrAccessTokenInvalid, got", err)
+	}
+
+	token.ExpiresAt = time.Now().Add(-time.Second)
+	if err := token.Check(secret); err != ErrAccessTokenInvalid {
+		t.Fatal("Expected an expired token to be invalid, got", err)
+	}
+}
+
+func TestAccessTokenAllows(t *testing.T) {
+	token, _, err := NewAccessToken("username", "ci", []Scope{ScopePublish}, "example.com/team/", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		scope     Scope
+		importURL string
+		allowed   bool
+	}{
+		{ScopeRead, "example.com/team/pkg", true},
+		{ScopePublish, "example.com/team/pkg", true},
+		{ScopePublish, "example.com/team", true},
+		{ScopeAdmin, "example.com/team/pkg", false},
+		{ScopePublish, "example.com/teammate/pkg", false},
+		{ScopeRead, "example.com/other", false},
+		{ScopeRead, "", false},
+	} {
+		if token.Allows(test.scope, test.importURL) != test.allowed {
+			t.Fatal("Expected", test.scope, "on", test.importURL, "allowed to be", test.allowed)
+		}
+	}
+}
+
+func TestNewAccessTokenInvalid(t *testing.T) {
+	if _, _, err := NewAccessToken("username", "", []Scope{ScopeRead}, "", time.Time{}); err != ErrAccessTokenNameEmpty {
+		t.Fatal("Expected ErrAccessTokenNameEmpty, got", err)
+	}
+	if _, _, err := NewAccessToken("username", "ci", nil, "", time.Time{}); err != ErrInvalidScope {
+		t.Fatal("Expected ErrInvalidScope, got", err)
+	}
+	if _, _, err := NewAccessToken("username", "ci", []Scope{"write"}, "", time.Time{}); err != ErrInvalidScope {
+		t.Fatal("Expected ErrInvalidScope, got", err)
+	}
+}
@@ -1,6 +1,9 @@
 package auth
 
 import (
+	"context"
+	"time"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -9,27 +12,114 @@ type User struct {
 	Username string `json:"username,omitempty"`
 	Disabled bool   `json:"disabled,omitempty"`
 	Admin    bool   `json:"admin,omitempty"`
+
+	// SessionsRevokedAt is a Unix time, tokens issued to the user at or before it are refused.
+	SessionsRevokedAt int64 `json:"sessions_revoked_at,omitempty"`
+}
+
+// RevokedToken is a login or refresh token that has been revoked before it expired.
+type RevokedToken struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 // Auth provides authentication.
 type Auth interface {
 	// Login validates the given credentials and if successful, generates a token.
-	Login(username, password string) (string, error)
+	Login(ctx context.Context, username, password string) (string, error)
 
 	// AddUser adds a new user.
-	AddUser(user *User) error
+	AddUser(ctx context.Context, user *User) error
 
 	// UpdateUser updates an existing user.
-	UpdateUser(user *User) error
+	UpdateUser(ctx context.Context, user *User) error
 
 	// SetPassword sets a password for a user.
-	SetPassword(username, password string) error
+	SetPassword(ctx context.Context, username, password string) error
 
 	// GetUser gets a User object.
-	GetUser(username string) (*User, error)
+	GetUser(ctx context.Context, username string) (*User, error)
 
 	// DeleteUser deletes a User.
-	DeleteUser(username string) error
+	DeleteUser(ctx context.Context, username string) error
+
+	// ListUsers lists all Users sorted by username.
+	ListUsers(ctx context.Context) ([]*User, error)
+
+	// GetPasswordHash gets the stored password hash of a user, nil if no password has been set.
+	GetPasswordHash(ctx context.Context, username string) ([]byte, error)
+
+	// SetPasswordHash sets the password hash of a user as returned by GetPasswordHash.
+	SetPasswordHash(ctx context.Context, username string, hash []byte) error
+
+	// AddAccessToken adds a personal access token for an existing user.
+	AddAccessToken(ctx context.Context, token *AccessToken) error
+
+	// GetAccessToken gets a personal access token by ID.
+	GetAccessToken(ctx context.Context, id string) (*AccessToken, error)
+
+	// UpdateAccessToken updates an existing personal access token.
+	UpdateAccessToken(ctx context.Context, token *AccessToken) error
+
+	// DeleteAccessToken deletes a personal access token.
+	DeleteAccessToken(ctx context.Context, id string) error
+
+	// ListAccessTokens lists the personal access tokens of a user sorted by creation time.
+	ListAccessTokens(ctx context.Context, username string) ([]*AccessToken, error)
+
+	// RevokeToken revokes the token with the given ID, it is remembered until it expires.
+	RevokeToken(ctx context.Context, token *RevokedToken) error
+
+	// TokenRevoked reports whether the token with the given ID has been revoked.
+	TokenRevoked(ctx context.Context, id string) (bool, error)
+
+	// ListRevokedTokens lists the revoked tokens that have not expired, sorted by ID.
+	ListRevokedTokens(ctx context.Context) ([]*RevokedToken, error)
+
+	// AddTeam adds a new team, its members must exist.
+	AddTeam(ctx context.Context, team *Team) error
+
+	// GetTeam gets a team, its members sorted.
+	GetTeam(ctx context.Context, name string) (*Team, error)
+
+	// UpdateTeam updates an existing team, replacing its members.
+	UpdateTeam(ctx context.Context, team *Team) error
+
+	// DeleteTeam deletes a team.
+	DeleteTeam(ctx context.Context, name string) error
+
+	// ListTeams lists all teams sorted by name.
+	ListTeams(ctx context.Context) ([]*Team, error)
+
+	// AddTeamMember adds an existing user to a team, it is not an error if they are already a member.
+	AddTeamMember(ctx context.Context, team, username string) error
+
+	// RemoveTeamMember removes a user from a team, it is not an error if they are not a member.
+	RemoveTeamMember(ctx context.Context, team, username string) error
+
+	// ListUserTeams lists the names of the teams a user is a member of, sorted.
+	ListUserTeams(ctx context.Context, username string) ([]string, error)
+
+	// GetLoginAttempts gets the failed logins recorded under a key, nil if there are none or they have expired.
+	GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error)
+
+	// SetLoginAttempts records failed logins until they expire, removing those that have expired.
+	SetLoginAttempts(ctx context.Context, attempts *LoginAttempts) error
+
+	// DeleteLoginAttempts forgets the failed logins recorded under a key.
+	DeleteLoginAttempts(ctx context.Context, key string) error
+
+	// ListLoginAttempts lists the failed logins that have not expired, sorted by key.
+	ListLoginAttempts(ctx context.Context) ([]*LoginAttempts, error)
+
+	// GetTOTP gets the two-factor authentication enrollment of a user, nil if they have none.
+	GetTOTP(ctx context.Context, username string) (*TOTP, error)
+
+	// SetTOTP adds or replaces the two-factor authentication enrollment of an existing user.
+	SetTOTP(ctx context.Context, totp *TOTP) error
+
+	// DeleteTOTP removes the two-factor authentication enrollment of a user.
+	DeleteTOTP(ctx context.Context, username string) error
 }
 
 // HashPassword creates a secure hash of a password for storage.
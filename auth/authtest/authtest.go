@@ -0,0 +1,777 @@
+// Package authtest provides a conformance suite that every Auth backend must pass.
+package authtest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+)
+
+// Run the conformance suite. newAuth must return a new Auth without any users each time it is
+// called, generating tokens with tm.
+func Run(t *testing.T, tm *auth.TokenManager, newAuth func(t *testing.T) auth.Auth) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, tm *auth.TokenManager, a auth.Auth)
+	}{
+		{"AddGetUser", testAddGetUser},
+		{"AddUserDuplicate", testAddUserDuplicate},
+		{"UserNotFound", testUserNotFound},
+		{"UsernameEmpty", testUsernameEmpty},
+		{"UpdateUser", testUpdateUser},
+		{"EnableDisableUser", testEnableDisableUser},
+		{"DeleteUser", testDeleteUser},
+		{"ListUsers", testListUsers},
+		{"PasswordHash", testPasswordHash},
+		{"Login", testLogin},
+		{"LoginWrongPassword", testLoginWrongPassword},
+		{"PasswordTooShort", testPasswordTooShort},
+		{"ConcurrentAddUser", testConcurrentAddUser},
+		{"AccessTokens", testAccessTokens},
+		{"DeleteUserAccessTokens", testDeleteUserAccessTokens},
+		{"RevokedTokens", testRevokedTokens},
+		{"SessionsRevokedAt", testSessionsRevokedAt},
+		{"Teams", testTeams},
+		{"DeleteUserTeams", testDeleteUserTeams},
+		{"LoginAttempts", testLoginAttempts},
+		{"TOTP", testTOTP},
+		{"Identities", testIdentities},
+	}
+
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			fn(t, tm, newAuth(t))
+		})
+	}
+}
+
+func addUser(t *testing.T, a auth.Auth, username, password string) {
+	ctx := context.Background()
+
+	if err := a.AddUser(ctx, &auth.User{Username: username}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetPassword(ctx, username, password); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAddGetUser(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	if err := a.AddUser(ctx, &auth.User{Username: "username", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := a.GetUser(ctx, "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "username" || !user.Admin || user.Disabled {
+		t.Fatal("Expected admin user 'username', got", user)
+	}
+}
+
+func testAddUserDuplicate(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	if err := a.AddUser(ctx, &auth.User{Username: "username", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.AddUser(ctx, &auth.User{Username: "username"}); err != auth.ErrUserAlreadyExists {
+		t.Fatal("Expected ErrUserAlreadyExists, got", err)
+	}
+
+	if user, err := a.GetUser(ctx, "username"); err != nil || !user.Admin {
+		t.Fatal("Expected existing user to be kept, got", user, err)
+	}
+}
+
+func testUserNotFound(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	if user, err := a.GetUser(ctx, "username"); err != auth.ErrUserDoesNotExist || user != nil {
+		t.Fatal("Expected nil user and ErrUserDoesNotExist, got", user, err)
+	}
+	if err := a.UpdateUser(ctx, &auth.User{Username: "username"}); err != auth.ErrUserDoesNotExist {
+		t.Fatal("Expected ErrUserDoesNotExist, got", err)
+	}
+	if token, err := a.Login(ctx, "username", "password"); err != auth.ErrInvalidCredentials || len(token) > 0 {
+		t.Fatal("Expected login of unknown user to fail with ErrInvalidCredentials, got", err)
+	}
+	if err := a.DeleteUser(ctx, "username"); err != nil {
+		t.Fatal("Expected deleting an unknown user to succeed, got", err)
+	}
+}
+
+func testUsernameEmpty(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	if err := a.AddUser(ctx, &auth.User{}); err != auth.ErrUsernameEmpty {
+		t.Fatal("Expected ErrUsernameEmpty, got", err)
+	}
+	if err := a.UpdateUser(ctx, &auth.User{}); err != auth.ErrUsernameEmpty {
+		t.Fatal("Expected ErrUsernameEmpty, got", err)
+	}
+	if err := a.SetPassword(ctx, "", "password"); err != auth.ErrUsernameEmpty {
+		t.Fatal("Expected ErrUsernameEmpty, got", err)
+	}
+	if _, err := a.GetUser(ctx, ""); err != auth.ErrUsernameEmpty {
+		t.Fatal("Expected ErrUsernameEmpty, got", err)
+	}
+	if _, err := a.Login(ctx, "", "password"); err != auth.ErrUsernameEmpty {
+		t.Fatal("Expected ErrUsernameEmpty, got", err)
+	}
+	if err := a.DeleteUser(ctx, ""); err != auth.ErrUsernameEmpty {
+		t.Fatal("Expected ErrUsernameEmpty, got", err)
+	}
+}
+
+func testUpdateUser(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "username", "password")
+
+	if err := a.UpdateUser(ctx, &auth.User{Username: "username", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if user, err := a.GetUser(ctx, "username"); err != nil || !user.Admin {
+		t.Fatal("Expected user to be updated, got", user, err)
+	}
+
+	// Updating a user must not change their password.
+	if _, err := a.Login(ctx, "username", "password"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testEnableDisableUser(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "username", "password")
+
+	if err := a.UpdateUser(ctx, &auth.User{Username: "username", Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := a.GetUser(ctx, "username"); err != nil || !user.Disabled {
+		t.Fatal("Expected user to be disabled, got", user, err)
+	}
+
+	if err := a.UpdateUser(ctx, &auth.User{Username: "username"}); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := a.GetUser(ctx, "username"); err != nil || user.Disabled {
+		t.Fatal("Expected user to be enabled, got", user, err)
+	}
+}
+
+func testDeleteUser(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "username", "password")
+	addUser(t, a, "other", "password")
+
+	if err := a.DeleteUser(ctx, "username"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.GetUser(ctx, "username"); err != auth.ErrUserDoesNotExist {
+		t.Fatal("Expected ErrUserDoesNotExist, got", err)
+	}
+	if _, err := a.Login(ctx, "username", "password"); err == nil {
+		t.Fatal("Expected login of deleted user to fail")
+	}
+	if _, err := a.GetUser(ctx, "other"); err != nil {
+		t.Fatal("Expected other user to be kept, got", err)
+	}
+}
+
+func testListUsers(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	users, err := a.ListUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatal("Expected no users, got", users)
+	}
+
+	addUser(t, a, "charlie", "password")
+	addUser(t, a, "alice", "password")
+	if err := a.AddUser(ctx, &auth.User{Username: "bob", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err = a.ListUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 || users[0].Username != "alice" || users[1].Username != "bob" || users[2].Username != "charlie" {
+		t.Fatal("Expected alice, bob and charlie, got", users)
+	}
+	if !users[1].Admin {
+		t.Fatal("Expected bob to be an admin")
+	}
+}
+
+func testPasswordHash(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "username", "password")
+	if err := a.AddUser(ctx, &auth.User{Username: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := a.GetPasswordHash(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash) != 0 {
+		t.Fatal("Expected no password hash, got", hash)
+	}
+
+	hash, err = a.GetPasswordHash(ctx, "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetPasswordHash(ctx, "other", hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Login(ctx, "other", "password"); err != nil {
+		t.Fatal("Expected login with copied password hash to succeed, got", err)
+	}
+
+	if _, err := a.GetPasswordHash(ctx, "missing"); err != auth.ErrUserDoesNotExist {
+		t.Fatal("Expected ErrUserDoesNotExist, got", err)
+	}
+	if err := a.SetPasswordHash(ctx, "missing", hash); err != auth.ErrUserDoesNotExist {
+		t.Fatal("Expected ErrUserDoesNotExist, got", err)
+	}
+}
+
+func testLogin(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "username", "password")
+
+	token, err := a.Login(ctx, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	username, err := tm.Validate(token)
+	if err != nil {
+		t.Fatal("Token", token, "did not validate:", err)
+	}
+	if username != "username" {
+		t.Fatal("Expected username, got", username)
+	}
+}
+
+func testLoginWrongPassword(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "username", "password")
+
+	if token, err := a.Login(ctx, "username", "wrong-password"); err != auth.ErrInvalidCredentials || len(token) > 0 {
+		t.Fatal("Expected login with wrong password to fail")
+	}
+
+	if err := a.SetPassword(ctx, "username", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Login(ctx, "username", "password"); err == nil {
+		t.Fatal("Expected login with old password to fail")
+	}
+	if _, err := a.Login(ctx, "username", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPasswordTooShort(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	if err := a.AddUser(ctx, &auth.User{Username: "username"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.SetPassword(ctx, "username", "short"); err != auth.ErrPasswordTooShort {
+		t.Fatal("Expected ErrPasswordTooShort, got", err)
+	}
+	if _, err := a.Login(ctx, "username", "short"); err != auth.ErrPasswordTooShort {
+		t.Fatal("Expected ErrPasswordTooShort, got", err)
+	}
+}
+
+func testConcurrentAddUser(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	count := 20
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- a.AddUser(ctx, &auth.User{Username: "username"})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else if err != auth.ErrUserAlreadyExists {
+			t.Fatal("Expected ErrUserAlreadyExists, got", err)
+		}
+	}
+
+	if succeeded != 1 {
+		t.Fatal("Expected exactly 1 AddUser to succeed, got", succeeded)
+	}
+}
+
+func newAccessToken(t *testing.T, username, name string) *auth.AccessToken {
+	token, _, err := auth.NewAccessToken(username, name, []auth.Scope{auth.ScopePublish}, "example.com/team", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func testAccessTokens(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	if err := a.AddAccessToken(ctx, newAccessToken(t, "username", "ci")); err != auth.ErrUserDoesNotExist {
+		t.Fatal("Expected ErrUserDoesNotExist, got", err)
+	}
+
+	addUser(t, a, "username", "password")
+	addUser(t, a, "other", "password")
+
+	first := newAccessToken(t, "username", "ci")
+	second := newAccessToken(t, "username", "laptop")
+	second.CreatedAt = first.CreatedAt.Add(time.Second)
+	for _, token := range []*auth.AccessToken{second, first, newAccessToken(t, "other", "ci")} {
+		if err := a.AddAccessToken(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.AddAccessToken(ctx, first); err != auth.ErrAccessTokenAlreadyExists {
+		t.Fatal("Expected ErrAccessTokenAlreadyExists, got", err)
+	}
+
+	token, err := a.GetAccessToken(ctx, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Username != "username" || token.Name != "ci" || token.Hash != first.Hash || token.Prefix != "example.com/team" ||
+		len(token.Scopes) != 1 || token.Scopes[0] != auth.ScopePublish || !token.CreatedAt.Equal(first.CreatedAt) {
+		t.Fatal("Expected the token as added, got", token)
+	}
+
+	tokens, err := a.ListAccessTokens(ctx, "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].ID != first.ID || tokens[1].ID != second.ID {
+		t.Fatal("Expected the tokens of username sorted by creation time, got", tokens)
+	}
+
+	used := time.Now().UTC().Truncate(time.Second)
+	token.LastUsed = used
+	if err := a.UpdateAccessToken(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := a.GetAccessToken(ctx, first.ID); err != nil || !token.LastUsed.Equal(used) {
+		t.Fatal("Expected the token to be updated, got", token, err)
+	}
+
+	if err := a.DeleteAccessToken(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.GetAccessToken(ctx, first.ID); err != auth.ErrAccessTokenDoesNotExist {
+		t.Fatal("Expected ErrAccessTokenDoesNotExist, got", err)
+	}
+	if err := a.UpdateAccessToken(ctx, first); err != auth.ErrAccessTokenDoesNotExist {
+		t.Fatal("Expected ErrAccessTokenDoesNotExist, got", err)
+	}
+	if err := a.DeleteAccessToken(ctx, first.ID); err != nil {
+		t.Fatal("Expected deleting an unknown token to succeed, got", err)
+	}
+}
+
+func testDeleteUserAccessTokens(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "username", "password")
+	addUser(t, a, "other", "password")
+
+	token := newAccessToken(t, "username", "ci")
+	kept := newAccessToken(t, "other", "ci")
+	for _, token := range []*auth.AccessToken{token, kept} {
+		if err := a.AddAccessToken(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := a.DeleteUser(ctx, "username"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.GetAccessToken(ctx, token.ID); err != auth.ErrAccessTokenDoesNotExist {
+		t.Fatal("Expected the tokens of a deleted user to be deleted, got", err)
+	}
+	if _, err := a.GetAccessToken(ctx, kept.ID); err != nil {
+		t.Fatal("Expected the tokens of other users to be kept, got", err)
+	}
+}
+
+func testRevokedTokens(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	if revoked, err := a.TokenRevoked(ctx, "unknown"); err != nil || revoked {
+		t.Fatal("Expected an unknown token not to be revoked, got", revoked, err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	for _, id := range []string{"second", "first"} {
+		if err := a.RevokeToken(ctx, &auth.RevokedToken{ID: id, ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if revoked, err := a.TokenRevoked(ctx, "first"); err != nil || !revoked {
+		t.Fatal("Expected the token to be revoked, got", revoked, err)
+	}
+
+	// Revoking an expired token makes room by forgetting the others that have expired.
+	if err := a.RevokeToken(ctx, &auth.RevokedToken{ID: "expired", ExpiresAt: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RevokeToken(ctx, &auth.RevokedToken{ID: "third", ExpiresAt: expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := a.TokenRevoked(ctx, "expired"); err != nil || revoked {
+		t.Fatal("Expected the expired token to be forgotten, got", revoked, err)
+	}
+
+	tokens, err := a.ListRevokedTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 3 || tokens[0].ID != "first" || tokens[1].ID != "second" || tokens[2].ID != "third" {
+		t.Fatal("Expected the revoked tokens sorted by ID, got", tokens)
+	}
+	if !tokens[0].ExpiresAt.Equal(expiresAt) {
+		t.Fatal("Expected the token to expire at", expiresAt, "got", tokens[0].ExpiresAt)
+	}
+}
+
+func testSessionsRevokedAt(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "username", "password")
+
+	revokedAt := time.Now().Unix()
+	if err := a.UpdateUser(ctx, &auth.User{Username: "username", SessionsRevokedAt: revokedAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := a.GetUser(ctx, "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.SessionsRevokedAt != revokedAt {
+		t.Fatal("Expected SessionsRevokedAt to be", revokedAt, "got", user.SessionsRevokedAt)
+	}
+}
+
+func testTeams(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "alice", "password")
+	addUser(t, a, "bob", "password")
+
+	if err := a.AddTeam(ctx, &auth.Team{}); err != auth.ErrTeamNameEmpty {
+		t.Fatal("Expected ErrTeamNameEmpty, got", err)
+	}
+	if err := a.AddTeam(ctx, &auth.Team{Name: "payments", Members: []string{"nobody"}}); err != auth.ErrUserDoesNotExist {
+		t.Fatal("Expected ErrUserDoesNotExist, got", err)
+	}
+	if err := a.AddTeam(ctx, &auth.Team{Name: "payments", Description: "Payments", Members: []string{"bob", "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddTeam(ctx, &auth.Team{Name: "payments"}); err != auth.ErrTeamAlreadyExists {
+		t.Fatal("Expected ErrTeamAlreadyExists, got", err)
+	}
+	if err := a.AddTeam(ctx, &auth.Team{Name: "infra"}); err != nil {
+		t.Fatal(err)
+	}
+
+	team, err := a.GetTeam(ctx, "payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if team.Description != "Payments" || len(team.Members) != 2 || team.Members[0] != "alice" || team.Members[1] != "bob" {
+		t.Fatal("Expected the team with its members sorted, got", team)
+	}
+	if _, err := a.GetTeam(ctx, "unknown"); err != auth.ErrTeamDoesNotExist {
+		t.Fatal("Expected ErrTeamDoesNotExist, got", err)
+	}
+
+	if err := a.AddTeamMember(ctx, "infra", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddTeamMember(ctx, "infra", "alice"); err != nil {
+		t.Fatal("Expected adding a member twice to succeed, got", err)
+	}
+	if err := a.AddTeamMember(ctx, "infra", "nobody"); err != auth.ErrUserDoesNotExist {
+		t.Fatal("Expected ErrUserDoesNotExist, got", err)
+	}
+	if err := a.AddTeamMember(ctx, "unknown", "alice"); err != auth.ErrTeamDoesNotExist {
+		t.Fatal("Expected ErrTeamDoesNotExist, got", err)
+	}
+
+	names, err := a.ListUserTeams(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "infra" || names[1] != "payments" {
+		t.Fatal("Expected alice in infra and payments, got", names)
+	}
+
+	if err := a.RemoveTeamMember(ctx, "payments", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RemoveTeamMember(ctx, "payments", "alice"); err != nil {
+		t.Fatal("Expected removing a non-member to succeed, got", err)
+	}
+	if names, err := a.ListUserTeams(ctx, "alice"); err != nil || len(names) != 1 || names[0] != "infra" {
+		t.Fatal("Expected alice in infra only, got", names, err)
+	}
+
+	team.Members = []string{"alice"}
+	if err := a.UpdateTeam(ctx, team); err != nil {
+		t.Fatal(err)
+	}
+	if team, err := a.GetTeam(ctx, "payments"); err != nil || len(team.Members) != 1 || team.Members[0] != "alice" {
+		t.Fatal("Expected the members to be replaced, got", team, err)
+	}
+	if err := a.UpdateTeam(ctx, &auth.Team{Name: "unknown"}); err != auth.ErrTeamDoesNotExist {
+		t.Fatal("Expected ErrTeamDoesNotExist, got", err)
+	}
+
+	teams, err := a.ListTeams(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(teams) != 2 || teams[0].Name != "infra" || teams[1].Name != "payments" {
+		t.Fatal("Expected the teams sorted by name, got", teams)
+	}
+
+	if err := a.DeleteTeam(ctx, "infra"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.GetTeam(ctx, "infra"); err != auth.ErrTeamDoesNotExist {
+		t.Fatal("Expected ErrTeamDoesNotExist, got", err)
+	}
+}
+
+func testDeleteUserTeams(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "alice", "password")
+	addUser(t, a, "bob", "password")
+	if err := a.AddTeam(ctx, &auth.Team{Name: "payments", Members: []string{"alice", "bob"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.DeleteUser(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if team, err := a.GetTeam(ctx, "payments"); err != nil || len(team.Members) != 1 || team.Members[0] != "bob" {
+		t.Fatal("Expected a deleted user to leave their teams, got", team, err)
+	}
+}
+
+func testLoginAttempts(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	if attempts, err := a.GetLoginAttempts(ctx, auth.UserAttemptsKey("username")); err != nil || attempts != nil {
+		t.Fatal("Expected no failed logins, got", attempts, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, key := range []string{auth.UserAttemptsKey("username"), auth.IPAttemptsKey("192.0.2.1")} {
+		attempts := &auth.LoginAttempts{Key: key}
+		attempts.Fail(auth.DefaultLockoutPolicy, now)
+		if err := a.SetLoginAttempts(ctx, attempts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attempts, err := a.GetLoginAttempts(ctx, auth.UserAttemptsKey("UserName"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts == nil || attempts.Failures != 1 || !attempts.LastFailure.Equal(now) || !attempts.ExpiresAt.After(now) {
+		t.Fatal("Expected one failed login, got", attempts)
+	}
+
+	// Recording failed logins forgets those that have expired.
+	if err := a.SetLoginAttempts(ctx, &auth.LoginAttempts{Key: "user:expired", Failures: 1, ExpiresAt: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, err := a.GetLoginAttempts(ctx, "user:expired"); err != nil || attempts != nil {
+		t.Fatal("Expected expired failed logins to be forgotten, got", attempts, err)
+	}
+
+	list, err := a.ListLoginAttempts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Key != "ip:192.0.2.1" || list[1].Key != "user:username" {
+		t.Fatal("Expected the failed logins sorted by key, got", list)
+	}
+
+	if err := a.DeleteLoginAttempts(ctx, auth.UserAttemptsKey("username")); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, err := a.GetLoginAttempts(ctx, auth.UserAttemptsKey("username")); err != nil || attempts != nil {
+		t.Fatal("Expected the failed logins to be forgotten, got", attempts, err)
+	}
+}
+
+func testTOTP(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+
+	addUser(t, a, "username", "password")
+
+	if totp, err := a.GetTOTP(ctx, "username"); err != nil || totp != nil {
+		t.Fatal("Expected no two-factor enrollment, got", totp, err)
+	}
+
+	totp, err := auth.NewTOTP("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := totp.GenerateRecoveryCodes(); err != nil {
+		t.Fatal(err)
+	}
+	totp.Enabled = true
+	if err := a.SetTOTP(ctx, totp); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := a.GetTOTP(ctx, "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Secret != totp.Secret || !got.Enabled || len(got.RecoveryCodes) != len(totp.RecoveryCodes) {
+		t.Fatal("Expected the stored two-factor enrollment, got", got)
+	}
+
+	missing, _ := auth.NewTOTP("missing")
+	if err := a.SetTOTP(ctx, missing); err != auth.ErrUserDoesNotExist {
+		t.Fatal("Expected ErrUserDoesNotExist, got", err)
+	}
+
+	if err := a.DeleteTOTP(ctx, "username"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := a.GetTOTP(ctx, "username"); err != nil || got != nil {
+		t.Fatal("Expected the two-factor enrollment to be removed, got", got, err)
+	}
+
+	// Deleting a user removes their enrollment.
+	if err := a.SetTOTP(ctx, totp); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DeleteUser(ctx, "username"); err != nil {
+		t.Fatal(err)
+	}
+	addUser(t, a, "username", "password")
+	if got, err := a.GetTOTP(ctx, "username"); err != nil || got != nil {
+		t.Fatal("Expected the enrollment of a deleted user to be removed, got", got, err)
+	}
+}
+
+func testIdentities(t *testing.T, tm *auth.TokenManager, a auth.Auth) {
+	ctx := context.Background()
+	ids := auth.FindIdentityStore(a)
+	if ids == nil {
+		t.Skip("Auth does not keep identities")
+	}
+
+	addUser(t, a, "alice", "password")
+	addUser(t, a, "bob", "password")
+
+	if i, err := ids.GetIdentity(ctx, "https://idp.example.com", "1"); err != nil || i != nil {
+		t.Fatal("Expected no identity, got", i, err)
+	}
+
+	for _, i := range []*auth.Identity{
+		{Issuer: "https://idp.example.com", Subject: "2", Username: "alice"},
+		{Issuer: "https://idp.example.com", Subject: "1", Username: "alice", Created: true},
+		{Issuer: "https://other.example.com", Subject: "1", Username: "bob"},
+	} {
+		if err := ids.SetIdentity(ctx, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	i, err := ids.GetIdentity(ctx, "https://idp.example.com", "1")
+	if err != nil || i == nil || i.Username != "alice" || !i.Created {
+		t.Fatal("Expected the stored identity, got", i, err)
+	}
+
+	list, err := ids.ListIdentities(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Subject != "1" || list[1].Subject != "2" {
+		t.Fatal("Expected the identities of alice sorted by subject, got", list)
+	}
+
+	if err := ids.SetIdentity(ctx, &auth.Identity{Issuer: "https://idp.example.com", Subject: "3", Username: "missing"}); err != auth.ErrUserDoesNotExist {
+		t.Fatal("Expected ErrUserDoesNotExist, got", err)
+	}
+	if err := ids.SetIdentity(ctx, &auth.Identity{Issuer: "https://idp.example.com", Username: "alice"}); err != auth.ErrIdentityEmpty {
+		t.Fatal("Expected ErrIdentityEmpty, got", err)
+	}
+
+	// Linking an identity again moves it to the other user.
+	if err := ids.SetIdentity(ctx, &auth.Identity{Issuer: "https://idp.example.com", Subject: "2", Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := ids.ListIdentities(ctx, "bob"); err != nil || len(list) != 2 {
+		t.Fatal("Expected bob to have two identities, got", list, err)
+	}
+
+	if err := ids.DeleteIdentity(ctx, "https://other.example.com", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := ids.GetIdentity(ctx, "https://other.example.com", "1"); err != nil || i != nil {
+		t.Fatal("Expected the identity to be unlinked, got", i, err)
+	}
+
+	// Deleting a user unlinks their identities.
+	if err := a.DeleteUser(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := ids.GetIdentity(ctx, "https://idp.example.com", "1"); err != nil || i != nil {
+		t.Fatal("Expected the identity of a deleted user to be unlinked, got", i, err)
+	}
+	if i, err := ids.GetIdentity(ctx, "https://idp.example.com", "2"); err != nil || i == nil || i.Username != "bob" {
+		t.Fatal("Expected the identities of others to be kept, got", i, err)
+	}
+}
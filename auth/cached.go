@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/deejross/dep-registry/util"
+)
+
+// CachedAuth wraps another Auth, caching the Users read from it. Entries are invalidated by
+// writes made through the CachedAuth, writes made by other processes are seen once the entries
+// expire. Logins and password hashes are never cached.
+type CachedAuth struct {
+	a     Auth
+	cache *util.LRU
+}
+
+// cachedUser is the cached result of GetUser.
+type cachedUser struct {
+	user *User
+	err  error
+}
+
+// NewCachedAuth creates a new CachedAuth around a holding up to size Users, each for up to ttl.
+func NewCachedAuth(a Auth, size int, ttl time.Duration) *CachedAuth {
+	return &CachedAuth{
+		a:     a,
+		cache: util.NewLRU(size, ttl),
+	}
+}
+
+// Login validates the given credentials and if successful, generates a token.
+func (a *CachedAuth) Login(ctx context.Context, username, password string) (string, error) {
+	return a.a.Login(ctx, username, password)
+}
+
+// AddUser adds a new user.
+func (a *CachedAuth) AddUser(ctx context.Context, user *User) error {
+	defer a.cache.Remove(user.Username)
+	return a.a.AddUser(ctx, user)
+}
+
+// UpdateUser updates an existing user.
+func (a *CachedAuth) UpdateUser(ctx context.Context, user *User) error {
+	defer a.cache.Remove(user.Username)
+	return a.a.UpdateUser(ctx, user)
+}
+
+// SetPassword sets a password for a user.
+func (a *CachedAuth) SetPassword(ctx context.Context, username, password string) error {
+	return a.a.SetPassword(ctx, username, password)
+}
+
+// GetUser gets a User object.
+func (a *CachedAuth) GetUser(ctx context.Context, username string) (*User, error) {
+	if val, ok := a.cache.Get(username); ok {
+		entry := val.(*cachedUser)
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		user := *entry.user
+		return &user, nil
+	}
+
+	gen := a.cache.Generation()
+	user, err := a.a.GetUser(ctx, username)
+	if err != nil && err != ErrUserDoesNotExist {
+		return nil, err
+	}
+
+	entry := &cachedUser{err: err}
+	if user != nil {
+		c := *user
+		entry.user = &c
+	}
+	a.cache.Add(username, entry, gen)
+
+	return user, err
+}
+
+// DeleteUser deletes a User.
+func (a *CachedAuth) DeleteUser(ctx context.Context, username string) error {
+	defer a.cache.Remove(username)
+	return a.a.DeleteUser(ctx, username)
+}
+
+// ListUsers lists all Users sorted by username, it is not cached.
+func (a *CachedAuth) ListUsers(ctx context.Context) ([]*User, error) {
+	return a.a.ListUsers(ctx)
+}
+
+// GetPasswordHash gets the stored password hash of a user, nil if no password has been set.
+func (a *CachedAuth) GetPasswordHash(ctx context.Context, username string) ([]byte, error) {
+	return a.a.GetPasswordHash(ctx, username)
+}
+
+// SetPasswordHash sets the password hash of a user as returned by GetPasswordHash.
+func (a *CachedAuth) SetPasswordHash(ctx context.Context, username string, hash []byte) error {
+	return a.a.SetPasswordHash(ctx, username, hash)
+}
+
+// AddAccessToken adds a personal access token for an existing user.
+func (a *CachedAuth) AddAccessToken(ctx context.Context, token *AccessToken) error {
+	return a.a.AddAccessToken(ctx, token)
+}
+
+// GetAccessToken gets a personal access token by ID, it is not cached so revocations are seen at once.
+func (a *CachedAuth) GetAccessToken(ctx context.Context, id string) (*AccessToken, error) {
+	return a.a.GetAccessToken(ctx, id)
+}
+
+// UpdateAccessToken updates an existing personal access token.
+func (a *CachedAuth) UpdateAccessToken(ctx context.Context, token *AccessToken) error {
+	return a.a.UpdateAccessToken(ctx, token)
+}
+
+// DeleteAccessToken deletes a personal access token.
+func (a *CachedAuth) DeleteAccessToken(ctx context.Context, id string) error {
+	return a.a.DeleteAccessToken(ctx, id)
+}
+
+// ListAccessTokens lists the personal access tokens of a user sorted by creation time.
+func (a *CachedAuth) ListAccessTokens(ctx context.Context, username string) ([]*AccessToken, error) {
+	return a.a.ListAccessTokens(ctx, username)
+}
+
+// RevokeToken revokes the token with the given ID, it is remembered until it expires.
+func (a *CachedAuth) RevokeToken(ctx context.Context, token *RevokedToken) error {
+	return a.a.RevokeToken(ctx, token)
+}
+
+// TokenRevoked reports whether the token with the given ID has been revoked, it is not cached so
+// revocations are seen at once.
+func (a *CachedAuth) TokenRevoked(ctx context.Context, id string) (bool, error) {
+	return a.a.TokenRevoked(ctx, id)
+}
+
+// ListRevokedTokens lists the revoked tokens that have not expired, sorted by ID.
+func (a *CachedAuth) ListRevokedTokens(ctx context.Context) ([]*RevokedToken, error) {
+	return a.a.ListRevokedTokens(ctx)
+}
+
+// AddTeam adds a new team, its members must exist.
+func (a *CachedAuth) AddTeam(ctx context.Context, team *Team) error {
+	return a.a.AddTeam(ctx, team)
+}
+
+// GetTeam gets a team, its members sorted.
+func (a *CachedAuth) GetTeam(ctx context.Context, name string) (*Team, error) {
+	return a.a.GetTeam(ctx, name)
+}
+
+// UpdateTeam updates an existing team, replacing its members.
+func (a *CachedAuth) UpdateTeam(ctx context.Context, team *Team) error {
+	return a.a.UpdateTeam(ctx, team)
+}
+
+// DeleteTeam deletes a team.
+func (a *CachedAuth) DeleteTeam(ctx context.Context, name string) error {
+	return a.a.DeleteTeam(ctx, name)
+}
+
+// ListTeams lists all teams sorted by name.
+func (a *CachedAuth) ListTeams(ctx context.Context) ([]*Team, error) {
+	return a.a.ListTeams(ctx)
+}
+
+// AddTeamMember adds an existing user to a team, it is not an error if they are already a member.
+func (a *CachedAuth) AddTeamMember(ctx context.Context, team, username string) error {
+	return a.a.AddTeamMember(ctx, team, username)
+}
+
+// RemoveTeamMember removes a user from a team, it is not an error if they are not a member.
+func (a *CachedAuth) RemoveTeamMember(ctx context.Context, team, username string) error {
+	return a.a.RemoveTeamMember(ctx, team, username)
+}
+
+// ListUserTeams lists the names of the teams a user is a member of, sorted. It is not cached so
+// membership changes are seen at once.
+func (a *CachedAuth) ListUserTeams(ctx context.Context, username string) ([]string, error) {
+	return a.a.ListUserTeams(ctx, username)
+}
+
+// GetLoginAttempts gets the failed logins recorded under a key, they are not cached.
+func (a *CachedAuth) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	return a.a.GetLoginAttempts(ctx, key)
+}
+
+// SetLoginAttempts records failed logins until they expire.
+func (a *CachedAuth) SetLoginAttempts(ctx context.Context, attempts *LoginAttempts) error {
+	return a.a.SetLoginAttempts(ctx, attempts)
+}
+
+// DeleteLoginAttempts forgets the failed logins recorded under a key.
+func (a *CachedAuth) DeleteLoginAttempts(ctx context.Context, key string) error {
+	return a.a.DeleteLoginAttempts(ctx, key)
+}
+
+// ListLoginAttempts lists the failed logins that have not expired, sorted by key.
+func (a *CachedAuth) ListLoginAttempts(ctx context.Context) ([]*LoginAttempts, error) {
+	return a.a.ListLoginAttempts(ctx)
+}
+
+// GetTOTP gets the two-factor authentication enrollment of a user, it is not cached.
+func (a *CachedAuth) GetTOTP(ctx context.Context, username string) (*TOTP, error) {
+	return a.a.GetTOTP(ctx, username)
+}
+
+// SetTOTP adds or replaces the two-factor authentication enrollment of an existing user.
+func (a *CachedAuth) SetTOTP(ctx context.Context, totp *TOTP) error {
+	return a.a.SetTOTP(ctx, totp)
+}
+
+// DeleteTOTP removes the two-factor authentication enrollment of a user.
+func (a *CachedAuth) DeleteTOTP(ctx context.Context, username string) error {
+	return a.a.DeleteTOTP(ctx, username)
+}
+
+// Unwrap returns the wrapped Auth.
+func (a *CachedAuth) Unwrap() Auth {
+	return a.a
+}
+
+// Purge removes every entry from the cache.
+func (a *CachedAuth) Purge() {
+	a.cache.Purge()
+}
+
+// Close the wrapped Auth if it can be closed.
+func (a *CachedAuth) Close() error {
+	if c, ok := a.a.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package auth_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/auth/authtest"
+)
+
+var conformanceTM = auth.NewTokenManager([]byte("super-secret-key"), time.Minute)
+
+func resolve(t *testing.T, path string) auth.Auth {
+	a, err := auth.Resolve(path, conformanceTM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestUserPassConformance(t *testing.T) {
+	authtest.Run(t, conformanceTM, func(t *testing.T) auth.Auth {
+		return resolve(t, "userpass://"+filepath.Join(t.TempDir(), "auth.bolt"))
+	})
+}
+
+func TestMemoryConformance(t *testing.T) {
+	authtest.Run(t, conformanceTM, func(t *testing.T) auth.Auth {
+		return resolve(t, "memory://")
+	})
+}
+
+func TestCachedConformance(t *testing.T) {
+	authtest.Run(t, conformanceTM, func(t *testing.T) auth.Auth {
+		return auth.NewCachedAuth(resolve(t, "memory://"), 100, time.Minute)
+	})
+}
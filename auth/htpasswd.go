@@ -0,0 +1,447 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrHtpasswdReadOnly indicates users are managed in the htpasswd file and cannot be changed through the registry.
+var ErrHtpasswdReadOnly = errors.New("Users are managed in the htpasswd file and cannot be changed here")
+
+// htpasswdCheckEvery is how often the files are checked for changes.
+const htpasswdCheckEvery = time.Second
+
+// htpasswdUser is a user of the htpasswd file.
+type htpasswdUser struct {
+	User
+	hash string
+}
+
+// HtpasswdAuth authenticates users against an htpasswd file with bcrypt or {SHA} entries. Users are admins
+// or disabled if the flags file says so, one user per line as <username>:admin,disabled. Both files are
+// reloaded when they change, they are the only source of users: they cannot be changed through the registry.
+type HtpasswdAuth struct {
+	path      string
+	flagsPath string
+	tm        *TokenManager
+
+	mu         sync.RWMutex
+	users      map[string]*htpasswdUser
+	stamp      string
+	checked    time.Time
+	checkEvery time.Duration
+}
+
+// NewHtpasswdAuth creates a new HtpasswdAuth from the htpasswd file at path and the flags file at
+// flagsPath, which need not exist.
+func NewHtpasswdAuth(path, flagsPath string, tm *TokenManager) (*HtpasswdAuth, error) {
+	a := &HtpasswdAuth{
+		path:       path,
+		flagsPath:  flagsPath,
+		tm:         tm,
+		checkEvery: htpasswdCheckEvery,
+	}
+
+	stamp, err := a.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	a.stamp = stamp
+	a.checked = time.Now()
+
+	return a, nil
+}
+
+// newHtpasswdAuthFromPath parses a connection string in the form htpasswd://<file>?flags=<file>,
+// the flags file is <file>.flags by default.
+func newHtpasswdAuthFromPath(path string, tm *TokenManager) (*HtpasswdAuth, error) {
+	name := strings.TrimPrefix(path, "htpasswd://")
+	flags := ""
+	if i := strings.Index(name, "?"); i >= 0 {
+		opts, err := url.ParseQuery(name[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		name, flags = name[:i], opts.Get("flags")
+	}
+	if len(name) == 0 {
+		return nil, errors.New("File is required: htpasswd://<file>")
+	}
+	if len(flags) == 0 {
+		flags = name + ".flags"
+	}
+
+	return NewHtpasswdAuth(name, flags, tm)
+}
+
+// Login validates the given credentials against the htpasswd file and if successful, generates a token.
+func (a *HtpasswdAuth) Login(ctx context.Context, username, password string) (string, error) {
+	if len(username) == 0 {
+		return "", ErrUsernameEmpty
+	}
+	if len(password) == 0 {
+		return "", ErrPasswordTooShort
+	}
+
+	user := a.user(username)
+	if user == nil {
+		return "", checkPassword(nil, password)
+	}
+	if err := checkHtpasswd(user.hash, password); err != nil {
+		return "", err
+	}
+
+	return a.tm.Generate(username)
+}
+
+// AddUser is not supported, users are added to the htpasswd file.
+func (a *HtpasswdAuth) AddUser(ctx context.Context, user *User) error {
+	return ErrHtpasswdReadOnly
+}
+
+// UpdateUser is not supported, users are changed in the flags file.
+func (a *HtpasswdAuth) UpdateUser(ctx context.Context, user *User) error {
+	return ErrHtpasswdReadOnly
+}
+
+// SetPassword is not supported, passwords are changed in the htpasswd file.
+func (a *HtpasswdAuth) SetPassword(ctx context.Context, username, password string) error {
+	return ErrHtpasswdReadOnly
+}
+
+// GetUser gets a User object.
+func (a *HtpasswdAuth) GetUser(ctx context.Context, username string) (*User, error) {
+	if len(username) == 0 {
+		return nil, ErrUsernameEmpty
+	}
+
+	user := a.user(username)
+	if user == nil {
+		return nil, ErrUserDoesNotExist
+	}
+
+	u := user.User
+	return &u, nil
+}
+
+// DeleteUser is not supported, users are removed from the htpasswd file.
+func (a *HtpasswdAuth) DeleteUser(ctx context.Context, username string) error {
+	return ErrHtpasswdReadOnly
+}
+
+// ListUsers lists all Users sorted by username.
+func (a *HtpasswdAuth) ListUsers(ctx context.Context) ([]*User, error) {
+	a.refresh()
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	users := make([]*User, 0, len(a.users))
+	for _, user := range a.users {
+		u := user.User
+		users = append(users, &u)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+// GetPasswordHash gets the bcrypt hash of a user, nil for other kinds of entries which cannot be used elsewhere.
+func (a *HtpasswdAuth) GetPasswordHash(ctx context.Context, username string) ([]byte, error) {
+	if len(username) == 0 {
+		return nil, ErrUsernameEmpty
+	}
+
+	user := a.user(username)
+	if user == nil {
+		return nil, ErrUserDoesNotExist
+	}
+	if !strings.HasPrefix(user.hash, "$2") {
+		return nil, nil
+	}
+	return []byte(user.hash), nil
+}
+
+// SetPasswordHash is not supported, passwords are changed in the htpasswd file.
+func (a *HtpasswdAuth) SetPasswordHash(ctx context.Context, username string, hash []byte) error {
+	return ErrHtpasswdReadOnly
+}
+
+// AddAccessToken is not supported, the htpasswd file has nowhere to keep tokens.
+func (a *HtpasswdAuth) AddAccessToken(ctx context.Context, token *AccessToken) error {
+	return ErrNotSupported
+}
+
+// GetAccessToken is not supported, the htpasswd file has nowhere to keep tokens.
+func (a *HtpasswdAuth) GetAccessToken(ctx context.Context, id string) (*AccessToken, error) {
+	return nil, ErrNotSupported
+}
+
+// UpdateAccessToken is not supported, the htpasswd file has nowhere to keep tokens.
+func (a *HtpasswdAuth) UpdateAccessToken(ctx context.Context, token *AccessToken) error {
+	return ErrNotSupported
+}
+
+// DeleteAccessToken is not supported, the htpasswd file has nowhere to keep tokens.
+func (a *HtpasswdAuth) DeleteAccessToken(ctx context.Context, id string) error {
+	return ErrNotSupported
+}
+
+// ListAccessTokens is not supported, the htpasswd file has nowhere to keep tokens.
+func (a *HtpasswdAuth) ListAccessTokens(ctx context.Context, username string) ([]*AccessToken, error) {
+	return nil, ErrNotSupported
+}
+
+// RevokeToken is not supported, the htpasswd file has nowhere to keep revocations.
+func (a *HtpasswdAuth) RevokeToken(ctx context.Context, token *RevokedToken) error {
+	return ErrNotSupported
+}
+
+// TokenRevoked is not supported, the htpasswd file has nowhere to keep revocations.
+func (a *HtpasswdAuth) TokenRevoked(ctx context.Context, id string) (bool, error) {
+	return false, ErrNotSupported
+}
+
+// ListRevokedTokens is not supported, the htpasswd file has nowhere to keep revocations.
+func (a *HtpasswdAuth) ListRevokedTokens(ctx context.Context) ([]*RevokedToken, error) {
+	return nil, ErrNotSupported
+}
+
+// AddTeam is not supported, the htpasswd file has nowhere to keep teams.
+func (a *HtpasswdAuth) AddTeam(ctx context.Context, team *Team) error {
+	return ErrNotSupported
+}
+
+// GetTeam is not supported, the htpasswd file has nowhere to keep teams.
+func (a *HtpasswdAuth) GetTeam(ctx context.Context, name string) (*Team, error) {
+	return nil, ErrNotSupported
+}
+
+// UpdateTeam is not supported, the htpasswd file has nowhere to keep teams.
+func (a *HtpasswdAuth) UpdateTeam(ctx context.Context, team *Team) error {
+	return ErrNotSupported
+}
+
+// DeleteTeam is not supported, the htpasswd file has nowhere to keep teams.
+func (a *HtpasswdAuth) DeleteTeam(ctx context.Context, name string) error {
+	return ErrNotSupported
+}
+
+// ListTeams is not supported, the htpasswd file has nowhere to keep teams.
+func (a *HtpasswdAuth) ListTeams(ctx context.Context) ([]*Team, error) {
+	return nil, ErrNotSupported
+}
+
+// AddTeamMember is not supported, the htpasswd file has nowhere to keep teams.
+func (a *HtpasswdAuth) AddTeamMember(ctx context.Context, team, username string) error {
+	return ErrNotSupported
+}
+
+// RemoveTeamMember is not supported, the htpasswd file has nowhere to keep teams.
+func (a *HtpasswdAuth) RemoveTeamMember(ctx context.Context, team, username string) error {
+	return ErrNotSupported
+}
+
+// ListUserTeams is not supported, the htpasswd file has nowhere to keep teams.
+func (a *HtpasswdAuth) ListUserTeams(ctx context.Context, username string) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// GetLoginAttempts is not supported, the htpasswd file has nowhere to keep failed logins.
+func (a *HtpasswdAuth) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	return nil, ErrNotSupported
+}
+
+// SetLoginAttempts is not supported, the htpasswd file has nowhere to keep failed logins.
+func (a *HtpasswdAuth) SetLoginAttempts(ctx context.Context, attempts *LoginAttempts) error {
+	return ErrNotSupported
+}
+
+// DeleteLoginAttempts is not supported, the htpasswd file has nowhere to keep failed logins.
+func (a *HtpasswdAuth) DeleteLoginAttempts(ctx context.Context, key string) error {
+	return ErrNotSupported
+}
+
+// ListLoginAttempts is not supported, the htpasswd file has nowhere to keep failed logins.
+func (a *HtpasswdAuth) ListLoginAttempts(ctx context.Context) ([]*LoginAttempts, error) {
+	return nil, ErrNotSupported
+}
+
+// GetTOTP is not supported, the htpasswd file has nowhere to keep two-factor authentication.
+func (a *HtpasswdAuth) GetTOTP(ctx context.Context, username string) (*TOTP, error) {
+	return nil, ErrNotSupported
+}
+
+// SetTOTP is not supported, the htpasswd file has nowhere to keep two-factor authentication.
+func (a *HtpasswdAuth) SetTOTP(ctx context.Context, totp *TOTP) error {
+	return ErrNotSupported
+}
+
+// DeleteTOTP is not supported, the htpasswd file has nowhere to keep two-factor authentication.
+func (a *HtpasswdAuth) DeleteTOTP(ctx context.Context, username string) error {
+	return ErrNotSupported
+}
+
+// user returns the user with the given username from the latest files, nil if there is none.
+func (a *HtpasswdAuth) user(username string) *htpasswdUser {
+	a.refresh()
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.users[username]
+}
+
+// refresh reloads the files if they have changed since they were loaded, at most once every checkEvery.
+// If they cannot be loaded every user is dropped, so users removed or disabled by the change cannot log in.
+func (a *HtpasswdAuth) refresh() {
+	a.mu.RLock()
+	fresh := time.Since(a.checked) < a.checkEvery
+	a.mu.RUnlock()
+	if fresh {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if time.Since(a.checked) < a.checkEvery {
+		return
+	}
+	a.checked = time.Now()
+
+	// Failures are remembered by their stamp too, so each is only logged once.
+	stamp, err := a.stat()
+	if stamp == a.stamp {
+		return
+	}
+	a.stamp = stamp
+
+	if err == nil {
+		err = a.load()
+	}
+	if err != nil {
+		a.users = map[string]*htpasswdUser{}
+		log.Println("No users can log in until", a.path, "can be loaded:", err)
+	}
+}
+
+// stat returns a stamp of the size and modification time of the files, or of the error if there is one.
+func (a *HtpasswdAuth) stat() (string, error) {
+	stamp := ""
+	for _, name := range []string{a.path, a.flagsPath} {
+		info, err := os.Stat(name)
+		if os.IsNotExist(err) && name == a.flagsPath {
+			stamp += "|none"
+			continue
+		}
+		if err != nil {
+			return "error: " + err.Error(), err
+		}
+		stamp += fmt.Sprintf("|%d:%d", info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
+
+// load reads the htpasswd and flags files, replacing the users, a.mu must be held or a not yet shared.
+func (a *HtpasswdAuth) load() error {
+	users := map[string]*htpasswdUser{}
+	err := readColonFile(a.path, func(username, hash string) error {
+		if _, ok := users[username]; ok {
+			return errors.New("User " + username + " is listed more than once")
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			log.Println("User", username, "in", a.path, "cannot log in, only bcrypt and {SHA} entries are supported")
+		}
+		users[username] = &htpasswdUser{User: User{Username: username}, hash: hash}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = readColonFile(a.flagsPath, func(username, flags string) error {
+		user, ok := users[username]
+		if !ok {
+			// Flags may be kept for users that are removed from the htpasswd file for now.
+			return nil
+		}
+		for _, flag := range strings.Split(flags, ",") {
+			switch strings.TrimSpace(flag) {
+			case "admin":
+				user.Admin = true
+			case "disabled":
+				user.Disabled = true
+			case "":
+			default:
+				return errors.New("Unknown flag " + flag + " for user " + username)
+			}
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	a.users = users
+	return nil
+}
+
+// readColonFile calls fn with the two halves of each <name>:<value> line of a file, skipping blank
+// lines and comments starting with #.
+func readColonFile(name string, fn func(name, value string) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+			return fmt.Errorf("Invalid line %d of %s, expected <username>:<value>", n, name)
+		}
+		if err := fn(parts[0], strings.TrimSpace(parts[1])); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// checkHtpasswd validates password against an htpasswd entry, bcrypt or {SHA}. Other kinds of entries,
+// such as MD5 or crypt, are always refused. Every failure returns ErrInvalidCredentials.
+func checkHtpasswd(hash, password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return checkPassword([]byte(hash), password)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		if subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(hash[5:])) == 1 {
+			return nil
+		}
+	}
+	return ErrInvalidCredentials
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var htpasswdTM = NewTokenManager([]byte("super-secret-key"), time.Minute)
+
+// writeHtpasswd writes an htpasswd file with a bcrypt entry for alice, a {SHA} entry for bob and an
+// unsupported MD5 entry for carol, and a flags file next to it.
+func writeHtpasswd(t *testing.T) string {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "htpasswd")
+
+	hash, err := HashPassword("alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("bob-secret"))
+
+	content := "# registry users\n" +
+		"alice:" + string(hash) + "\n" +
+		"bob:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n" +
+		"\n" +
+		"carol:$apr1$salt$hash\n"
+	if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name+".flags", []byte("alice:admin\nbob: disabled\ngone:admin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestHtpasswdLogin(t *testing.T) {
+	ctx := context.Background()
+	a, err := newHtpasswdAuthFromPath("htpasswd://"+writeHtpasswd(t), htpasswdTM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for username, password := range map[string]string{"alice": "alice-secret", "bob": "bob-secret"} {
+		token, err := a.Login(ctx, username, password)
+		if err != nil {
+			t.Fatal("Expected", username, "to log in, got", err)
+		}
+		if subject, err := htpasswdTM.Validate(token); err != nil || subject != username {
+			t.Fatal("Expected a token for", username, "got", subject, err)
+		}
+	}
+
+	for _, c := range [][2]string{{"alice", "bob-secret"}, {"bob", "wrong"}, {"carol", "carol-secret"}, {"dave", "dave-secret"}} {
+		if _, err := a.Login(ctx, c[0], c[1]); err != ErrInvalidCredentials {
+			t.Fatal("Expected ErrInvalidCredentials for", c[0], "got", err)
+		}
+	}
+	if _, err := a.Login(ctx, "alice", ""); err != ErrPasswordTooShort {
+		t.Fatal("Expected ErrPasswordTooShort, got", err)
+	}
+}
+
+func TestHtpasswdUsers(t *testing.T) {
+	ctx := context.Background()
+	a, err := newHtpasswdAuthFromPath("htpasswd://"+writeHtpasswd(t), htpasswdTM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user, err := a.GetUser(ctx, "alice"); err != nil || !user.Admin || user.Disabled {
+		t.Fatal("Expected alice to be an admin, got", user, err)
+	}
+	if user, err := a.GetUser(ctx, "bob"); err != nil || user.Admin || !user.Disabled {
+		t.Fatal("Expected bob to be disabled, got", user, err)
+	}
+	if _, err := a.GetUser(ctx, "gone"); err != ErrUserDoesNotExist {
+		t.Fatal("Expected flags without a user to be ignored, got", err)
+	}
+
+	users, err := a.ListUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 || users[0].Username != "alice" || users[1].Username != "bob" || users[2].Username != "carol" {
+		t.Fatal("Expected the users sorted by username, got", users)
+	}
+
+	if hash, err := a.GetPasswordHash(ctx, "alice"); err != nil || ValidatePassword(hash, "alice-secret") != nil {
+		t.Fatal("Expected the bcrypt hash of alice, got", string(hash), err)
+	}
+	if hash, err := a.GetPasswordHash(ctx, "bob"); err != nil || hash != nil {
+		t.Fatal("Expected no hash for a {SHA} entry, got", string(hash), err)
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	ctx := context.Background()
+	name := writeHtpasswd(t)
+	a, err := NewHtpasswdAuth(name, name+".flags", htpasswdTM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.checkEvery = 0
+
+	hash, err := HashPassword("dave-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte("dave:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Login(ctx, "dave", "dave-secret"); err != nil {
+		t.Fatal("Expected the added user to log in, got", err)
+	}
+	if _, err := a.GetUser(ctx, "alice"); err != ErrUserDoesNotExist {
+		t.Fatal("Expected the removed user to be gone, got", err)
+	}
+
+	if err := ioutil.WriteFile(name+".flags", []byte("dave:admin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := a.GetUser(ctx, "dave"); err != nil || !user.Admin {
+		t.Fatal("Expected the changed flags to be loaded, got", user, err)
+	}
+
+	// A file that cannot be read drops every user until it is fixed.
+	if err := ioutil.WriteFile(name+".flags", []byte("dave:admin,owner\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.GetUser(ctx, "dave"); err != ErrUserDoesNotExist {
+		t.Fatal("Expected no users, got", err)
+	}
+	if _, err := a.Login(ctx, "dave", "dave-secret"); err != ErrInvalidCredentials {
+		t.Fatal("Expected logins to be refused, got", err)
+	}
+
+	if err := ioutil.WriteFile(name+".flags", []byte("dave:disabled\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := a.GetUser(ctx, "dave"); err != nil || !user.Disabled {
+		t.Fatal("Expected the fixed files to be loaded, got", user, err)
+	}
+}
+
+func TestHtpasswdInvalid(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "htpasswd")
+	for _, content := range []string{"alice\n", "alice:\n", "alice:$2y$x\nalice:$2y$y\n"} {
+		if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewHtpasswdAuth(name, name+".flags", htpasswdTM); err == nil {
+			t.Fatal("Expected an error for", content)
+		}
+	}
+
+	if _, err := NewHtpasswdAuth(name+".missing", name+".flags", htpasswdTM); err == nil {
+		t.Fatal("Expected an error for a missing file")
+	}
+	if _, err := Resolve("htpasswd://", htpasswdTM); err == nil {
+		t.Fatal("Expected an error without a file")
+	}
+}
+
+func TestHtpasswdFromPath(t *testing.T) {
+	name := writeHtpasswd(t)
+	flags := filepath.Join(filepath.Dir(name), "other.flags")
+	if err := ioutil.WriteFile(flags, []byte("bob:admin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := Resolve("htpasswd://"+name+"?flags="+flags, htpasswdTM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := a.GetUser(context.Background(), "bob"); err != nil || !user.Admin || user.Disabled {
+		t.Fatal("Expected the flags file to be used, got", user, err)
+	}
+}
+
+func TestHtpasswdReadOnly(t *testing.T) {
+	ctx := context.Background()
+	a, err := newHtpasswdAuthFromPath("htpasswd://"+writeHtpasswd(t), htpasswdTM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.AddUser(ctx, &User{Username: "dave"}); err != ErrHtpasswdReadOnly {
+		t.Fatal("Expected ErrHtpasswdReadOnly from AddUser, got", err)
+	}
+	if err := a.UpdateUser(ctx, &User{Username: "alice"}); err != ErrHtpasswdReadOnly {
+		t.Fatal("Expected ErrHtpasswdReadOnly from UpdateUser, got", err)
+	}
+	if err := a.SetPassword(ctx, "alice", "new-secret"); err != ErrHtpasswdReadOnly {
+		t.Fatal("Expected ErrHtpasswdReadOnly from SetPassword, got", err)
+	}
+	if err := a.SetPasswordHash(ctx, "alice", []byte("hash")); err != ErrHtpasswdReadOnly {
+		t.Fatal("Expected ErrHtpasswdReadOnly from SetPasswordHash, got", err)
+	}
+	if err := a.DeleteUser(ctx, "alice"); err != ErrHtpasswdReadOnly {
+		t.Fatal("Expected ErrHtpasswdReadOnly from DeleteUser, got", err)
+	}
+	if _, err := a.ListAccessTokens(ctx, "alice"); err != ErrNotSupported {
+		t.Fatal("Expected ErrNotSupported from ListAccessTokens, got", err)
+	}
+}
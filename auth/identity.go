@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrIdentityEmpty indicates an identity was given without an issuer or subject.
+	ErrIdentityEmpty = errors.New("Identity issuer and subject are required")
+
+	// ErrIdentityNotLinked indicates an identity provider logged in a user whose username belongs to an
+	// existing account, which an admin must link the identity to first.
+	ErrIdentityNotLinked = errors.New("Account exists and is not linked to this identity, ask an admin to link it")
+)
+
+// Identity links an account at an external identity provider, named by the provider's issuer and the
+// account's subject, to a user. The subject never changes, unlike the username the provider gives.
+type Identity struct {
+	Issuer   string `json:"issuer"`
+	Subject  string `json:"subject"`
+	Username string `json:"username"`
+
+	// Created is set when the user was added for this identity, the identity provider then decides whether they are an admin.
+	Created   bool      `json:"created,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IdentityStore is implemented by Auths that keep the external identities linked to users. Deleting a user
+// unlinks their identities.
+type IdentityStore interface {
+	// GetIdentity gets the identity with the given issuer and subject, nil if it is not linked to a user.
+	GetIdentity(ctx context.Context, issuer, subject string) (*Identity, error)
+
+	// SetIdentity links an identity to an existing user, replacing the user it was linked to.
+	SetIdentity(ctx context.Context, identity *Identity) error
+
+	// DeleteIdentity unlinks an identity from its user.
+	DeleteIdentity(ctx context.Context, issuer, subject string) error
+
+	// ListIdentities lists the identities linked to a user sorted by issuer, then subject.
+	ListIdentities(ctx context.Context, username string) ([]*Identity, error)
+}
+
+// FindIdentityStore returns the first IdentityStore among a and the Auths it wraps, or nil if there is none.
+func FindIdentityStore(a Auth) IdentityStore {
+	for a != nil {
+		if s, ok := a.(IdentityStore); ok {
+			return s
+		}
+
+		w, ok := a.(interface{ Unwrap() Auth })
+		if !ok {
+			return nil
+		}
+		a = w.Unwrap()
+	}
+	return nil
+}
+
+// ExternalLogin is a user logged in by an external identity provider.
+type ExternalLogin struct {
+	Issuer  string
+	Subject string
+
+	// Username is the username the identity provider gives the user, used when they are added.
+	Username string
+
+	// Admin is whether the identity provider makes the user an admin, nil if admins are managed in the registry.
+	Admin *bool
+}
+
+// identityKey is the key of an identity, issuers and subjects do not contain NUL.
+func identityKey(issuer, subject string) string {
+	return issuer + "\x00" + subject
+}
+
+// sortIdentities sorts identities by issuer, then subject.
+func sortIdentities(list []*Identity) {
+	sort.Slice(list, func(i, j int) bool {
+		return identityKey(list[i].Issuer, list[i].Subject) < identityKey(list[j].Issuer, list[j].Subject)
+	})
+}
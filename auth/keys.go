@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	// ErrInvalidSigningKey indicates a key file does not hold an RSA key of at least 2048 bits or an Ed25519 key.
+	ErrInvalidSigningKey = errors.New("Signing key must be a PEM encoded RSA private key of at least 2048 bits or Ed25519 private key")
+
+	// ErrNoSigningKey indicates a TokenManager was given no keys.
+	ErrNoSigningKey = errors.New("No signing key")
+)
+
+// SigningMethodEdDSA signs tokens with Ed25519 keys, which jwt-go does not support itself.
+var SigningMethodEdDSA jwt.SigningMethod = signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEdDSA struct{}
+
+func (signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+// SigningKey is a key tokens are signed and verified with. Asymmetric keys are identified by the
+// RFC 7638 thumbprint of their public key, which is given as the kid header of the tokens they sign.
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	// private signs tokens, it is the secret for HMAC keys.
+	private interface{}
+
+	// public verifies tokens, it is nil for HMAC keys.
+	public crypto.PublicKey
+}
+
+// NewHMACKey returns an HS256 SigningKey for a shared secret. It has no ID, its tokens have no kid.
+func NewHMACKey(secret []byte) *SigningKey {
+	return &SigningKey{
+		Method:  jwt.SigningMethodHS256,
+		private: secret,
+	}
+}
+
+// ParseSigningKey parses a PEM encoded RSA or Ed25519 private key, which sign with RS256 and EdDSA.
+func ParseSigningKey(data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidSigningKey
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, ErrInvalidSigningKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &SigningKey{private: key}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return nil, ErrInvalidSigningKey
+		}
+		k.Method = jwt.SigningMethodRS256
+		k.public = &key.PublicKey
+	case ed25519.PrivateKey:
+		k.Method = SigningMethodEdDSA
+		k.public = key.Public()
+	default:
+		return nil, ErrInvalidSigningKey
+	}
+
+	k.ID = k.JWK().thumbprint()
+	return k, nil
+}
+
+// LoadSigningKey loads a PEM encoded RSA or Ed25519 private key from a file.
+func LoadSigningKey(name string) (*SigningKey, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ParseSigningKey(data)
+	if err != nil {
+		return nil, errors.New("While loading signing key " + name + ": " + err.Error())
+	}
+	return key, nil
+}
+
+// GenerateSigningKey generates an Ed25519 SigningKey, returning it along with its PEM encoding.
+func GenerateSigningKey() (*SigningKey, []byte, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	key, err := ParseSigningKey(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, data, nil
+}
+
+// JWK is a public key as a JSON Web Key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// JWK returns the public key as a JSON Web Key, or nil for HMAC keys.
+func (k *SigningKey) JWK() *JWK {
+	jwk := &JWK{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return nil
+	}
+
+	return jwk
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the key, the hash of its required members.
+func (j *JWK) thumbprint() string {
+	members := map[string]string{"kty": j.Kty}
+	if j.Kty == "RSA" {
+		members["e"] = j.E
+		members["n"] = j.N
+	} else {
+		members["crv"] = j.Crv
+		members["x"] = j.X
+	}
+
+	// Maps are encoded with their keys sorted and no whitespace, as the thumbprint requires.
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// verifyKey returns the key that verifies tokens signed with the SigningKey.
+func (k *SigningKey) verifyKey() interface{} {
+	if k.public != nil {
+		return k.public
+	}
+	return k.private
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func generateRSAKey(t *testing.T) *SigningKey {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ParseSigningKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func generateEd25519Key(t *testing.T) *SigningKey {
+	key, _, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSigningKeys(t *testing.T) {
+	for _, key := range []*SigningKey{generateRSAKey(t), generateEd25519Key(t)} {
+		tm := NewTokenManager(nil, time.Minute)
+		if err := tm.SetKeys(key); err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := tm.Generate("the-username")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, _, err := new(jwt.Parser).ParseUnverified(token, &Claims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.Method.Alg() != key.Method.Alg() || tok.Header["kid"] != key.ID {
+			t.Fatal("Expected a", key.Method.Alg(), "token with kid", key.ID, "got", tok.Header)
+		}
+
+		if username, err := tm.Validate(token); err != nil || username != "the-username" {
+			t.Fatal("Expected a token for the-username, got", username, err)
+		}
+	}
+}
+
+func TestParseSigningKeyInvalid(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{
+		[]byte("not a key"),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("public")}),
+	} {
+		if _, err := ParseSigningKey(data); err != ErrInvalidSigningKey {
+			t.Fatal("Expected ErrInvalidSigningKey, got", err)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	secret := []byte("super-secret-key")
+	old := generateRSAKey(t)
+	next := generateEd25519Key(t)
+
+	tm := NewTokenManager(secret, time.Minute)
+	hmacToken, err := tm.Generate("the-username")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tm.SetKeys(old, NewHMACKey(secret)); err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := tm.Generate("the-username")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate, tokens signed with the older keys stay valid.
+	if err := tm.SetKeys(next, old, NewHMACKey(secret)); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{hmacToken, oldToken} {
+		if _, err := tm.Validate(token); err != nil {
+			t.Fatal("Expected a token signed before the rotation to be valid, got", err)
+		}
+	}
+
+	jwks := tm.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != next.ID || jwks.Keys[0].Kty != "OKP" || jwks.Keys[1].Kid != old.ID || jwks.Keys[1].Kty != "RSA" {
+		t.Fatal("Expected the public keys without the HMAC secret, got", jwks.Keys)
+	}
+
+	// Retire the older keys.
+	if err := tm.SetKeys(next); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{hmacToken, oldToken} {
+		if _, err := tm.Validate(token); err == nil {
+			t.Fatal("Expected a token signed with a retired key to be refused")
+		}
+	}
+
+	if err := tm.SetKeys(); err != ErrNoSigningKey {
+		t.Fatal("Expected ErrNoSigningKey, got", err)
+	}
+}
+
+func TestAlgorithmConfusion(t *testing.T) {
+	key := generateRSAKey(t)
+	tm := NewTokenManager(nil, time.Minute)
+	if err := tm.SetKeys(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// An HS256 token using the public key, which anyone can fetch, as the secret.
+	jwk := key.JWK()
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{StandardClaims: jwt.StandardClaims{
+		Subject:   "the-username",
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	}})
+	tok.Header["kid"] = key.ID
+	token, err := tok.SignedString([]byte(jwk.N))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tm.Validate(token); err == nil || !strings.Contains(err.Error(), jwt.ErrSignatureInvalid.Error()) {
+		t.Fatal("Expected the forged token to be refused, got", err)
+	}
+}
+
+func TestThumbprint(t *testing.T) {
+	// The example of RFC 7638 section 3.1.
+	jwk := &JWK{
+		Kty: "RSA",
+		E:   "AQAB",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMs" +
+			"tn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91" +
+			"CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+	}
+
+	if id := jwk.thumbprint(); id != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Fatal("Expected the thumbprint of the RFC, got", id)
+	}
+}
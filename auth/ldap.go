@@ -0,0 +1,461 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	// ErrManagedExternally indicates users are managed outside of the registry and cannot be changed through it.
+	ErrManagedExternally = errors.New("Users are managed by the directory and cannot be changed here")
+)
+
+// ldapConn is the part of an LDAP connection used by LDAPAuth.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPConfig configures an LDAPAuth.
+type LDAPConfig struct {
+	// URL of the directory server, ldap://host:port or ldaps://host:port.
+	URL string
+
+	// BaseDN is where users are searched for.
+	BaseDN string
+
+	// BindDN and BindPassword are the account used to look up users, anonymous if empty.
+	BindDN       string
+	BindPassword string
+
+	// UserAttr is the attribute holding the username, uid by default.
+	UserAttr string
+
+	// Filter limits which entries are users, (objectClass=person) by default.
+	Filter string
+
+	// AdminGroup is the DN of the group whose members are admins, nobody is an admin if empty.
+	AdminGroup string
+
+	// StartTLS upgrades ldap:// connections to TLS before binding.
+	StartTLS bool
+
+	// InsecureSkipVerify disables verification of the server's certificate, for testing only.
+	InsecureSkipVerify bool
+}
+
+// LDAPAuth authenticates users against an LDAP directory by binding as them. The directory is
+// the only source of users: they cannot be added, changed or given passwords through the registry.
+type LDAPAuth struct {
+	cfg  LDAPConfig
+	tm   *TokenManager
+	dial func(ctx context.Context) (ldapConn, error)
+}
+
+// NewLDAPAuth creates a new LDAPAuth.
+func NewLDAPAuth(cfg LDAPConfig, tm *TokenManager) (*LDAPAuth, error) {
+	if len(cfg.BaseDN) == 0 {
+		return nil, errors.New("Base DN is required: ldap://<host>/<base DN>")
+	}
+	if len(cfg.UserAttr) == 0 {
+		cfg.UserAttr = "uid"
+	}
+	if len(cfg.Filter) == 0 {
+		cfg.Filter = "(objectClass=person)"
+	}
+	if _, err := ldap.CompileFilter(cfg.Filter); err != nil {
+		return nil, errors.New("Invalid LDAP filter: " + err.Error())
+	}
+
+	a := &LDAPAuth{
+		cfg: cfg,
+		tm:  tm,
+	}
+	a.dial = a.dialServer
+	return a, nil
+}
+
+// newLDAPAuthFromPath parses a connection string in the form
+// ldap[s]://<host>[:<port>]/<base DN>?bind_dn=<DN>&bind_password=<password>&user_attr=<attribute>&filter=<filter>&admin_group=<DN>&starttls=<bool>&insecure=<bool>.
+func newLDAPAuthFromPath(path string, tm *TokenManager) (*LDAPAuth, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	opts := u.Query()
+
+	cfg := LDAPConfig{
+		URL:          u.Scheme + "://" + u.Host,
+		BaseDN:       strings.TrimPrefix(u.Path, "/"),
+		BindDN:       opts.Get("bind_dn"),
+		BindPassword: opts.Get("bind_password"),
+		UserAttr:     opts.Get("user_attr"),
+		Filter:       opts.Get("filter"),
+		AdminGroup:   opts.Get("admin_group"),
+	}
+	for name, field := range map[string]*bool{"starttls": &cfg.StartTLS, "insecure": &cfg.InsecureSkipVerify} {
+		if v := opts.Get(name); len(v) > 0 {
+			if *field, err = strconv.ParseBool(v); err != nil {
+				return nil, errors.New("Invalid " + name + ": " + v)
+			}
+		}
+	}
+
+	return NewLDAPAuth(cfg, tm)
+}
+
+// Login binds to the directory as the user and if successful, generates a token.
+func (a *LDAPAuth) Login(ctx context.Context, username, password string) (string, error) {
+	if len(username) == 0 {
+		return "", ErrUsernameEmpty
+	}
+	if len(password) == 0 {
+		// An empty password is an unauthenticated bind, which most servers accept for any DN.
+		return "", ErrPasswordTooShort
+	}
+
+	err := a.session(ctx, func(conn ldapConn) error {
+		entry, err := a.findUser(conn, username)
+		if err != nil {
+			return err
+		}
+		return conn.Bind(entry.DN, password)
+	})
+	if err == ErrUserDoesNotExist || ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return "", ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return a.tm.Generate(username)
+}
+
+// AddUser is not supported, users are added to the directory.
+func (a *LDAPAuth) AddUser(ctx context.Context, user *User) error {
+	return ErrManagedExternally
+}
+
+// UpdateUser is not supported, users are changed in the directory.
+func (a *LDAPAuth) UpdateUser(ctx context.Context, user *User) error {
+	return ErrManagedExternally
+}
+
+// SetPassword is not supported, passwords are changed in the directory.
+func (a *LDAPAuth) SetPassword(ctx context.Context, username, password string) error {
+	return ErrManagedExternally
+}
+
+// GetUser gets a User object, an admin if they are a member of the admin group.
+func (a *LDAPAuth) GetUser(ctx context.Context, username string) (*User, error) {
+	if len(username) == 0 {
+		return nil, ErrUsernameEmpty
+	}
+
+	var user *User
+	err := a.session(ctx, func(conn ldapConn) error {
+		entry, err := a.findUser(conn, username)
+		if err != nil {
+			return err
+		}
+
+		user = &User{Username: username}
+		user.Admin, err = a.isAdmin(conn, entry.DN, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// DeleteUser is not supported, users are removed from the directory.
+func (a *LDAPAuth) DeleteUser(ctx context.Context, username string) error {
+	return ErrManagedExternally
+}
+
+// ListUsers lists all Users in the directory sorted by username.
+func (a *LDAPAuth) ListUsers(ctx context.Context) ([]*User, error) {
+	users := []*User{}
+	err := a.session(ctx, func(conn ldapConn) error {
+		res, err := conn.Search(a.userSearch(a.cfg.Filter))
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range res.Entries {
+			username := entry.GetAttributeValue(a.cfg.UserAttr)
+			if len(username) == 0 {
+				continue
+			}
+
+			admin, err := a.isAdmin(conn, entry.DN, username)
+			if err != nil {
+				return err
+			}
+			users = append(users, &User{Username: username, Admin: admin})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+// GetPasswordHash returns nil for users in the directory, their passwords never leave it.
+func (a *LDAPAuth) GetPasswordHash(ctx context.Context, username string) ([]byte, error) {
+	if _, err := a.GetUser(ctx, username); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// SetPasswordHash is not supported, passwords are changed in the directory.
+func (a *LDAPAuth) SetPasswordHash(ctx context.Context, username string, hash []byte) error {
+	return ErrManagedExternally
+}
+
+// AddAccessToken is not supported, the directory has nowhere to keep them.
+func (a *LDAPAuth) AddAccessToken(ctx context.Context, token *AccessToken) error {
+	return ErrNotSupported
+}
+
+// GetAccessToken is not supported, the directory has nowhere to keep them.
+func (a *LDAPAuth) GetAccessToken(ctx context.Context, id string) (*AccessToken, error) {
+	return nil, ErrNotSupported
+}
+
+// UpdateAccessToken is not supported, the directory has nowhere to keep them.
+func (a *LDAPAuth) UpdateAccessToken(ctx context.Context, token *AccessToken) error {
+	return ErrNotSupported
+}
+
+// DeleteAccessToken is not supported, the directory has nowhere to keep them.
+func (a *LDAPAuth) DeleteAccessToken(ctx context.Context, id string) error {
+	return ErrNotSupported
+}
+
+// ListAccessTokens is not supported, the directory has nowhere to keep them.
+func (a *LDAPAuth) ListAccessTokens(ctx context.Context, username string) ([]*AccessToken, error) {
+	return nil, ErrNotSupported
+}
+
+// RevokeToken is not supported, the directory has nowhere to keep revocations.
+func (a *LDAPAuth) RevokeToken(ctx context.Context, token *RevokedToken) error {
+	return ErrNotSupported
+}
+
+// TokenRevoked is not supported, the directory has nowhere to keep revocations.
+func (a *LDAPAuth) TokenRevoked(ctx context.Context, id string) (bool, error) {
+	return false, ErrNotSupported
+}
+
+// ListRevokedTokens is not supported, the directory has nowhere to keep revocations.
+func (a *LDAPAuth) ListRevokedTokens(ctx context.Context) ([]*RevokedToken, error) {
+	return nil, ErrNotSupported
+}
+
+// AddTeam is not supported, the directory has nowhere to keep teams.
+func (a *LDAPAuth) AddTeam(ctx context.Context, team *Team) error {
+	return ErrNotSupported
+}
+
+// GetTeam is not supported, the directory has nowhere to keep teams.
+func (a *LDAPAuth) GetTeam(ctx context.Context, name string) (*Team, error) {
+	return nil, ErrNotSupported
+}
+
+// UpdateTeam is not supported, the directory has nowhere to keep teams.
+func (a *LDAPAuth) UpdateTeam(ctx context.Context, team *Team) error {
+	return ErrNotSupported
+}
+
+// DeleteTeam is not supported, the directory has nowhere to keep teams.
+func (a *LDAPAuth) DeleteTeam(ctx context.Context, name string) error {
+	return ErrNotSupported
+}
+
+// ListTeams is not supported, the directory has nowhere to keep teams.
+func (a *LDAPAuth) ListTeams(ctx context.Context) ([]*Team, error) {
+	return nil, ErrNotSupported
+}
+
+// AddTeamMember is not supported, the directory has nowhere to keep teams.
+func (a *LDAPAuth) AddTeamMember(ctx context.Context, team, username string) error {
+	return ErrNotSupported
+}
+
+// RemoveTeamMember is not supported, the directory has nowhere to keep teams.
+func (a *LDAPAuth) RemoveTeamMember(ctx context.Context, team, username string) error {
+	return ErrNotSupported
+}
+
+// ListUserTeams is not supported, the directory has nowhere to keep teams.
+func (a *LDAPAuth) ListUserTeams(ctx context.Context, username string) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// GetLoginAttempts is not supported, the directory has nowhere to keep failed logins.
+func (a *LDAPAuth) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	return nil, ErrNotSupported
+}
+
+// SetLoginAttempts is not supported, the directory has nowhere to keep failed logins.
+func (a *LDAPAuth) SetLoginAttempts(ctx context.Context, attempts *LoginAttempts) error {
+	return ErrNotSupported
+}
+
+// DeleteLoginAttempts is not supported, the directory has nowhere to keep failed logins.
+func (a *LDAPAuth) DeleteLoginAttempts(ctx context.Context, key string) error {
+	return ErrNotSupported
+}
+
+// ListLoginAttempts is not supported, the directory has nowhere to keep failed logins.
+func (a *LDAPAuth) ListLoginAttempts(ctx context.Context) ([]*LoginAttempts, error) {
+	return nil, ErrNotSupported
+}
+
+// GetTOTP is not supported, two-factor authentication is left to the directory.
+func (a *LDAPAuth) GetTOTP(ctx context.Context, username string) (*TOTP, error) {
+	return nil, ErrNotSupported
+}
+
+// SetTOTP is not supported, two-factor authentication is left to the directory.
+func (a *LDAPAuth) SetTOTP(ctx context.Context, totp *TOTP) error {
+	return ErrNotSupported
+}
+
+// DeleteTOTP is not supported, two-factor authentication is left to the directory.
+func (a *LDAPAuth) DeleteTOTP(ctx context.Context, username string) error {
+	return ErrNotSupported
+}
+
+// session opens a connection bound as the lookup account, runs fn and closes the connection.
+// The connection is closed early if ctx is done, failing whatever fn is waiting for.
+func (a *LDAPAuth) session(ctx context.Context, fn func(conn ldapConn) error) error {
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	if len(a.cfg.BindDN) > 0 {
+		err = conn.Bind(a.cfg.BindDN, a.cfg.BindPassword)
+	}
+	if err == nil {
+		err = fn(conn)
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// findUser returns the directory entry of a user.
+func (a *LDAPAuth) findUser(conn ldapConn, username string) (*ldap.Entry, error) {
+	filter := "(&" + a.cfg.Filter + "(" + a.cfg.UserAttr + "=" + ldap.EscapeFilter(username) + "))"
+	res, err := conn.Search(a.userSearch(filter))
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(res.Entries) {
+	case 0:
+		return nil, ErrUserDoesNotExist
+	case 1:
+		return res.Entries[0], nil
+	default:
+		return nil, errors.New("More than one directory entry for user " + username)
+	}
+}
+
+// isAdmin reports whether the entry dn, with the given username, is a member of the admin group.
+// Members may be listed by DN, as in groupOfNames and groupOfUniqueNames, or by username, as in posixGroup.
+func (a *LDAPAuth) isAdmin(conn ldapConn, dn, username string) (bool, error) {
+	if len(a.cfg.AdminGroup) == 0 {
+		return false, nil
+	}
+
+	filter := "(|(member=" + ldap.EscapeFilter(dn) + ")(uniqueMember=" + ldap.EscapeFilter(dn) + ")(memberUid=" + ldap.EscapeFilter(username) + "))"
+	res, err := conn.Search(ldap.NewSearchRequest(a.cfg.AdminGroup, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+		1, 0, false, filter, []string{"dn"}, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return false, errors.New("Admin group does not exist: " + a.cfg.AdminGroup)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return len(res.Entries) > 0, nil
+}
+
+// userSearch returns a search for users below the base DN.
+func (a *LDAPAuth) userSearch(filter string) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(a.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, filter, []string{a.cfg.UserAttr}, nil)
+}
+
+// dialServer connects to the directory server, upgrading to TLS if configured.
+func (a *LDAPAuth) dialServer(ctx context.Context) (ldapConn, error) {
+	u, err := url.Parse(a.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Hostname()
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: a.cfg.InsecureSkipVerify}
+
+	var c net.Conn
+	switch u.Scheme {
+	case "ldap":
+		c, err = (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(host, portOr(u, "389")))
+	case "ldaps":
+		c, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", net.JoinHostPort(host, portOr(u, "636")))
+	default:
+		return nil, errors.New("Unknown LDAP scheme: " + u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn := ldap.NewConn(c, u.Scheme == "ldaps")
+	conn.Start()
+
+	if a.cfg.StartTLS && u.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// portOr returns the port of u, or def if it has none.
+func portOr(u *url.URL, def string) string {
+	if p := u.Port(); len(p) > 0 {
+		return p
+	}
+	return def
+}
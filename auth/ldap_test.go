@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeDirectory is an in-memory stand-in for an LDAP server, supporting the searches LDAPAuth makes.
+type fakeDirectory struct {
+	entries   map[string]map[string][]string
+	passwords map[string]string
+}
+
+func newFakeDirectory() *fakeDirectory {
+	d := &fakeDirectory{
+		entries:   map[string]map[string][]string{},
+		passwords: map[string]string{},
+	}
+	d.add("cn=reader,dc=example,dc=org", "reader-secret", map[string][]string{"objectClass": {"organizationalRole"}})
+	d.add("uid=alice,ou=people,dc=example,dc=org", "alice-secret", map[string][]string{"objectClass": {"person"}, "uid": {"alice"}})
+	d.add("uid=bob,ou=people,dc=example,dc=org", "bob-secret", map[string][]string{"objectClass": {"person"}, "uid": {"bob"}})
+	d.add("uid=printer,ou=devices,dc=example,dc=org", "printer-secret", map[string][]string{"objectClass": {"device"}, "uid": {"printer"}})
+	d.add("cn=admins,ou=groups,dc=example,dc=org", "", map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"member":      {"uid=alice,ou=people,dc=example,dc=org"},
+	})
+	return d
+}
+
+func (d *fakeDirectory) add(dn, password string, attrs map[string][]string) {
+	lower := map[string][]string{}
+	for name, values := range attrs {
+		lower[strings.ToLower(name)] = values
+	}
+	d.entries[dn] = lower
+	if len(password) > 0 {
+		d.passwords[dn] = password
+	}
+}
+
+func (d *fakeDirectory) auth(cfg LDAPConfig) *LDAPAuth {
+	a, err := NewLDAPAuth(cfg, NewTokenManager([]byte("super-secret-key"), time.Minute))
+	if err != nil {
+		panic(err)
+	}
+	a.dial = func(ctx context.Context) (ldapConn, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return &fakeConn{d: d}, nil
+	}
+	return a
+}
+
+type fakeConn struct {
+	d *fakeDirectory
+}
+
+func (c *fakeConn) Bind(dn, password string) error {
+	if expected, ok := c.d.passwords[dn]; !ok || expected != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("Invalid credentials"))
+	}
+	return nil
+}
+
+func (c *fakeConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	filter, err := ldap.CompileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Scope == ldap.ScopeBaseObject {
+		if _, ok := c.d.entries[req.BaseDN]; !ok {
+			return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("No such object"))
+		}
+	}
+
+	res := &ldap.SearchResult{}
+	for dn, attrs := range c.d.entries {
+		inScope := dn == req.BaseDN
+		if req.Scope == ldap.ScopeWholeSubtree {
+			inScope = inScope || strings.HasSuffix(dn, ","+req.BaseDN)
+		}
+		if inScope && matches(filter, attrs) {
+			res.Entries = append(res.Entries, ldap.NewEntry(dn, attrs))
+		}
+	}
+	return res, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// matches evaluates the filters LDAPAuth uses against the attributes of an entry.
+func matches(f *ber.Packet, attrs map[string][]string) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, child := range f.Children {
+			if !matches(child, attrs) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range f.Children {
+			if matches(child, attrs) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterEqualityMatch:
+		name := strings.ToLower(string(f.Children[0].Data.Bytes()))
+		for _, v := range attrs[name] {
+			if strings.EqualFold(v, string(f.Children[1].Data.Bytes())) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(attrs[strings.ToLower(string(f.Data.Bytes()))]) > 0
+	}
+	return false
+}
+
+var testLDAPConfig = LDAPConfig{
+	URL:          "ldap://localhost",
+	BaseDN:       "dc=example,dc=org",
+	BindDN:       "cn=reader,dc=example,dc=org",
+	BindPassword: "reader-secret",
+	AdminGroup:   "cn=admins,ou=groups,dc=example,dc=org",
+}
+
+func TestLDAPLogin(t *testing.T) {
+	ctx := context.Background()
+	a := newFakeDirectory().auth(testLDAPConfig)
+
+	token, err := a.Login(ctx, "alice", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username, err := a.tm.Validate(token); err != nil || username != "alice" {
+		t.Fatal("Expected a token for alice, got", username, err)
+	}
+
+	if _, err := a.Login(ctx, "alice", "wrong-secret"); err != ErrInvalidCredentials {
+		t.Fatal("Expected ErrInvalidCredentials, got", err)
+	}
+	if _, err := a.Login(ctx, "alice", ""); err != ErrPasswordTooShort {
+		t.Fatal("Expected ErrPasswordTooShort for an unauthenticated bind, got", err)
+	}
+	if _, err := a.Login(ctx, "carol", "carol-secret"); err != ErrInvalidCredentials {
+		t.Fatal("Expected unknown users to be refused like a wrong password, got", err)
+	}
+	if _, err := a.Login(ctx, "printer", "printer-secret"); err != ErrInvalidCredentials {
+		t.Fatal("Expected entries outside the filter to be ignored, got", err)
+	}
+	if _, err := a.Login(ctx, "*", "alice-secret"); err != ErrInvalidCredentials {
+		t.Fatal("Expected the username to be escaped, got", err)
+	}
+}
+
+func TestLDAPLookupBind(t *testing.T) {
+	cfg := testLDAPConfig
+	cfg.BindPassword = "wrong-secret"
+	a := newFakeDirectory().auth(cfg)
+
+	if _, err := a.GetUser(context.Background(), "alice"); !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		t.Fatal("Expected the lookup bind to fail, got", err)
+	}
+}
+
+func TestLDAPGetUser(t *testing.T) {
+	ctx := context.Background()
+	a := newFakeDirectory().auth(testLDAPConfig)
+
+	alice, err := a.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Username != "alice" || !alice.Admin {
+		t.Fatal("Expected alice to be an admin, got", alice)
+	}
+
+	bob, err := a.GetUser(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.Admin {
+		t.Fatal("Expected bob not to be an admin")
+	}
+
+	if _, err := a.GetUser(ctx, "carol"); err != ErrUserDoesNotExist {
+		t.Fatal("Expected ErrUserDoesNotExist, got", err)
+	}
+
+	if hash, err := a.GetPasswordHash(ctx, "bob"); err != nil || hash != nil {
+		t.Fatal("Expected no password hash, got", hash, err)
+	}
+}
+
+func TestLDAPPosixGroup(t *testing.T) {
+	d := newFakeDirectory()
+	d.add("cn=admins,ou=groups,dc=example,dc=org", "", map[string][]string{
+		"objectClass": {"posixGroup"},
+		"memberUid":   {"bob"},
+	})
+	a := d.auth(testLDAPConfig)
+
+	bob, err := a.GetUser(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bob.Admin {
+		t.Fatal("Expected bob to be an admin through memberUid")
+	}
+}
+
+func TestLDAPListUsers(t *testing.T) {
+	a := newFakeDirectory().auth(testLDAPConfig)
+
+	users, err := a.ListUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Username != "alice" || !users[0].Admin || users[1].Username != "bob" || users[1].Admin {
+		t.Fatal("Unexpected users", users)
+	}
+}
+
+func TestLDAPReadOnly(t *testing.T) {
+	ctx := context.Background()
+	a := newFakeDirectory().auth(testLDAPConfig)
+
+	if err := a.AddUser(ctx, &User{Username: "carol"}); err != ErrManagedExternally {
+		t.Fatal("Expected ErrManagedExternally from AddUser, got", err)
+	}
+	if err := a.UpdateUser(ctx, &User{Username: "alice"}); err != ErrManagedExternally {
+		t.Fatal("Expected ErrManagedExternally from UpdateUser, got", err)
+	}
+	if err := a.SetPassword(ctx, "alice", "new-secret"); err != ErrManagedExternally {
+		t.Fatal("Expected ErrManagedExternally from SetPassword, got", err)
+	}
+	if err := a.SetPasswordHash(ctx, "alice", []byte("hash")); err != ErrManagedExternally {
+		t.Fatal("Expected ErrManagedExternally from SetPasswordHash, got", err)
+	}
+	if err := a.DeleteUser(ctx, "alice"); err != ErrManagedExternally {
+		t.Fatal("Expected ErrManagedExternally from DeleteUser, got", err)
+	}
+}
+
+func TestLDAPCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	a := newFakeDirectory().auth(testLDAPConfig)
+	if _, err := a.Login(ctx, "alice", "alice-secret"); err != context.Canceled {
+		t.Fatal("Expected context.Canceled, got", err)
+	}
+}
+
+func TestLDAPFromPath(t *testing.T) {
+	a, err := Resolve("ldaps://ldap.example.org:1636/dc=example,dc=org?bind_dn=cn%3Dreader,dc%3Dexample,dc%3Dorg&bind_password=secret&user_attr=sAMAccountName&admin_group=cn%3Dadmins,dc%3Dexample,dc%3Dorg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := a.(*LDAPAuth).cfg
+	if cfg.URL != "ldaps://ldap.example.org:1636" || cfg.BaseDN != "dc=example,dc=org" || cfg.BindDN != "cn=reader,dc=example,dc=org" ||
+		cfg.BindPassword != "secret" || cfg.UserAttr != "sAMAccountName" || cfg.AdminGroup != "cn=admins,dc=example,dc=org" ||
+		cfg.Filter != "(objectClass=person)" {
+		t.Fatal("Unexpected config", cfg)
+	}
+
+	if _, err := Resolve("ldap://ldap.example.org", nil); err == nil {
+		t.Fatal("Expected an error without a base DN")
+	}
+	if _, err := Resolve("ldap://ldap.example.org/dc=example?filter=(uid=", nil); err == nil {
+		t.Fatal("Expected an error for an invalid filter")
+	}
+}
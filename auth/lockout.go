@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrTooManyAttempts indicates logins for the user or from the address are refused after too many failures.
+var ErrTooManyAttempts = errors.New("Too many failed login attempts, try again later")
+
+// LockoutPolicy decides how failed password logins are throttled. After each failure the next login
+// must wait Delay, doubled for every failure after the first up to MaxDelay. After MaxFailures in a row
+// logins are refused for Lockout. Failures are forgotten once Lockout has passed since the last one.
+type LockoutPolicy struct {
+	MaxFailures int
+	Delay       time.Duration
+	MaxDelay    time.Duration
+	Lockout     time.Duration
+
+	// MaxIPFailures locks out an IP address after this many failures in a row, addresses are not delayed.
+	MaxIPFailures int
+}
+
+// DefaultLockoutPolicy is used unless another LockoutPolicy is set.
+var DefaultLockoutPolicy = LockoutPolicy{
+	MaxFailures:   10,
+	Delay:         time.Second,
+	MaxDelay:      30 * time.Second,
+	Lockout:       15 * time.Minute,
+	MaxIPFailures: 100,
+}
+
+// ForIP returns the LockoutPolicy applied to IP addresses, which are locked out without delays.
+func (p LockoutPolicy) ForIP() LockoutPolicy {
+	return LockoutPolicy{MaxFailures: p.MaxIPFailures, Lockout: p.Lockout}
+}
+
+// delay returns how long to wait after the given number of failures.
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	d := p.Delay
+	for i := 1; i < failures && d > 0 && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay && p.MaxDelay > 0 {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// LoginAttempts are the failed password logins in a row for a user or from an IP address.
+type LoginAttempts struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+
+	// ExpiresAt is when the failures are forgotten.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UserAttemptsKey returns the LoginAttempts key of a user, usernames are compared case insensitively.
+func UserAttemptsKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// IPAttemptsKey returns the LoginAttempts key of an IP address.
+func IPAttemptsKey(ip string) string {
+	return "ip:" + ip
+}
+
+// RetryAt returns when the next login may be attempted, it may be in the past.
+func (l *LoginAttempts) RetryAt(p LockoutPolicy) time.Time {
+	retry := l.LastFailure.Add(p.delay(l.Failures))
+	if l.LockedUntil.After(retry) {
+		retry = l.LockedUntil
+	}
+	return retry
+}
+
+// Fail records a failed login at now, starting over if the earlier failures have expired.
+func (l *LoginAttempts) Fail(p LockoutPolicy, now time.Time) {
+	if !now.Before(l.ExpiresAt) {
+		l.Failures = 0
+		l.LockedUntil = time.Time{}
+	}
+
+	l.Failures++
+	l.LastFailure = now
+	if p.MaxFailures > 0 && l.Failures >= p.MaxFailures {
+		l.LockedUntil = now.Add(p.Lockout)
+	}
+
+	l.ExpiresAt = now.Add(p.Lockout)
+	if retry := l.RetryAt(p); retry.After(l.ExpiresAt) {
+		l.ExpiresAt = retry
+	}
+}
+
+// expired reports whether the failures have been forgotten.
+func (l *LoginAttempts) expired() bool {
+	return !time.Now().Before(l.ExpiresAt)
+}
+
+// sortLoginAttempts sorts attempts by key.
+func sortLoginAttempts(attempts []*LoginAttempts) {
+	sort.Slice(attempts, func(i, j int) bool {
+		return attempts[i].Key < attempts[j].Key
+	})
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// checkPassword validates password against hash. A nil hash is an unknown user, the password is compared
+// with a dummy hash so they take as long to refuse as a wrong password. Both return ErrInvalidCredentials.
+func checkPassword(hash []byte, password string) error {
+	if hash == nil {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+		})
+		ValidatePassword(dummyHash, password)
+		return ErrInvalidCredentials
+	}
+
+	if err := ValidatePassword(hash, password); err != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptsFail(t *testing.T) {
+	p := LockoutPolicy{MaxFailures: 4, Delay: time.Second, MaxDelay: 3 * time.Second, Lockout: time.Minute}
+	now := time.Now()
+	l := &LoginAttempts{Key: UserAttemptsKey("username")}
+
+	// Each failure doubles the delay up to MaxDelay.
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		l.Fail(p, now)
+		if l.Failures != i+1 || !l.RetryAt(p).Equal(now.Add(delay)) || !l.LockedUntil.IsZero() {
+			t.Fatal("Expected a delay of", delay, "after", i+1, "failures, got", l.RetryAt(p).Sub(now), l)
+		}
+	}
+
+	l.Fail(p, now)
+	if !l.LockedUntil.Equal(now.Add(time.Minute)) || !l.RetryAt(p).Equal(l.LockedUntil) || !l.ExpiresAt.Equal(l.LockedUntil) {
+		t.Fatal("Expected a lockout after MaxFailures, got", l)
+	}
+
+	// Failures after they have expired start over.
+	l.Fail(p, l.ExpiresAt)
+	if l.Failures != 1 || !l.LockedUntil.IsZero() {
+		t.Fatal("Expected the expired failures to be forgotten, got", l)
+	}
+}
+
+func TestLockoutPolicyForIP(t *testing.T) {
+	p := DefaultLockoutPolicy.ForIP()
+	now := time.Now()
+	l := &LoginAttempts{Key: IPAttemptsKey("192.0.2.1")}
+
+	for i := 0; i < DefaultLockoutPolicy.MaxIPFailures-1; i++ {
+		l.Fail(p, now)
+	}
+	if l.RetryAt(p).After(now) {
+		t.Fatal("Expected addresses not to be delayed, got", l.RetryAt(p).Sub(now))
+	}
+
+	l.Fail(p, now)
+	if !l.LockedUntil.Equal(now.Add(DefaultLockoutPolicy.Lockout)) {
+		t.Fatal("Expected the address to be locked out after MaxIPFailures, got", l)
+	}
+}
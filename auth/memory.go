@@ -0,0 +1,604 @@
+package auth
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryAuth implements user password authentication held in memory, contents are lost
+// when the process exits.
+type MemoryAuth struct {
+	mu        sync.RWMutex
+	users     map[string]User
+	passwords map[string][]byte
+	tokens    map[string]*AccessToken
+	revoked   map[string]time.Time
+	teams     map[string]*Team
+	attempts  map[string]LoginAttempts
+	totps     map[string]*TOTP
+	ids       map[string]Identity
+	tm        *TokenManager
+}
+
+// NewMemoryAuth creates a new MemoryAuth object.
+func NewMemoryAuth(tm *TokenManager) *MemoryAuth {
+	return &MemoryAuth{
+		users:     map[string]User{},
+		passwords: map[string][]byte{},
+		tokens:    map[string]*AccessToken{},
+		revoked:   map[string]time.Time{},
+		teams:     map[string]*Team{},
+		attempts:  map[string]LoginAttempts{},
+		totps:     map[string]*TOTP{},
+		ids:       map[string]Identity{},
+		tm:        tm,
+	}
+}
+
+// Login validates the given credentials and if successful, generates a token.
+func (a *MemoryAuth) Login(ctx context.Context, username, password string) (string, error) {
+	if len(username) == 0 {
+		return "", ErrUsernameEmpty
+	}
+	if len(password) < 6 {
+		return "", ErrPasswordTooShort
+	}
+
+	a.mu.RLock()
+	passHash := a.passwords[username]
+	a.mu.RUnlock()
+
+	if err := checkPassword(passHash, password); err != nil {
+		return "", err
+	}
+
+	return a.tm.Generate(username)
+}
+
+// AddUser adds a new user.
+func (a *MemoryAuth) AddUser(ctx context.Context, user *User) error {
+	if len(user.Username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.users[user.Username]; ok {
+		return ErrUserAlreadyExists
+	}
+
+	a.users[user.Username] = *user
+	return nil
+}
+
+// UpdateUser updates an existing user.
+func (a *MemoryAuth) UpdateUser(ctx context.Context, user *User) error {
+	if len(user.Username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.users[user.Username]; !ok {
+		return ErrUserDoesNotExist
+	}
+
+	a.users[user.Username] = *user
+	return nil
+}
+
+// SetPassword sets a password for a user.
+func (a *MemoryAuth) SetPassword(ctx context.Context, username, password string) error {
+	if len(username) == 0 {
+		return ErrUsernameEmpty
+	}
+	if len(password) < 6 {
+		return ErrPasswordTooShort
+	}
+
+	passHash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.passwords[username] = passHash
+	return nil
+}
+
+// GetUser gets a User object.
+func (a *MemoryAuth) GetUser(ctx context.Context, username string) (*User, error) {
+	if len(username) == 0 {
+		return nil, ErrUsernameEmpty
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	user, ok := a.users[username]
+	if !ok {
+		return nil, ErrUserDoesNotExist
+	}
+
+	return &user, nil
+}
+
+// DeleteUser deletes a User.
+func (a *MemoryAuth) DeleteUser(ctx context.Context, username string) error {
+	if len(username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.users, username)
+	delete(a.passwords, username)
+	delete(a.totps, username)
+	for key, i := range a.ids {
+		if i.Username == username {
+			delete(a.ids, key)
+		}
+	}
+	for id, t := range a.tokens {
+		if t.Username == username {
+			delete(a.tokens, id)
+		}
+	}
+	for _, t := range a.teams {
+		t.removeMember(username)
+	}
+	return nil
+}
+
+// ListUsers lists all Users sorted by username.
+func (a *MemoryAuth) ListUsers(ctx context.Context) ([]*User, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	users := make([]*User, 0, len(a.users))
+	for _, user := range a.users {
+		u := user
+		users = append(users, &u)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+// GetPasswordHash gets the stored password hash of a user, nil if no password has been set.
+func (a *MemoryAuth) GetPasswordHash(ctx context.Context, username string) ([]byte, error) {
+	if len(username) == 0 {
+		return nil, ErrUsernameEmpty
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if _, ok := a.users[username]; !ok {
+		return nil, ErrUserDoesNotExist
+	}
+
+	return append([]byte(nil), a.passwords[username]...), nil
+}
+
+// SetPasswordHash sets the password hash of a user as returned by GetPasswordHash.
+func (a *MemoryAuth) SetPasswordHash(ctx context.Context, username string, hash []byte) error {
+	if len(username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.users[username]; !ok {
+		return ErrUserDoesNotExist
+	}
+
+	a.passwords[username] = append([]byte(nil), hash...)
+	return nil
+}
+
+// AddAccessToken adds a personal access token for an existing user.
+func (a *MemoryAuth) AddAccessToken(ctx context.Context, token *AccessToken) error {
+	if len(token.Username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.users[token.Username]; !ok {
+		return ErrUserDoesNotExist
+	}
+	if _, ok := a.tokens[token.ID]; ok {
+		return ErrAccessTokenAlreadyExists
+	}
+
+	a.tokens[token.ID] = token.clone()
+	return nil
+}
+
+// GetAccessToken gets a personal access token by ID.
+func (a *MemoryAuth) GetAccessToken(ctx context.Context, id string) (*AccessToken, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	t, ok := a.tokens[id]
+	if !ok {
+		return nil, ErrAccessTokenDoesNotExist
+	}
+
+	return t.clone(), nil
+}
+
+// UpdateAccessToken updates an existing personal access token.
+func (a *MemoryAuth) UpdateAccessToken(ctx context.Context, token *AccessToken) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.tokens[token.ID]; !ok {
+		return ErrAccessTokenDoesNotExist
+	}
+
+	a.tokens[token.ID] = token.clone()
+	return nil
+}
+
+// DeleteAccessToken deletes a personal access token.
+func (a *MemoryAuth) DeleteAccessToken(ctx context.Context, id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.tokens, id)
+	return nil
+}
+
+// ListAccessTokens lists the personal access tokens of a user sorted by creation time.
+func (a *MemoryAuth) ListAccessTokens(ctx context.Context, username string) ([]*AccessToken, error) {
+	if len(username) == 0 {
+		return nil, ErrUsernameEmpty
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	tokens := []*AccessToken{}
+	for _, t := range a.tokens {
+		if t.Username == username {
+			tokens = append(tokens, t.clone())
+		}
+	}
+
+	sortAccessTokens(tokens)
+	return tokens, nil
+}
+
+// RevokeToken revokes the token with the given ID, it is remembered until it expires.
+func (a *MemoryAuth) RevokeToken(ctx context.Context, token *RevokedToken) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for id, expiresAt := range a.revoked {
+		if expiresAt.Before(now) {
+			delete(a.revoked, id)
+		}
+	}
+
+	a.revoked[token.ID] = token.ExpiresAt
+	return nil
+}
+
+// TokenRevoked reports whether the token with the given ID has been revoked.
+func (a *MemoryAuth) TokenRevoked(ctx context.Context, id string) (bool, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	_, ok := a.revoked[id]
+	return ok, nil
+}
+
+// ListRevokedTokens lists the revoked tokens that have not expired, sorted by ID.
+func (a *MemoryAuth) ListRevokedTokens(ctx context.Context) ([]*RevokedToken, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	now := time.Now()
+	tokens := []*RevokedToken{}
+	for id, expiresAt := range a.revoked {
+		if !expiresAt.Before(now) {
+			tokens = append(tokens, &RevokedToken{ID: id, ExpiresAt: expiresAt})
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID < tokens[j].ID
+	})
+	return tokens, nil
+}
+
+// AddTeam adds a new team, its members must exist.
+func (a *MemoryAuth) AddTeam(ctx context.Context, team *Team) error {
+	if len(team.Name) == 0 {
+		return ErrTeamNameEmpty
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.teams[team.Name]; ok {
+		return ErrTeamAlreadyExists
+	}
+	if err := a.checkMembers(team); err != nil {
+		return err
+	}
+
+	a.teams[team.Name] = team.clone()
+	return nil
+}
+
+// GetTeam gets a team, its members sorted.
+func (a *MemoryAuth) GetTeam(ctx context.Context, name string) (*Team, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	t, ok := a.teams[name]
+	if !ok {
+		return nil, ErrTeamDoesNotExist
+	}
+	return t.clone(), nil
+}
+
+// UpdateTeam updates an existing team, replacing its members.
+func (a *MemoryAuth) UpdateTeam(ctx context.Context, team *Team) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.teams[team.Name]; !ok {
+		return ErrTeamDoesNotExist
+	}
+	if err := a.checkMembers(team); err != nil {
+		return err
+	}
+
+	a.teams[team.Name] = team.clone()
+	return nil
+}
+
+// DeleteTeam deletes a team.
+func (a *MemoryAuth) DeleteTeam(ctx context.Context, name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.teams, name)
+	return nil
+}
+
+// ListTeams lists all teams sorted by name.
+func (a *MemoryAuth) ListTeams(ctx context.Context) ([]*Team, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	teams := []*Team{}
+	for _, t := range a.teams {
+		teams = append(teams, t.clone())
+	}
+
+	sortTeams(teams)
+	return teams, nil
+}
+
+// AddTeamMember adds an existing user to a team, it is not an error if they are already a member.
+func (a *MemoryAuth) AddTeamMember(ctx context.Context, team, username string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	t, ok := a.teams[team]
+	if !ok {
+		return ErrTeamDoesNotExist
+	}
+	if _, ok := a.users[username]; !ok {
+		return ErrUserDoesNotExist
+	}
+
+	t.addMember(username)
+	return nil
+}
+
+// RemoveTeamMember removes a user from a team, it is not an error if they are not a member.
+func (a *MemoryAuth) RemoveTeamMember(ctx context.Context, team, username string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	t, ok := a.teams[team]
+	if !ok {
+		return ErrTeamDoesNotExist
+	}
+
+	t.removeMember(username)
+	return nil
+}
+
+// ListUserTeams lists the names of the teams a user is a member of, sorted.
+func (a *MemoryAuth) ListUserTeams(ctx context.Context, username string) ([]string, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	names := []string{}
+	for _, t := range a.teams {
+		if t.HasMember(username) {
+			names = append(names, t.Name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetLoginAttempts gets the failed logins recorded under a key, nil if there are none or they have expired.
+func (a *MemoryAuth) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	attempts, ok := a.attempts[key]
+	if !ok || attempts.expired() {
+		return nil, nil
+	}
+	return &attempts, nil
+}
+
+// SetLoginAttempts records failed logins until they expire, removing those that have expired.
+func (a *MemoryAuth) SetLoginAttempts(ctx context.Context, attempts *LoginAttempts) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, l := range a.attempts {
+		if l.expired() {
+			delete(a.attempts, key)
+		}
+	}
+
+	a.attempts[attempts.Key] = *attempts
+	return nil
+}
+
+// DeleteLoginAttempts forgets the failed logins recorded under a key.
+func (a *MemoryAuth) DeleteLoginAttempts(ctx context.Context, key string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.attempts, key)
+	return nil
+}
+
+// ListLoginAttempts lists the failed logins that have not expired, sorted by key.
+func (a *MemoryAuth) ListLoginAttempts(ctx context.Context) ([]*LoginAttempts, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	list := []*LoginAttempts{}
+	for _, l := range a.attempts {
+		if !l.expired() {
+			l := l
+			list = append(list, &l)
+		}
+	}
+
+	sortLoginAttempts(list)
+	return list, nil
+}
+
+// GetTOTP gets the two-factor authentication enrollment of a user, nil if they have none.
+func (a *MemoryAuth) GetTOTP(ctx context.Context, username string) (*TOTP, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	t, ok := a.totps[username]
+	if !ok {
+		return nil, nil
+	}
+	return t.clone(), nil
+}
+
+// SetTOTP adds or replaces the two-factor authentication enrollment of an existing user.
+func (a *MemoryAuth) SetTOTP(ctx context.Context, totp *TOTP) error {
+	if len(totp.Username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.users[totp.Username]; !ok {
+		return ErrUserDoesNotExist
+	}
+
+	a.totps[totp.Username] = totp.clone()
+	return nil
+}
+
+// DeleteTOTP removes the two-factor authentication enrollment of a user.
+func (a *MemoryAuth) DeleteTOTP(ctx context.Context, username string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.totps, username)
+	return nil
+}
+
+// GetIdentity gets the identity with the given issuer and subject, nil if it is not linked to a user.
+func (a *MemoryAuth) GetIdentity(ctx context.Context, issuer, subject string) (*Identity, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	i, ok := a.ids[identityKey(issuer, subject)]
+	if !ok {
+		return nil, nil
+	}
+	return &i, nil
+}
+
+// SetIdentity links an identity to an existing user, replacing the user it was linked to.
+func (a *MemoryAuth) SetIdentity(ctx context.Context, identity *Identity) error {
+	if len(identity.Issuer) == 0 || len(identity.Subject) == 0 {
+		return ErrIdentityEmpty
+	}
+	if len(identity.Username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.users[identity.Username]; !ok {
+		return ErrUserDoesNotExist
+	}
+
+	a.ids[identityKey(identity.Issuer, identity.Subject)] = *identity
+	return nil
+}
+
+// DeleteIdentity unlinks an identity from its user.
+func (a *MemoryAuth) DeleteIdentity(ctx context.Context, issuer, subject string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.ids, identityKey(issuer, subject))
+	return nil
+}
+
+// ListIdentities lists the identities linked to a user sorted by issuer, then subject.
+func (a *MemoryAuth) ListIdentities(ctx context.Context, username string) ([]*Identity, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	list := []*Identity{}
+	for _, i := range a.ids {
+		if i.Username == username {
+			i := i
+			list = append(list, &i)
+		}
+	}
+
+	sortIdentities(list)
+	return list, nil
+}
+
+// checkMembers returns ErrUserDoesNotExist if a member of the team does not exist, a.mu must be held.
+func (a *MemoryAuth) checkMembers(team *Team) error {
+	for _, name := range team.Members {
+		if _, ok := a.users[name]; !ok {
+			return ErrUserDoesNotExist
+		}
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+// Package oidc logs users in through an OpenID Connect identity provider, the Gate then issues them
+// registry tokens like a password login would.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+)
+
+var (
+	// ErrInvalidState indicates the callback does not belong to the login started by this browser.
+	ErrInvalidState = errors.New("Login request does not match, start the login again")
+
+	// ErrNoRedirectURL indicates the authorization code flow was used without a redirect URL configured.
+	ErrNoRedirectURL = errors.New("No OIDC redirect URL is configured")
+
+	// ErrDeviceNotSupported indicates the identity provider does not offer the device code flow.
+	ErrDeviceNotSupported = errors.New("Identity provider does not support device code login")
+)
+
+// CookieName is the cookie keeping an AuthRequest in the browser between the redirect to the identity provider and the callback.
+const CookieName = "goreg_oidc"
+
+// authRequestTTL is how long a browser has to complete an authorization code login.
+const authRequestTTL = 10 * time.Minute
+
+// Config configures a Provider.
+type Config struct {
+	// Issuer is the URL of the identity provider, its metadata is discovered from <Issuer>/.well-known/openid-configuration.
+	Issuer string
+
+	// ClientID and ClientSecret identify the registry to the identity provider, the secret is empty for public clients.
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is where the identity provider sends browsers back to, the registry's /api/v1/auth/oidc/callback.
+	// Only the device code flow is available if it is empty.
+	RedirectURL string
+
+	// Scopes requested from the identity provider, openid, profile and email by default.
+	Scopes []string
+
+	// UsernameClaim is the ID token claim holding the username, preferred_username by default.
+	UsernameClaim string
+
+	// GroupsClaim is the ID token claim listing the user's groups, groups by default.
+	GroupsClaim string
+
+	// AdminGroup is the group whose members are admins, for users the registry added at their first login.
+	// If empty, admins are managed in the registry.
+	AdminGroup string
+}
+
+// Error is an error returned by the identity provider, such as authorization_pending while a device code login waits for the user.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Description) > 0 {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+// AuthRequest is an authorization code login in progress. OTP is the two-factor authentication code
+// of users who have enabled it, given when the login is started.
+type AuthRequest struct {
+	State    string
+	Verifier string
+	Nonce    string
+	OTP      string
+}
+
+// DeviceAuthorization is returned to a CLI starting a device code login. The CLI shows the user where to
+// enter UserCode, then polls with DeviceCode every Interval seconds until the user has logged in.
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+// metadata is the part of the identity provider's discovery document used by Provider.
+type metadata struct {
+	Issuer                      string `json:"issuer"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+}
+
+// tokenResponse is the part of a token endpoint response used by Provider.
+type tokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+// Provider logs users in through an OpenID Connect identity provider, returning who logged in for the
+// Gate to issue tokens to. Whether they are an admin follows the admin group if one is configured.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu          sync.Mutex
+	meta        *metadata
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+// NewProvider creates a new Provider, the identity provider is contacted on first use.
+func NewProvider(cfg Config) (*Provider, error) {
+	if len(cfg.Issuer) == 0 {
+		return nil, errors.New("OIDC issuer is required")
+	}
+	if len(cfg.ClientID) == 0 {
+		return nil, errors.New("OIDC client ID is required")
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if len(cfg.UsernameClaim) == 0 {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if len(cfg.GroupsClaim) == 0 {
+		cfg.GroupsClaim = "groups"
+	}
+
+	return &Provider{
+		cfg:    cfg,
+		client: &http.Client{},
+	}, nil
+}
+
+// NewAuthRequest starts an authorization code login with a new state, PKCE verifier and nonce.
+func (p *Provider) NewAuthRequest(otp string) (*AuthRequest, error) {
+	req := &AuthRequest{OTP: otp}
+	for _, field := range []*string{&req.State, &req.Verifier, &req.Nonce} {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		*field = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return req, nil
+}
+
+// AuthCodeURL returns the identity provider URL to send the browser to for req.
+func (p *Provider) AuthCodeURL(ctx context.Context, req *AuthRequest) (string, error) {
+	if len(p.cfg.RedirectURL) == 0 {
+		return "", ErrNoRedirectURL
+	}
+
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(req.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {req.State},
+		"nonce":                 {req.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Cookie returns the cookie keeping req in the browser until the callback.
+func (p *Provider) Cookie(req *AuthRequest) *http.Cookie {
+	path := "/"
+	if u, err := url.Parse(p.cfg.RedirectURL); err == nil && len(u.Path) > 0 {
+		path = u.Path
+	}
+
+	return &http.Cookie{
+		Name:     CookieName,
+		Value:    req.State + "." + req.Verifier + "." + req.Nonce + "." + base64.RawURLEncoding.EncodeToString([]byte(req.OTP)),
+		Path:     path,
+		MaxAge:   int(authRequestTTL / time.Second),
+		Secure:   strings.HasPrefix(p.cfg.RedirectURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ParseCookie returns the AuthRequest kept in a cookie returned by Cookie.
+func ParseCookie(c *http.Cookie) (*AuthRequest, error) {
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 4 {
+		return nil, ErrInvalidState
+	}
+	otp, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+	return &AuthRequest{State: parts[0], Verifier: parts[1], Nonce: parts[2], OTP: string(otp)}, nil
+}
+
+// Exchange completes an authorization code login, the state and code are those given to the callback.
+// Returns the user who logged in.
+func (p *Provider) Exchange(ctx context.Context, req *AuthRequest, state, code string) (*auth.ExternalLogin, error) {
+	if len(req.State) == 0 || state != req.State {
+		return nil, ErrInvalidState
+	}
+
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &tokenResponse{}
+	err = p.post(ctx, meta.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {req.Verifier},
+	}, res)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.login(ctx, res.IDToken, req.Nonce)
+}
+
+// StartDevice starts a device code login.
+func (p *Provider) StartDevice(ctx context.Context) (*DeviceAuthorization, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.DeviceAuthorizationEndpoint) == 0 {
+		return nil, ErrDeviceNotSupported
+	}
+
+	da := &DeviceAuthorization{}
+	err = p.post(ctx, meta.DeviceAuthorizationEndpoint, url.Values{
+		"scope": {strings.Join(p.cfg.Scopes, " ")},
+	}, da)
+	if err != nil {
+		return nil, err
+	}
+
+	return da, nil
+}
+
+// PollDevice checks whether the user has completed the device code login, returning who logged in if so.
+// While the user has not, an *Error with the code authorization_pending or slow_down is returned.
+func (p *Provider) PollDevice(ctx context.Context, deviceCode string) (*auth.ExternalLogin, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &tokenResponse{}
+	err = p.post(ctx, meta.TokenEndpoint, url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {deviceCode},
+	}, res)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.login(ctx, res.IDToken, "")
+}
+
+// login validates the ID token and returns the user it names.
+func (p *Provider) login(ctx context.Context, idToken, nonce string) (*auth.ExternalLogin, error) {
+	claims, err := p.verify(ctx, idToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	if len(subject) == 0 {
+		return nil, errors.New("ID token has no sub claim")
+	}
+	username, _ := claims[p.cfg.UsernameClaim].(string)
+	if len(username) == 0 {
+		return nil, errors.New("ID token has no " + p.cfg.UsernameClaim + " claim")
+	}
+
+	login := &auth.ExternalLogin{
+		Issuer:   p.cfg.Issuer,
+		Subject:  subject,
+		Username: username,
+	}
+	if len(p.cfg.AdminGroup) > 0 {
+		admin := p.isAdmin(claims[p.cfg.GroupsClaim])
+		login.Admin = &admin
+	}
+	return login, nil
+}
+
+// isAdmin reports whether the groups claim contains the admin group.
+func (p *Provider) isAdmin(groups interface{}) bool {
+	switch groups := groups.(type) {
+	case string:
+		return groups == p.cfg.AdminGroup
+	case []interface{}:
+		for _, g := range groups {
+			if g == p.cfg.AdminGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// metadata returns the identity provider's discovery document, fetching it on first use.
+func (p *Provider) metadata(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	meta := &metadata{}
+	if err := p.get(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", meta); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != p.cfg.Issuer {
+		return nil, errors.New("Identity provider reports a different issuer: " + meta.Issuer)
+	}
+	if len(meta.AuthorizationEndpoint) == 0 || len(meta.TokenEndpoint) == 0 || len(meta.JWKSURI) == 0 {
+		return nil, errors.New("Identity provider metadata is incomplete")
+	}
+
+	p.meta = meta
+	return meta, nil
+}
+
+// get fetches a JSON document into v.
+func (p *Provider) get(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	return p.do(req, v)
+}
+
+// post sends a form to an endpoint of the identity provider authenticated as the client, decoding the response into v.
+func (p *Provider) post(ctx context.Context, u string, form url.Values, v interface{}) error {
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(p.cfg.ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	return p.do(req, v)
+}
+
+// do sends a request to the identity provider, decoding a JSON response into v or an OAuth error into an *Error.
+func (p *Provider) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		oauthErr := &Error{}
+		if json.Unmarshal(body, oauthErr) == nil && len(oauthErr.Code) > 0 {
+			return oauthErr
+		}
+		return errors.New("Identity provider returned " + res.Status + " for " + req.URL.Path)
+	}
+
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,421 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// mockIdP is a local identity provider supporting the authorization code flow with PKCE and the device code flow.
+type mockIdP struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	key     *rsa.PrivateKey
+	kid     string
+	codes   map[string]*mockGrant
+	devices map[string]*mockGrant
+
+	// modify, if set, changes the claims of the next ID tokens before they are signed.
+	modify func(claims jwt.MapClaims)
+}
+
+// mockGrant is a code issued by the mockIdP, the claims are set once the user has logged in.
+type mockGrant struct {
+	challenge   string
+	redirectURI string
+	nonce       string
+	claims      jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	idp := &mockIdP{
+		codes:   map[string]*mockGrant{},
+		devices: map[string]*mockGrant{},
+	}
+	idp.rotate(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                        idp.URL,
+			"authorization_endpoint":        idp.URL + "/authorize",
+			"token_endpoint":                idp.URL + "/token",
+			"device_authorization_endpoint": idp.URL + "/device",
+			"jwks_uri":                      idp.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", idp.keys)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/device", idp.device)
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// rotate replaces the signing key with a new one under a new key ID.
+func (idp *mockIdP) rotate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.key = key
+	idp.kid = randomString()
+}
+
+// authorize acts as a browser sent to authURL where the user logs in, returning the query the IdP redirects back with.
+func (idp *mockIdP) authorize(t *testing.T, authURL string, claims jwt.MapClaims) url.Values {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != "registry" || q.Get("code_challenge_method") != "S256" || len(q.Get("code_challenge")) == 0 {
+		t.Fatal("Unexpected authorization request", authURL)
+	}
+
+	code := randomString()
+	idp.mu.Lock()
+	idp.codes[code] = &mockGrant{
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		claims:      claims,
+	}
+	idp.mu.Unlock()
+
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+// approve logs the user in for a device code.
+func (idp *mockIdP) approve(deviceCode string, claims jwt.MapClaims) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.devices[deviceCode].claims = claims
+}
+
+func (idp *mockIdP) keys(w http.ResponseWriter, req *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *mockIdP) device(w http.ResponseWriter, req *http.Request) {
+	if req.PostFormValue("client_id") != "registry" {
+		oauthError(w, "invalid_client")
+		return
+	}
+
+	deviceCode := randomString()
+	idp.mu.Lock()
+	idp.devices[deviceCode] = &mockGrant{}
+	idp.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_code":      deviceCode,
+		"user_code":        "ABCD-EFGH",
+		"verification_uri": idp.URL + "/activate",
+		"expires_in":       600,
+		"interval":         5,
+	})
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, req *http.Request) {
+	if id, secret, ok := req.BasicAuth(); !ok || id != "registry" || secret != "client-secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(&Error{Code: "invalid_client"})
+		return
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	var grant *mockGrant
+	switch req.PostFormValue("grant_type") {
+	case "authorization_code":
+		grant = idp.codes[req.PostFormValue("code")]
+		delete(idp.codes, req.PostFormValue("code"))
+		if grant == nil || grant.redirectURI != req.PostFormValue("redirect_uri") {
+			oauthError(w, "invalid_grant")
+			return
+		}
+		verifier := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+			oauthError(w, "invalid_grant")
+			return
+		}
+	case "urn:ietf:params:oauth:grant-type:device_code":
+		grant = idp.devices[req.PostFormValue("device_code")]
+		if grant == nil {
+			oauthError(w, "invalid_grant")
+			return
+		}
+		if grant.claims == nil {
+			oauthError(w, "authorization_pending")
+			return
+		}
+		delete(idp.devices, req.PostFormValue("device_code"))
+	default:
+		oauthError(w, "unsupported_grant_type")
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss": idp.URL,
+		"aud": "registry",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	if len(grant.nonce) > 0 {
+		claims["nonce"] = grant.nonce
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	if idp.modify != nil {
+		idp.modify(claims)
+	}
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = idp.kid
+	idToken, err := tok.SignedString(idp.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func oauthError(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(&Error{Code: code})
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newTestProvider(t *testing.T, idp *mockIdP) *Provider {
+	p, err := NewProvider(Config{
+		Issuer:       idp.URL + "/",
+		ClientID:     "registry",
+		ClientSecret: "client-secret",
+		RedirectURL:  "https://registry.example.org/api/v1/auth/oidc/callback",
+		AdminGroup:   "registry-admins",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// codeLogin runs an authorization code login for a user with the given claims.
+func codeLogin(t *testing.T, p *Provider, idp *mockIdP, claims jwt.MapClaims) (*auth.ExternalLogin, error) {
+	ctx := context.Background()
+
+	req, err := p.NewAuthRequest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthCodeURL(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookie, err := ParseCookie(p.Cookie(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := idp.authorize(t, authURL, claims)
+	return p.Exchange(ctx, cookie, q.Get("state"), q.Get("code"))
+}
+
+func TestAuthCodeLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp)
+
+	login, err := codeLogin(t, p, idp, jwt.MapClaims{"sub": "1001", "preferred_username": "alice", "groups": []string{"engineering", "registry-admins"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.Issuer != idp.URL || login.Subject != "1001" || login.Username != "alice" {
+		t.Fatal("Expected alice to be logged in, got", login)
+	}
+	if login.Admin == nil || !*login.Admin {
+		t.Fatal("Expected alice to be an admin")
+	}
+
+	login, err = codeLogin(t, p, idp, jwt.MapClaims{"sub": "1001", "preferred_username": "alice", "groups": "engineering"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.Admin == nil || *login.Admin {
+		t.Fatal("Expected alice to no longer be an admin")
+	}
+
+	// Without an admin group, admins are managed in the registry.
+	p.cfg.AdminGroup = ""
+	if login, err := codeLogin(t, p, idp, jwt.MapClaims{"sub": "1001", "preferred_username": "alice"}); err != nil || login.Admin != nil {
+		t.Fatal("Expected no admin flag, got", login, err)
+	}
+}
+
+func TestAuthCodeLoginRejected(t *testing.T) {
+	ctx := context.Background()
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp)
+	claims := jwt.MapClaims{"sub": "1001", "preferred_username": "alice"}
+
+	req, _ := p.NewAuthRequest("")
+	authURL, err := p.AuthCodeURL(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := idp.authorize(t, authURL, claims)
+	if _, err := p.Exchange(ctx, req, "other-state", q.Get("code")); err != ErrInvalidState {
+		t.Fatal("Expected ErrInvalidState, got", err)
+	}
+
+	stolen := *req
+	stolen.Verifier = randomString()
+	if _, err := p.Exchange(ctx, &stolen, q.Get("state"), q.Get("code")); err == nil || err.(*Error).Code != "invalid_grant" {
+		t.Fatal("Expected invalid_grant for the wrong verifier, got", err)
+	}
+
+	for name, modify := range map[string]func(jwt.MapClaims){
+		"nonce":    func(c jwt.MapClaims) { c["nonce"] = "replayed" },
+		"audience": func(c jwt.MapClaims) { c["aud"] = []string{"another-client"} },
+		"issuer":   func(c jwt.MapClaims) { c["iss"] = "https://evil.example.org" },
+		"expiry":   func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"username": func(c jwt.MapClaims) { delete(c, "preferred_username") },
+		"subject":  func(c jwt.MapClaims) { delete(c, "sub") },
+	} {
+		idp.modify = modify
+		if _, err := codeLogin(t, p, idp, claims); err == nil {
+			t.Fatal("Expected an ID token with a bad", name, "to be rejected")
+		}
+	}
+	idp.modify = nil
+}
+
+func TestForgedSignature(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp)
+	claims := jwt.MapClaims{"sub": "1001", "preferred_username": "alice"}
+
+	if _, err := codeLogin(t, p, idp, claims); err != nil {
+		t.Fatal(err)
+	}
+
+	// A token signed by another key under the same key ID.
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.key = forger
+	idp.mu.Unlock()
+
+	if _, err := codeLogin(t, p, idp, claims); err == nil {
+		t.Fatal("Expected the forged ID token to be rejected")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp)
+	claims := jwt.MapClaims{"sub": "1001", "preferred_username": "alice"}
+
+	if _, err := codeLogin(t, p, idp, claims); err != nil {
+		t.Fatal(err)
+	}
+
+	idp.rotate(t)
+	if _, err := codeLogin(t, p, idp, claims); err == nil {
+		t.Fatal("Expected the keys not to be fetched again so soon")
+	}
+
+	p.keysFetched = time.Time{}
+	if _, err := codeLogin(t, p, idp, claims); err != nil {
+		t.Fatal("Expected the new key to be fetched, got", err)
+	}
+}
+
+func TestDeviceLogin(t *testing.T) {
+	ctx := context.Background()
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp)
+
+	da, err := p.StartDevice(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if da.UserCode != "ABCD-EFGH" || da.VerificationURI != idp.URL+"/activate" || da.Interval != 5 {
+		t.Fatal("Unexpected device authorization", da)
+	}
+
+	if _, err := p.PollDevice(ctx, da.DeviceCode); err == nil || err.(*Error).Code != "authorization_pending" {
+		t.Fatal("Expected authorization_pending, got", err)
+	}
+
+	idp.approve(da.DeviceCode, jwt.MapClaims{"sub": "1002", "preferred_username": "bob"})
+	login, err := p.PollDevice(ctx, da.DeviceCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.Subject != "1002" || login.Username != "bob" || login.Admin == nil || *login.Admin {
+		t.Fatal("Expected bob to be logged in as a regular user, got", login)
+	}
+}
+
+func TestCookie(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp)
+
+	req, _ := p.NewAuthRequest("12345.6")
+	c := p.Cookie(req)
+	if c.Path != "/api/v1/auth/oidc/callback" || !c.Secure || !c.HttpOnly {
+		t.Fatal("Unexpected cookie", c)
+	}
+
+	parsed, err := ParseCookie(c)
+	if err != nil || *parsed != *req {
+		t.Fatal("Expected the AuthRequest back, got", parsed, err)
+	}
+	if _, err := ParseCookie(&http.Cookie{Name: CookieName, Value: "garbage"}); err != ErrInvalidState {
+		t.Fatal("Expected ErrInvalidState, got", err)
+	}
+}
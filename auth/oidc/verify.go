@@ -0,0 +1,180 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// keyRefreshInterval limits how often the signing keys are fetched again for an unknown key ID.
+var keyRefreshInterval = time.Minute
+
+// jwk is the part of a JSON Web Key used to verify ID tokens.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verify checks the signature and claims of an ID token and returns its claims. The nonce is
+// only checked if not empty.
+func (p *Provider) verify(ctx context.Context, idToken, nonce string) (jwt.MapClaims, error) {
+	if len(idToken) == 0 {
+		return nil, errors.New("Identity provider returned no ID token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(tok *jwt.Token) (interface{}, error) {
+		switch tok.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, errors.New("Unsupported signing method " + tok.Method.Alg())
+		}
+
+		kid, _ := tok.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, errors.New("Invalid ID token: " + err.Error())
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.cfg.Issuer {
+		return nil, errors.New("Invalid ID token: issued by " + iss)
+	}
+	if !p.hasAudience(claims["aud"]) {
+		return nil, errors.New("Invalid ID token: not issued to this client")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("Invalid ID token: no expiry")
+	}
+	if len(nonce) > 0 {
+		if n, _ := claims["nonce"].(string); n != nonce {
+			return nil, errors.New("Invalid ID token: nonce does not match")
+		}
+	}
+
+	return claims, nil
+}
+
+// hasAudience reports whether the aud claim, a string or a list, contains the client ID.
+func (p *Provider) hasAudience(aud interface{}) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == p.cfg.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == p.cfg.ClientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the identity provider's public key with the given ID, fetching the keys again if it is
+// unknown, as happens after the identity provider rotates its keys. An empty ID matches the only key.
+func (p *Provider) key(ctx context.Context, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := p.findKey(kid); key != nil {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < keyRefreshInterval {
+		return nil, errors.New("Unknown signing key " + kid)
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := p.get(ctx, p.meta.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	if key := p.findKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, errors.New("Unknown signing key " + kid)
+}
+
+// findKey returns the known key with the given ID, or the only key if the ID is empty.
+func (p *Provider) findKey(kid string) interface{} {
+	if len(kid) == 0 && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+// publicKey decodes an RSA or elliptic curve key.
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("Unsupported curve " + k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errors.New("Unsupported key type " + k.Kty)
+	}
+}
+
+// decodeInt decodes a base64url encoded big-endian integer.
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -15,6 +15,12 @@ func Resolve(path string, tm *TokenManager) (Auth, error) {
 	switch parts[0] {
 	case "userpass":
 		return NewUserPassAuth(path, tm)
+	case "memory":
+		return NewMemoryAuth(tm), nil
+	case "ldap", "ldaps":
+		return newLDAPAuthFromPath(path, tm)
+	case "htpasswd":
+		return newHtpasswdAuthFromPath(path, tm)
 	default:
 		return nil, errors.New("Unknown backend: " + parts[0])
 	}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	// ErrTeamAlreadyExists indicates a team with the same name already exists.
+	ErrTeamAlreadyExists = errors.New("Team already exists")
+
+	// ErrTeamDoesNotExist indicates the given team does not exist.
+	ErrTeamDoesNotExist = errors.New("Team does not exist")
+
+	// ErrTeamNameEmpty indicates the given team name was empty.
+	ErrTeamNameEmpty = errors.New("Team name cannot be empty")
+)
+
+// Team is a named group of users, roles granted to a team on an Import apply to its members.
+type Team struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Members     []string `json:"members"`
+}
+
+// HasMember reports whether the user is a member of the Team.
+func (t *Team) HasMember(username string) bool {
+	for _, name := range t.Members {
+		if name == username {
+			return true
+		}
+	}
+	return false
+}
+
+// addMember adds a user to the Team, keeping Members sorted.
+func (t *Team) addMember(username string) {
+	if t.HasMember(username) {
+		return
+	}
+	t.Members = append(t.Members, username)
+	sort.Strings(t.Members)
+}
+
+// removeMember removes a user from the Team, returns false if they were not a member.
+func (t *Team) removeMember(username string) bool {
+	for i, name := range t.Members {
+		if name == username {
+			t.Members = append(t.Members[:i], t.Members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of the Team with its Members sorted, sharing nothing with it.
+func (t *Team) clone() *Team {
+	c := *t
+	c.Members = append([]string{}, t.Members...)
+	sort.Strings(c.Members)
+	return &c
+}
+
+// sortTeams sorts teams by name.
+func sortTeams(teams []*Team) {
+	sort.Slice(teams, func(i, j int) bool {
+		return teams[i].Name < teams[j].Name
+	})
+}
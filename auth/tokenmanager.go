@@ -1,53 +1,174 @@
 package auth
 
 import (
+	"errors"
 	"time"
 
+	"github.com/deejross/dep-registry/util"
 	"github.com/dgrijalva/jwt-go"
 )
 
+var (
+	// ErrWrongTokenType indicates a refresh token was used as an access token or the other way around.
+	ErrWrongTokenType = errors.New("Wrong type of token")
+
+	// ErrTokenRevoked indicates a token was logged out, refreshed or had its sessions revoked.
+	ErrTokenRevoked = errors.New("Token has been revoked")
+)
+
+// DefaultRefreshTTL is how long refresh tokens are valid unless changed with SetRefreshTTL.
+const DefaultRefreshTTL = 7 * 24 * time.Hour
+
+// Claims are the claims of a token generated by a TokenManager.
+type Claims struct {
+	jwt.StandardClaims
+
+	// Refresh is set for refresh tokens, which can only be exchanged for new tokens.
+	Refresh bool `json:"refresh,omitempty"`
+}
+
+// Tokens are an access token and the refresh token that renews it.
+type Tokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+
+	// ExpiresIn is the number of seconds the access token is valid for.
+	ExpiresIn int `json:"expires_in"`
+}
+
 // TokenManager object.
 type TokenManager struct {
-	signingKey []byte
+	// keys verify tokens, the first also signs them.
+	keys       []*SigningKey
 	ttl        time.Duration
+	refreshTTL time.Duration
 }
 
-// NewTokenManager returns a new TokenManager.
+// NewTokenManager returns a new TokenManager signing with an HS256 secret.
 func NewTokenManager(key []byte, ttl time.Duration) *TokenManager {
 	return &TokenManager{
-		signingKey: key,
+		keys:       []*SigningKey{NewHMACKey(key)},
 		ttl:        ttl,
+		refreshTTL: DefaultRefreshTTL,
+	}
+}
+
+// SetKeys replaces the signing keys. The first key signs new tokens, the others only verify tokens
+// signed before a rotation. Tokens signed with a key no longer given are refused.
+func (t *TokenManager) SetKeys(keys ...*SigningKey) error {
+	if len(keys) == 0 {
+		return ErrNoSigningKey
+	}
+
+	t.keys = keys
+	return nil
+}
+
+// JWKS returns the public keys that verify tokens, so other services can verify them. HMAC keys are secret and left out.
+func (t *TokenManager) JWKS() *JWKS {
+	set := &JWKS{Keys: []*JWK{}}
+	for _, k := range t.keys {
+		if jwk := k.JWK(); jwk != nil {
+			set.Keys = append(set.Keys, jwk)
+		}
 	}
+	return set
+}
+
+// SetRefreshTTL sets how long refresh tokens are valid.
+func (t *TokenManager) SetRefreshTTL(ttl time.Duration) {
+	t.refreshTTL = ttl
 }
 
 // Generate a token for a username.
 func (t *TokenManager) Generate(username string) (string, error) {
-	claims := jwt.StandardClaims{
-		Subject:   username,
-		Issuer:    "dep-registry",
-		ExpiresAt: time.Now().Add(t.ttl).Unix(),
+	return t.sign(username, t.ttl, false)
+}
+
+// GenerateTokens generates an access token and a refresh token for a username.
+func (t *TokenManager) GenerateTokens(username string) (*Tokens, error) {
+	token, err := t.sign(username, t.ttl, false)
+	if err != nil {
+		return nil, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(t.signingKey)
+	refresh, err := t.sign(username, t.refreshTTL, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokens{
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int(t.ttl / time.Second),
+	}, nil
 }
 
 // Validate and return the username for a token.
 func (t *TokenManager) Validate(token string) (string, error) {
-	claims := jwt.StandardClaims{}
-	tok, err := jwt.ParseWithClaims(token, &claims, func(tok *jwt.Token) (interface{}, error) {
-		return t.signingKey, nil
-	})
+	claims, err := t.Parse(token, false)
 	if err != nil {
 		return "", err
 	}
-	if _, ok := tok.Method.(*jwt.SigningMethodHMAC); !ok {
-		return "", jwt.ErrSignatureInvalid
+
+	return claims.Subject, nil
+}
+
+// Parse validates an access token, or a refresh token if refresh is set, and returns its claims.
+func (t *TokenManager) Parse(token string, refresh bool) (*Claims, error) {
+	claims := &Claims{}
+	tok, err := jwt.ParseWithClaims(token, claims, func(tok *jwt.Token) (interface{}, error) {
+		kid, _ := tok.Header["kid"].(string)
+		key := t.findKey(kid)
+
+		// The algorithm must be the key's, or a public key could be used as an HMAC secret.
+		if key == nil || tok.Method.Alg() != key.Method.Alg() {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return key.verifyKey(), nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	if !tok.Valid {
-		return "", jwt.ErrInvalidKey
+		return nil, jwt.ErrInvalidKey
+	}
+	if claims.Refresh != refresh {
+		return nil, ErrWrongTokenType
 	}
 
-	return claims.Subject, nil
+	return claims, nil
+}
+
+// sign generates a token with a new ID for a username, valid for ttl.
+func (t *TokenManager) sign(username string, ttl time.Duration, refresh bool) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        util.UUID4(),
+			Subject:   username,
+			Issuer:    "dep-registry",
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+		Refresh: refresh,
+	}
+
+	key := t.keys[0]
+	token := jwt.NewWithClaims(key.Method, claims)
+	if len(key.ID) > 0 {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.private)
+}
+
+// findKey returns the key with the given ID, or nil if there is none.
+func (t *TokenManager) findKey(id string) *SigningKey {
+	for _, k := range t.keys {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
 }
@@ -23,3 +23,41 @@ func TestTokens(t *testing.T) {
 		t.Fatal("Token validation failed", username, "does not equal", theUser)
 	}
 }
+
+func TestRefreshTokens(t *testing.T) {
+	tm := NewTokenManager([]byte("super-secret-key"), time.Minute)
+	tm.SetRefreshTTL(time.Hour)
+
+	tokens, err := tm.GenerateTokens("the-username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.ExpiresIn != 60 {
+		t.Fatal("Expected the access token to expire in 60 seconds, got", tokens.ExpiresIn)
+	}
+
+	access, err := tm.Parse(tokens.Token, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := tm.Parse(tokens.RefreshToken, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access.Subject != "the-username" || refresh.Subject != "the-username" {
+		t.Fatal("Expected tokens for the-username, got", access.Subject, refresh.Subject)
+	}
+	if len(access.Id) == 0 || access.Id == refresh.Id {
+		t.Fatal("Expected tokens with distinct IDs, got", access.Id, refresh.Id)
+	}
+	if refresh.ExpiresAt-refresh.IssuedAt != 3600 {
+		t.Fatal("Expected the refresh token to be valid for an hour, got", refresh.ExpiresAt-refresh.IssuedAt)
+	}
+
+	if _, err := tm.Validate(tokens.RefreshToken); err != ErrWrongTokenType {
+		t.Fatal("Expected ErrWrongTokenType for a refresh token used as an access token, got", err)
+	}
+	if _, err := tm.Parse(tokens.Token, true); err != ErrWrongTokenType {
+		t.Fatal("Expected ErrWrongTokenType for an access token used as a refresh token, got", err)
+	}
+}
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTOTPRequired indicates the user has two-factor authentication enabled and gave no code.
+	ErrTOTPRequired = errors.New("Two-factor authentication code required")
+
+	// ErrInvalidTOTP indicates the two-factor authentication code or recovery code was wrong or already used.
+	ErrInvalidTOTP = errors.New("Invalid two-factor authentication code")
+
+	// ErrTOTPNotEnrolled indicates the user has not enrolled in two-factor authentication.
+	ErrTOTPNotEnrolled = errors.New("Two-factor authentication is not enabled")
+
+	// ErrTOTPAlreadyEnabled indicates the user already has two-factor authentication enabled.
+	ErrTOTPAlreadyEnabled = errors.New("Two-factor authentication is already enabled")
+)
+
+const (
+	// totpPeriod is how long each code is valid.
+	totpPeriod = 30 * time.Second
+
+	// totpDigits is the length of each code.
+	totpDigits = 6
+
+	// totpSkew is the number of periods a code may be early or late by, for clocks that drift.
+	totpSkew = 1
+
+	// recoveryCodeCount is the number of recovery codes given when two-factor authentication is enabled.
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP is the time-based one-time password (RFC 6238) enrollment of a user. It is Enabled once the user
+// has confirmed a code, from then on logins require a code or one of the recovery codes, which are only
+// stored hashed and can each be used once.
+type TOTP struct {
+	Username      string    `json:"username"`
+	Secret        string    `json:"secret"`
+	Enabled       bool      `json:"enabled,omitempty"`
+	RecoveryCodes []string  `json:"recovery_codes,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	// LastStep is the period of the last code accepted, codes are refused for it and earlier periods so they cannot be replayed.
+	LastStep int64 `json:"last_step,omitempty"`
+}
+
+// NewTOTP creates a TOTP enrollment for a user with a random secret, it is not Enabled.
+func NewTOTP(username string) (*TOTP, error) {
+	if len(username) == 0 {
+		return nil, ErrUsernameEmpty
+	}
+
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return &TOTP{
+		Username:  username,
+		Secret:    totpEncoding.EncodeToString(b),
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// URI returns the otpauth URI of the TOTP, for authenticator apps to scan as a QR code.
+func (t *TOTP) URI(issuer string) string {
+	q := url.Values{}
+	q.Set("secret", t.Secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + t.Username,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// Code returns the code of the TOTP at the given time.
+func (t *TOTP) Code(at time.Time) (string, error) {
+	secret, err := totpEncoding.DecodeString(strings.ToUpper(t.Secret))
+	if err != nil {
+		return "", err
+	}
+	return totpCode(secret, totpStep(at)), nil
+}
+
+// Check validates a code, or if it is not one a recovery code, at now. An accepted code moves LastStep
+// and an accepted recovery code is removed, the TOTP must be stored afterwards so neither can be used again.
+func (t *TOTP) Check(code string, now time.Time) error {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return t.checkCode(code, now)
+	}
+	return t.useRecoveryCode(code)
+}
+
+// checkCode validates a code from an authenticator app, allowing for totpSkew.
+func (t *TOTP) checkCode(code string, now time.Time) error {
+	secret, err := totpEncoding.DecodeString(strings.ToUpper(t.Secret))
+	if err != nil {
+		return err
+	}
+
+	step := totpStep(now)
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s <= t.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, s)), []byte(code)) == 1 {
+			t.LastStep = s
+			return nil
+		}
+	}
+	return ErrInvalidTOTP
+}
+
+// GenerateRecoveryCodes replaces the recovery codes, returning the new ones to give to the user.
+func (t *TOTP) GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		code = code[:8] + "-" + code[8:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	t.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// useRecoveryCode removes the recovery code if it is one of the TOTP.
+func (t *TOTP) useRecoveryCode(code string) error {
+	hash := hashRecoveryCode(code)
+	for i, h := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i:i], t.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrInvalidTOTP
+}
+
+// clone returns a copy of the TOTP that shares nothing with it.
+func (t *TOTP) clone() *TOTP {
+	c := *t
+	c.RecoveryCodes = append([]string(nil), t.RecoveryCodes...)
+	return &c
+}
+
+// hashRecoveryCode hashes a recovery code for storage. Codes are random, so a fast hash is enough.
+// Dashes and case are ignored, as users copy them by hand.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// totpStep returns the period a time falls in.
+func totpStep(at time.Time) int64 {
+	return at.Unix() / int64(totpPeriod/time.Second)
+}
+
+// totpCode returns the HOTP (RFC 4226) code of a secret for a period.
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
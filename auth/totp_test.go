@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA1 test vectors of RFC 6238, truncated to 6 digits.
+	totp := &TOTP{Secret: totpEncoding.EncodeToString([]byte("12345678901234567890"))}
+	for at, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := totp.Code(time.Unix(at, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Fatal("Expected", expected, "at", at, "got", code)
+		}
+	}
+}
+
+func TestTOTPCheck(t *testing.T) {
+	totp, err := NewTOTP("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	late, _ := totp.Code(now.Add(-totpPeriod))
+	if err := totp.Check(late, now); err != nil {
+		t.Fatal("Expected a code from the last period to be accepted, got", err)
+	}
+	if err := totp.Check(late, now); err != ErrInvalidTOTP {
+		t.Fatal("Expected a used code to be refused, got", err)
+	}
+
+	code, _ := totp.Code(now)
+	if err := totp.Check(code, now); err != nil {
+		t.Fatal(err)
+	}
+
+	old, _ := totp.Code(now.Add(-3 * totpPeriod))
+	totp.LastStep = 0
+	if err := totp.Check(old, now); err != ErrInvalidTOTP {
+		t.Fatal("Expected an old code to be refused, got", err)
+	}
+}
+
+func TestTOTPRecoveryCodes(t *testing.T) {
+	totp, err := NewTOTP("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(totp.RecoveryCodes) != recoveryCodeCount {
+		t.Fatal("Expected", recoveryCodeCount, "recovery codes, got", codes, totp.RecoveryCodes)
+	}
+	for _, h := range totp.RecoveryCodes {
+		for _, c := range codes {
+			if strings.Contains(h, strings.Replace(c, "-", "", -1)) {
+				t.Fatal("Expected recovery codes to be stored hashed, got", h)
+			}
+		}
+	}
+
+	// Codes are accepted without the dash and in upper case, but only once.
+	code := strings.ToUpper(strings.Replace(codes[3], "-", "", -1))
+	if err := totp.Check(code, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := totp.Check(codes[3], time.Now()); err != ErrInvalidTOTP {
+		t.Fatal("Expected a used recovery code to be refused, got", err)
+	}
+	if len(totp.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Fatal("Expected the used recovery code to be removed, got", totp.RecoveryCodes)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	totp := &TOTP{Username: "username", Secret: "JBSWY3DPEHPK3PXP"}
+	uri := totp.URI("dep-registry")
+	if !strings.HasPrefix(uri, "otpauth://totp/dep-registry:username?") || !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") {
+		t.Fatal("Unexpected otpauth URI", uri)
+	}
+}
@@ -1,11 +1,14 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/deejross/dep-registry/schema"
 )
 
 var (
@@ -21,10 +24,30 @@ var (
 	// ErrPasswordTooShort indicates the given password was too short.
 	ErrPasswordTooShort = errors.New("Password must be at least 6 characters long")
 
-	boltAuthBucket = []byte("dep-reg-auth")
-	passSuffix     = ":pass"
+	// ErrInvalidCredentials indicates the username and password were refused, whether or not the user exists.
+	ErrInvalidCredentials = errors.New("Invalid username or password")
+
+	boltAuthBucket    = []byte("dep-reg-auth")
+	boltTokenBucket   = []byte("dep-reg-auth-tokens")
+	boltRevokedBucket = []byte("dep-reg-auth-revoked")
+	boltTeamBucket    = []byte("dep-reg-auth-teams")
+	boltAttemptBucket = []byte("dep-reg-auth-attempts")
+	boltTOTPBucket    = []byte("dep-reg-auth-totp")
+	boltIdentBucket   = []byte("dep-reg-auth-identities")
+	passSuffix        = ":pass"
 )
 
+// boltAuthMigrations upgrade the auth bucket, append new migrations to the end.
+var boltAuthMigrations = []schema.Migration{
+	schema.CreateBuckets(boltAuthBucket),
+	schema.CreateBuckets(boltTokenBucket),
+	schema.CreateBuckets(boltRevokedBucket),
+	schema.CreateBuckets(boltTeamBucket),
+	schema.CreateBuckets(boltAttemptBucket),
+	schema.CreateBuckets(boltTOTPBucket),
+	schema.CreateBuckets(boltIdentBucket),
+}
+
 // UserPassAuth implements basic user password authentication using a BoltDB backend.
 type UserPassAuth struct {
 	db *bolt.DB
@@ -38,10 +61,8 @@ func NewUserPassAuth(address string, tm *TokenManager) (*UserPassAuth, error) {
 		return nil, err
 	}
 
-	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(boltAuthBucket)
-		return err
-	}); err != nil {
+	if err := schema.Migrate(db, string(boltAuthBucket), boltAuthMigrations); err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -52,7 +73,7 @@ func NewUserPassAuth(address string, tm *TokenManager) (*UserPassAuth, error) {
 }
 
 // Login validates the given credentials and if successful, generates a token.
-func (a *UserPassAuth) Login(username, password string) (string, error) {
+func (a *UserPassAuth) Login(ctx context.Context, username, password string) (string, error) {
 	if len(username) == 0 {
 		return "", ErrUsernameEmpty
 	}
@@ -63,14 +84,9 @@ func (a *UserPassAuth) Login(username, password string) (string, error) {
 	key := []byte(username + passSuffix)
 	token := ""
 
-	err := a.db.View(func(tx *bolt.Tx) error {
+	err := a.view(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltAuthBucket)
-		passHash := b.Get(key)
-		if passHash == nil {
-			return ErrUserDoesNotExist
-		}
-
-		if err := ValidatePassword(passHash, password); err != nil {
+		if err := checkPassword(b.Get(key), password); err != nil {
 			return err
 		}
 
@@ -83,14 +99,14 @@ func (a *UserPassAuth) Login(username, password string) (string, error) {
 }
 
 // AddUser adds a new user.
-func (a *UserPassAuth) AddUser(user *User) error {
+func (a *UserPassAuth) AddUser(ctx context.Context, user *User) error {
 	if len(user.Username) == 0 {
 		return ErrUsernameEmpty
 	}
 
 	key := []byte(user.Username)
 
-	return a.db.Update(func(tx *bolt.Tx) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltAuthBucket)
 		if b.Get(key) != nil {
 			return ErrUserAlreadyExists
@@ -106,14 +122,14 @@ func (a *UserPassAuth) AddUser(user *User) error {
 }
 
 // UpdateUser updates an existing user.
-func (a *UserPassAuth) UpdateUser(user *User) error {
+func (a *UserPassAuth) UpdateUser(ctx context.Context, user *User) error {
 	if len(user.Username) == 0 {
 		return ErrUsernameEmpty
 	}
 
 	key := []byte(user.Username)
 
-	return a.db.Update(func(tx *bolt.Tx) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltAuthBucket)
 		if b.Get(key) == nil {
 			return ErrUserDoesNotExist
@@ -129,7 +145,7 @@ func (a *UserPassAuth) UpdateUser(user *User) error {
 }
 
 // SetPassword sets a password for a user.
-func (a *UserPassAuth) SetPassword(username, password string) error {
+func (a *UserPassAuth) SetPassword(ctx context.Context, username, password string) error {
 	if len(username) == 0 {
 		return ErrUsernameEmpty
 	}
@@ -139,7 +155,7 @@ func (a *UserPassAuth) SetPassword(username, password string) error {
 
 	key := []byte(username + passSuffix)
 
-	return a.db.Update(func(tx *bolt.Tx) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltAuthBucket)
 		passHash, err := HashPassword(password)
 		if err != nil {
@@ -151,7 +167,7 @@ func (a *UserPassAuth) SetPassword(username, password string) error {
 }
 
 // GetUser gets a User object.
-func (a *UserPassAuth) GetUser(username string) (*User, error) {
+func (a *UserPassAuth) GetUser(ctx context.Context, username string) (*User, error) {
 	if len(username) == 0 {
 		return nil, ErrUsernameEmpty
 	}
@@ -159,7 +175,7 @@ func (a *UserPassAuth) GetUser(username string) (*User, error) {
 	key := []byte(username)
 	user := &User{}
 
-	err := a.db.View(func(tx *bolt.Tx) error {
+	err := a.view(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltAuthBucket)
 		userB := b.Get(key)
 		if userB == nil {
@@ -168,20 +184,709 @@ func (a *UserPassAuth) GetUser(username string) (*User, error) {
 
 		return json.Unmarshal(userB, user)
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return user, err
+	return user, nil
 }
 
 // DeleteUser deletes a User.
-func (a *UserPassAuth) DeleteUser(username string) error {
+func (a *UserPassAuth) DeleteUser(ctx context.Context, username string) error {
 	if len(username) == 0 {
 		return ErrUsernameEmpty
 	}
 
 	key := []byte(username)
 
-	return a.db.Update(func(tx *bolt.Tx) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAuthBucket)
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte(username + passSuffix)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltTOTPBucket).Delete(key); err != nil {
+			return err
+		}
+
+		ids, err := listIdentities(tx, username)
+		if err != nil {
+			return err
+		}
+		for _, i := range ids {
+			if err := tx.Bucket(boltIdentBucket).Delete([]byte(identityKey(i.Issuer, i.Subject))); err != nil {
+				return err
+			}
+		}
+
+		tokens, err := listAccessTokens(tx, username)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if err := tx.Bucket(boltTokenBucket).Delete([]byte(t.ID)); err != nil {
+				return err
+			}
+		}
+
+		teams, err := listTeams(tx)
+		if err != nil {
+			return err
+		}
+		for _, t := range teams {
+			if t.removeMember(username) {
+				if err := putTeam(tx, t); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// ListUsers lists all Users sorted by username.
+func (a *UserPassAuth) ListUsers(ctx context.Context) ([]*User, error) {
+	users := []*User{}
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltAuthBucket)
-		return b.Delete(key)
+		return b.ForEach(func(k, v []byte) error {
+			if strings.HasSuffix(string(k), passSuffix) {
+				return nil
+			}
+
+			user := &User{}
+			if err := json.Unmarshal(v, user); err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// GetPasswordHash gets the stored password hash of a user, nil if no password has been set.
+func (a *UserPassAuth) GetPasswordHash(ctx context.Context, username string) ([]byte, error) {
+	if len(username) == 0 {
+		return nil, ErrUsernameEmpty
+	}
+
+	var hash []byte
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAuthBucket)
+		if b.Get([]byte(username)) == nil {
+			return ErrUserDoesNotExist
+		}
+
+		hash = append(hash, b.Get([]byte(username+passSuffix))...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hash, nil
+}
+
+// SetPasswordHash sets the password hash of a user as returned by GetPasswordHash.
+func (a *UserPassAuth) SetPasswordHash(ctx context.Context, username string, hash []byte) error {
+	if len(username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAuthBucket)
+		if b.Get([]byte(username)) == nil {
+			return ErrUserDoesNotExist
+		}
+
+		return b.Put([]byte(username+passSuffix), hash)
+	})
+}
+
+// AddAccessToken adds a personal access token for an existing user.
+func (a *UserPassAuth) AddAccessToken(ctx context.Context, token *AccessToken) error {
+	if len(token.Username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(boltAuthBucket).Get([]byte(token.Username)) == nil {
+			return ErrUserDoesNotExist
+		}
+
+		b := tx.Bucket(boltTokenBucket)
+		if b.Get([]byte(token.ID)) != nil {
+			return ErrAccessTokenAlreadyExists
+		}
+
+		bs, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(token.ID), bs)
+	})
+}
+
+// GetAccessToken gets a personal access token by ID.
+func (a *UserPassAuth) GetAccessToken(ctx context.Context, id string) (*AccessToken, error) {
+	token := &AccessToken{}
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		bs := tx.Bucket(boltTokenBucket).Get([]byte(id))
+		if bs == nil {
+			return ErrAccessTokenDoesNotExist
+		}
+
+		return json.Unmarshal(bs, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// UpdateAccessToken updates an existing personal access token.
+func (a *UserPassAuth) UpdateAccessToken(ctx context.Context, token *AccessToken) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTokenBucket)
+		if b.Get([]byte(token.ID)) == nil {
+			return ErrAccessTokenDoesNotExist
+		}
+
+		bs, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(token.ID), bs)
+	})
+}
+
+// DeleteAccessToken deletes a personal access token.
+func (a *UserPassAuth) DeleteAccessToken(ctx context.Context, id string) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokenBucket).Delete([]byte(id))
+	})
+}
+
+// ListAccessTokens lists the personal access tokens of a user sorted by creation time.
+func (a *UserPassAuth) ListAccessTokens(ctx context.Context, username string) ([]*AccessToken, error) {
+	if len(username) == 0 {
+		return nil, ErrUsernameEmpty
+	}
+
+	var tokens []*AccessToken
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		tokens, err = listAccessTokens(tx, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortAccessTokens(tokens)
+	return tokens, nil
+}
+
+// listAccessTokens reads the personal access tokens of a user.
+func listAccessTokens(tx *bolt.Tx, username string) ([]*AccessToken, error) {
+	tokens := []*AccessToken{}
+
+	err := tx.Bucket(boltTokenBucket).ForEach(func(k, v []byte) error {
+		token := &AccessToken{}
+		if err := json.Unmarshal(v, token); err != nil {
+			return err
+		}
+		if token.Username == username {
+			tokens = append(tokens, token)
+		}
+		return nil
+	})
+
+	return tokens, err
+}
+
+// RevokeToken revokes the token with the given ID, it is remembered until it expires.
+func (a *UserPassAuth) RevokeToken(ctx context.Context, token *RevokedToken) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRevokedBucket)
+
+		// Forget revocations of tokens that have expired since.
+		now := time.Now()
+		expired := [][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			expiresAt, err := time.Parse(time.RFC3339, string(v))
+			if err != nil || expiresAt.Before(now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return b.Put([]byte(token.ID), []byte(token.ExpiresAt.UTC().Format(time.RFC3339)))
+	})
+}
+
+// TokenRevoked reports whether the token with the given ID has been revoked.
+func (a *UserPassAuth) TokenRevoked(ctx context.Context, id string) (bool, error) {
+	revoked := false
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		revoked = tx.Bucket(boltRevokedBucket).Get([]byte(id)) != nil
+		return nil
+	})
+
+	return revoked, err
+}
+
+// ListRevokedTokens lists the revoked tokens that have not expired, sorted by ID.
+func (a *UserPassAuth) ListRevokedTokens(ctx context.Context) ([]*RevokedToken, error) {
+	tokens := []*RevokedToken{}
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		now := time.Now()
+		return tx.Bucket(boltRevokedBucket).ForEach(func(k, v []byte) error {
+			expiresAt, err := time.Parse(time.RFC3339, string(v))
+			if err != nil {
+				return err
+			}
+			if !expiresAt.Before(now) {
+				tokens = append(tokens, &RevokedToken{ID: string(k), ExpiresAt: expiresAt})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// AddTeam adds a new team, its members must exist.
+func (a *UserPassAuth) AddTeam(ctx context.Context, team *Team) error {
+	if len(team.Name) == 0 {
+		return ErrTeamNameEmpty
+	}
+
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(boltTeamBucket).Get([]byte(team.Name)) != nil {
+			return ErrTeamAlreadyExists
+		}
+		if err := checkMembers(tx, team); err != nil {
+			return err
+		}
+
+		return putTeam(tx, team.clone())
+	})
+}
+
+// GetTeam gets a team, its members sorted.
+func (a *UserPassAuth) GetTeam(ctx context.Context, name string) (*Team, error) {
+	var team *Team
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		team, err = getTeam(tx, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return team, nil
+}
+
+// UpdateTeam updates an existing team, replacing its members.
+func (a *UserPassAuth) UpdateTeam(ctx context.Context, team *Team) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(boltTeamBucket).Get([]byte(team.Name)) == nil {
+			return ErrTeamDoesNotExist
+		}
+		if err := checkMembers(tx, team); err != nil {
+			return err
+		}
+
+		return putTeam(tx, team.clone())
+	})
+}
+
+// DeleteTeam deletes a team.
+func (a *UserPassAuth) DeleteTeam(ctx context.Context, name string) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTeamBucket).Delete([]byte(name))
+	})
+}
+
+// ListTeams lists all teams sorted by name.
+func (a *UserPassAuth) ListTeams(ctx context.Context) ([]*Team, error) {
+	var teams []*Team
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		teams, err = listTeams(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return teams, nil
+}
+
+// AddTeamMember adds an existing user to a team, it is not an error if they are already a member.
+func (a *UserPassAuth) AddTeamMember(ctx context.Context, team, username string) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		t, err := getTeam(tx, team)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(boltAuthBucket).Get([]byte(username)) == nil {
+			return ErrUserDoesNotExist
+		}
+
+		t.addMember(username)
+		return putTeam(tx, t)
+	})
+}
+
+// RemoveTeamMember removes a user from a team, it is not an error if they are not a member.
+func (a *UserPassAuth) RemoveTeamMember(ctx context.Context, team, username string) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		t, err := getTeam(tx, team)
+		if err != nil {
+			return err
+		}
+
+		if !t.removeMember(username) {
+			return nil
+		}
+		return putTeam(tx, t)
+	})
+}
+
+// ListUserTeams lists the names of the teams a user is a member of, sorted.
+func (a *UserPassAuth) ListUserTeams(ctx context.Context, username string) ([]string, error) {
+	names := []string{}
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		teams, err := listTeams(tx)
+		if err != nil {
+			return err
+		}
+		for _, t := range teams {
+			if t.HasMember(username) {
+				names = append(names, t.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// getTeam reads a team within a transaction.
+func getTeam(tx *bolt.Tx, name string) (*Team, error) {
+	bs := tx.Bucket(boltTeamBucket).Get([]byte(name))
+	if bs == nil {
+		return nil, ErrTeamDoesNotExist
+	}
+
+	team := &Team{}
+	if err := json.Unmarshal(bs, team); err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// putTeam writes a team within a transaction.
+func putTeam(tx *bolt.Tx, team *Team) error {
+	bs, err := json.Marshal(team)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltTeamBucket).Put([]byte(team.Name), bs)
+}
+
+// listTeams reads every team within a transaction, sorted by name as bolt keeps keys sorted.
+func listTeams(tx *bolt.Tx) ([]*Team, error) {
+	teams := []*Team{}
+	err := tx.Bucket(boltTeamBucket).ForEach(func(k, v []byte) error {
+		team := &Team{}
+		if err := json.Unmarshal(v, team); err != nil {
+			return err
+		}
+		teams = append(teams, team)
+		return nil
+	})
+
+	return teams, err
+}
+
+// checkMembers returns ErrUserDoesNotExist if a member of the team does not exist.
+func checkMembers(tx *bolt.Tx, team *Team) error {
+	b := tx.Bucket(boltAuthBucket)
+	for _, name := range team.Members {
+		if b.Get([]byte(name)) == nil {
+			return ErrUserDoesNotExist
+		}
+	}
+	return nil
+}
+
+// GetLoginAttempts gets the failed logins recorded under a key, nil if there are none or they have expired.
+func (a *UserPassAuth) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	var attempts *LoginAttempts
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltAttemptBucket).Get([]byte(key))
+		if val == nil {
+			return nil
+		}
+
+		l := &LoginAttempts{}
+		if err := json.Unmarshal(val, l); err != nil {
+			return err
+		}
+		if !l.expired() {
+			attempts = l
+		}
+		return nil
+	})
+
+	return attempts, err
+}
+
+// SetLoginAttempts records failed logins until they expire, removing those that have expired.
+func (a *UserPassAuth) SetLoginAttempts(ctx context.Context, attempts *LoginAttempts) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAttemptBucket)
+
+		expired := [][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			l := &LoginAttempts{}
+			if err := json.Unmarshal(v, l); err != nil || l.expired() {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		bs, err := json.Marshal(attempts)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(attempts.Key), bs)
+	})
+}
+
+// DeleteLoginAttempts forgets the failed logins recorded under a key.
+func (a *UserPassAuth) DeleteLoginAttempts(ctx context.Context, key string) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAttemptBucket).Delete([]byte(key))
 	})
 }
+
+// ListLoginAttempts lists the failed logins that have not expired, sorted by key.
+func (a *UserPassAuth) ListLoginAttempts(ctx context.Context) ([]*LoginAttempts, error) {
+	list := []*LoginAttempts{}
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAttemptBucket).ForEach(func(k, v []byte) error {
+			l := &LoginAttempts{}
+			if err := json.Unmarshal(v, l); err != nil {
+				return err
+			}
+			if !l.expired() {
+				list = append(list, l)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// GetTOTP gets the two-factor authentication enrollment of a user, nil if they have none.
+func (a *UserPassAuth) GetTOTP(ctx context.Context, username string) (*TOTP, error) {
+	var totp *TOTP
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltTOTPBucket).Get([]byte(username))
+		if val == nil {
+			return nil
+		}
+
+		totp = &TOTP{}
+		return json.Unmarshal(val, totp)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return totp, nil
+}
+
+// SetTOTP adds or replaces the two-factor authentication enrollment of an existing user.
+func (a *UserPassAuth) SetTOTP(ctx context.Context, totp *TOTP) error {
+	if len(totp.Username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(boltAuthBucket).Get([]byte(totp.Username)) == nil {
+			return ErrUserDoesNotExist
+		}
+
+		bs, err := json.Marshal(totp)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltTOTPBucket).Put([]byte(totp.Username), bs)
+	})
+}
+
+// DeleteTOTP removes the two-factor authentication enrollment of a user.
+func (a *UserPassAuth) DeleteTOTP(ctx context.Context, username string) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTOTPBucket).Delete([]byte(username))
+	})
+}
+
+// GetIdentity gets the identity with the given issuer and subject, nil if it is not linked to a user.
+func (a *UserPassAuth) GetIdentity(ctx context.Context, issuer, subject string) (*Identity, error) {
+	var identity *Identity
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltIdentBucket).Get([]byte(identityKey(issuer, subject)))
+		if val == nil {
+			return nil
+		}
+
+		identity = &Identity{}
+		return json.Unmarshal(val, identity)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+// SetIdentity links an identity to an existing user, replacing the user it was linked to.
+func (a *UserPassAuth) SetIdentity(ctx context.Context, identity *Identity) error {
+	if len(identity.Issuer) == 0 || len(identity.Subject) == 0 {
+		return ErrIdentityEmpty
+	}
+	if len(identity.Username) == 0 {
+		return ErrUsernameEmpty
+	}
+
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(boltAuthBucket).Get([]byte(identity.Username)) == nil {
+			return ErrUserDoesNotExist
+		}
+
+		bs, err := json.Marshal(identity)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltIdentBucket).Put([]byte(identityKey(identity.Issuer, identity.Subject)), bs)
+	})
+}
+
+// DeleteIdentity unlinks an identity from its user.
+func (a *UserPassAuth) DeleteIdentity(ctx context.Context, issuer, subject string) error {
+	return a.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIdentBucket).Delete([]byte(identityKey(issuer, subject)))
+	})
+}
+
+// ListIdentities lists the identities linked to a user sorted by issuer, then subject.
+func (a *UserPassAuth) ListIdentities(ctx context.Context, username string) ([]*Identity, error) {
+	var list []*Identity
+
+	err := a.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		list, err = listIdentities(tx, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// listIdentities lists the identities linked to a user sorted by issuer, then subject, as they are keyed.
+func listIdentities(tx *bolt.Tx, username string) ([]*Identity, error) {
+	list := []*Identity{}
+
+	err := tx.Bucket(boltIdentBucket).ForEach(func(k, v []byte) error {
+		i := &Identity{}
+		if err := json.Unmarshal(v, i); err != nil {
+			return err
+		}
+		if i.Username == username {
+			list = append(list, i)
+		}
+		return nil
+	})
+
+	return list, err
+}
+
+// Close the BoltDB file.
+func (a *UserPassAuth) Close() error {
+	return a.db.Close()
+}
+
+// update runs fn in a read-write transaction unless ctx is already done.
+func (a *UserPassAuth) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.db.Update(fn)
+}
+
+// view runs fn in a read-only transaction unless ctx is already done.
+func (a *UserPassAuth) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.db.View(fn)
+}
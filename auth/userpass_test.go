@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"os"
 	"testing"
 	"time"
@@ -21,7 +22,9 @@ func TestNewUserPassAuth(t *testing.T) {
 }
 
 func TestLoginUnknownUser(t *testing.T) {
-	token, err := upa.Login("username", "password")
+	ctx := context.Background()
+
+	token, err := upa.Login(ctx, "username", "password")
 	if err == nil {
 		t.Fatal("Expected an error since user does not exist")
 	}
@@ -32,17 +35,21 @@ func TestLoginUnknownUser(t *testing.T) {
 }
 
 func TestAddUser(t *testing.T) {
+	ctx := context.Background()
+
 	user := &User{
 		Username: "username",
 	}
 
-	if err := upa.AddUser(user); err != nil {
+	if err := upa.AddUser(ctx, user); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestGetUser(t *testing.T) {
-	user, err := upa.GetUser("username")
+	ctx := context.Background()
+
+	user, err := upa.GetUser(ctx, "username")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,13 +60,17 @@ func TestGetUser(t *testing.T) {
 }
 
 func TestSetPassword(t *testing.T) {
-	if err := upa.SetPassword("username", "password"); err != nil {
+	ctx := context.Background()
+
+	if err := upa.SetPassword(ctx, "username", "password"); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestLoginSuccess(t *testing.T) {
-	token, err := upa.Login("username", "password")
+	ctx := context.Background()
+
+	token, err := upa.Login(ctx, "username", "password")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -75,26 +86,30 @@ func TestLoginSuccess(t *testing.T) {
 }
 
 func TestUpdateUserFail(t *testing.T) {
+	ctx := context.Background()
+
 	user := &User{
 		Username: "no-username",
 	}
 
-	if err := upa.UpdateUser(user); err != ErrUserDoesNotExist {
+	if err := upa.UpdateUser(ctx, user); err != ErrUserDoesNotExist {
 		t.Fatal("Expected ErrUserDoesNotExist, got", err)
 	}
 }
 
 func TestUpdateUserSuccess(t *testing.T) {
+	ctx := context.Background()
+
 	user := &User{
 		Username: "username",
 		Admin:    true,
 	}
 
-	if err := upa.UpdateUser(user); err != nil {
+	if err := upa.UpdateUser(ctx, user); err != nil {
 		t.Fatal(err)
 	}
 
-	user, err := upa.GetUser("username")
+	user, err := upa.GetUser(ctx, "username")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -105,7 +120,9 @@ func TestUpdateUserSuccess(t *testing.T) {
 }
 
 func TestDeleteUser(t *testing.T) {
-	if err := upa.DeleteUser("username"); err != nil {
+	ctx := context.Background()
+
+	if err := upa.DeleteUser(ctx, "username"); err != nil {
 		t.Fatal(err)
 	}
 }
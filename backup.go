@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/backup"
+)
+
+// runBackup writes a backup archive of the registry: backup [-o file] [config file].
+// The archive is written to stdout if no file is given.
+func runBackup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "", "write the archive to this file instead of stdout")
+	flags.Parse(args)
+
+	cfg := loadConfig(flags.Args())
+	sm := openStoreManager(cfg)
+	a := openAuth(cfg, auth.NewTokenManager([]byte(cfg.SigningKey), cfg.TokenTTL))
+
+	w := os.Stdout
+	if len(*output) > 0 {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalln("While creating backup file:", err)
+		}
+		w = f
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+
+	report, err := backup.Write(ctx, w, a, sm)
+	if err != nil {
+		log.Fatalln("While writing backup:", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalln("While writing backup:", err)
+	}
+
+	log.Println("Backed up", report.Users, "users,", report.Teams, "teams,", report.Organizations, "organizations,", report.Imports, "imports and", report.Versions, "versions, skipped", report.Skipped, "versions deleted during the backup")
+}
+
+// runRestore restores a backup archive into the configured stores: restore [-i file] [config file].
+// The archive is read from stdin if no file is given.
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	input := flags.String("i", "", "read the archive from this file instead of stdin")
+	flags.Parse(args)
+
+	cfg := loadConfig(flags.Args())
+	sm := openStoreManager(cfg)
+	a := openAuth(cfg, auth.NewTokenManager([]byte(cfg.SigningKey), cfg.TokenTTL))
+
+	var r io.Reader = os.Stdin
+	if len(*input) > 0 {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatalln("While opening backup file:", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+
+	report, err := backup.Restore(ctx, r, a, sm)
+	if err != nil {
+		log.Fatalln("While restoring backup:", err)
+	}
+
+	log.Println("Restored", report.Users, "users,", report.Teams, "teams,", report.Organizations, "organizations,", report.Imports, "imports and", report.Versions, "versions, skipped", report.Skipped, "versions")
+}
@@ -0,0 +1,488 @@
+// Package backup writes and restores portable archives of a registry, independent of its backends.
+//
+// An archive is a gzipped tar file holding, in order:
+//
+//	manifest.json   format version and creation time
+//	users.json      Users and their password hashes
+//	imports.json    Imports and their committed Versions
+//	blobs/<bin id>  the binary of each Version
+//
+// The metadata is read before any binary is, so a Version deleted while the archive is being
+// written leaves no binary behind, and is skipped when the archive is restored.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/storemanager"
+	"github.com/deejross/dep-registry/util"
+)
+
+// Format is the version of the archive format written by Write. Format 2 added teams, format 3 organizations.
+const Format = 3
+
+const (
+	manifestName = "manifest.json"
+	usersName    = "users.json"
+	teamsName    = "teams.json"
+	orgsName     = "orgs.json"
+	importsName  = "imports.json"
+	blobsPrefix  = "blobs/"
+)
+
+// ErrInvalidArchive indicates the archive is not a registry backup or is missing a section.
+var ErrInvalidArchive = errors.New("Not a valid registry backup")
+
+// ErrSizeMismatch indicates a binary is not the size recorded in its Version.
+var ErrSizeMismatch = errors.New("Binary does not match size")
+
+// Manifest describes an archive.
+type Manifest struct {
+	Format  int       `json:"format"`
+	Created time.Time `json:"created"`
+}
+
+// User is a User, their password hash, personal access tokens, two-factor authentication enrollment
+// and linked external identities.
+type User struct {
+	User         *auth.User          `json:"user"`
+	PasswordHash string              `json:"password_hash,omitempty"`
+	AccessTokens []*auth.AccessToken `json:"access_tokens,omitempty"`
+	TOTP         *auth.TOTP          `json:"totp,omitempty"`
+	Identities   []*auth.Identity    `json:"identities,omitempty"`
+}
+
+// Import is an Import and its Versions.
+type Import struct {
+	Import   *models.Import    `json:"import"`
+	Versions []*models.Version `json:"versions"`
+}
+
+// Report counts what was written or restored.
+type Report struct {
+	Users         int `json:"users"`
+	Teams         int `json:"teams"`
+	Organizations int `json:"organizations"`
+	Imports       int `json:"imports"`
+	Versions      int `json:"versions"`
+
+	// Skipped Versions were deleted while the archive was being written or already existed when restored.
+	Skipped int `json:"skipped"`
+}
+
+// Write a snapshot of the users, Imports, Versions and binaries to w.
+func Write(ctx context.Context, w io.Writer, a auth.Auth, sm *storemanager.StoreManager) (*Report, error) {
+	report := &Report{}
+
+	users, err := readUsers(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	report.Users = len(users)
+
+	teams, err := a.ListTeams(ctx)
+	if err == auth.ErrNotSupported {
+		teams = []*auth.Team{}
+	} else if err != nil {
+		return nil, err
+	}
+	report.Teams = len(teams)
+
+	orgs, err := sm.ListOrganizations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.Organizations = len(orgs)
+
+	imports, err := readImports(ctx, sm)
+	if err != nil {
+		return nil, err
+	}
+	report.Imports = len(imports)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := writeJSON(tw, manifestName, &Manifest{Format: Format, Created: time.Now().UTC()}); err != nil {
+		return nil, err
+	}
+	if err := writeJSON(tw, usersName, users); err != nil {
+		return nil, err
+	}
+	if err := writeJSON(tw, teamsName, teams); err != nil {
+		return nil, err
+	}
+	if err := writeJSON(tw, orgsName, orgs); err != nil {
+		return nil, err
+	}
+	if err := writeJSON(tw, importsName, imports); err != nil {
+		return nil, err
+	}
+
+	for _, m := range imports {
+		for _, v := range m.Versions {
+			reader, err := sm.GetVersionBinary(ctx, v)
+			if err == util.ErrNotFound {
+				report.Skipped++
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			if err := writeBinary(ctx, tw, v, reader); err != nil {
+				return nil, errors.New("While writing " + v.ImportURL + " " + v.Name + ": " + err.Error())
+			}
+			report.Versions++
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Restore the contents of an archive written by Write. Users and Imports that already exist are
+// updated and Versions that already exist are skipped, so an interrupted restore can be run again.
+func Restore(ctx context.Context, r io.Reader, a auth.Auth, sm *storemanager.StoreManager) (*Report, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	manifest := &Manifest{}
+	if err := readJSON(tr, manifestName, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Format > Format {
+		return nil, errors.New("Backup format " + strconv.Itoa(manifest.Format) + " is newer than this build supports")
+	}
+
+	users := []*User{}
+	if err := readJSON(tr, usersName, &users); err != nil {
+		return nil, err
+	}
+	teams := []*auth.Team{}
+	if manifest.Format >= 2 {
+		if err := readJSON(tr, teamsName, &teams); err != nil {
+			return nil, err
+		}
+	}
+	orgs := []*models.Organization{}
+	if manifest.Format >= 3 {
+		if err := readJSON(tr, orgsName, &orgs); err != nil {
+			return nil, err
+		}
+	}
+	imports := []*Import{}
+	if err := readJSON(tr, importsName, &imports); err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+
+	for _, u := range users {
+		if err := restoreUser(ctx, a, u); err != nil {
+			return report, err
+		}
+		report.Users++
+	}
+
+	for _, t := range teams {
+		if err := restoreTeam(ctx, a, t); err != nil {
+			return report, err
+		}
+		report.Teams++
+	}
+
+	for _, o := range orgs {
+		if err := restoreOrganization(ctx, sm, o); err != nil {
+			return report, err
+		}
+		report.Organizations++
+	}
+
+	versions := map[string]*models.Version{}
+	owners := map[string]*models.Import{}
+	for _, m := range imports {
+		if err := sm.RestoreImport(ctx, m.Import); err != nil {
+			return report, err
+		}
+		report.Imports++
+
+		for _, v := range m.Versions {
+			versions[v.BinID] = v
+			owners[v.BinID] = m.Import
+		}
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+
+		id := strings.TrimPrefix(hdr.Name, blobsPrefix)
+		v, ok := versions[id]
+		if !ok || id == hdr.Name {
+			continue
+		}
+
+		// Only the Version already existing is skipped, a binary left behind without one is an error.
+		delete(versions, id)
+		if err := sm.Restore(ctx, owners[id], v, tr); err == util.ErrAlreadyExists {
+			report.Skipped++
+			continue
+		} else if err != nil {
+			return report, errors.New("While restoring " + v.ImportURL + " " + v.Name + ": " + err.Error())
+		}
+		report.Versions++
+	}
+
+	report.Skipped += len(versions)
+	return report, nil
+}
+
+// readUsers reads every User, their password hash, personal access tokens, two-factor authentication enrollment
+// and linked external identities.
+func readUsers(ctx context.Context, a auth.Auth) ([]*User, error) {
+	list, err := a.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := auth.FindIdentityStore(a)
+	users := []*User{}
+	for _, user := range list {
+		hash, err := a.GetPasswordHash(ctx, user.Username)
+		if err == auth.ErrUserDoesNotExist {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		tokens, err := a.ListAccessTokens(ctx, user.Username)
+		if err != nil && err != auth.ErrNotSupported {
+			return nil, err
+		}
+
+		totp, err := a.GetTOTP(ctx, user.Username)
+		if err != nil && err != auth.ErrNotSupported {
+			return nil, err
+		}
+
+		var identities []*auth.Identity
+		if ids != nil {
+			if identities, err = ids.ListIdentities(ctx, user.Username); err != nil {
+				return nil, err
+			}
+		}
+
+		users = append(users, &User{
+			User:         user,
+			PasswordHash: string(hash),
+			AccessTokens: tokens,
+			TOTP:         totp,
+			Identities:   identities,
+		})
+	}
+
+	return users, nil
+}
+
+// readImports reads every Import and its committed Versions.
+func readImports(ctx context.Context, sm *storemanager.StoreManager) ([]*Import, error) {
+	list, err := sm.ListImports(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	imports := []*Import{}
+	for _, m := range list {
+		versions, err := sm.GetVersions(ctx, m.ImportURL)
+		if err == util.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		imports = append(imports, &Import{
+			Import:   m,
+			Versions: versions,
+		})
+	}
+
+	return imports, nil
+}
+
+// restoreUser adds a User or updates it if it already exists, then sets its password hash, access tokens,
+// two-factor authentication enrollment and linked external identities.
+func restoreUser(ctx context.Context, a auth.Auth, u *User) error {
+	if u.User == nil {
+		return ErrInvalidArchive
+	}
+
+	if err := a.AddUser(ctx, u.User); err == auth.ErrUserAlreadyExists {
+		if err := a.UpdateUser(ctx, u.User); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if len(u.PasswordHash) > 0 {
+		if err := a.SetPasswordHash(ctx, u.User.Username, []byte(u.PasswordHash)); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range u.AccessTokens {
+		if err := a.AddAccessToken(ctx, t); err == auth.ErrAccessTokenAlreadyExists {
+			if err := a.UpdateAccessToken(ctx, t); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if u.TOTP != nil {
+		if err := a.SetTOTP(ctx, u.TOTP); err != nil {
+			return err
+		}
+	}
+
+	if len(u.Identities) == 0 {
+		return nil
+	}
+	ids := auth.FindIdentityStore(a)
+	if ids == nil {
+		return auth.ErrNotSupported
+	}
+	for _, i := range u.Identities {
+		if err := ids.SetIdentity(ctx, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreOrganization adds an Organization or replaces it if it already exists.
+func restoreOrganization(ctx context.Context, sm *storemanager.StoreManager, o *models.Organization) error {
+	err := sm.AddOrganization(ctx, o)
+	if err == util.ErrAlreadyExists {
+		return sm.UpdateOrganization(ctx, o)
+	}
+	return err
+}
+
+// restoreTeam adds a team or replaces its members if it already exists.
+func restoreTeam(ctx context.Context, a auth.Auth, t *auth.Team) error {
+	err := a.AddTeam(ctx, t)
+	if err == auth.ErrTeamAlreadyExists {
+		return a.UpdateTeam(ctx, t)
+	}
+	return err
+}
+
+func writeJSON(tw *tar.Writer, name string, val interface{}) error {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(tw, name, data)
+}
+
+// writeBinary streams the binary of a Version into the archive and closes reader if it can be closed.
+// Binaries of Versions stored before their size was recorded are spooled to a temporary file first.
+func writeBinary(ctx context.Context, tw *tar.Writer, v *models.Version, reader io.Reader) error {
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
+	reader = util.NewContextReader(ctx, reader)
+
+	size := v.Size
+	if size == 0 {
+		f, err := ioutil.TempFile("", "dep-reg-backup-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		if size, err = io.Copy(f, reader); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		reader = f
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    blobsPrefix + v.BinID,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(tw, reader)
+	if err == nil && n != size {
+		err = ErrSizeMismatch
+	}
+	return err
+}
+
+func writeFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(tw, bytes.NewReader(data))
+	return err
+}
+
+// readJSON reads the next file of the archive, which must be named name, into val.
+func readJSON(tr *tar.Reader, name string, val interface{}) error {
+	hdr, err := tr.Next()
+	if err == io.EOF || (err == nil && hdr.Name != name) {
+		return ErrInvalidArchive
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.NewDecoder(tr).Decode(val)
+}
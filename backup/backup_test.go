@@ -0,0 +1,234 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/binstore"
+	"github.com/deejross/dep-registry/metastore"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/storemanager"
+)
+
+var tm = auth.NewTokenManager([]byte("secret"), time.Hour)
+
+func newRegistry() (auth.Auth, *storemanager.StoreManager, binstore.BinStore) {
+	bin := binstore.NewMemoryBinStore()
+	return auth.NewMemoryAuth(tm), storemanager.NewStoreManager(bin, metastore.NewMemoryMetaStore()), bin
+}
+
+func TestWriteRestore(t *testing.T) {
+	ctx := context.Background()
+
+	a, sm, bin := newRegistry()
+
+	if err := a.AddUser(ctx, &auth.User{Username: "admin", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetPassword(ctx, "admin", "password"); err != nil {
+		t.Fatal(err)
+	}
+	pat, secret, err := auth.NewAccessToken("admin", "ci", []auth.Scope{auth.ScopeRead}, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddAccessToken(ctx, pat); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddTeam(ctx, &auth.Team{Name: "payments", Members: []string{"admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	totp, err := auth.NewTOTP("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	totp.Enabled = true
+	if err := a.SetTOTP(ctx, totp); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.FindIdentityStore(a).SetIdentity(ctx, &auth.Identity{Issuer: "https://idp.example.com", Subject: "1001", Username: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.AddOrganization(ctx, &models.Organization{Name: "example", Prefixes: []string{"example.com"}, Owners: []string{"admin"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := models.NewImport("example.com/pkg")
+	m.Private = true
+	m.Owners = []string{"admin"}
+	m.Grants = []models.Grant{{Team: "payments", Role: models.RoleReader}}
+	v1 := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+	v2 := models.NewVersion(m, "1.1.0", models.ArchZip)
+	gone := models.NewVersion(m, "1.2.0", models.ArchTar)
+	for _, v := range []*models.Version{v1, v2, gone} {
+		if err := sm.Add(ctx, m, v, bytes.NewReader([]byte("archive "+v.Name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Versions stored before their size was recorded are written all the same.
+	legacy := *v2
+	legacy.Size = 0
+	if err := sm.MetaStore().UpdateVersion(ctx, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.DisableVersion(ctx, m.ImportURL, "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.RestoreImport(ctx, models.NewImport("example.com/empty")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A binary deleted after the metadata was read is skipped.
+	if err := bin.Delete(ctx, gone); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	report, err := Write(ctx, buf, a, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Users != 1 || report.Teams != 1 || report.Organizations != 1 || report.Imports != 2 || report.Versions != 2 || report.Skipped != 1 {
+		t.Fatal("Unexpected backup report", report)
+	}
+
+	a2, sm2, _ := newRegistry()
+	report, err = Restore(ctx, bytes.NewReader(buf.Bytes()), a2, sm2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Users != 1 || report.Teams != 1 || report.Organizations != 1 || report.Imports != 2 || report.Versions != 2 || report.Skipped != 1 {
+		t.Fatal("Unexpected restore report", report)
+	}
+
+	if _, err := a2.Login(ctx, "admin", "password"); err != nil {
+		t.Fatal("Expected restored user to log in, got", err)
+	}
+	if user, err := a2.GetUser(ctx, "admin"); err != nil || !user.Admin {
+		t.Fatal("Expected restored admin user, got", user, err)
+	}
+	if restored, err := a2.GetAccessToken(ctx, pat.ID); err != nil || restored.Check(secret) != nil {
+		t.Fatal("Expected restored access token to be accepted, got", restored, err)
+	}
+	if team, err := a2.GetTeam(ctx, "payments"); err != nil || !team.HasMember("admin") {
+		t.Fatal("Expected restored team, got", team, err)
+	}
+	if restored, err := a2.GetTOTP(ctx, "admin"); err != nil || restored == nil || restored.Secret != totp.Secret || !restored.Enabled {
+		t.Fatal("Expected restored two-factor enrollment, got", restored, err)
+	}
+	if restored, err := auth.FindIdentityStore(a2).GetIdentity(ctx, "https://idp.example.com", "1001"); err != nil || restored == nil || restored.Username != "admin" {
+		t.Fatal("Expected restored identity, got", restored, err)
+	}
+	if org, err := sm2.GetOrganization(ctx, "example"); err != nil || org.Claim("example.com/pkg") != "example.com" {
+		t.Fatal("Expected restored organization, got", org, err)
+	}
+
+	got, err := sm2.Get(ctx, m.ImportURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Private || len(got.Owners) != 1 || len(got.Grants) != 1 {
+		t.Fatal("Expected restored import to keep its fields, got", got)
+	}
+	if _, err := sm2.Get(ctx, "example.com/empty"); err != nil {
+		t.Fatal("Expected import without versions to be restored, got", err)
+	}
+
+	versions, err := sm2.GetVersions(ctx, m.ImportURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Name != "1.0.0" || versions[1].Name != "1.1.0" {
+		t.Fatal("Expected versions 1.0.0 and 1.1.0, got", versions)
+	}
+	if versions[0].Digest != v1.Digest || versions[0].BinID != v1.BinID || versions[1].Size != v2.Size || !versions[1].Disabled {
+		t.Fatal("Expected restored versions to keep their fields, got", versions)
+	}
+
+	reader, err := sm2.GetVersionBinary(ctx, versions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "archive 1.0.0" {
+		t.Fatal("Expected restored binary, got", string(data))
+	}
+
+	// Restoring again skips what already exists.
+	report, err = Restore(ctx, bytes.NewReader(buf.Bytes()), a2, sm2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Versions != 0 || report.Skipped != 3 {
+		t.Fatal("Expected every version to be skipped, got", report)
+	}
+}
+
+func TestRestoreOrphanedBinary(t *testing.T) {
+	ctx := context.Background()
+
+	a, sm, _ := newRegistry()
+	m := models.NewImport("example.com/pkg")
+	v := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+	if err := sm.Add(ctx, m, v, bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := Write(ctx, buf, a, sm); err != nil {
+		t.Fatal(err)
+	}
+
+	// A binary left behind without its Version, for example by an interrupted restore.
+	a2, sm2, bin2 := newRegistry()
+	if err := bin2.Add(ctx, v, bytes.NewReader([]byte("arch"))); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Restore(ctx, bytes.NewReader(buf.Bytes()), a2, sm2)
+	if err == nil || !strings.Contains(err.Error(), storemanager.ErrBinaryExists.Error()) {
+		t.Fatal("Expected ErrBinaryExists, got", err)
+	}
+	if report.Versions != 0 || report.Skipped != 0 {
+		t.Fatal("Expected the version to be neither restored nor skipped, got", report)
+	}
+
+	if err := bin2.Delete(ctx, v); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Restore(ctx, bytes.NewReader(buf.Bytes()), a2, sm2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Versions != 1 || report.Skipped != 0 {
+		t.Fatal("Expected the version to be restored, got", report)
+	}
+}
+
+func TestRestoreInvalidArchive(t *testing.T) {
+	ctx := context.Background()
+
+	a, sm, _ := newRegistry()
+
+	if _, err := Restore(ctx, bytes.NewReader([]byte("not an archive")), a, sm); err == nil {
+		t.Fatal("Expected an error restoring an invalid archive")
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := Write(ctx, buf, a, sm); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if _, err := Restore(ctx, bytes.NewReader(data[:len(data)/2]), a, sm); err == nil {
+		t.Fatal("Expected an error restoring a truncated archive")
+	}
+}
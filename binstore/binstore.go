@@ -1,6 +1,7 @@
 package binstore
 
 import (
+	"context"
 	"io"
 
 	"github.com/deejross/dep-registry/models"
@@ -9,11 +10,14 @@ import (
 // BinStore represents a binary store.
 type BinStore interface {
 	// Add to the binary store.
-	Add(v *models.Version, reader io.Reader) error
+	Add(ctx context.Context, v *models.Version, reader io.Reader) error
 
 	// Get a binary from the store.
-	Get(v *models.Version) (io.Reader, error)
+	Get(ctx context.Context, v *models.Version) (io.Reader, error)
 
 	// Delete a binary from the store.
-	Delete(v *models.Version) error
+	Delete(ctx context.Context, v *models.Version) error
+
+	// List the BinIDs of all binaries in the store.
+	List(ctx context.Context) ([]string, error)
 }
@@ -0,0 +1,288 @@
+// Package binstoretest provides a conformance suite that every BinStore backend must pass.
+package binstoretest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/deejross/dep-registry/binstore"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// Run the conformance suite. newStore must return a new, empty BinStore each time it is called.
+func Run(t *testing.T, newStore func(t *testing.T) binstore.BinStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s binstore.BinStore)
+	}{
+		{"AddGet", testAddGet},
+		{"AddGetArchiveTypes", testAddGetArchiveTypes},
+		{"AddGetEmpty", testAddGetEmpty},
+		{"AddDuplicate", testAddDuplicate},
+		{"AddCancelled", testAddCancelled},
+		{"GetNotFound", testGetNotFound},
+		{"Delete", testDelete},
+		{"List", testList},
+		{"ConcurrentAddGet", testConcurrentAddGet},
+		{"ConcurrentAddDuplicate", testConcurrentAddDuplicate},
+	}
+
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			fn(t, newStore(t))
+		})
+	}
+}
+
+func newVersion(name string, archive models.ArchType) *models.Version {
+	return models.NewVersion(models.NewImport("example.com/pkg"), name, archive)
+}
+
+func content(name string) []byte {
+	return bytes.Repeat([]byte("binary content for "+name+" "), 64)
+}
+
+func expectContent(t *testing.T, s binstore.BinStore, v *models.Version, expected []byte) {
+	ctx := context.Background()
+
+	reader, err := s.Get(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, expected) {
+		t.Fatal("Binary for", v.Name, "does not match what was added")
+	}
+}
+
+func testAddGet(t *testing.T, s binstore.BinStore) {
+	ctx := context.Background()
+
+	v := newVersion("1.0.0", models.ArchTarGz)
+	if err := s.Add(ctx, v, bytes.NewReader(content(v.Name))); err != nil {
+		t.Fatal(err)
+	}
+
+	expectContent(t, s, v, content(v.Name))
+}
+
+func testAddGetArchiveTypes(t *testing.T, s binstore.BinStore) {
+	ctx := context.Background()
+
+	for _, archive := range []models.ArchType{models.ArchTar, models.ArchTarGz, models.ArchZip} {
+		v := newVersion(string(archive), archive)
+		if err := s.Add(ctx, v, bytes.NewReader(content(v.Name))); err != nil {
+			t.Fatal(err)
+		}
+		expectContent(t, s, v, content(v.Name))
+	}
+}
+
+func testAddGetEmpty(t *testing.T, s binstore.BinStore) {
+	ctx := context.Background()
+
+	v := newVersion("1.0.0", models.ArchTar)
+	if err := s.Add(ctx, v, bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectContent(t, s, v, []byte{})
+}
+
+func testAddDuplicate(t *testing.T, s binstore.BinStore) {
+	ctx := context.Background()
+
+	v := newVersion("1.0.0", models.ArchTarGz)
+	if err := s.Add(ctx, v, bytes.NewReader(content("first"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Add(ctx, v, bytes.NewReader(content("second"))); err != util.ErrAlreadyExists {
+		t.Fatal("Expected ErrAlreadyExists, got", err)
+	}
+
+	expectContent(t, s, v, content("first"))
+}
+
+// cancellingReader cancels a context after its first read, like a client disconnecting part way through an upload.
+type cancellingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	defer r.cancel()
+	if len(p) > 16 {
+		p = p[:16]
+	}
+	return r.r.Read(p)
+}
+
+func testAddCancelled(t *testing.T, s binstore.BinStore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	v := newVersion("1.0.0", models.ArchTarGz)
+	reader := &cancellingReader{r: bytes.NewReader(content(v.Name)), cancel: cancel}
+	if err := s.Add(ctx, v, reader); err != context.Canceled {
+		t.Fatal("Expected context.Canceled, got", err)
+	}
+
+	if _, err := s.Get(context.Background(), v); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound after a cancelled Add, got", err)
+	}
+}
+
+func testGetNotFound(t *testing.T, s binstore.BinStore) {
+	ctx := context.Background()
+
+	if _, err := s.Get(ctx, newVersion("1.0.0", models.ArchTarGz)); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+}
+
+func testDelete(t *testing.T, s binstore.BinStore) {
+	ctx := context.Background()
+
+	v := newVersion("1.0.0", models.ArchTarGz)
+	other := newVersion("1.1.0", models.ArchTarGz)
+	for _, ver := range []*models.Version{v, other} {
+		if err := s.Add(ctx, ver, bytes.NewReader(content(ver.Name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete(ctx, v); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(ctx, v); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+	expectContent(t, s, other, content(other.Name))
+
+	if err := s.Delete(ctx, v); err != nil {
+		t.Fatal("Expected deleting an unknown binary to succeed, got", err)
+	}
+
+	// The BinID may be reused once deleted.
+	if err := s.Add(ctx, v, bytes.NewReader(content("again"))); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, s, v, content("again"))
+}
+
+func testList(t *testing.T, s binstore.BinStore) {
+	ctx := context.Background()
+
+	ids, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatal("Expected no binaries, got", ids)
+	}
+
+	versions := []*models.Version{
+		newVersion("1.0.0", models.ArchTar),
+		newVersion("1.1.0", models.ArchTarGz),
+		newVersion("1.2.0", models.ArchZip),
+	}
+	for _, v := range versions {
+		if err := s.Add(ctx, v, bytes.NewReader(content(v.Name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(ctx, versions[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err = s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bool{}
+	for _, id := range ids {
+		found[id] = true
+	}
+	if len(ids) != 2 || !found[versions[0].BinID] || !found[versions[2].BinID] {
+		t.Fatal("Expected BinIDs of 1.0.0 and 1.2.0, got", ids)
+	}
+}
+
+func testConcurrentAddGet(t *testing.T, s binstore.BinStore) {
+	ctx := context.Background()
+
+	count := 20
+	versions := make([]*models.Version, count)
+	for i := range versions {
+		versions[i] = newVersion("1.0."+strconv.Itoa(i), models.ArchTar)
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, count)
+	for _, v := range versions {
+		wg.Add(1)
+		go func(v *models.Version) {
+			defer wg.Done()
+			errs <- s.Add(ctx, v, bytes.NewReader(content(v.Name)))
+		}(v)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, v := range versions {
+		expectContent(t, s, v, content(v.Name))
+	}
+}
+
+func testConcurrentAddDuplicate(t *testing.T, s binstore.BinStore) {
+	ctx := context.Background()
+
+	count := 20
+	v := newVersion("1.0.0", models.ArchTarGz)
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.Add(ctx, v, bytes.NewReader(content(v.Name)))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else if err != util.ErrAlreadyExists {
+			t.Fatal("Expected ErrAlreadyExists, got", err)
+		}
+	}
+
+	if succeeded != 1 {
+		t.Fatal("Expected exactly 1 Add to succeed, got", succeeded)
+	}
+}
@@ -2,17 +2,23 @@ package binstore
 
 import (
 	"bytes"
+	"context"
 	"io"
-	"io/ioutil"
 	"strings"
 
 	"github.com/boltdb/bolt"
 	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/schema"
 	"github.com/deejross/dep-registry/util"
 )
 
 var boltBinBucket = []byte("dep-reg-binstore")
 
+// boltBinMigrations upgrade the BinStore bucket, append new migrations to the end.
+var boltBinMigrations = []schema.Migration{
+	schema.CreateBuckets(boltBinBucket),
+}
+
 // BoltDB store.
 type BoltDB struct {
 	db *bolt.DB
@@ -25,10 +31,8 @@ func NewBoltBinStore(address string) (BinStore, error) {
 		return nil, err
 	}
 
-	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(boltBinBucket)
-		return err
-	}); err != nil {
+	if err := schema.Migrate(db, string(boltBinBucket), boltBinMigrations); err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -38,30 +42,31 @@ func NewBoltBinStore(address string) (BinStore, error) {
 }
 
 // Add a new version to the BinStore.
-func (s *BoltDB) Add(v *models.Version, reader io.Reader) error {
+func (s *BoltDB) Add(ctx context.Context, v *models.Version, reader io.Reader) error {
 	key := []byte(v.BinID)
 
-	return s.db.Update(func(tx *bolt.Tx) error {
+	// Read before the transaction so a slow upload does not hold the write lock.
+	val, err := util.ReadAll(ctx, reader)
+	if err != nil {
+		return err
+	}
+
+	return s.update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltBinBucket)
 		if b.Get(key) != nil {
 			return util.ErrAlreadyExists
 		}
 
-		val, err := ioutil.ReadAll(reader)
-		if err != nil {
-			return err
-		}
-
 		return b.Put(key, val)
 	})
 }
 
 // Get a Version from the BinStore.
-func (s *BoltDB) Get(v *models.Version) (io.Reader, error) {
+func (s *BoltDB) Get(ctx context.Context, v *models.Version) (io.Reader, error) {
 	var buf *bytes.Buffer
 	key := []byte(v.BinID)
 
-	if err := s.db.View(func(tx *bolt.Tx) error {
+	if err := s.view(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltBinBucket)
 		val := b.Get(key)
 
@@ -78,12 +83,51 @@ func (s *BoltDB) Get(v *models.Version) (io.Reader, error) {
 	return buf, nil
 }
 
+// List the BinIDs of all binaries in the BinStore.
+func (s *BoltDB) List(ctx context.Context) ([]string, error) {
+	ids := []string{}
+
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBinBucket)
+		return b.ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
 // Delete a Version from the BinStore.
-func (s *BoltDB) Delete(v *models.Version) error {
+func (s *BoltDB) Delete(ctx context.Context, v *models.Version) error {
 	key := []byte(v.BinID)
 
-	return s.db.Update(func(tx *bolt.Tx) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltBinBucket)
 		return b.Delete(key)
 	})
 }
+
+// Close the BoltDB file.
+func (s *BoltDB) Close() error {
+	return s.db.Close()
+}
+
+// update runs fn in a read-write transaction unless ctx is already done.
+func (s *BoltDB) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(fn)
+}
+
+// view runs fn in a read-only transaction unless ctx is already done.
+func (s *BoltDB) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.View(fn)
+}
@@ -0,0 +1,378 @@
+package binstore
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// ErrNoCache indicates no BinStore keeps a cache of binaries.
+var ErrNoCache = errors.New("No binary cache configured")
+
+// Cache is implemented by BinStores that keep a cache of binaries.
+type Cache interface {
+	// CacheStats returns the cache's counters and current size.
+	CacheStats() CacheStats
+
+	// Purge removes the given BinIDs from the cache, or every entry if none are given.
+	Purge(ids ...string) error
+}
+
+// CacheStats counts the activity of a Cache.
+type CacheStats struct {
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Fills      int64 `json:"fills"`
+	Evictions  int64 `json:"evictions"`
+	Mismatches int64 `json:"mismatches"`
+	Entries    int   `json:"entries"`
+	Bytes      int64 `json:"bytes"`
+	MaxBytes   int64 `json:"max_bytes"`
+}
+
+// FindCache returns the first Cache among bin and the BinStores it wraps, or nil if there is none.
+func FindCache(bin BinStore) Cache {
+	if c, ok := find(bin, func(b BinStore) bool {
+		_, ok := b.(Cache)
+		return ok
+	}).(Cache); ok {
+		return c
+	}
+	return nil
+}
+
+// CachedBinStore keeps the most recently used binaries of another BinStore in files on local disk,
+// up to a total size. A binary is only cached if it matches the digest of its Version. Binaries
+// are never changed once stored, so cached files stay valid until their Version is deleted.
+type CachedBinStore struct {
+	bin      BinStore
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	id   string
+	size int64
+}
+
+// NewCachedBinStore creates a new CachedBinStore around bin keeping up to maxBytes of binaries in dir.
+// Files already in dir are kept, oldest first in line for eviction.
+func NewCachedBinStore(bin BinStore, dir string, maxBytes int64) (*CachedBinStore, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("Invalid cache size: " + strconv.FormatInt(maxBytes, 10))
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &CachedBinStore{
+		bin:      bin,
+		dir:      dir,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			// Left behind by a fill that was interrupted.
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+
+		s.entries[info.Name()] = s.order.PushBack(&cacheEntry{id: info.Name(), size: info.Size()})
+		s.stats.Bytes += info.Size()
+	}
+	s.evict()
+
+	return s, nil
+}
+
+// newCachedBinStoreFromPath parses a connection string in the form
+// cached://<connection string>?dir=<directory>&size=<bytes>.
+func newCachedBinStoreFromPath(path string) (BinStore, error) {
+	inner, opts, err := wrapperOptions(path, "cached", "dir", "size")
+	if err != nil {
+		return nil, err
+	}
+
+	dir := opts.Get("dir")
+	if len(dir) == 0 {
+		return nil, errors.New("Cache directory is required: cached://<connection string>?dir=<directory>")
+	}
+
+	size, err := strconv.ParseInt(opts.Get("size"), 10, 64)
+	if err != nil {
+		return nil, errors.New("Cache size in bytes is required: cached://<connection string>?size=<bytes>")
+	}
+
+	bin, err := Resolve(inner)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCachedBinStore(bin, dir, size)
+}
+
+// Add a new version to the BinStore, it is cached once read.
+func (s *CachedBinStore) Add(ctx context.Context, v *models.Version, reader io.Reader) error {
+	return s.bin.Add(ctx, v, reader)
+}
+
+// Get a Version from the BinStore. A binary that is not cached is streamed from the wrapped BinStore
+// and cached once it has been read to the end. Close the returned reader when done with it.
+func (s *CachedBinStore) Get(ctx context.Context, v *models.Version) (io.Reader, error) {
+	if f, ok := s.open(v.BinID); ok {
+		return f, nil
+	}
+
+	s.mu.Lock()
+	s.stats.Misses++
+	s.mu.Unlock()
+
+	reader, err := s.bin.Get(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	if !validCacheID(v.BinID) {
+		return reader, nil
+	}
+
+	// Written to a hidden temporary file and renamed, so a cached file is always complete.
+	f, err := ioutil.TempFile(s.dir, ".fill-")
+	if err != nil {
+		return reader, nil
+	}
+
+	return &fillReader{s: s, v: v, r: util.NewContextReader(ctx, reader), closer: reader, f: f, h: sha256.New()}, nil
+}
+
+// Delete a Version from the BinStore.
+func (s *CachedBinStore) Delete(ctx context.Context, v *models.Version) error {
+	if err := s.bin.Delete(ctx, v); err != nil {
+		return err
+	}
+	return s.Purge(v.BinID)
+}
+
+// List the BinIDs of all binaries in the BinStore.
+func (s *CachedBinStore) List(ctx context.Context) ([]string, error) {
+	return s.bin.List(ctx)
+}
+
+// Unwrap returns the wrapped BinStore.
+func (s *CachedBinStore) Unwrap() BinStore {
+	return s.bin
+}
+
+// Close the wrapped BinStore if it can be closed.
+func (s *CachedBinStore) Close() error {
+	return closeBinStore(s.bin)
+}
+
+// CacheStats returns the cache's counters and current size.
+func (s *CachedBinStore) CacheStats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.Entries = s.order.Len()
+	stats.MaxBytes = s.maxBytes
+	return stats
+}
+
+// Purge removes the given BinIDs from the cache, or every entry if none are given.
+func (s *CachedBinStore) Purge(ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(ids) == 0 {
+		for id := range s.entries {
+			ids = append(ids, id)
+		}
+	}
+
+	for _, id := range ids {
+		el, ok := s.entries[id]
+		if !ok {
+			continue
+		}
+		if err := s.remove(el); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open opens the cached file of id. The file is opened while holding the lock, once open it can be read
+// even if it is evicted.
+func (s *CachedBinStore) open(id string) (*os.File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[id]
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, id))
+	if err != nil {
+		s.remove(el)
+		return nil, false
+	}
+
+	s.order.MoveToFront(el)
+	s.stats.Hits++
+	return f, true
+}
+
+// fill caches the binary of a Version written to the temporary file f if it matches the Version's digest,
+// sum is the SHA-256 of its size bytes.
+func (s *CachedBinStore) fill(v *models.Version, f *os.File, size int64, sum []byte) {
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	if len(v.Digest) > 0 && v.Digest != "sha256:"+hex.EncodeToString(sum) {
+		os.Remove(f.Name())
+		s.mu.Lock()
+		s.stats.Mismatches++
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(f.Name(), filepath.Join(s.dir, v.BinID)); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	if el, ok := s.entries[v.BinID]; ok {
+		s.stats.Bytes -= el.Value.(*cacheEntry).size
+		s.order.Remove(el)
+	}
+	s.entries[v.BinID] = s.order.PushFront(&cacheEntry{id: v.BinID, size: size})
+	s.stats.Bytes += size
+	s.stats.Fills++
+	s.evict()
+}
+
+// fillReader passes a binary through from the wrapped BinStore while writing it to a temporary file,
+// which is cached once the binary has been read to the end. Binaries larger than the cache are not written.
+type fillReader struct {
+	s *CachedBinStore
+	v *models.Version
+
+	// r reads the binary given by the wrapped BinStore, closer, which is closed with the fillReader.
+	r      io.Reader
+	closer io.Reader
+
+	// f is the temporary file, nil once it is cached or abandoned, h hashes the n bytes read.
+	f *os.File
+	h hash.Hash
+	n int64
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 && r.f != nil {
+		r.n += int64(n)
+		r.h.Write(p[:n])
+		if r.n > r.s.maxBytes {
+			r.abandon()
+		} else if _, werr := r.f.Write(p[:n]); werr != nil {
+			r.abandon()
+		}
+	}
+
+	if err == io.EOF && r.f != nil {
+		r.s.fill(r.v, r.f, r.n, r.h.Sum(nil))
+		r.f = nil
+	} else if err != nil {
+		r.abandon()
+	}
+	return n, err
+}
+
+// Close stops caching a binary that has not been read to the end and closes the wrapped reader.
+func (r *fillReader) Close() error {
+	r.abandon()
+	if c, ok := r.closer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// abandon removes the temporary file, the binary is not cached.
+func (r *fillReader) abandon() {
+	if r.f == nil {
+		return
+	}
+	r.f.Close()
+	os.Remove(r.f.Name())
+	r.f = nil
+}
+
+// evict removes the least recently used entries until the cache fits, the lock must be held.
+func (s *CachedBinStore) evict() {
+	for s.stats.Bytes > s.maxBytes {
+		el := s.order.Back()
+		if el == nil {
+			return
+		}
+		if err := s.remove(el); err != nil {
+			return
+		}
+		s.stats.Evictions++
+	}
+}
+
+// remove deletes an entry and its file, the lock must be held.
+func (s *CachedBinStore) remove(el *list.Element) error {
+	entry := el.Value.(*cacheEntry)
+	if err := os.Remove(filepath.Join(s.dir, entry.id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.order.Remove(el)
+	delete(s.entries, entry.id)
+	s.stats.Bytes -= entry.size
+	return nil
+}
+
+// validCacheID reports whether a BinID can safely be used as a file name.
+func validCacheID(id string) bool {
+	return len(id) > 0 && !strings.HasPrefix(id, ".") && !strings.ContainsAny(id, `/\`)
+}
@@ -0,0 +1,168 @@
+package binstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/deejross/dep-registry/models"
+)
+
+func newCachedVersion(t *testing.T, bin BinStore, name string, data []byte) *models.Version {
+	ctx := context.Background()
+
+	v := models.NewVersion(models.NewImport("example.com/pkg"), name, models.ArchTarGz)
+	sum := sha256.Sum256(data)
+	v.Digest = "sha256:" + hex.EncodeToString(sum[:])
+
+	if err := bin.Add(ctx, v, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func expectCached(t *testing.T, s *CachedBinStore, v *models.Version, expected []byte) {
+	ctx := context.Background()
+
+	reader, err := s.Get(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.(io.Closer).Close()
+	if !bytes.Equal(data, expected) {
+		t.Fatal("Unexpected binary for", v.Name)
+	}
+}
+
+func TestCachedBinStore(t *testing.T) {
+	ctx := context.Background()
+
+	inner := NewMemoryBinStore()
+	dir := filepath.Join(t.TempDir(), "cache")
+	s, err := NewCachedBinStore(inner, dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("a"), 100)
+	v1 := newCachedVersion(t, s, "1.0.0", data)
+	v2 := newCachedVersion(t, s, "1.1.0", data)
+	v3 := newCachedVersion(t, s, "1.2.0", data)
+
+	expectCached(t, s, v1, data)
+	expectCached(t, s, v1, data)
+	if stats := s.CacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Fills != 1 || stats.Bytes != 100 {
+		t.Fatal("Unexpected stats", stats)
+	}
+
+	// Served from disk even if the wrapped BinStore loses it.
+	if err := inner.Delete(ctx, v1); err != nil {
+		t.Fatal(err)
+	}
+	expectCached(t, s, v1, data)
+
+	// Filling a third binary evicts the least recently used.
+	expectCached(t, s, v2, data)
+	expectCached(t, s, v1, data)
+	expectCached(t, s, v3, data)
+	stats := s.CacheStats()
+	if stats.Evictions != 1 || stats.Entries != 2 || stats.Bytes != 200 {
+		t.Fatal("Unexpected stats", stats)
+	}
+	if _, ok := s.entries[v2.BinID]; ok {
+		t.Fatal("Expected 1.1.0 to be evicted")
+	}
+
+	// Cached files are kept when reopened.
+	s, err = NewCachedBinStore(inner, dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.CacheStats(); stats.Entries != 2 || stats.Bytes != 200 {
+		t.Fatal("Expected cached files to be kept, got", stats)
+	}
+	expectCached(t, s, v1, data)
+
+	if err := s.Purge(v1.BinID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, v1); err == nil {
+		t.Fatal("Expected purged binary missing from the wrapped BinStore not to be found")
+	}
+	if err := s.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.CacheStats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Fatal("Expected empty cache, got", stats)
+	}
+}
+
+func TestCachedBinStoreMismatch(t *testing.T) {
+	s, err := NewCachedBinStore(NewMemoryBinStore(), t.TempDir(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := newCachedVersion(t, s, "1.0.0", []byte("archive"))
+	v.Digest = "sha256:0000"
+	expectCached(t, s, v, []byte("archive"))
+
+	if stats := s.CacheStats(); stats.Mismatches != 1 || stats.Entries != 0 {
+		t.Fatal("Expected mismatched binary not to be cached, got", stats)
+	}
+}
+
+func TestCachedBinStorePartialRead(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewCachedBinStore(NewMemoryBinStore(), dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("a"), 100)
+	v := newCachedVersion(t, s, "1.0.0", data)
+
+	// A binary is only cached once read to the end.
+	reader, err := s.Get(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(reader, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.CacheStats(); stats.Fills != 0 {
+		t.Fatal("Expected nothing to be cached before the end, got", stats)
+	}
+	if err := reader.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Fatal("Expected the temporary file to be removed, got", infos[0].Name())
+	}
+
+	expectCached(t, s, v, data)
+	if stats := s.CacheStats(); stats.Fills != 1 || stats.Bytes != 100 {
+		t.Fatal("Expected the binary to be cached, got", stats)
+	}
+}
+
+func TestFindCache(t *testing.T) {
+	bin, err := Resolve("compressed://cached://memory://?dir=" + t.TempDir() + "&size=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cache := FindCache(bin); cache == nil {
+		t.Fatal("Expected to find the cache")
+	}
+	if cache := FindCache(NewMemoryBinStore()); cache != nil {
+		t.Fatal("Expected no cache, got", cache)
+	}
+}
@@ -0,0 +1,148 @@
+package binstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// ErrUnknownEncoding indicates a binary was stored using an encoding this build does not support.
+var ErrUnknownEncoding = errors.New("Unknown binary encoding")
+
+// CompressedBinStore compresses uncompressed archives before handing them to another BinStore. The
+// Encoding and StoredSize of each Version are set when its binary is stored, so binaries stored before
+// compression was enabled are returned as stored.
+type CompressedBinStore struct {
+	bin   BinStore
+	level int
+}
+
+// NewCompressedBinStore creates a new CompressedBinStore around bin using the given gzip compression level.
+func NewCompressedBinStore(bin BinStore, level int) (*CompressedBinStore, error) {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return nil, errors.New("Invalid compression level: " + strconv.Itoa(level))
+	}
+
+	return &CompressedBinStore{
+		bin:   bin,
+		level: level,
+	}, nil
+}
+
+// newCompressedBinStoreFromPath parses a connection string in the form
+// compressed://<connection string>?codec=gzip&level=<1-9>.
+func newCompressedBinStoreFromPath(path string) (BinStore, error) {
+	inner, opts, err := wrapperOptions(path, "compressed", "codec", "level")
+	if err != nil {
+		return nil, err
+	}
+
+	if codec := opts.Get("codec"); len(codec) > 0 && codec != "gzip" {
+		return nil, errors.New("Unsupported compression codec: " + codec)
+	}
+
+	// The level gzip uses by default.
+	level := 6
+	if v := opts.Get("level"); len(v) > 0 {
+		level, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bin, err := Resolve(inner)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCompressedBinStore(bin, level)
+}
+
+// Add a new version to the BinStore.
+func (s *CompressedBinStore) Add(ctx context.Context, v *models.Version, reader io.Reader) error {
+	if v.ArchiveType != models.ArchTar {
+		v.Encoding, v.StoredSize = models.EncodingIdentity, 0
+		return s.bin.Add(ctx, v, reader)
+	}
+
+	data, err := util.ReadAll(ctx, reader)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, s.level)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	v.Encoding, v.StoredSize = models.EncodingGzip, int64(buf.Len())
+	return s.bin.Add(ctx, v, buf)
+}
+
+// Get a Version from the BinStore. Close the returned reader when done with it.
+func (s *CompressedBinStore) Get(ctx context.Context, v *models.Version) (io.Reader, error) {
+	reader, err := s.bin.Get(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v.Encoding {
+	case models.EncodingIdentity:
+		return reader, nil
+	case models.EncodingGzip:
+		zr, err := gzip.NewReader(reader)
+		if err != nil {
+			closeReader(reader)
+			return nil, err
+		}
+		return &gzipReader{Reader: zr, closer: reader}, nil
+	default:
+		closeReader(reader)
+		return nil, ErrUnknownEncoding
+	}
+}
+
+// Delete a Version from the BinStore.
+func (s *CompressedBinStore) Delete(ctx context.Context, v *models.Version) error {
+	return s.bin.Delete(ctx, v)
+}
+
+// List the BinIDs of all binaries in the BinStore.
+func (s *CompressedBinStore) List(ctx context.Context) ([]string, error) {
+	return s.bin.List(ctx)
+}
+
+// Close the wrapped BinStore if it can be closed.
+func (s *CompressedBinStore) Close() error {
+	return closeBinStore(s.bin)
+}
+
+// Unwrap returns the wrapped BinStore.
+func (s *CompressedBinStore) Unwrap() BinStore {
+	return s.bin
+}
+
+// gzipReader decompresses a binary, closing the reader of the wrapped BinStore with it.
+type gzipReader struct {
+	*gzip.Reader
+	closer io.Reader
+}
+
+// Close the decompressor and the wrapped reader.
+func (r *gzipReader) Close() error {
+	r.Reader.Close()
+	return closeReader(r.closer)
+}
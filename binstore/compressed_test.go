@@ -0,0 +1,135 @@
+package binstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/deejross/dep-registry/models"
+)
+
+var compBinAddress = "binstore.comp.test.bolt"
+var compContent = bytes.Repeat([]byte("an uncompressed tar archive "), 100)
+var compBin *BoltDB
+var comp *CompressedBinStore
+
+func TestNewCompressedBinStore(t *testing.T) {
+	os.Remove(compBinAddress)
+
+	bin, err := NewBoltBinStore("boltdb://" + compBinAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compBin = bin.(*BoltDB)
+
+	comp, err = NewCompressedBinStore(bin, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, level := range []int{-2, -1, 0, 10} {
+		if _, err := NewCompressedBinStore(bin, level); err == nil {
+			t.Fatal("Expected level", level, "to be rejected")
+		}
+	}
+}
+
+func TestCompressedAddGet(t *testing.T) {
+	ctx := context.Background()
+
+	v := &models.Version{BinID: "tar-bin", ArchiveType: models.ArchTar}
+	if err := comp.Add(ctx, v, bytes.NewReader(compContent)); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := comp.Get(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	if !bytes.Equal(data, compContent) {
+		t.Fatal("Decompressed binary does not match")
+	}
+
+	if v.Encoding != models.EncodingGzip {
+		t.Fatal("Expected the gzip encoding to be recorded, got", v.Encoding)
+	}
+	if v.StoredSize == 0 || v.StoredSize >= int64(len(compContent)) {
+		t.Fatal("Expected stored size", v.StoredSize, "to be less than logical size", len(compContent))
+	}
+}
+
+func TestCompressedSkipsCompressedArchives(t *testing.T) {
+	ctx := context.Background()
+
+	v := &models.Version{BinID: "tgz-bin", ArchiveType: models.ArchTarGz}
+	if err := comp.Add(ctx, v, bytes.NewReader(compContent)); err != nil {
+		t.Fatal(err)
+	}
+	if v.Encoding != models.EncodingIdentity || v.StoredSize != 0 {
+		t.Fatal("Expected tgz archive to be stored as given, got", v.Encoding, v.StoredSize)
+	}
+
+	reader, err := compBin.Get(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	if !bytes.Equal(data, compContent) {
+		t.Fatal("Expected tgz archive to be stored as given")
+	}
+}
+
+func TestCompressedReadsExistingBinaries(t *testing.T) {
+	ctx := context.Background()
+
+	v := &models.Version{BinID: "old-bin", ArchiveType: models.ArchTar}
+	if err := compBin.Add(ctx, v, bytes.NewReader(compContent)); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := comp.Get(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	if !bytes.Equal(data, compContent) {
+		t.Fatal("Existing binary does not match")
+	}
+
+	// A binary that happens to look like a compressed one is still returned as stored.
+	v = &models.Version{BinID: "gzip-looking-bin", ArchiveType: models.ArchTar}
+	content := append([]byte("\x00DRC\x01"), compContent...)
+	if err := compBin.Add(ctx, v, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	reader, err = comp.Get(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(reader)
+	if !bytes.Equal(data, content) {
+		t.Fatal("Existing binary does not match")
+	}
+}
+
+func TestCompressedUnknownEncoding(t *testing.T) {
+	ctx := context.Background()
+
+	v := &models.Version{BinID: "unknown-bin", ArchiveType: models.ArchTar, Encoding: "zstd"}
+	if err := compBin.Add(ctx, v, bytes.NewReader(compContent)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := comp.Get(ctx, v); err != ErrUnknownEncoding {
+		t.Fatal("Expected ErrUnknownEncoding, got", err)
+	}
+}
+
+func TestCompressedCleanup(t *testing.T) {
+	compBin.db.Close()
+	if err := os.Remove(compBinAddress); err != nil {
+		t.Fatal(err)
+	}
+}
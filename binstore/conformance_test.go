@@ -0,0 +1,55 @@
+package binstore_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/deejross/dep-registry/binstore"
+	"github.com/deejross/dep-registry/binstore/binstoretest"
+)
+
+const testKey = "test:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func resolve(t *testing.T, path string) binstore.BinStore {
+	s, err := binstore.Resolve(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBoltConformance(t *testing.T) {
+	binstoretest.Run(t, func(t *testing.T) binstore.BinStore {
+		return resolve(t, "boltdb://"+filepath.Join(t.TempDir(), "binstore.bolt"))
+	})
+}
+
+func TestMemoryConformance(t *testing.T) {
+	binstoretest.Run(t, func(t *testing.T) binstore.BinStore {
+		return resolve(t, "memory://")
+	})
+}
+
+func TestEncryptedConformance(t *testing.T) {
+	binstoretest.Run(t, func(t *testing.T) binstore.BinStore {
+		return resolve(t, "encrypted://memory://?keystore="+filepath.Join(t.TempDir(), "keys.bolt")+"&key="+testKey)
+	})
+}
+
+func TestCompressedConformance(t *testing.T) {
+	binstoretest.Run(t, func(t *testing.T) binstore.BinStore {
+		return resolve(t, "compressed://memory://?level=9")
+	})
+}
+
+func TestCachedConformance(t *testing.T) {
+	binstoretest.Run(t, func(t *testing.T) binstore.BinStore {
+		return resolve(t, "cached://memory://?dir="+filepath.Join(t.TempDir(), "cache")+"&size=1000000")
+	})
+}
+
+func TestMultiConformance(t *testing.T) {
+	binstoretest.Run(t, func(t *testing.T) binstore.BinStore {
+		return resolve(t, "multi://memory://|boltdb://"+filepath.Join(t.TempDir(), "replica.bolt")+"?quorum=2")
+	})
+}
@@ -0,0 +1,326 @@
+package binstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/boltdb/bolt"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/schema"
+	"github.com/deejross/dep-registry/util"
+)
+
+var boltKeyBucket = []byte("dep-reg-binstore-keys")
+
+// boltKeyMigrations upgrade the key store bucket, append new migrations to the end.
+var boltKeyMigrations = []schema.Migration{
+	schema.CreateBuckets(boltKeyBucket),
+}
+
+// envelope is a data key wrapped by a master key.
+type envelope struct {
+	KeyID string `json:"kid"`
+	Key   []byte `json:"key"`
+}
+
+// EncryptedBinStore encrypts binaries with AES-256-GCM before handing them to another BinStore.
+// Each binary is encrypted with its own data key, which is wrapped by the active master key
+// and kept in a separate key store, so master keys can be rotated without rewriting binaries.
+type EncryptedBinStore struct {
+	bin  BinStore
+	db   *bolt.DB
+	keys *KeyRing
+}
+
+// NewEncryptedBinStore creates a new EncryptedBinStore around bin, keeping the wrapped data keys
+// in the BoltDB file keystore. Data keys wrapped by a master key other than the active one are
+// re-wrapped with the active key.
+func NewEncryptedBinStore(bin BinStore, keys *KeyRing, keystore string) (*EncryptedBinStore, error) {
+	db, err := bolt.Open(keystore, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := schema.Migrate(db, string(boltKeyBucket), boltKeyMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &EncryptedBinStore{
+		bin:  bin,
+		db:   db,
+		keys: keys,
+	}
+
+	if _, err := s.Rotate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// newEncryptedBinStoreFromPath parses a connection string in the form
+// encrypted://<connection string>?keystore=<file>&keyfile=<file> where the master keys
+// may instead be given inline with key=<id>:<hex key>.
+func newEncryptedBinStoreFromPath(path string) (BinStore, error) {
+	inner, opts, err := wrapperOptions(path, "encrypted", "keystore", "keyfile", "key")
+	if err != nil {
+		return nil, err
+	}
+
+	keystore := opts.Get("keystore")
+	if len(keystore) == 0 {
+		return nil, errors.New("Encrypted BinStore requires a keystore option")
+	}
+
+	var keys *KeyRing
+	if name := opts.Get("keyfile"); len(name) > 0 {
+		keys, err = LoadKeyRing(name)
+	} else {
+		keys, err = ParseKeyRing(opts.Get("key"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bin, err := Resolve(inner)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEncryptedBinStore(bin, keys, keystore)
+}
+
+// Add a new version to the BinStore.
+func (s *EncryptedBinStore) Add(ctx context.Context, v *models.Version, reader io.Reader) error {
+	key := []byte(v.BinID)
+
+	plaintext, err := util.ReadAll(ctx, reader)
+	if err != nil {
+		return err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+
+	ciphertext, err := seal(dataKey, plaintext, key)
+	if err != nil {
+		return err
+	}
+
+	keyID, masterKey := s.keys.Active()
+	wrapped, err := seal(masterKey, dataKey, key)
+	if err != nil {
+		return err
+	}
+
+	env, err := json.Marshal(&envelope{KeyID: keyID, Key: wrapped})
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKeyBucket)
+		if b.Get(key) != nil {
+			return util.ErrAlreadyExists
+		}
+		return b.Put(key, env)
+	}); err != nil {
+		return err
+	}
+
+	if err := s.bin.Add(ctx, v, bytes.NewReader(ciphertext)); err != nil {
+		s.deleteKey(key)
+		return err
+	}
+
+	return nil
+}
+
+// Get a Version from the BinStore.
+func (s *EncryptedBinStore) Get(ctx context.Context, v *models.Version) (io.Reader, error) {
+	key := []byte(v.BinID)
+	var dataKey []byte
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKeyBucket)
+		val := b.Get(key)
+		if val == nil {
+			return util.ErrNotFound
+		}
+
+		var err error
+		dataKey, err = s.unwrap(val, key)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	reader, err := s.bin.Get(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := util.ReadAll(ctx, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := open(dataKey, ciphertext, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(plaintext), nil
+}
+
+// Delete a Version from the BinStore.
+func (s *EncryptedBinStore) Delete(ctx context.Context, v *models.Version) error {
+	if err := s.bin.Delete(ctx, v); err != nil {
+		return err
+	}
+	return s.deleteKey([]byte(v.BinID))
+}
+
+// List the BinIDs of all binaries in the BinStore.
+func (s *EncryptedBinStore) List(ctx context.Context) ([]string, error) {
+	return s.bin.List(ctx)
+}
+
+// Rotate re-wraps every data key that is not wrapped by the active master key and
+// returns the number of data keys that were re-wrapped.
+func (s *EncryptedBinStore) Rotate() (int, error) {
+	keyID, masterKey := s.keys.Active()
+	count := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKeyBucket)
+		updates := map[string][]byte{}
+
+		if err := b.ForEach(func(k, val []byte) error {
+			env := &envelope{}
+			if err := json.Unmarshal(val, env); err != nil {
+				return err
+			}
+			if env.KeyID == keyID {
+				return nil
+			}
+
+			dataKey, err := s.unwrap(val, k)
+			if err != nil {
+				return err
+			}
+
+			wrapped, err := seal(masterKey, dataKey, k)
+			if err != nil {
+				return err
+			}
+
+			newVal, err := json.Marshal(&envelope{KeyID: keyID, Key: wrapped})
+			if err != nil {
+				return err
+			}
+
+			updates[string(k)] = newVal
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for k, val := range updates {
+			if err := b.Put([]byte(k), val); err != nil {
+				return err
+			}
+		}
+
+		count = len(updates)
+		return nil
+	})
+
+	return count, err
+}
+
+// unwrap a data key from its serialized envelope.
+func (s *EncryptedBinStore) unwrap(val, key []byte) ([]byte, error) {
+	env := &envelope{}
+	if err := json.Unmarshal(val, env); err != nil {
+		return nil, err
+	}
+
+	masterKey, err := s.keys.Get(env.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(masterKey, env.Key, key)
+}
+
+// deleteKey removes a wrapped data key from the key store.
+func (s *EncryptedBinStore) deleteKey(key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKeyBucket)
+		return b.Delete(key)
+	})
+}
+
+// seal encrypts plaintext with AES-256-GCM, authenticating additional data ad.
+// The random nonce is prepended to the result.
+func seal(key, plaintext, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// open decrypts a ciphertext created by seal.
+func open(key, ciphertext, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("Ciphertext too short")
+	}
+
+	nonce := ciphertext[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], ad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Close the key store and the wrapped BinStore if it can be closed.
+func (s *EncryptedBinStore) Close() error {
+	if err := closeBinStore(s.bin); err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+// Unwrap returns the wrapped BinStore.
+func (s *EncryptedBinStore) Unwrap() BinStore {
+	return s.bin
+}
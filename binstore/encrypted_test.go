@@ -0,0 +1,121 @@
+package binstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/deejross/dep-registry/models"
+)
+
+var encBinAddress = "binstore.enc.test.bolt"
+var encKeyAddress = "binstore.keys.test.bolt"
+var oldKey = "old:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+var newKey = "new:1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+var encVersion = &models.Version{ImportURL: "example.com/pkg", Name: "1.0.0", BinID: "the-bin-id"}
+var encContent = []byte("some proprietary code")
+
+func openEncrypted(t *testing.T, keys string) *EncryptedBinStore {
+	ring, err := ParseKeyRing(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin, err := NewBoltBinStore("boltdb://" + encBinAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewEncryptedBinStore(bin, ring, encKeyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func closeEncrypted(s *EncryptedBinStore) {
+	s.bin.(*BoltDB).db.Close()
+	s.db.Close()
+}
+
+func TestEncryptedAddGet(t *testing.T) {
+	ctx := context.Background()
+
+	os.Remove(encBinAddress)
+	os.Remove(encKeyAddress)
+
+	s := openEncrypted(t, oldKey)
+	defer closeEncrypted(s)
+
+	if err := s.Add(ctx, encVersion, bytes.NewReader(encContent)); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := s.bin.Get(ctx, encVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadAll(reader)
+	if bytes.Contains(raw, encContent) {
+		t.Fatal("Expected stored binary to be encrypted")
+	}
+
+	reader, err = s.Get(ctx, encVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := ioutil.ReadAll(reader)
+	if !bytes.Equal(plain, encContent) {
+		t.Fatal("Expected", string(encContent), "got", string(plain))
+	}
+}
+
+func TestEncryptedRotate(t *testing.T) {
+	ctx := context.Background()
+
+	s := openEncrypted(t, newKey+"\n"+oldKey)
+	n, err := s.Rotate()
+	closeEncrypted(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatal("Expected data keys to be re-wrapped on open, re-wrapped", n, "again")
+	}
+
+	s = openEncrypted(t, newKey)
+	defer closeEncrypted(s)
+
+	reader, err := s.Get(ctx, encVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := ioutil.ReadAll(reader)
+	if !bytes.Equal(plain, encContent) {
+		t.Fatal("Expected", string(encContent), "got", string(plain))
+	}
+}
+
+func TestEncryptedUnknownKey(t *testing.T) {
+	ring, _ := ParseKeyRing(oldKey)
+	bin, err := NewBoltBinStore("boltdb://" + encBinAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bin.(*BoltDB).db.Close()
+
+	if _, err := NewEncryptedBinStore(bin, ring, encKeyAddress); err != ErrUnknownMasterKey {
+		t.Fatal("Expected ErrUnknownMasterKey, got", err)
+	}
+}
+
+func TestEncryptedCleanup(t *testing.T) {
+	if err := os.Remove(encBinAddress); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(encKeyAddress); err != nil {
+		t.Fatal(err)
+	}
+}
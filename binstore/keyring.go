@@ -0,0 +1,93 @@
+package binstore
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	// ErrNoMasterKey indicates no master key was given to an encrypted BinStore.
+	ErrNoMasterKey = errors.New("At least one master key is required")
+
+	// ErrInvalidMasterKey indicates a master key could not be parsed.
+	ErrInvalidMasterKey = errors.New("Master keys must be in the form <id>:<64 hex characters>")
+
+	// ErrUnknownMasterKey indicates a data key was wrapped by a master key that is not in the KeyRing.
+	ErrUnknownMasterKey = errors.New("Data key was wrapped by an unknown master key")
+)
+
+// KeyRing holds the master keys used to wrap data keys. The first key is the active key
+// and is used to wrap new data keys, all keys can be used to unwrap existing data keys.
+type KeyRing struct {
+	ids  []string
+	keys map[string][]byte
+}
+
+// ParseKeyRing parses master keys, one per line, in the form <id>:<hex encoded 32 byte key>.
+// Blank lines and lines starting with # are ignored.
+func ParseKeyRing(s string) (*KeyRing, error) {
+	k := &KeyRing{
+		keys: map[string][]byte{},
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, ErrInvalidMasterKey
+		}
+
+		key, err := hex.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, ErrInvalidMasterKey
+		}
+
+		if _, ok := k.keys[parts[0]]; ok {
+			return nil, errors.New("Duplicate master key ID: " + parts[0])
+		}
+
+		k.ids = append(k.ids, parts[0])
+		k.keys[parts[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(k.ids) == 0 {
+		return nil, ErrNoMasterKey
+	}
+
+	return k, nil
+}
+
+// LoadKeyRing reads master keys from a file, see ParseKeyRing for the format.
+func LoadKeyRing(name string) (*KeyRing, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseKeyRing(string(b))
+}
+
+// Active returns the ID and value of the key used to wrap new data keys.
+func (k *KeyRing) Active() (string, []byte) {
+	return k.ids[0], k.keys[k.ids[0]]
+}
+
+// Get a master key by ID.
+func (k *KeyRing) Get(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+	return key, nil
+}
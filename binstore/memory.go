@@ -0,0 +1,79 @@
+package binstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// Memory BinStore implementation, contents are lost when the process exits.
+type Memory struct {
+	mu   sync.RWMutex
+	bins map[string][]byte
+}
+
+// NewMemoryBinStore creates a new Memory BinStore.
+func NewMemoryBinStore() BinStore {
+	return &Memory{
+		bins: map[string][]byte{},
+	}
+}
+
+// Add a new version to the BinStore.
+func (s *Memory) Add(ctx context.Context, v *models.Version, reader io.Reader) error {
+	val, err := util.ReadAll(ctx, reader)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.bins[v.BinID]; ok {
+		return util.ErrAlreadyExists
+	}
+
+	s.bins[v.BinID] = val
+	return nil
+}
+
+// Get a Version from the BinStore.
+func (s *Memory) Get(ctx context.Context, v *models.Version) (io.Reader, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	val, ok := s.bins[v.BinID]
+	if !ok {
+		return nil, util.ErrNotFound
+	}
+
+	return bytes.NewReader(val), nil
+}
+
+// List the BinIDs of all binaries in the BinStore.
+func (s *Memory) List(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]string, 0, len(s.bins))
+	for id := range s.bins {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// Delete a Version from the BinStore.
+func (s *Memory) Delete(ctx context.Context, v *models.Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.bins, v.BinID)
+	return nil
+}
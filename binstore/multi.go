@@ -0,0 +1,358 @@
+package binstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// ErrNoReplicas indicates no BinStore replicates binaries.
+var ErrNoReplicas = errors.New("No replicated binary store configured")
+
+// unhealthyFor is how long a replica that failed is tried after the others.
+var unhealthyFor = 30 * time.Second
+
+// MultiBinStore writes every binary to several BinStores, called replicas. An Add succeeds once
+// quorum replicas have stored the binary, reads try each replica in turn, preferring those that
+// have not failed recently, and Repair copies binaries to the replicas that are missing them.
+//
+// A Delete must succeed on every replica: a binary left on a replica would be copied back by Repair.
+type MultiBinStore struct {
+	replicas []BinStore
+	quorum   int
+
+	mu             sync.Mutex
+	unhealthyUntil []time.Time
+	locks          map[string]chan struct{}
+}
+
+// RepairReport counts what Repair did.
+type RepairReport struct {
+	// Copied is the number of binaries copied to a replica missing them.
+	Copied int `json:"copied"`
+
+	// Failed lists the replicas, by position, that a binary could not be copied to.
+	Failed map[int]int `json:"failed"`
+}
+
+// NewMultiBinStore creates a new MultiBinStore writing to replicas, an Add succeeds once quorum of them have stored a binary.
+func NewMultiBinStore(replicas []BinStore, quorum int) (*MultiBinStore, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("At least one replica is required")
+	}
+	if quorum < 1 || quorum > len(replicas) {
+		return nil, errors.New("Invalid quorum " + strconv.Itoa(quorum) + " for " + strconv.Itoa(len(replicas)) + " replicas")
+	}
+
+	return &MultiBinStore{
+		replicas:       replicas,
+		quorum:         quorum,
+		unhealthyUntil: make([]time.Time, len(replicas)),
+		locks:          map[string]chan struct{}{},
+	}, nil
+}
+
+// newMultiBinStoreFromPath parses a connection string in the form
+// multi://<connection string>|<connection string>...?quorum=<replicas>, quorum defaults to every replica.
+func newMultiBinStoreFromPath(path string) (BinStore, error) {
+	inner, opts, err := wrapperOptions(path, "multi", "quorum")
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := []BinStore{}
+	for _, p := range strings.Split(inner, "|") {
+		bin, err := Resolve(p)
+		if err != nil {
+			for _, r := range replicas {
+				closeBinStore(r)
+			}
+			return nil, err
+		}
+		replicas = append(replicas, bin)
+	}
+
+	quorum := len(replicas)
+	if v := opts.Get("quorum"); len(v) > 0 {
+		if quorum, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewMultiBinStore(replicas, quorum)
+}
+
+// Add a new version to the BinStore.
+func (s *MultiBinStore) Add(ctx context.Context, v *models.Version, reader io.Reader) error {
+	data, err := util.ReadAll(ctx, reader)
+	if err != nil {
+		return err
+	}
+
+	s.lock(v.BinID)
+	defer s.unlock(v.BinID)
+
+	errs := s.each(ctx, func(bin BinStore) error {
+		return bin.Add(ctx, v, bytes.NewReader(data))
+	})
+
+	stored := 0
+	exists := false
+	var first error
+	for _, err := range errs {
+		if err == nil {
+			stored++
+		} else if err == util.ErrAlreadyExists {
+			exists = true
+		} else if first == nil {
+			first = err
+		}
+	}
+
+	if !exists && stored >= s.quorum {
+		return nil
+	}
+
+	// Undo the writes that succeeded so the BinID is not left with different binaries,
+	// even if ctx is done.
+	cleanup := context.WithoutCancel(ctx)
+	for i, err := range errs {
+		if err == nil {
+			s.replicas[i].Delete(cleanup, v)
+		}
+	}
+
+	if exists {
+		return util.ErrAlreadyExists
+	}
+	return first
+}
+
+// Get a Version from the first replica that has it.
+func (s *MultiBinStore) Get(ctx context.Context, v *models.Version) (io.Reader, error) {
+	err := util.ErrNotFound
+	for _, i := range s.readOrder() {
+		reader, rerr := s.replicas[i].Get(ctx, v)
+		if rerr == nil {
+			s.setHealthy(i, true)
+			return reader, nil
+		}
+		if ctx.Err() != nil {
+			// The caller gave up, which says nothing about the replica.
+			return nil, ctx.Err()
+		}
+
+		if rerr != util.ErrNotFound {
+			s.setHealthy(i, false)
+			err = rerr
+		}
+	}
+
+	return nil, err
+}
+
+// Delete a Version from every replica.
+func (s *MultiBinStore) Delete(ctx context.Context, v *models.Version) error {
+	s.lock(v.BinID)
+	defer s.unlock(v.BinID)
+
+	for _, err := range s.each(ctx, func(bin BinStore) error {
+		return bin.Delete(ctx, v)
+	}) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List the BinIDs of the binaries stored on any replica.
+func (s *MultiBinStore) List(ctx context.Context) ([]string, error) {
+	found := map[string]bool{}
+	for _, bin := range s.replicas {
+		ids, err := bin.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			found[id] = true
+		}
+	}
+
+	ids := make([]string, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Repair copies every binary stored on any replica to the replicas that are missing it.
+// Binaries are copied without their archive type, which only wrappers such as compressed:// use.
+func (s *MultiBinStore) Repair(ctx context.Context) (*RepairReport, error) {
+	report := &RepairReport{Failed: map[int]int{}}
+
+	stored := make([]map[string]bool, len(s.replicas))
+	for i, bin := range s.replicas {
+		ids, err := bin.List(ctx)
+		if err != nil {
+			return report, err
+		}
+
+		stored[i] = map[string]bool{}
+		for _, id := range ids {
+			stored[i][id] = true
+		}
+	}
+
+	ids, err := s.List(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		v := &models.Version{BinID: id}
+		for i, bin := range s.replicas {
+			if stored[i][id] {
+				continue
+			}
+
+			if err := s.copyTo(ctx, bin, v); err != nil {
+				report.Failed[i]++
+				continue
+			}
+			report.Copied++
+		}
+	}
+
+	return report, nil
+}
+
+// copyTo copies a binary from the other replicas to bin.
+func (s *MultiBinStore) copyTo(ctx context.Context, bin BinStore, v *models.Version) error {
+	s.lock(v.BinID)
+	defer s.unlock(v.BinID)
+
+	reader, err := s.Get(ctx, v)
+	if err == util.ErrNotFound {
+		// Deleted since the replicas were listed.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := bin.Add(ctx, v, reader); err != nil && err != util.ErrAlreadyExists {
+		return err
+	}
+	return nil
+}
+
+// Close every replica that can be closed.
+func (s *MultiBinStore) Close() error {
+	var first error
+	for _, bin := range s.replicas {
+		if err := closeBinStore(bin); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// each calls fn with every replica concurrently and returns the errors in replica order.
+// Replicas are not marked unhealthy for errors caused by ctx being done.
+func (s *MultiBinStore) each(ctx context.Context, fn func(bin BinStore) error) []error {
+	errs := make([]error, len(s.replicas))
+
+	wg := sync.WaitGroup{}
+	for i, bin := range s.replicas {
+		wg.Add(1)
+		go func(i int, bin BinStore) {
+			defer wg.Done()
+			errs[i] = fn(bin)
+			if ctx.Err() != nil {
+				return
+			}
+			s.setHealthy(i, errs[i] == nil || errs[i] == util.ErrAlreadyExists)
+		}(i, bin)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// readOrder returns the positions of the replicas, healthy ones first.
+func (s *MultiBinStore) readOrder() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	healthy := []int{}
+	unhealthy := []int{}
+	for i, until := range s.unhealthyUntil {
+		if now.Before(until) {
+			unhealthy = append(unhealthy, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (s *MultiBinStore) setHealthy(i int, healthy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if healthy {
+		s.unhealthyUntil[i] = time.Time{}
+	} else {
+		s.unhealthyUntil[i] = time.Now().Add(unhealthyFor)
+	}
+}
+
+// lock serializes writes of the same BinID, so concurrent Adds cannot each win on different replicas.
+func (s *MultiBinStore) lock(id string) {
+	for {
+		s.mu.Lock()
+		ch, ok := s.locks[id]
+		if !ok {
+			s.locks[id] = make(chan struct{})
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+		<-ch
+	}
+}
+
+func (s *MultiBinStore) unlock(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	close(s.locks[id])
+	delete(s.locks, id)
+}
+
+// FindMulti returns the first MultiBinStore among bin and the BinStores it wraps, or nil if there is none.
+func FindMulti(bin BinStore) *MultiBinStore {
+	if m, ok := find(bin, func(b BinStore) bool {
+		_, ok := b.(*MultiBinStore)
+		return ok
+	}).(*MultiBinStore); ok {
+		return m
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package binstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+var errReplicaDown = errors.New("Replica down")
+
+// downBinStore fails every operation while down is set.
+type downBinStore struct {
+	BinStore
+	down bool
+}
+
+func (s *downBinStore) Add(ctx context.Context, v *models.Version, reader io.Reader) error {
+	if s.down {
+		return errReplicaDown
+	}
+	return s.BinStore.Add(ctx, v, reader)
+}
+
+func (s *downBinStore) Get(ctx context.Context, v *models.Version) (io.Reader, error) {
+	if s.down {
+		return nil, errReplicaDown
+	}
+	return s.BinStore.Get(ctx, v)
+}
+
+func (s *downBinStore) Delete(ctx context.Context, v *models.Version) error {
+	if s.down {
+		return errReplicaDown
+	}
+	return s.BinStore.Delete(ctx, v)
+}
+
+func (s *downBinStore) List(ctx context.Context) ([]string, error) {
+	if s.down {
+		return nil, errReplicaDown
+	}
+	return s.BinStore.List(ctx)
+}
+
+func newMulti(t *testing.T, quorum int) (*MultiBinStore, []*downBinStore) {
+	replicas := []*downBinStore{
+		{BinStore: NewMemoryBinStore()},
+		{BinStore: NewMemoryBinStore()},
+		{BinStore: NewMemoryBinStore()},
+	}
+
+	s, err := NewMultiBinStore([]BinStore{replicas[0], replicas[1], replicas[2]}, quorum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, replicas
+}
+
+func expectMulti(t *testing.T, bin BinStore, v *models.Version, expected string) {
+	ctx := context.Background()
+
+	reader, err := bin.Get(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	if string(data) != expected {
+		t.Fatal("Expected", expected, "got", string(data))
+	}
+}
+
+func TestMultiQuorum(t *testing.T) {
+	ctx := context.Background()
+
+	s, replicas := newMulti(t, 2)
+	v := models.NewVersion(models.NewImport("example.com/pkg"), "1.0.0", models.ArchTarGz)
+
+	replicas[0].down = true
+	if err := s.Add(ctx, v, bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal("Expected quorum of 2 to be met, got", err)
+	}
+
+	// Read from the healthy replicas while the first is down.
+	expectMulti(t, s, v, "archive")
+
+	replicas[1].down = true
+	other := models.NewVersion(models.NewImport("example.com/pkg"), "1.1.0", models.ArchTarGz)
+	if err := s.Add(ctx, other, bytes.NewReader([]byte("archive"))); err != errReplicaDown {
+		t.Fatal("Expected quorum of 2 not to be met, got", err)
+	}
+	if _, err := replicas[2].Get(ctx, other); err != util.ErrNotFound {
+		t.Fatal("Expected the write that succeeded to be undone, got", err)
+	}
+
+	if err := s.Delete(ctx, v); err != errReplicaDown {
+		t.Fatal("Expected delete to fail while a replica is down, got", err)
+	}
+}
+
+func TestMultiRepair(t *testing.T) {
+	ctx := context.Background()
+
+	s, replicas := newMulti(t, 1)
+	v := models.NewVersion(models.NewImport("example.com/pkg"), "1.0.0", models.ArchTarGz)
+
+	replicas[0].down = true
+	replicas[1].down = true
+	if err := s.Add(ctx, v, bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+
+	replicas[0].down = false
+	if _, err := s.Repair(ctx); err != errReplicaDown {
+		t.Fatal("Expected repair to fail while a replica cannot be listed, got", err)
+	}
+
+	replicas[1].down = false
+	report, err := s.Repair(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 2 || len(report.Failed) != 0 {
+		t.Fatal("Expected 2 copies, got", report)
+	}
+
+	for _, r := range replicas {
+		expectMulti(t, r, v, "archive")
+	}
+}
+
+func TestMultiFromPath(t *testing.T) {
+	bin, err := Resolve("cached://multi://memory://|memory://?quorum=1&dir=" + t.TempDir() + "&size=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	multi := FindMulti(bin)
+	if multi == nil || len(multi.replicas) != 2 || multi.quorum != 1 {
+		t.Fatal("Expected 2 replicas with a quorum of 1, got", multi)
+	}
+
+	if _, err := Resolve("multi://memory://|memory://?quorum=3"); err == nil {
+		t.Fatal("Expected an error for a quorum larger than the number of replicas")
+	}
+}
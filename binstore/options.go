@@ -0,0 +1,72 @@
+package binstore
+
+import (
+	"io"
+	"net/url"
+	"strings"
+)
+
+// wrapperOptions splits the connection string of a wrapping backend into the
+// connection string of the wrapped backend and the options that belong to the
+// wrapper. Options are given as a query string at the end of the connection string,
+// any options not listed in keys are passed on to the wrapped backend.
+func wrapperOptions(path, prefix string, keys ...string) (string, url.Values, error) {
+	rest := strings.TrimPrefix(path, prefix+"://")
+	opts := url.Values{}
+
+	i := strings.LastIndex(rest, "?")
+	if i < 0 {
+		return rest, opts, nil
+	}
+
+	query, err := url.ParseQuery(rest[i+1:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, key := range keys {
+		if v, ok := query[key]; ok {
+			opts[key] = v
+			delete(query, key)
+		}
+	}
+
+	inner := rest[:i]
+	if len(query) > 0 {
+		inner += "?" + query.Encode()
+	}
+
+	return inner, opts, nil
+}
+
+// closeBinStore closes a BinStore if it holds resources that can be closed.
+func closeBinStore(bin BinStore) error {
+	if c, ok := bin.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// closeReader closes a reader returned by a BinStore if it can be closed.
+func closeReader(r io.Reader) error {
+	if c, ok := r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// find returns the first of bin and the BinStores it wraps for which match returns true, or nil.
+func find(bin BinStore, match func(BinStore) bool) BinStore {
+	for bin != nil {
+		if match(bin) {
+			return bin
+		}
+
+		w, ok := bin.(interface{ Unwrap() BinStore })
+		if !ok {
+			return nil
+		}
+		bin = w.Unwrap()
+	}
+	return nil
+}
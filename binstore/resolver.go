@@ -15,6 +15,16 @@ func Resolve(path string) (BinStore, error) {
 	switch parts[0] {
 	case "boltdb":
 		return NewBoltBinStore(path)
+	case "memory":
+		return NewMemoryBinStore(), nil
+	case "encrypted":
+		return newEncryptedBinStoreFromPath(path)
+	case "compressed":
+		return newCompressedBinStoreFromPath(path)
+	case "cached":
+		return newCachedBinStoreFromPath(path)
+	case "multi":
+		return newMultiBinStoreFromPath(path)
 	default:
 		return nil, errors.New("Unknown backend: " + parts[0])
 	}
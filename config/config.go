@@ -2,23 +2,57 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/deejross/dep-registry/util"
 )
 
 const envPrefix = "GOREG_"
 
+// MinRecoverAfter is the shortest RecoverAfter allowed, shorter ones would roll back uploads still in progress
+// on other registry instances sharing the stores.
+const MinRecoverAfter = time.Minute
+
+// DefaultSigningKeyFile holds the key tokens are signed with when no key is configured, it is generated if missing.
+const DefaultSigningKeyFile = "signing-key.pem"
+
 // Config object.
 type Config struct {
 	AuthPath      string        `json:"auth_path,omitempty"`
 	BinStorePath  string        `json:"binstore_path,omitempty"`
 	MetaStorePath string        `json:"metastore_path,omitempty"`
 	SigningKey    string        `json:"signing_key,omitempty"`
+	SigningKeys   []string      `json:"signing_keys,omitempty"`
 	TokenTTL      time.Duration `json:"token_ttl,omitempty"`
+	RefreshTTL    time.Duration `json:"refresh_ttl,omitempty"`
 	Port          string        `json:"port,omitempty"`
+	RecoverAfter  time.Duration `json:"recover_after,omitempty"`
+	ReadOnly      bool          `json:"read_only,omitempty"`
+	CacheSize     int           `json:"cache_size,omitempty"`
+	CacheTTL      time.Duration `json:"cache_ttl,omitempty"`
+	RepairEvery   time.Duration `json:"repair_every,omitempty"`
+	ReadTimeout   time.Duration `json:"read_timeout,omitempty"`
+	WriteTimeout  time.Duration `json:"write_timeout,omitempty"`
+	AdminTimeout  time.Duration `json:"admin_timeout,omitempty"`
+
+	LoginMaxFailures   int           `json:"login_max_failures,omitempty"`
+	LoginIPMaxFailures int           `json:"login_ip_max_failures,omitempty"`
+	LoginDelay         time.Duration `json:"login_delay,omitempty"`
+	LoginLockout       time.Duration `json:"login_lockout,omitempty"`
+	RequireAdmin2FA    bool          `json:"require_admin_2fa,omitempty"`
+	TOTPIssuer         string        `json:"totp_issuer,omitempty"`
+
+	OIDCIssuer        string `json:"oidc_issuer,omitempty"`
+	OIDCClientID      string `json:"oidc_client_id,omitempty"`
+	OIDCClientSecret  string `json:"oidc_client_secret,omitempty"`
+	OIDCRedirectURL   string `json:"oidc_redirect_url,omitempty"`
+	OIDCScopes        string `json:"oidc_scopes,omitempty"`
+	OIDCUsernameClaim string `json:"oidc_username_claim,omitempty"`
+	OIDCGroupsClaim   string `json:"oidc_groups_claim,omitempty"`
+	OIDCAdminGroup    string `json:"oidc_admin_group,omitempty"`
 }
 
 // FromFile gets a Config object from a file.
@@ -57,12 +91,84 @@ func FromEnvironment(c *Config) *Config {
 	if v := os.Getenv(envPrefix + "SIGNING_KEY"); len(v) > 0 {
 		c.SigningKey = v
 	}
+	if v := os.Getenv(envPrefix + "SIGNING_KEYS"); len(v) > 0 {
+		c.SigningKeys = strings.Split(v, ",")
+	}
 	if v := os.Getenv(envPrefix + "TOKEN_TTL"); len(v) > 0 {
 		c.TokenTTL, _ = time.ParseDuration(v)
 	}
+	if v := os.Getenv(envPrefix + "REFRESH_TTL"); len(v) > 0 {
+		c.RefreshTTL, _ = time.ParseDuration(v)
+	}
 	if v := os.Getenv(envPrefix + "PORT"); len(v) > 0 {
 		c.Port = v
 	}
+	if v := os.Getenv(envPrefix + "RECOVER_AFTER"); len(v) > 0 {
+		c.RecoverAfter, _ = time.ParseDuration(v)
+	}
+	if v := os.Getenv(envPrefix + "READ_ONLY"); len(v) > 0 {
+		c.ReadOnly, _ = strconv.ParseBool(v)
+	}
+	if v := os.Getenv(envPrefix + "CACHE_SIZE"); len(v) > 0 {
+		c.CacheSize, _ = strconv.Atoi(v)
+	}
+	if v := os.Getenv(envPrefix + "CACHE_TTL"); len(v) > 0 {
+		c.CacheTTL, _ = time.ParseDuration(v)
+	}
+	if v := os.Getenv(envPrefix + "REPAIR_EVERY"); len(v) > 0 {
+		c.RepairEvery, _ = time.ParseDuration(v)
+	}
+	if v := os.Getenv(envPrefix + "READ_TIMEOUT"); len(v) > 0 {
+		c.ReadTimeout, _ = time.ParseDuration(v)
+	}
+	if v := os.Getenv(envPrefix + "WRITE_TIMEOUT"); len(v) > 0 {
+		c.WriteTimeout, _ = time.ParseDuration(v)
+	}
+	if v := os.Getenv(envPrefix + "ADMIN_TIMEOUT"); len(v) > 0 {
+		c.AdminTimeout, _ = time.ParseDuration(v)
+	}
+	if v := os.Getenv(envPrefix + "LOGIN_MAX_FAILURES"); len(v) > 0 {
+		c.LoginMaxFailures, _ = strconv.Atoi(v)
+	}
+	if v := os.Getenv(envPrefix + "LOGIN_IP_MAX_FAILURES"); len(v) > 0 {
+		c.LoginIPMaxFailures, _ = strconv.Atoi(v)
+	}
+	if v := os.Getenv(envPrefix + "LOGIN_DELAY"); len(v) > 0 {
+		c.LoginDelay, _ = time.ParseDuration(v)
+	}
+	if v := os.Getenv(envPrefix + "LOGIN_LOCKOUT"); len(v) > 0 {
+		c.LoginLockout, _ = time.ParseDuration(v)
+	}
+	if v := os.Getenv(envPrefix + "REQUIRE_ADMIN_2FA"); len(v) > 0 {
+		c.RequireAdmin2FA, _ = strconv.ParseBool(v)
+	}
+	if v := os.Getenv(envPrefix + "TOTP_ISSUER"); len(v) > 0 {
+		c.TOTPIssuer = v
+	}
+	if v := os.Getenv(envPrefix + "OIDC_ISSUER"); len(v) > 0 {
+		c.OIDCIssuer = v
+	}
+	if v := os.Getenv(envPrefix + "OIDC_CLIENT_ID"); len(v) > 0 {
+		c.OIDCClientID = v
+	}
+	if v := os.Getenv(envPrefix + "OIDC_CLIENT_SECRET"); len(v) > 0 {
+		c.OIDCClientSecret = v
+	}
+	if v := os.Getenv(envPrefix + "OIDC_REDIRECT_URL"); len(v) > 0 {
+		c.OIDCRedirectURL = v
+	}
+	if v := os.Getenv(envPrefix + "OIDC_SCOPES"); len(v) > 0 {
+		c.OIDCScopes = v
+	}
+	if v := os.Getenv(envPrefix + "OIDC_USERNAME_CLAIM"); len(v) > 0 {
+		c.OIDCUsernameClaim = v
+	}
+	if v := os.Getenv(envPrefix + "OIDC_GROUPS_CLAIM"); len(v) > 0 {
+		c.OIDCGroupsClaim = v
+	}
+	if v := os.Getenv(envPrefix + "OIDC_ADMIN_GROUP"); len(v) > 0 {
+		c.OIDCAdminGroup = v
+	}
 
 	return c
 }
@@ -78,16 +184,48 @@ func (c *Config) Validate() error {
 	if len(c.MetaStorePath) == 0 {
 		c.MetaStorePath = "boltdb://metastore.bolt"
 	}
-	if len(c.SigningKey) == 0 {
-		log.Println("WARNING: No signing key specified, generating a temporary key")
-		c.SigningKey = util.UUID4()
+	if len(c.SigningKey) == 0 && len(c.SigningKeys) == 0 {
+		log.Println("WARNING: No signing key specified, using", DefaultSigningKeyFile)
+		c.SigningKeys = []string{DefaultSigningKeyFile}
 	}
 	if c.TokenTTL < time.Minute {
-		log.Println("WARNING: TokenTTL cannot be less than a minute, setting to 24h")
+		log.Println("WARNING: TokenTTL cannot be less than a minute, setting to 15m")
+		c.TokenTTL = 15 * time.Minute
+	}
+	if c.RefreshTTL == 0 {
+		c.RefreshTTL = 7 * 24 * time.Hour
+	}
+	if c.RefreshTTL < c.TokenTTL {
+		log.Println("WARNING: RefreshTTL cannot be less than TokenTTL, setting to", c.TokenTTL)
+		c.RefreshTTL = c.TokenTTL
 	}
 	if len(c.Port) == 0 {
 		c.Port = "8080"
 	}
+	if c.RecoverAfter == 0 {
+		c.RecoverAfter = time.Hour
+	}
+	if c.RecoverAfter < MinRecoverAfter {
+		return errors.New("RecoverAfter cannot be less than " + MinRecoverAfter.String())
+	}
+	if c.CacheSize > 0 && c.CacheTTL <= 0 {
+		c.CacheTTL = time.Minute
+	}
+	if c.LoginMaxFailures == 0 {
+		c.LoginMaxFailures = 10
+	}
+	if c.LoginIPMaxFailures == 0 {
+		c.LoginIPMaxFailures = 100
+	}
+	if c.LoginDelay == 0 {
+		c.LoginDelay = time.Second
+	}
+	if c.LoginLockout <= 0 {
+		c.LoginLockout = 15 * time.Minute
+	}
+	if len(c.TOTPIssuer) == 0 {
+		c.TOTPIssuer = "dep-registry"
+	}
 
 	return nil
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/deejross/dep-registry/storemanager"
+)
+
+// fsck checks the stores for inconsistencies: fsck [-verify] [-repair] [config file].
+// Exits with status 1 if inconsistencies were found and not repaired.
+func fsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	verify := flags.Bool("verify", false, "verify the digest of every binary")
+	repair := flags.Bool("repair", false, "delete orphaned binaries and disable broken versions")
+	flags.Parse(args)
+
+	cfg := loadConfig(flags.Args())
+	sm := openStoreManager(cfg)
+
+	ctx, stop := commandContext()
+	defer stop()
+
+	report, err := sm.Check(ctx, storemanager.CheckOptions{
+		Verify: *verify,
+		Repair: *repair,
+	})
+	if err != nil {
+		log.Fatalln("While checking stores:", err)
+	}
+
+	for _, id := range report.Orphans {
+		fmt.Println("orphaned binary:", id)
+	}
+	for _, v := range report.Dangling {
+		fmt.Println("missing binary:", v.ImportURL, v.Name, v.BinID)
+	}
+	for _, v := range report.Corrupt {
+		fmt.Println("corrupt binary:", v.ImportURL, v.Name, v.BinID)
+	}
+
+	problems := len(report.Orphans) + len(report.Dangling) + len(report.Corrupt)
+	fmt.Println("checked", report.Checked, "versions, found", problems, "problems")
+
+	if report.Repaired {
+		fmt.Println("repaired: orphaned binaries deleted, broken versions disabled")
+	} else if problems > 0 {
+		os.Exit(1)
+	}
+}
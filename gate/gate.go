@@ -1,117 +1,788 @@
 package gate
 
 import (
+	"context"
 	"errors"
 	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/backup"
+	"github.com/deejross/dep-registry/binstore"
+	"github.com/deejross/dep-registry/migrate"
 	"github.com/deejross/dep-registry/models"
 	"github.com/deejross/dep-registry/storemanager"
+	"github.com/deejross/dep-registry/util"
 )
 
-// ErrNotAuthorized indicates the user does not have permission to perform the requested action.
-var ErrNotAuthorized = errors.New("Not authorized")
+var (
+	// ErrNotAuthorized indicates the user does not have permission to perform the requested action.
+	ErrNotAuthorized = errors.New("Not authorized")
+
+	// ErrReadOnly indicates the registry is in read-only mode and cannot be changed.
+	ErrReadOnly = errors.New("Registry is read-only")
+)
 
 // Gate validates and enforces the proper logic when interacting with the stores.
 type Gate struct {
 	a  auth.Auth
 	sm *storemanager.StoreManager
 	tm *auth.TokenManager
+
+	// readOnly is 1 while writes are refused, accessed atomically.
+	readOnly int32
+
+	// lockout throttles failed password logins, logins holds the usernames being logged in.
+	lockout auth.LockoutPolicy
+	logins  sync.Map
+
+	// totpIssuer names the registry in authenticator apps, requireAdminTOTP refuses admins without two-factor authentication.
+	totpIssuer       string
+	requireAdminTOTP bool
 }
 
 // NewGate returns a new Gate object.
 func NewGate(a auth.Auth, sm *storemanager.StoreManager, tm *auth.TokenManager) *Gate {
 	return &Gate{
-		a:  a,
-		sm: sm,
-		tm: tm,
+		a:          a,
+		sm:         sm,
+		tm:         tm,
+		lockout:    auth.DefaultLockoutPolicy,
+		totpIssuer: DefaultTOTPIssuer,
 	}
 }
 
-// Login generates a token on successful login.
-func (g *Gate) Login(username, password string) (string, error) {
-	return g.a.Login(username, password)
+// ReadOnly reports whether the registry is in read-only mode.
+func (g *Gate) ReadOnly() bool {
+	return atomic.LoadInt32(&g.readOnly) == 1
 }
 
-// ParseToken parses the auth token and returns the associated User object if valid.
-func (g *Gate) ParseToken(token string) (*auth.User, error) {
-	if len(token) == 0 {
-		return nil, nil
+// SetReadOnly puts the registry in or out of read-only mode, where every change is refused with ErrReadOnly.
+func (g *Gate) SetReadOnly(readOnly bool) {
+	val := int32(0)
+	if readOnly {
+		val = 1
+	}
+	atomic.StoreInt32(&g.readOnly, val)
+}
+
+// ChangeReadOnly puts the registry in or out of read-only mode on behalf of an admin user.
+func (g *Gate) ChangeReadOnly(ctx context.Context, token string, readOnly bool) error {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
 	}
 
-	username, err := g.tm.Validate(token)
+	g.SetReadOnly(readOnly)
+	return nil
+}
+
+// requireWritable returns ErrReadOnly if the registry is in read-only mode.
+func (g *Gate) requireWritable() error {
+	if g.ReadOnly() {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Login generates an access token and a refresh token on successful login. Users with two-factor authentication
+// enabled must also give a code from their authenticator app or a recovery code as otp. Failed logins for
+// the user and from the IP address of the client are throttled by the LockoutPolicy.
+func (g *Gate) Login(ctx context.Context, username, password, otp, ip string) (*auth.Tokens, error) {
+	keys := g.attemptKeys(username, ip)
+	if len(keys) > 0 {
+		// Only one password is tried for a user at a time, so parallel guesses cannot slip in before a failure is recorded.
+		key := auth.UserAttemptsKey(username)
+		if _, busy := g.logins.LoadOrStore(key, true); busy {
+			return nil, auth.ErrTooManyAttempts
+		}
+		defer g.logins.Delete(key)
+
+		if err := g.checkAttempts(ctx, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	token, err := g.a.Login(ctx, username, password)
+	if err == auth.ErrInvalidCredentials {
+		g.loginFailed(ctx, keys)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The backend may have normalized the username, use the one it gave the token.
+	subject, err := g.tm.Validate(token)
 	if err != nil {
 		return nil, err
 	}
 
-	return g.a.GetUser(username)
+	return g.issueTokens(ctx, keys, username, subject, otp)
+}
+
+// issueTokens generates tokens for the user subject once their credentials have been checked, if they give
+// their two-factor authentication code as otp. keys are the LoginAttempts keys of the login attempted as username.
+func (g *Gate) issueTokens(ctx context.Context, keys map[string]auth.LockoutPolicy, username, subject, otp string) (*auth.Tokens, error) {
+	err := g.checkTOTP(ctx, subject, otp)
+	if err == auth.ErrInvalidTOTP {
+		g.loginFailed(ctx, keys)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) > 0 {
+		g.loginSucceeded(ctx, username)
+	}
+
+	return g.tm.GenerateTokens(subject)
+}
+
+// Refresh exchanges a refresh token for new tokens. The refresh token is revoked unless the registry is
+// read-only or the Auth cannot store revocations, in which case it stays valid until it expires.
+func (g *Gate) Refresh(ctx context.Context, refreshToken string) (*auth.Tokens, error) {
+	claims, err := g.tm.Parse(refreshToken, true)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := g.sessionUser(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := g.tm.GenerateTokens(user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if !g.ReadOnly() {
+		if err := g.revoke(ctx, claims); err != nil && err != auth.ErrNotSupported {
+			return nil, err
+		}
+	}
+
+	return tokens, nil
 }
 
-// CanUser determines if a user can perform an action, returns nil if successful.
-func (g *Gate) CanUser(user *auth.User, m *models.Import, write, admin bool) error {
-	if user.Disabled {
+// Logout revokes a login token and the refresh token issued with it. Either may be empty, and a login
+// token that is no longer valid is ignored if a refresh token is given, so a session can still be ended
+// after its login token has expired. If the Auth cannot store revocations, the tokens stay valid until they expire.
+func (g *Gate) Logout(ctx context.Context, token, refreshToken string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	var claims, refreshClaims *auth.Claims
+	var err error
+	if len(refreshToken) > 0 {
+		refreshClaims, err = g.tm.Parse(refreshToken, true)
+		if err != nil {
+			return err
+		}
+	}
+	if len(token) > 0 {
+		claims, err = g.tm.Parse(token, false)
+		if err != nil && refreshClaims == nil {
+			return err
+		}
+	}
+	if claims == nil && refreshClaims == nil {
 		return ErrNotAuthorized
 	}
+	if claims != nil && refreshClaims != nil && refreshClaims.Subject != claims.Subject {
+		return ErrNotAuthorized
+	}
+
+	for _, c := range []*auth.Claims{claims, refreshClaims} {
+		if c == nil {
+			continue
+		}
+		if _, err := g.sessionUser(ctx, c); err != nil {
+			return err
+		}
+	}
+	for _, c := range []*auth.Claims{claims, refreshClaims} {
+		if c == nil {
+			continue
+		}
+		if err := g.revoke(ctx, c); err != nil && err != auth.ErrNotSupported {
+			return err
+		}
+	}
+	return nil
+}
 
+// RevokeSessions revokes every login and refresh token issued to a user so far on behalf of an admin user.
+// Personal access tokens are not affected, they are revoked one by one.
+func (g *Gate) RevokeSessions(ctx context.Context, token, username string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+
+	user, err := g.a.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
 	if user == nil {
-		if write || m.Private {
-			return ErrNotAuthorized
+		return auth.ErrUserDoesNotExist
+	}
+
+	user.SessionsRevokedAt = time.Now().Unix()
+	return g.a.UpdateUser(ctx, user)
+}
+
+// revoke adds the token with the given claims to the revocation list until it expires.
+func (g *Gate) revoke(ctx context.Context, claims *auth.Claims) error {
+	return g.a.RevokeToken(ctx, &auth.RevokedToken{
+		ID:        claims.Id,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+}
+
+// sessionUser returns the enabled user a login or refresh token was issued to, unless the token
+// has been revoked, either by itself or along with every session of the user.
+func (g *Gate) sessionUser(ctx context.Context, claims *auth.Claims) (*auth.User, error) {
+	revoked, err := g.a.TokenRevoked(ctx, claims.Id)
+	if err != nil && err != auth.ErrNotSupported {
+		return nil, err
+	}
+	if revoked {
+		return nil, auth.ErrTokenRevoked
+	}
+
+	user, err := g.a.GetUser(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Disabled {
+		return nil, ErrNotAuthorized
+	}
+	if claims.IssuedAt <= user.SessionsRevokedAt {
+		return nil, auth.ErrTokenRevoked
+	}
+
+	return user, nil
+}
+
+// JWKS returns the public keys that verify login tokens.
+func (g *Gate) JWKS() *auth.JWKS {
+	return g.tm.JWKS()
+}
+
+// ParseToken parses the auth token or personal access token and returns the associated User object if valid.
+func (g *Gate) ParseToken(ctx context.Context, token string) (*auth.User, error) {
+	user, _, err := g.parseToken(ctx, token)
+	return user, err
+}
+
+// parseToken parses the auth token or personal access token and returns the associated User object
+// if valid, along with the AccessToken if it is a personal access token.
+func (g *Gate) parseToken(ctx context.Context, token string) (*auth.User, *auth.AccessToken, error) {
+	if len(token) == 0 {
+		return nil, nil, nil
+	}
+
+	id, ok := auth.AccessTokenID(token)
+	if !ok {
+		claims, err := g.tm.Parse(token, false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		user, err := g.sessionUser(ctx, claims)
+		return user, nil, err
+	}
+
+	pat, err := g.a.GetAccessToken(ctx, id)
+	if err == auth.ErrAccessTokenDoesNotExist {
+		return nil, nil, auth.ErrAccessTokenInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pat.Check(token); err != nil {
+		return nil, nil, err
+	}
+
+	user, err := g.a.GetUser(ctx, pat.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	g.touchAccessToken(ctx, pat)
+	return user, pat, nil
+}
+
+// touchAccessToken records that a personal access token was used, at most once a minute to limit writes.
+func (g *Gate) touchAccessToken(ctx context.Context, pat *auth.AccessToken) {
+	if g.ReadOnly() || time.Since(pat.LastUsed) < time.Minute {
+		return
+	}
+
+	pat.LastUsed = time.Now().UTC()
+	if err := g.a.UpdateAccessToken(ctx, pat); err != nil && err != auth.ErrAccessTokenDoesNotExist {
+		log.Println("While recording use of access token", pat.ID+":", err)
+	}
+}
+
+// requireAdmin returns nil if the token belongs to an enabled admin user. A personal access token
+// must have the admin scope and no prefix.
+func (g *Gate) requireAdmin(ctx context.Context, token string) error {
+	user, pat, err := g.parseToken(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	admin, err := g.isAdmin(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		if user != nil && !user.Disabled && user.Admin {
+			return ErrAdminTOTPRequired
 		}
-	} else if user.Admin {
-		return nil
-	} else if admin && !user.Admin {
 		return ErrNotAuthorized
-	} else if write {
-		for _, name := range m.Owners {
-			if user.Username == name {
-				return nil
-			}
+	}
+	if pat != nil && !pat.Allows(auth.ScopeAdmin, "") {
+		return ErrNotAuthorized
+	}
+
+	return nil
+}
+
+// requireLogin returns the enabled user a login token belongs to, personal access tokens are refused.
+func (g *Gate) requireLogin(ctx context.Context, token string) (*auth.User, error) {
+	user, pat, err := g.parseToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil || user.Disabled || pat != nil {
+		return nil, ErrNotAuthorized
+	}
+
+	return user, nil
+}
+
+// CreateAccessToken creates a personal access token for the user of a login token, returning it along
+// with the token to give to them. Only admins may create tokens with the admin scope.
+func (g *Gate) CreateAccessToken(ctx context.Context, token, name string, scopes []auth.Scope, prefix string, expiresAt time.Time) (*auth.AccessToken, string, error) {
+	if err := g.requireWritable(); err != nil {
+		return nil, "", err
+	}
+
+	user, err := g.requireLogin(ctx, token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	admin, err := g.isAdmin(ctx, user)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, scope := range scopes {
+		if scope == auth.ScopeAdmin && !admin {
+			return nil, "", ErrNotAuthorized
 		}
-	} else if m.Private {
-		for _, name := range m.Owners {
-			if user.Username == name {
-				return nil
-			}
+	}
+
+	pat, secret, err := auth.NewAccessToken(user.Username, name, scopes, prefix, expiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := g.a.AddAccessToken(ctx, pat); err != nil {
+		return nil, "", err
+	}
+
+	return pat, secret, nil
+}
+
+// ListAccessTokens lists the personal access tokens of the user of a login token.
+func (g *Gate) ListAccessTokens(ctx context.Context, token string) ([]*auth.AccessToken, error) {
+	user, err := g.requireLogin(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return g.a.ListAccessTokens(ctx, user.Username)
+}
+
+// RevokeAccessToken deletes a personal access token of the user of a login token, admins may revoke anyone's.
+func (g *Gate) RevokeAccessToken(ctx context.Context, token, id string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	user, err := g.requireLogin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	pat, err := g.a.GetAccessToken(ctx, id)
+	if err != nil {
+		return err
+	}
+	if pat.Username != user.Username {
+		admin, err := g.isAdmin(ctx, user)
+		if err != nil {
+			return err
 		}
-		for _, name := range m.Readers {
-			if user.Username == name {
-				return nil
-			}
+		if !admin {
+			return auth.ErrAccessTokenDoesNotExist
 		}
+	}
+
+	return g.a.DeleteAccessToken(ctx, id)
+}
+
+// GetGrants returns the roles granted on an Import on behalf of one of its owners.
+func (g *Gate) GetGrants(ctx context.Context, token, url string) ([]models.Grant, error) {
+	m, err := g.ownedImport(ctx, token, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Grants == nil {
+		return []models.Grant{}, nil
+	}
+	return m.Grants, nil
+}
+
+// SetGrant gives a user or team a role on an Import on behalf of one of its owners, replacing the role they had.
+func (g *Gate) SetGrant(ctx context.Context, token, url string, grant models.Grant) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := grant.Validate(); err != nil {
+		return err
+	}
+
+	m, err := g.ownedImport(ctx, token, url)
+	if err != nil {
+		return err
+	}
+
+	if len(grant.User) > 0 {
+		_, err = g.a.GetUser(ctx, grant.User)
 	} else {
+		_, err = g.a.GetTeam(ctx, grant.Team)
+	}
+	if err != nil {
+		return err
+	}
+
+	m.SetGrant(grant)
+	return g.sm.UpdateImport(ctx, m)
+}
+
+// RemoveGrant removes the role of a user or team on an Import on behalf of one of its owners.
+func (g *Gate) RemoveGrant(ctx context.Context, token, url string, grant models.Grant) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	m, err := g.ownedImport(ctx, token, url)
+	if err != nil {
+		return err
+	}
+
+	if !m.RemoveGrant(grant) {
 		return nil
 	}
+	return g.sm.UpdateImport(ctx, m)
+}
+
+// ownedImport returns an Import if the token belongs to one of its owners.
+func (g *Gate) ownedImport(ctx context.Context, token, url string) (*models.Import, error) {
+	user, pat, err := g.parseToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := g.sm.Get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := g.canAccess(ctx, user, pat, m, models.RoleOwner); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ListTeams lists all teams on behalf of an admin user.
+func (g *Gate) ListTeams(ctx context.Context, token string) ([]*auth.Team, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+
+	return g.a.ListTeams(ctx)
+}
+
+// GetTeam gets a team on behalf of an admin user.
+func (g *Gate) GetTeam(ctx context.Context, token, name string) (*auth.Team, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+
+	return g.a.GetTeam(ctx, name)
+}
+
+// AddTeam adds a team on behalf of an admin user.
+func (g *Gate) AddTeam(ctx context.Context, token string, team *auth.Team) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+
+	return g.a.AddTeam(ctx, team)
+}
+
+// DeleteTeam deletes a team on behalf of an admin user. Roles granted to it are kept, and apply again
+// if a team with the same name is added.
+func (g *Gate) DeleteTeam(ctx context.Context, token, name string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+
+	return g.a.DeleteTeam(ctx, name)
+}
+
+// AddTeamMember adds a user to a team on behalf of an admin user.
+func (g *Gate) AddTeamMember(ctx context.Context, token, team, username string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+
+	return g.a.AddTeamMember(ctx, team, username)
+}
+
+// RemoveTeamMember removes a user from a team on behalf of an admin user.
+func (g *Gate) RemoveTeamMember(ctx context.Context, token, team, username string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+
+	return g.a.RemoveTeamMember(ctx, team, username)
+}
+
+// ListOrganizations lists all Organizations on behalf of an admin user.
+func (g *Gate) ListOrganizations(ctx context.Context, token string) ([]*models.Organization, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+
+	return g.sm.ListOrganizations(ctx)
+}
+
+// GetOrganization gets an Organization on behalf of an admin user.
+func (g *Gate) GetOrganization(ctx context.Context, token, name string) (*models.Organization, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+
+	return g.sm.GetOrganization(ctx, name)
+}
+
+// AddOrganization adds an Organization on behalf of an admin user.
+func (g *Gate) AddOrganization(ctx context.Context, token string, o *models.Organization) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+	if err := g.checkOrganization(ctx, o); err != nil {
+		return err
+	}
+
+	return g.sm.AddOrganization(ctx, o)
+}
+
+// UpdateOrganization replaces the prefixes, roles and defaults of an Organization on behalf of an admin user.
+// Imports that already exist below its prefixes are not changed.
+func (g *Gate) UpdateOrganization(ctx context.Context, token string, o *models.Organization) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+	if err := g.checkOrganization(ctx, o); err != nil {
+		return err
+	}
+
+	return g.sm.UpdateOrganization(ctx, o)
+}
+
+// DeleteOrganization deletes an Organization on behalf of an admin user, releasing its prefixes.
+func (g *Gate) DeleteOrganization(ctx context.Context, token, name string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+
+	return g.sm.DeleteOrganization(ctx, name)
+}
+
+// ClaimPrefix adds an import path prefix to an Organization on behalf of an admin user.
+func (g *Gate) ClaimPrefix(ctx context.Context, token, name, prefix string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+
+	o, err := g.sm.GetOrganization(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	o.Prefixes = append(o.Prefixes, prefix)
+	if err := g.checkOrganization(ctx, o); err != nil {
+		return err
+	}
+	return g.sm.UpdateOrganization(ctx, o)
+}
+
+// ReleasePrefix removes an import path prefix from an Organization on behalf of an admin user,
+// it is not an error if the Organization did not claim it.
+func (g *Gate) ReleasePrefix(ctx context.Context, token, name, prefix string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+
+	prefix, err := models.NormalizePrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	o, err := g.sm.GetOrganization(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	for i, p := range o.Prefixes {
+		if p == prefix {
+			o.Prefixes = append(o.Prefixes[:i], o.Prefixes[i+1:]...)
+			return g.sm.UpdateOrganization(ctx, o)
+		}
+	}
+	return nil
+}
+
+// checkOrganization validates an Organization, checking the users and teams it grants roles to exist
+// and that no other Organization claims one of its prefixes.
+func (g *Gate) checkOrganization(ctx context.Context, o *models.Organization) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	for _, grant := range o.Grants {
+		var err error
+		if len(grant.User) > 0 {
+			_, err = g.a.GetUser(ctx, grant.User)
+		} else {
+			_, err = g.a.GetTeam(ctx, grant.Team)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	orgs, err := g.sm.ListOrganizations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, other := range orgs {
+		if other.Name == o.Name {
+			continue
+		}
+		// Prefixes nested below those of another Organization may be claimed, the longest claim wins.
+		for _, p := range o.Prefixes {
+			if other.Claim(p) == p {
+				return models.ErrPrefixClaimed
+			}
+		}
+	}
 
-	return ErrNotAuthorized
+	return nil
 }
 
 // Add a new Version.
-func (g *Gate) Add(token string, m *models.Import, v *models.Version, reader io.Reader) error {
-	user, err := g.ParseToken(token)
+func (g *Gate) Add(ctx context.Context, token string, m *models.Import, v *models.Version, reader io.Reader) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return err
 	}
 
-	if err := g.CanUser(user, m, true, false); err != nil {
+	// Publishing to an existing Import is checked against its stored roles, not those given. A new Import
+	// below a prefix claimed by an Organization takes the roles and visibility of the Organization.
+	existing, err := g.sm.Get(ctx, m.ImportURL)
+	if err == nil {
+		m = existing
+	} else if err != util.ErrNotFound {
+		return err
+	} else {
+		orgs, err := g.sm.ListOrganizations(ctx)
+		if err != nil {
+			return err
+		}
+		if org := models.FindOrganization(orgs, m.ImportURL); org != nil {
+			m = org.NewImport(m)
+		}
+	}
+
+	if err := g.canAccess(ctx, user, pat, m, models.RolePublisher); err != nil {
 		return err
 	}
 
-	return g.sm.Add(m, v, reader)
+	return g.sm.Add(ctx, m, v, reader)
 }
 
 // Get an Import.
-func (g *Gate) Get(token, url string) (*models.Import, error) {
-	user, err := g.ParseToken(token)
+func (g *Gate) Get(ctx context.Context, token, url string) (*models.Import, error) {
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return nil, err
 	}
 
-	m, err := g.sm.Get(url)
+	m, err := g.sm.Get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := g.CanUser(user, m, false, false); err != nil {
+	if err := g.canAccess(ctx, user, pat, m, models.RoleReader); err != nil {
 		return nil, err
 	}
 
@@ -119,182 +790,295 @@ func (g *Gate) Get(token, url string) (*models.Import, error) {
 }
 
 // GetVersions gets a list of Versions.
-func (g *Gate) GetVersions(token, url string) ([]*models.Version, error) {
-	user, err := g.ParseToken(token)
+func (g *Gate) GetVersions(ctx context.Context, token, url string) ([]*models.Version, error) {
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return nil, err
 	}
 
-	m, err := g.sm.Get(url)
+	m, err := g.sm.Get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := g.CanUser(user, m, false, false); err != nil {
+	if err := g.canAccess(ctx, user, pat, m, models.RoleReader); err != nil {
 		return nil, err
 	}
 
-	return g.sm.GetVersions(url)
+	return g.sm.GetVersions(ctx, url)
 }
 
 // GetVersion gets a Version.
-func (g *Gate) GetVersion(token, url, versionName string) (*models.Version, error) {
-	user, err := g.ParseToken(token)
+func (g *Gate) GetVersion(ctx context.Context, token, url, versionName string) (*models.Version, error) {
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return nil, err
 	}
 
-	m, err := g.sm.Get(url)
+	m, err := g.sm.Get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := g.CanUser(user, m, false, false); err != nil {
+	if err := g.canAccess(ctx, user, pat, m, models.RoleReader); err != nil {
 		return nil, err
 	}
 
-	return g.sm.GetVersion(url, versionName)
+	return g.sm.GetVersion(ctx, url, versionName)
 }
 
 // GetVersionBinary downloads the binary for the version.
-func (g *Gate) GetVersionBinary(token, url, versionName string) (io.Reader, error) {
-	user, err := g.ParseToken(token)
+func (g *Gate) GetVersionBinary(ctx context.Context, token, url, versionName string) (io.Reader, error) {
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return nil, err
 	}
 
-	m, err := g.sm.Get(url)
+	m, err := g.sm.Get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := g.CanUser(user, m, false, false); err != nil {
+	if err := g.canAccess(ctx, user, pat, m, models.RoleReader); err != nil {
 		return nil, err
 	}
 
-	v, err := g.sm.GetVersion(url, versionName)
+	v, err := g.sm.GetVersion(ctx, url, versionName)
 	if err != nil {
 		return nil, err
 	}
 
-	return g.sm.GetVersionBinary(v)
+	return g.sm.GetVersionBinary(ctx, v)
 }
 
 // DisableImport disables an import and all its versions.
-func (g *Gate) DisableImport(token, url string) error {
-	user, err := g.ParseToken(token)
+func (g *Gate) DisableImport(ctx context.Context, token, url string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return err
 	}
 
-	m, err := g.sm.Get(url)
+	m, err := g.sm.Get(ctx, url)
 	if err != nil {
 		return err
 	}
 
-	if err := g.CanUser(user, m, true, true); err != nil {
+	if err := g.canAccess(ctx, user, pat, m, models.RoleMaintainer); err != nil {
 		return err
 	}
 
-	return g.sm.DisableImport(url)
+	return g.sm.DisableImport(ctx, url)
 }
 
 // DisableVersion disables a version.
-func (g *Gate) DisableVersion(token, url, version string) error {
-	user, err := g.ParseToken(token)
+func (g *Gate) DisableVersion(ctx context.Context, token, url, version string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return err
 	}
 
-	m, err := g.sm.Get(url)
+	m, err := g.sm.Get(ctx, url)
 	if err != nil {
 		return err
 	}
 
-	if err := g.CanUser(user, m, true, true); err != nil {
+	if err := g.canAccess(ctx, user, pat, m, models.RoleMaintainer); err != nil {
 		return err
 	}
 
-	return g.sm.DisableVersion(url, version)
+	return g.sm.DisableVersion(ctx, url, version)
 }
 
 // EnableImport enables an import and all its versions.
-func (g *Gate) EnableImport(token, url string) error {
-	user, err := g.ParseToken(token)
+func (g *Gate) EnableImport(ctx context.Context, token, url string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return err
 	}
 
-	m, err := g.sm.Get(url)
+	m, err := g.sm.Get(ctx, url)
 	if err != nil {
 		return err
 	}
 
-	if err := g.CanUser(user, m, true, true); err != nil {
+	if err := g.canAccess(ctx, user, pat, m, models.RoleMaintainer); err != nil {
 		return err
 	}
 
-	return g.sm.EnableImport(url)
+	return g.sm.EnableImport(ctx, url)
 }
 
 // EnableVersion enables a version.
-func (g *Gate) EnableVersion(token, url, version string) error {
-	user, err := g.ParseToken(token)
+func (g *Gate) EnableVersion(ctx context.Context, token, url, version string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return err
 	}
 
-	m, err := g.sm.Get(url)
+	m, err := g.sm.Get(ctx, url)
 	if err != nil {
 		return err
 	}
 
-	if err := g.CanUser(user, m, true, true); err != nil {
+	if err := g.canAccess(ctx, user, pat, m, models.RoleMaintainer); err != nil {
 		return err
 	}
 
-	return g.sm.EnableVersion(url, version)
+	return g.sm.EnableVersion(ctx, url, version)
 }
 
 // DeleteImport deletes an import and all its versions.
-func (g *Gate) DeleteImport(token, url string) error {
-	user, err := g.ParseToken(token)
+func (g *Gate) DeleteImport(ctx context.Context, token, url string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return err
 	}
 
-	m, err := g.sm.Get(url)
+	m, err := g.sm.Get(ctx, url)
 	if err != nil {
 		return err
 	}
 
-	if err := g.CanUser(user, m, true, true); err != nil {
+	if err := g.canAccess(ctx, user, pat, m, models.RoleOwner); err != nil {
 		return err
 	}
 
-	return g.sm.DeleteImport(url)
+	return g.sm.DeleteImport(ctx, url)
 }
 
 // DeleteVersion deletes a version.
-func (g *Gate) DeleteVersion(token, url, versionName string) error {
-	user, err := g.ParseToken(token)
+func (g *Gate) DeleteVersion(ctx context.Context, token, url, versionName string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	user, pat, err := g.parseToken(ctx, token)
 	if err != nil {
 		return err
 	}
 
-	m, err := g.sm.Get(url)
+	m, err := g.sm.Get(ctx, url)
 	if err != nil {
 		return err
 	}
 
-	if err := g.CanUser(user, m, true, true); err != nil {
+	if err := g.canAccess(ctx, user, pat, m, models.RoleMaintainer); err != nil {
 		return err
 	}
 
-	v, err := g.sm.GetVersion(url, versionName)
+	v, err := g.sm.GetVersion(ctx, url, versionName)
+	if err != nil {
+		return err
+	}
+
+	return g.sm.DeleteVersion(ctx, m, v)
+}
+
+// Check the stores for inconsistencies, repairing them if requested.
+func (g *Gate) Check(ctx context.Context, token string, opts storemanager.CheckOptions) (*storemanager.CheckReport, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+	if opts.Repair {
+		if err := g.requireWritable(); err != nil {
+			return nil, err
+		}
+	}
+
+	return g.sm.Check(ctx, opts)
+}
+
+// Backup writes a backup archive of the registry to w.
+func (g *Gate) Backup(ctx context.Context, token string, w io.Writer) (*backup.Report, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+
+	return backup.Write(ctx, w, g.a, g.sm)
+}
+
+// Migrate copies the registry into the backends given by the non-empty connection strings.
+func (g *Gate) Migrate(ctx context.Context, token, authPath, metaPath, binPath string, opts migrate.Options) (*migrate.Report, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+
+	dst, err := migrate.Resolve(authPath, metaPath, binPath, g.tm)
 	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+
+	src := &migrate.Registry{
+		Auth: g.a,
+		Meta: g.sm.MetaStore(),
+		Bin:  g.sm.BinStore(),
+	}
+	return migrate.Run(ctx, src, dst, opts)
+}
+
+// CacheStats returns the counters of the binary cache.
+func (g *Gate) CacheStats(ctx context.Context, token string) (*binstore.CacheStats, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+
+	cache := binstore.FindCache(g.sm.BinStore())
+	if cache == nil {
+		return nil, binstore.ErrNoCache
+	}
+
+	stats := cache.CacheStats()
+	return &stats, nil
+}
+
+// PurgeCache removes the given BinIDs from the binary cache, or every entry if none are given.
+func (g *Gate) PurgeCache(ctx context.Context, token string, ids ...string) error {
+	if err := g.requireAdmin(ctx, token); err != nil {
 		return err
 	}
 
-	return g.sm.DeleteVersion(m, v)
+	cache := binstore.FindCache(g.sm.BinStore())
+	if cache == nil {
+		return binstore.ErrNoCache
+	}
+
+	return cache.Purge(ids...)
+}
+
+// Repair copies binaries to the replicas of the BinStore that are missing them.
+func (g *Gate) Repair(ctx context.Context, token string) (*binstore.RepairReport, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+	if err := g.requireWritable(); err != nil {
+		return nil, err
+	}
+
+	multi := binstore.FindMulti(g.sm.BinStore())
+	if multi == nil {
+		return nil, binstore.ErrNoReplicas
+	}
+
+	return multi.Repair(ctx)
 }
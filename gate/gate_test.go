@@ -0,0 +1,825 @@
+package gate
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/binstore"
+	"github.com/deejross/dep-registry/metastore"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/storemanager"
+)
+
+var tm = auth.NewTokenManager([]byte("super-secret-key"), time.Minute)
+var a = auth.NewMemoryAuth(tm)
+var g = NewGate(a, storemanager.NewStoreManager(binstore.NewMemoryBinStore(), metastore.NewMemoryMetaStore()), tm)
+var ownerToken, otherToken string
+
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+
+	for _, name := range []string{"owner", "other"} {
+		if err := a.AddUser(ctx, &auth.User{Username: name}); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.SetPassword(ctx, name, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ownerToken = login(t, "owner").Token
+	otherToken = login(t, "other").Token
+}
+
+func login(t *testing.T, username string) *auth.Tokens {
+	tokens, err := g.Login(context.Background(), username, "password", "", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestAdd(t *testing.T) {
+	ctx := context.Background()
+
+	m := models.NewImport("example.com/pkg")
+	m.Owners = []string{"owner"}
+	v := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+
+	if err := g.Add(ctx, otherToken, m, v, bytes.NewReader([]byte("archive"))); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+
+	if err := g.Add(ctx, ownerToken, m, v, bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetVersionBinary(t *testing.T) {
+	ctx := context.Background()
+
+	reader, err := g.GetVersionBinary(ctx, otherToken, "example.com/pkg", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadAll(reader)
+	if string(data) != "archive" {
+		t.Fatal("Expected 'archive', got", string(data))
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	if err := g.ChangeReadOnly(ctx, ownerToken, true); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+
+	g.SetReadOnly(true)
+	defer g.SetReadOnly(false)
+
+	m := models.NewImport("example.com/pkg")
+	v := models.NewVersion(m, "1.1.0", models.ArchTarGz)
+	if err := g.Add(ctx, ownerToken, m, v, bytes.NewReader([]byte("archive"))); err != ErrReadOnly {
+		t.Fatal("Expected ErrReadOnly, got", err)
+	}
+	if err := g.DeleteVersion(ctx, ownerToken, "example.com/pkg", "1.0.0"); err != ErrReadOnly {
+		t.Fatal("Expected ErrReadOnly, got", err)
+	}
+
+	if _, err := g.GetVersionBinary(ctx, otherToken, "example.com/pkg", "1.0.0"); err != nil {
+		t.Fatal("Expected reads to succeed in read-only mode, got", err)
+	}
+}
+
+func TestAccessTokens(t *testing.T) {
+	ctx := context.Background()
+
+	_, publish, err := g.CreateAccessToken(ctx, ownerToken, "ci", []auth.Scope{auth.ScopePublish}, "example.com/team", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, read, err := g.CreateAccessToken(ctx, ownerToken, "mirror", []auth.Scope{auth.ScopeRead}, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := g.CreateAccessToken(ctx, ownerToken, "root", []auth.Scope{auth.ScopeAdmin}, "", time.Time{}); err != ErrNotAuthorized {
+		t.Fatal("Expected only admins to create admin tokens, got", err)
+	}
+	if _, _, err := g.CreateAccessToken(ctx, publish, "copy", []auth.Scope{auth.ScopePublish}, "", time.Time{}); err != ErrNotAuthorized {
+		t.Fatal("Expected access tokens not to create other tokens, got", err)
+	}
+
+	m := models.NewImport("example.com/team/pkg")
+	m.Owners = []string{"owner"}
+	if err := g.Add(ctx, publish, m, models.NewVersion(m, "1.0.0", models.ArchTarGz), bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add(ctx, read, m, models.NewVersion(m, "1.1.0", models.ArchTarGz), bytes.NewReader([]byte("archive"))); err != ErrNotAuthorized {
+		t.Fatal("Expected a read token not to publish, got", err)
+	}
+
+	outside := models.NewImport("example.com/other")
+	outside.Owners = []string{"owner"}
+	if err := g.Add(ctx, publish, outside, models.NewVersion(outside, "1.0.0", models.ArchTarGz), bytes.NewReader([]byte("archive"))); err != ErrNotAuthorized {
+		t.Fatal("Expected a token not to publish outside its prefix, got", err)
+	}
+
+	if _, err := g.GetVersionBinary(ctx, read, "example.com/team/pkg", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := g.ListAccessTokens(ctx, ownerToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].Name != "ci" || tokens[0].LastUsed.IsZero() || tokens[1].Name != "mirror" {
+		t.Fatal("Expected the ci and mirror tokens, used, got", tokens)
+	}
+
+	if err := g.RevokeAccessToken(ctx, otherToken, tokens[0].ID); err != auth.ErrAccessTokenDoesNotExist {
+		t.Fatal("Expected other users not to revoke the token, got", err)
+	}
+	if err := g.RevokeAccessToken(ctx, ownerToken, tokens[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.ParseToken(ctx, publish); err != auth.ErrAccessTokenInvalid {
+		t.Fatal("Expected a revoked token to be invalid, got", err)
+	}
+}
+
+func TestCanUserAnonymous(t *testing.T) {
+	ctx := context.Background()
+
+	m := models.NewImport("example.com/pkg")
+	if err := g.CanUser(ctx, nil, m, models.RoleReader); err != nil {
+		t.Fatal("Expected anonymous users to read public imports, got", err)
+	}
+	if err := g.CanUser(ctx, nil, m, models.RolePublisher); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+
+	m.Private = true
+	if err := g.CanUser(ctx, nil, m, models.RoleReader); err != ErrNotAuthorized {
+		t.Fatal("Expected anonymous users not to read private imports, got", err)
+	}
+}
+
+func TestRefreshLogout(t *testing.T) {
+	ctx := context.Background()
+
+	tokens := login(t, "other")
+	refreshed, err := g.Refresh(ctx, tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Refresh(ctx, tokens.RefreshToken); err != auth.ErrTokenRevoked {
+		t.Fatal("Expected a used refresh token to be revoked, got", err)
+	}
+	if _, err := g.Refresh(ctx, refreshed.Token); err != auth.ErrWrongTokenType {
+		t.Fatal("Expected ErrWrongTokenType, got", err)
+	}
+
+	if err := g.Logout(ctx, refreshed.Token, login(t, "owner").RefreshToken); err != ErrNotAuthorized {
+		t.Fatal("Expected another user's refresh token to be refused, got", err)
+	}
+
+	if err := g.Logout(ctx, refreshed.Token, refreshed.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.ParseToken(ctx, refreshed.Token); err != auth.ErrTokenRevoked {
+		t.Fatal("Expected a logged out token to be revoked, got", err)
+	}
+	if _, err := g.Refresh(ctx, refreshed.RefreshToken); err != auth.ErrTokenRevoked {
+		t.Fatal("Expected a logged out refresh token to be revoked, got", err)
+	}
+
+	// The refresh token is enough once the login token has expired.
+	tokens = login(t, "other")
+	if err := g.Logout(ctx, "expired", ""); err == nil {
+		t.Fatal("Expected an invalid token to be refused")
+	}
+	if err := g.Logout(ctx, "expired", tokens.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Refresh(ctx, tokens.RefreshToken); err != auth.ErrTokenRevoked {
+		t.Fatal("Expected a logged out refresh token to be revoked, got", err)
+	}
+	if err := g.Logout(ctx, "", ""); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized without tokens, got", err)
+	}
+}
+
+// noRevokeAuth is an Auth that cannot store revocations, like LDAP.
+type noRevokeAuth struct {
+	*auth.MemoryAuth
+}
+
+func (a noRevokeAuth) RevokeToken(ctx context.Context, token *auth.RevokedToken) error {
+	return auth.ErrNotSupported
+}
+
+func TestLogoutNotSupported(t *testing.T) {
+	ctx := context.Background()
+
+	na := noRevokeAuth{auth.NewMemoryAuth(tm)}
+	ng := NewGate(na, storemanager.NewStoreManager(binstore.NewMemoryBinStore(), metastore.NewMemoryMetaStore()), tm)
+	if err := na.AddUser(ctx, &auth.User{Username: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := na.SetPassword(ctx, "user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := ng.Login(ctx, "user", "password", "", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ng.Logout(ctx, tokens.Token, tokens.RefreshToken); err != nil {
+		t.Fatal("Expected logout to succeed without revocations, got", err)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	ctx := context.Background()
+
+	if err := a.AddUser(ctx, &auth.User{Username: "admin", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetPassword(ctx, "admin", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddUser(ctx, &auth.User{Username: "leaked"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetPassword(ctx, "leaked", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	adminToken := login(t, "admin").Token
+	tokens := login(t, "leaked")
+
+	if err := g.RevokeSessions(ctx, tokens.Token, "leaked"); err != ErrNotAuthorized {
+		t.Fatal("Expected only admins to revoke sessions, got", err)
+	}
+	if err := g.RevokeSessions(ctx, adminToken, "leaked"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := g.ParseToken(ctx, tokens.Token); err != auth.ErrTokenRevoked {
+		t.Fatal("Expected the access token to be revoked, got", err)
+	}
+	if _, err := g.Refresh(ctx, tokens.RefreshToken); err != auth.ErrTokenRevoked {
+		t.Fatal("Expected the refresh token to be revoked, got", err)
+	}
+
+	// Tokens issued after the revocation are accepted, iat has a resolution of a second.
+	time.Sleep(time.Until(time.Unix(time.Now().Unix()+1, 0)))
+	if _, err := g.ParseToken(ctx, login(t, "leaked").Token); err != nil {
+		t.Fatal("Expected a new login to be accepted, got", err)
+	}
+}
+
+func TestDisabledUserToken(t *testing.T) {
+	ctx := context.Background()
+
+	if err := a.AddUser(ctx, &auth.User{Username: "disabled"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetPassword(ctx, "disabled", "password"); err != nil {
+		t.Fatal(err)
+	}
+	tokens := login(t, "disabled")
+
+	if err := a.UpdateUser(ctx, &auth.User{Username: "disabled", Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.ParseToken(ctx, tokens.Token); err != ErrNotAuthorized {
+		t.Fatal("Expected the token of a disabled user to be refused, got", err)
+	}
+	if _, err := g.Refresh(ctx, tokens.RefreshToken); err != ErrNotAuthorized {
+		t.Fatal("Expected the refresh token of a disabled user to be refused, got", err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	ctx := context.Background()
+
+	for _, name := range []string{"dev", "maintainer", "outsider"} {
+		if err := a.AddUser(ctx, &auth.User{Username: name}); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.SetPassword(ctx, name, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.AddTeam(ctx, &auth.Team{Name: "payments", Members: []string{"dev"}}); err != nil {
+		t.Fatal(err)
+	}
+	devToken := login(t, "dev").Token
+	maintainerToken := login(t, "maintainer").Token
+	outsiderToken := login(t, "outsider").Token
+
+	m := models.NewImport("example.com/payments")
+	m.Owners = []string{"owner"}
+	m.Private = true
+	if err := g.Add(ctx, ownerToken, m, models.NewVersion(m, "1.0.0", models.ArchTarGz), bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Roles given when publishing to an existing Import are ignored.
+	claimed := models.NewImport("example.com/payments")
+	claimed.Owners = []string{"dev"}
+	if err := g.Add(ctx, devToken, claimed, models.NewVersion(claimed, "1.1.0", models.ArchTarGz), bytes.NewReader([]byte("archive"))); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+
+	if err := g.SetGrant(ctx, devToken, m.ImportURL, models.Grant{Team: "payments", Role: models.RolePublisher}); err != ErrNotAuthorized {
+		t.Fatal("Expected only owners to grant roles, got", err)
+	}
+	if err := g.SetGrant(ctx, ownerToken, m.ImportURL, models.Grant{User: "dev", Team: "payments", Role: models.RoleReader}); err != models.ErrInvalidGrant {
+		t.Fatal("Expected ErrInvalidGrant, got", err)
+	}
+	if err := g.SetGrant(ctx, ownerToken, m.ImportURL, models.Grant{Team: "unknown", Role: models.RoleReader}); err != auth.ErrTeamDoesNotExist {
+		t.Fatal("Expected ErrTeamDoesNotExist, got", err)
+	}
+	for _, grant := range []models.Grant{
+		{Team: "payments", Role: models.RolePublisher},
+		{User: "maintainer", Role: models.RoleReader},
+		{User: "maintainer", Role: models.RoleMaintainer},
+	} {
+		if err := g.SetGrant(ctx, ownerToken, m.ImportURL, grant); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grants, err := g.GetGrants(ctx, ownerToken, m.ImportURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 2 || grants[1].Role != models.RoleMaintainer {
+		t.Fatal("Expected the team grant and the replaced maintainer grant, got", grants)
+	}
+
+	// Team members publish and read the private Import, outsiders do neither.
+	if err := g.Add(ctx, devToken, m, models.NewVersion(m, "1.1.0", models.ArchTarGz), bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(ctx, devToken, m.ImportURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(ctx, outsiderToken, m.ImportURL); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+	if err := g.DisableVersion(ctx, devToken, m.ImportURL, "1.1.0"); err != ErrNotAuthorized {
+		t.Fatal("Expected publishers not to disable versions, got", err)
+	}
+
+	// Maintainers disable and delete versions, but only owners delete the Import.
+	if err := g.DisableVersion(ctx, maintainerToken, m.ImportURL, "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.DeleteVersion(ctx, maintainerToken, m.ImportURL, "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.DeleteImport(ctx, maintainerToken, m.ImportURL); err != ErrNotAuthorized {
+		t.Fatal("Expected maintainers not to delete the import, got", err)
+	}
+
+	// Leaving the team removes its roles.
+	if err := a.RemoveTeamMember(ctx, "payments", "dev"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(ctx, devToken, m.ImportURL); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+
+	if err := g.RemoveGrant(ctx, ownerToken, m.ImportURL, models.Grant{User: "maintainer"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.DisableVersion(ctx, maintainerToken, m.ImportURL, "1.0.0"); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+}
+
+func TestOrganizations(t *testing.T) {
+	ctx := context.Background()
+
+	for _, name := range []string{"payer", "stranger"} {
+		if err := a.AddUser(ctx, &auth.User{Username: name}); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.SetPassword(ctx, name, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.AddTeam(ctx, &auth.Team{Name: "payers", Members: []string{"payer"}}); err != nil {
+		t.Fatal(err)
+	}
+	adminToken := login(t, "admin").Token
+	payerToken := login(t, "payer").Token
+	strangerToken := login(t, "stranger").Token
+
+	org := &models.Organization{
+		Name:     "payments",
+		Prefixes: []string{"git.corp.example/payments/*"},
+		Private:  true,
+		Owners:   []string{"owner"},
+		Grants:   []models.Grant{{Team: "payers", Role: models.RolePublisher}},
+	}
+	if err := g.AddOrganization(ctx, ownerToken, org); err != ErrNotAuthorized {
+		t.Fatal("Expected only admins to add organizations, got", err)
+	}
+	if err := g.AddOrganization(ctx, adminToken, org); err != nil {
+		t.Fatal(err)
+	}
+	if org.Prefixes[0] != "git.corp.example/payments" {
+		t.Fatal("Expected the prefix to be normalized, got", org.Prefixes)
+	}
+	if err := g.AddOrganization(ctx, adminToken, &models.Organization{Name: "squatter", Prefixes: []string{"git.corp.example/payments/"}}); err != models.ErrPrefixClaimed {
+		t.Fatal("Expected ErrPrefixClaimed, got", err)
+	}
+
+	add := func(token, url string) (*models.Import, error) {
+		m := models.NewImport(url)
+		m.Owners = []string{"stranger"}
+		if err := g.Add(ctx, token, m, models.NewVersion(m, "1.0.0", models.ArchTarGz), bytes.NewReader([]byte("archive"))); err != nil {
+			return nil, err
+		}
+		return g.sm.Get(ctx, url)
+	}
+
+	// Only members of the organization create imports below its prefix, which take its defaults.
+	if _, err := add(strangerToken, "git.corp.example/payments/ledger"); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+	m, err := add(payerToken, "git.corp.example/payments/ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Private || len(m.Owners) != 1 || m.Owners[0] != "owner" || len(m.Grants) != 1 {
+		t.Fatal("Expected the import to take the defaults of the organization, got", m)
+	}
+	if _, err := add(strangerToken, "git.corp.example/paymentsx"); err != nil {
+		t.Fatal("Expected paths outside the prefix to be unclaimed, got", err)
+	}
+
+	// The longest claim wins.
+	if err := g.AddOrganization(ctx, adminToken, &models.Organization{Name: "secret", Prefixes: []string{"git.corp.example/payments/secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := add(payerToken, "git.corp.example/payments/secret/keys"); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+
+	if err := g.ReleasePrefix(ctx, adminToken, "payments", "git.corp.example/payments/*"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := add(strangerToken, "git.corp.example/payments/wallet"); err != nil {
+		t.Fatal("Expected a released prefix to be unclaimed, got", err)
+	}
+	if err := g.ClaimPrefix(ctx, adminToken, "payments", "git.corp.example/payments/secret"); err != models.ErrPrefixClaimed {
+		t.Fatal("Expected ErrPrefixClaimed, got", err)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	ctx := context.Background()
+
+	la := auth.NewMemoryAuth(tm)
+	lg := NewGate(la, storemanager.NewStoreManager(binstore.NewMemoryBinStore(), metastore.NewMemoryMetaStore()), tm)
+	lg.SetLockoutPolicy(auth.LockoutPolicy{MaxFailures: 3, Lockout: time.Minute, MaxIPFailures: 5})
+
+	for _, user := range []*auth.User{{Username: "admin", Admin: true}, {Username: "victim"}} {
+		if err := la.AddUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if err := la.SetPassword(ctx, user.Username, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A successful login forgets the failures of the user.
+	for _, password := range []string{"wrong-password", "wrong-password", "password", "wrong-password", "wrong-password"} {
+		if _, err := lg.Login(ctx, "victim", password, "", "192.0.2.1"); err != nil && err != auth.ErrInvalidCredentials {
+			t.Fatal("Expected ErrInvalidCredentials, got", err)
+		}
+	}
+	if _, err := lg.Login(ctx, "victim", "wrong-password", "", "192.0.2.2"); err != auth.ErrInvalidCredentials {
+		t.Fatal("Expected ErrInvalidCredentials, got", err)
+	}
+	if _, err := lg.Login(ctx, "Victim", "password", "", "192.0.2.3"); err != auth.ErrTooManyAttempts {
+		t.Fatal("Expected the account to be locked from every address, got", err)
+	}
+
+	// Unknown users are refused like a wrong password.
+	if _, err := lg.Login(ctx, "ghost", "password", "", "192.0.2.3"); err != auth.ErrInvalidCredentials {
+		t.Fatal("Expected ErrInvalidCredentials, got", err)
+	}
+
+	// Guessing across accounts locks out the address.
+	for i := 0; i < 5; i++ {
+		if _, err := lg.Login(ctx, "user"+strconv.Itoa(i), "password", "", "192.0.2.4"); err != auth.ErrInvalidCredentials {
+			t.Fatal("Expected ErrInvalidCredentials, got", err)
+		}
+	}
+	if _, err := lg.Login(ctx, "admin", "password", "", "192.0.2.4"); err != auth.ErrTooManyAttempts {
+		t.Fatal("Expected the address to be locked out, got", err)
+	}
+
+	adminToken, err := lg.Login(ctx, "admin", "password", "", "192.0.2.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempts, err := lg.ListLoginAttempts(ctx, adminToken.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 11 || attempts[3].Key != "ip:192.0.2.4" || attempts[len(attempts)-1].Key != "user:victim" || attempts[len(attempts)-1].LockedUntil.IsZero() {
+		t.Fatal("Expected the failed logins of users and addresses, got", attempts)
+	}
+
+	if err := lg.ClearLoginAttempts(ctx, adminToken.Token, "victim", "192.0.2.4"); err != nil {
+		t.Fatal(err)
+	}
+	victimToken, err := lg.Login(ctx, "victim", "password", "", "192.0.2.4")
+	if err != nil {
+		t.Fatal("Expected the lockouts to be lifted, got", err)
+	}
+	if err := lg.ClearLoginAttempts(ctx, victimToken.Token, "ghost", ""); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	ctx := context.Background()
+
+	ta := auth.NewMemoryAuth(tm)
+	tg := NewGate(ta, storemanager.NewStoreManager(binstore.NewMemoryBinStore(), metastore.NewMemoryMetaStore()), tm)
+	tg.SetLockoutPolicy(auth.LockoutPolicy{MaxFailures: 10, Lockout: time.Minute})
+	tg.SetRequireAdminTOTP(true)
+
+	for _, user := range []*auth.User{{Username: "admin", Admin: true}, {Username: "user"}} {
+		if err := ta.AddUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if err := ta.SetPassword(ctx, user.Username, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	code := func(username string) string {
+		totp, err := ta.GetTOTP(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := totp.Code(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// Admins without two-factor authentication only have the roles granted to them.
+	adminToken, err := tg.Login(ctx, "admin", "password", "", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tg.ListLoginAttempts(ctx, adminToken.Token); err != ErrAdminTOTPRequired {
+		t.Fatal("Expected ErrAdminTOTPRequired, got", err)
+	}
+	admin, _ := ta.GetUser(ctx, "admin")
+	if role, err := tg.RoleOf(ctx, admin, &models.Import{ImportURL: "example.com/a"}); err != nil || role != "" {
+		t.Fatal("Expected no role, got", role, err)
+	}
+
+	enrollment, err := tg.EnrollTOTP(ctx, adminToken.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/"+DefaultTOTPIssuer+":admin?") {
+		t.Fatal("Unexpected otpauth URI", enrollment.URI)
+	}
+	if _, err := tg.ConfirmTOTP(ctx, adminToken.Token, "abcdef"); err != auth.ErrInvalidTOTP {
+		t.Fatal("Expected ErrInvalidTOTP, got", err)
+	}
+	used := code("admin")
+	recovery, err := tg.ConfirmTOTP(ctx, adminToken.Token, used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tg.EnrollTOTP(ctx, adminToken.Token); err != auth.ErrTOTPAlreadyEnabled {
+		t.Fatal("Expected ErrTOTPAlreadyEnabled, got", err)
+	}
+	if _, err := tg.ListLoginAttempts(ctx, adminToken.Token); err != nil {
+		t.Fatal("Expected admins with two-factor authentication to act as admins, got", err)
+	}
+
+	// Logins need a code, a wrong or used one counts as a failed login.
+	if _, err := tg.Login(ctx, "admin", "password", "", "192.0.2.1"); err != auth.ErrTOTPRequired {
+		t.Fatal("Expected ErrTOTPRequired, got", err)
+	}
+	if _, err := tg.Login(ctx, "admin", "password", used, "192.0.2.1"); err != auth.ErrInvalidTOTP {
+		t.Fatal("Expected a used code to be refused, got", err)
+	}
+	if attempts, err := ta.GetLoginAttempts(ctx, auth.UserAttemptsKey("admin")); err != nil || attempts == nil || attempts.Failures != 1 {
+		t.Fatal("Expected a failed login, got", attempts, err)
+	}
+	if _, err := tg.Login(ctx, "admin", "wrong-password", recovery[0], "192.0.2.1"); err != auth.ErrInvalidCredentials {
+		t.Fatal("Expected ErrInvalidCredentials, got", err)
+	}
+	if _, err := tg.Login(ctx, "admin", "password", recovery[0], "192.0.2.1"); err != nil {
+		t.Fatal("Expected a recovery code to be accepted, got", err)
+	}
+	if _, err := tg.Login(ctx, "admin", "password", recovery[0], "192.0.2.1"); err != auth.ErrInvalidTOTP {
+		t.Fatal("Expected a used recovery code to be refused, got", err)
+	}
+
+	if err := tg.DisableTOTP(ctx, adminToken.Token, ""); err != auth.ErrTOTPRequired {
+		t.Fatal("Expected ErrTOTPRequired, got", err)
+	}
+	if err := tg.DisableTOTP(ctx, adminToken.Token, recovery[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tg.ListLoginAttempts(ctx, adminToken.Token); err != ErrAdminTOTPRequired {
+		t.Fatal("Expected ErrAdminTOTPRequired, got", err)
+	}
+
+	// Admins can turn it off for users who lost their app.
+	userToken, err := tg.Login(ctx, "user", "password", "", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tg.EnrollTOTP(ctx, userToken.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tg.ConfirmTOTP(ctx, userToken.Token, code("user")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tg.ResetTOTP(ctx, userToken.Token, "user"); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+	tg.SetRequireAdminTOTP(false)
+	if err := tg.ResetTOTP(ctx, adminToken.Token, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tg.Login(ctx, "user", "password", "", "192.0.2.1"); err != nil {
+		t.Fatal("Expected a login without a code after the reset, got", err)
+	}
+}
+
+// noTOTPAuth is an Auth that cannot store two-factor authentication, like LDAP.
+type noTOTPAuth struct {
+	*auth.MemoryAuth
+}
+
+func (a noTOTPAuth) GetTOTP(ctx context.Context, username string) (*auth.TOTP, error) {
+	return nil, auth.ErrNotSupported
+}
+
+func TestRequireAdminTOTPNotSupported(t *testing.T) {
+	ctx := context.Background()
+
+	na := noTOTPAuth{auth.NewMemoryAuth(tm)}
+	ng := NewGate(na, storemanager.NewStoreManager(binstore.NewMemoryBinStore(), metastore.NewMemoryMetaStore()), tm)
+	if err := na.AddUser(ctx, &auth.User{Username: "admin", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := na.SetPassword(ctx, "admin", "password"); err != nil {
+		t.Fatal(err)
+	}
+	adminToken, err := ng.Login(ctx, "admin", "password", "", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ng.ListLoginAttempts(ctx, adminToken.Token); err != nil {
+		t.Fatal(err)
+	}
+	ng.SetRequireAdminTOTP(true)
+	if _, err := ng.ListLoginAttempts(ctx, adminToken.Token); err != ErrAdminTOTPRequired {
+		t.Fatal("Expected admins to be refused when two-factor authentication cannot be stored, got", err)
+	}
+}
+
+func TestLoginExternal(t *testing.T) {
+	ctx := context.Background()
+
+	ea := auth.NewMemoryAuth(tm)
+	eg := NewGate(ea, storemanager.NewStoreManager(binstore.NewMemoryBinStore(), metastore.NewMemoryMetaStore()), tm)
+	eg.SetLockoutPolicy(auth.LockoutPolicy{MaxFailures: 1, Lockout: time.Minute})
+
+	for _, user := range []*auth.User{{Username: "admin", Admin: true}, {Username: "local", Admin: true}, {Username: "provisioned"}} {
+		if err := ea.AddUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"admin", "local"} {
+		if err := ea.SetPassword(ctx, name, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	adminToken, err := eg.Login(ctx, "admin", "password", "", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yes, no := true, false
+	external := func(subject, username string, admin *bool) *auth.ExternalLogin {
+		return &auth.ExternalLogin{Issuer: "https://idp.example.com", Subject: subject, Username: username, Admin: admin}
+	}
+	subject := func(tokens *auth.Tokens) string {
+		s, err := tm.Validate(tokens.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// New users are added, their admin flag follows the identity provider.
+	tokens, err := eg.LoginExternal(ctx, external("1", "alice", &yes), "", "192.0.2.1")
+	if err != nil || subject(tokens) != "alice" {
+		t.Fatal("Expected alice to be added, got", tokens, err)
+	}
+	if user, _ := ea.GetUser(ctx, "alice"); !user.Admin {
+		t.Fatal("Expected alice to be an admin")
+	}
+	if _, err := eg.LoginExternal(ctx, external("1", "alice-renamed", &no), "", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := ea.GetUser(ctx, "alice"); user.Admin {
+		t.Fatal("Expected alice to no longer be an admin")
+	}
+
+	// Accounts with a password or another identity are not taken over by the username alone.
+	if _, err := eg.LoginExternal(ctx, external("2", "local", &no), "", "192.0.2.1"); err != auth.ErrIdentityNotLinked {
+		t.Fatal("Expected ErrIdentityNotLinked for an account with a password, got", err)
+	}
+	if _, err := eg.LoginExternal(ctx, external("3", "alice", &yes), "", "192.0.2.1"); err != auth.ErrIdentityNotLinked {
+		t.Fatal("Expected ErrIdentityNotLinked for an account with another identity, got", err)
+	}
+	if tokens, err := eg.LoginExternal(ctx, external("4", "provisioned", nil), "", "192.0.2.1"); err != nil || subject(tokens) != "provisioned" {
+		t.Fatal("Expected an account without a password to be linked, got", tokens, err)
+	}
+
+	// Once an admin links it, the identity logs in, but cannot change whether the local account is an admin.
+	if err := eg.LinkIdentity(ctx, tokens.Token, "https://idp.example.com", "2", "local"); err != ErrNotAuthorized {
+		t.Fatal("Expected ErrNotAuthorized, got", err)
+	}
+	if err := eg.LinkIdentity(ctx, adminToken.Token, "https://idp.example.com", "2", "local"); err != nil {
+		t.Fatal(err)
+	}
+	if tokens, err := eg.LoginExternal(ctx, external("2", "someone-else", &no), "", "192.0.2.1"); err != nil || subject(tokens) != "local" {
+		t.Fatal("Expected the linked identity to log in, got", tokens, err)
+	}
+	if user, _ := ea.GetUser(ctx, "local"); !user.Admin {
+		t.Fatal("Expected the local admin to be kept an admin")
+	}
+	if identities, err := eg.ListIdentities(ctx, adminToken.Token, "local"); err != nil || len(identities) != 1 || identities[0].Created {
+		t.Fatal("Expected the linked identity, got", identities, err)
+	}
+
+	// Two-factor authentication and lockouts apply.
+	totp, err := auth.NewTOTP("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	totp.Enabled = true
+	if err := ea.SetTOTP(ctx, totp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eg.LoginExternal(ctx, external("2", "local", nil), "", "192.0.2.1"); err != auth.ErrTOTPRequired {
+		t.Fatal("Expected ErrTOTPRequired, got", err)
+	}
+	if _, err := eg.LoginExternal(ctx, external("2", "local", nil), "000000", "192.0.2.1"); err != auth.ErrInvalidTOTP {
+		t.Fatal("Expected ErrInvalidTOTP, got", err)
+	}
+	code, err := totp.Code(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eg.LoginExternal(ctx, external("2", "local", nil), code, "192.0.2.1"); err != auth.ErrTooManyAttempts {
+		t.Fatal("Expected the account to be locked out, got", err)
+	}
+
+	if err := eg.UnlinkIdentity(ctx, adminToken.Token, "https://idp.example.com", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eg.LoginExternal(ctx, external("2", "local", nil), code, "192.0.2.1"); err != auth.ErrIdentityNotLinked {
+		t.Fatal("Expected the unlinked identity to be refused, got", err)
+	}
+
+	if err := ea.UpdateUser(ctx, &auth.User{Username: "provisioned", Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eg.LoginExternal(ctx, external("4", "provisioned", nil), "", "192.0.2.1"); err != ErrNotAuthorized {
+		t.Fatal("Expected disabled users to be refused, got", err)
+	}
+}
@@ -0,0 +1,184 @@
+package gate
+
+import (
+	"context"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+)
+
+// LoginExternal generates an access token and a refresh token for a user logged in by an external identity
+// provider, such as OpenID Connect. The identity is known by its issuer and subject: the first login adds a
+// user with the username the provider gives, or links the identity to the existing user with that username
+// if they have no password and no other identity. Otherwise an admin must link it with LinkIdentity.
+// Two-factor authentication and the LockoutPolicy apply as they do to Login.
+func (g *Gate) LoginExternal(ctx context.Context, login *auth.ExternalLogin, otp, ip string) (*auth.Tokens, error) {
+	user, err := g.externalUser(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrNotAuthorized
+	}
+
+	keys := g.attemptKeys(user.Username, ip)
+	if len(keys) > 0 {
+		key := auth.UserAttemptsKey(user.Username)
+		if _, busy := g.logins.LoadOrStore(key, true); busy {
+			return nil, auth.ErrTooManyAttempts
+		}
+		defer g.logins.Delete(key)
+
+		if err := g.checkAttempts(ctx, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	return g.issueTokens(ctx, keys, user.Username, user.Username, otp)
+}
+
+// externalUser returns the user an identity is linked to, linking it first if it is new. The admin flag
+// of users added for their identity follows the identity provider, unless the registry is read-only.
+func (g *Gate) externalUser(ctx context.Context, login *auth.ExternalLogin) (*auth.User, error) {
+	if len(login.Issuer) == 0 || len(login.Subject) == 0 {
+		return nil, auth.ErrIdentityEmpty
+	}
+	ids, err := g.identities()
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := ids.GetIdentity(ctx, login.Issuer, login.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if identity != nil {
+		user, err := g.a.GetUser(ctx, identity.Username)
+		if err != nil {
+			return nil, err
+		}
+		if identity.Created && login.Admin != nil && user.Admin != *login.Admin && !g.ReadOnly() {
+			user.Admin = *login.Admin
+			if err := g.a.UpdateUser(ctx, user); err != nil {
+				return nil, err
+			}
+		}
+		return user, nil
+	}
+
+	if len(login.Username) == 0 {
+		return nil, auth.ErrUsernameEmpty
+	}
+	if err := g.requireWritable(); err != nil {
+		return nil, err
+	}
+
+	identity = &auth.Identity{
+		Issuer:    login.Issuer,
+		Subject:   login.Subject,
+		Username:  login.Username,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	user, err := g.a.GetUser(ctx, login.Username)
+	switch {
+	case err == auth.ErrUserDoesNotExist:
+		user = &auth.User{Username: login.Username, Admin: login.Admin != nil && *login.Admin}
+		if err := g.a.AddUser(ctx, user); err != nil {
+			return nil, err
+		}
+		identity.Created = true
+	case err != nil:
+		return nil, err
+	default:
+		if err := g.canLinkIdentity(ctx, ids, user.Username); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ids.SetIdentity(ctx, identity); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// identities returns the IdentityStore of the Auth, auth.ErrNotSupported if it cannot keep identities.
+func (g *Gate) identities() (auth.IdentityStore, error) {
+	if ids := auth.FindIdentityStore(g.a); ids != nil {
+		return ids, nil
+	}
+	return nil, auth.ErrNotSupported
+}
+
+// canLinkIdentity returns auth.ErrIdentityNotLinked unless the user has no password and no identity, so an
+// identity provider cannot take over an account because it gives the same username.
+func (g *Gate) canLinkIdentity(ctx context.Context, ids auth.IdentityStore, username string) error {
+	hash, err := g.a.GetPasswordHash(ctx, username)
+	if err != nil {
+		return err
+	}
+	if len(hash) > 0 {
+		return auth.ErrIdentityNotLinked
+	}
+
+	identities, err := ids.ListIdentities(ctx, username)
+	if err != nil {
+		return err
+	}
+	if len(identities) > 0 {
+		return auth.ErrIdentityNotLinked
+	}
+	return nil
+}
+
+// ListIdentities lists the external identities linked to a user on behalf of an admin user.
+func (g *Gate) ListIdentities(ctx context.Context, token, username string) ([]*auth.Identity, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+	ids, err := g.identities()
+	if err != nil {
+		return nil, err
+	}
+
+	return ids.ListIdentities(ctx, username)
+}
+
+// LinkIdentity links the external identity with the given issuer and subject to a user on behalf of an
+// admin user, who must have checked that the identity belongs to them.
+func (g *Gate) LinkIdentity(ctx context.Context, token, issuer, subject, username string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+	ids, err := g.identities()
+	if err != nil {
+		return err
+	}
+
+	return ids.SetIdentity(ctx, &auth.Identity{
+		Issuer:    issuer,
+		Subject:   subject,
+		Username:  username,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// UnlinkIdentity unlinks the external identity with the given issuer and subject from its user on behalf
+// of an admin user. Logging in with it again adds a new user or links it as on its first login.
+func (g *Gate) UnlinkIdentity(ctx context.Context, token, issuer, subject string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+	ids, err := g.identities()
+	if err != nil {
+		return err
+	}
+
+	return ids.DeleteIdentity(ctx, issuer, subject)
+}
@@ -0,0 +1,118 @@
+package gate
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+)
+
+// SetLockoutPolicy sets how failed password logins are throttled, the zero LockoutPolicy turns it off.
+func (g *Gate) SetLockoutPolicy(p auth.LockoutPolicy) {
+	g.lockout = p
+}
+
+// attemptKeys returns the LoginAttempts keys of a login and the LockoutPolicy of each.
+func (g *Gate) attemptKeys(username, ip string) map[string]auth.LockoutPolicy {
+	keys := map[string]auth.LockoutPolicy{}
+	if g.lockout.MaxFailures > 0 || g.lockout.Delay > 0 {
+		keys[auth.UserAttemptsKey(username)] = g.lockout
+	}
+	if g.lockout.MaxIPFailures > 0 && len(ip) > 0 {
+		keys[auth.IPAttemptsKey(ip)] = g.lockout.ForIP()
+	}
+	return keys
+}
+
+// checkAttempts returns auth.ErrTooManyAttempts if a login under any of the keys must wait. An Auth
+// that cannot store failed logins is not throttled.
+func (g *Gate) checkAttempts(ctx context.Context, keys map[string]auth.LockoutPolicy) error {
+	now := time.Now()
+	for key, p := range keys {
+		attempts, err := g.a.GetLoginAttempts(ctx, key)
+		if err == auth.ErrNotSupported {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if attempts != nil && now.Before(attempts.RetryAt(p)) {
+			return auth.ErrTooManyAttempts
+		}
+	}
+	return nil
+}
+
+// loginFailed records a failed login under each of the keys. Failures are recorded even while the
+// registry is read-only, so it cannot be used to get around the throttling.
+func (g *Gate) loginFailed(ctx context.Context, keys map[string]auth.LockoutPolicy) {
+	now := time.Now()
+	for key, p := range keys {
+		attempts, err := g.a.GetLoginAttempts(ctx, key)
+		if err == nil && attempts == nil {
+			attempts = &auth.LoginAttempts{Key: key}
+		}
+		if err == nil {
+			attempts.Fail(p, now)
+			err = g.a.SetLoginAttempts(ctx, attempts)
+		}
+		if err == auth.ErrNotSupported {
+			return
+		}
+		if err != nil {
+			log.Println("Could not record failed login for", key+":", err)
+		}
+	}
+}
+
+// loginSucceeded forgets the failed logins of a user. Those from their IP address are kept, or one
+// account could be used to keep guessing the passwords of others.
+func (g *Gate) loginSucceeded(ctx context.Context, username string) {
+	key := auth.UserAttemptsKey(username)
+	attempts, err := g.a.GetLoginAttempts(ctx, key)
+	if err == nil && attempts != nil {
+		err = g.a.DeleteLoginAttempts(ctx, key)
+	}
+	if err != nil && err != auth.ErrNotSupported {
+		log.Println("Could not clear failed logins for", key+":", err)
+	}
+}
+
+// ListLoginAttempts lists the users and IP addresses with failed logins on behalf of an admin user.
+func (g *Gate) ListLoginAttempts(ctx context.Context, token string) ([]*auth.LoginAttempts, error) {
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return nil, err
+	}
+
+	return g.a.ListLoginAttempts(ctx)
+}
+
+// ClearLoginAttempts forgets the failed logins of a user, an IP address, or both on behalf of an admin user,
+// lifting any lockout.
+func (g *Gate) ClearLoginAttempts(ctx context.Context, token, username, ip string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+
+	keys := []string{}
+	if len(username) > 0 {
+		keys = append(keys, auth.UserAttemptsKey(username))
+	}
+	if len(ip) > 0 {
+		keys = append(keys, auth.IPAttemptsKey(ip))
+	}
+	if len(keys) == 0 {
+		return auth.ErrUsernameEmpty
+	}
+
+	for _, key := range keys {
+		if err := g.a.DeleteLoginAttempts(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package gate
+
+import (
+	"context"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/models"
+)
+
+// RoleOf returns the highest role of a user on an Import, from the Grants to them and their teams.
+// Owners and Readers of the Import are owners and readers, and admins are owners of every Import unless
+// they must enable two-factor authentication first.
+// The empty Role is returned if the user has none.
+func (g *Gate) RoleOf(ctx context.Context, user *auth.User, m *models.Import) (models.Role, error) {
+	if user == nil || user.Disabled {
+		return "", nil
+	}
+	if user.Admin {
+		admin, err := g.isAdmin(ctx, user)
+		if err != nil {
+			return "", err
+		}
+		if admin {
+			return models.RoleOwner, nil
+		}
+	}
+
+	role := models.Role("")
+	raise := func(r models.Role) {
+		if !role.Includes(r) {
+			role = r
+		}
+	}
+
+	for _, name := range m.Owners {
+		if name == user.Username {
+			raise(models.RoleOwner)
+		}
+	}
+	for _, name := range m.Readers {
+		if name == user.Username {
+			raise(models.RoleReader)
+		}
+	}
+
+	// Teams are only looked up if the Import has been granted to one.
+	var teams map[string]bool
+	for _, grant := range m.Grants {
+		if len(grant.User) > 0 {
+			if grant.User == user.Username {
+				raise(grant.Role)
+			}
+			continue
+		}
+
+		if teams == nil {
+			names, err := g.a.ListUserTeams(ctx, user.Username)
+			if err != nil && err != auth.ErrNotSupported {
+				return "", err
+			}
+			teams = map[string]bool{}
+			for _, name := range names {
+				teams[name] = true
+			}
+		}
+		if teams[grant.Team] {
+			raise(grant.Role)
+		}
+	}
+
+	return role, nil
+}
+
+// CanUser returns nil if the user has at least the given role on the Import. Anyone may read a public Import.
+func (g *Gate) CanUser(ctx context.Context, user *auth.User, m *models.Import, role models.Role) error {
+	if user != nil && user.Disabled {
+		return ErrNotAuthorized
+	}
+	if role == models.RoleReader && !m.Private {
+		return nil
+	}
+
+	have, err := g.RoleOf(ctx, user, m)
+	if err != nil {
+		return err
+	}
+	if !have.Valid() || !have.Includes(role) {
+		return ErrNotAuthorized
+	}
+
+	return nil
+}
+
+// roleScopes are the personal access token scopes needed to act with each role.
+var roleScopes = map[models.Role]auth.Scope{
+	models.RoleReader:     auth.ScopeRead,
+	models.RolePublisher:  auth.ScopePublish,
+	models.RoleMaintainer: auth.ScopeAdmin,
+	models.RoleOwner:      auth.ScopeAdmin,
+}
+
+// canAccess is CanUser for a token, a personal access token must also have the scope needed and cover m with its prefix.
+func (g *Gate) canAccess(ctx context.Context, user *auth.User, pat *auth.AccessToken, m *models.Import, role models.Role) error {
+	if err := g.CanUser(ctx, user, m, role); err != nil {
+		return err
+	}
+
+	if pat != nil && !pat.Allows(roleScopes[role], m.ImportURL) {
+		return ErrNotAuthorized
+	}
+
+	return nil
+}
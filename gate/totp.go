@@ -0,0 +1,213 @@
+package gate
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+)
+
+// ErrAdminTOTPRequired indicates an admin must enable two-factor authentication before acting as one.
+var ErrAdminTOTPRequired = errors.New("Admins must enable two-factor authentication")
+
+// DefaultTOTPIssuer names the registry in authenticator apps unless another issuer is set.
+const DefaultTOTPIssuer = "dep-registry"
+
+// TOTPEnrollment is what a user adds to their authenticator app to enable two-factor authentication.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// SetTOTPIssuer sets the name of the registry shown by authenticator apps.
+func (g *Gate) SetTOTPIssuer(issuer string) {
+	g.totpIssuer = issuer
+}
+
+// SetRequireAdminTOTP sets whether admins who log in with a password must enable two-factor authentication
+// before they can act as admins. Until they do they have only the roles granted to them.
+func (g *Gate) SetRequireAdminTOTP(require bool) {
+	g.requireAdminTOTP = require
+}
+
+// EnrollTOTP starts two-factor authentication for the user of a login token, replacing an enrollment
+// that has not been confirmed. It is enabled once ConfirmTOTP is given a code from the authenticator app.
+func (g *Gate) EnrollTOTP(ctx context.Context, token string) (*TOTPEnrollment, error) {
+	if err := g.requireWritable(); err != nil {
+		return nil, err
+	}
+
+	user, err := g.requireLogin(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := g.a.GetTOTP(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Enabled {
+		return nil, auth.ErrTOTPAlreadyEnabled
+	}
+
+	totp, err := auth.NewTOTP(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.a.SetTOTP(ctx, totp); err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{Secret: totp.Secret, URI: totp.URI(g.totpIssuer)}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication for the user of a login token with a code from their
+// authenticator app, returning the recovery codes to give to them, which cannot be recovered later.
+func (g *Gate) ConfirmTOTP(ctx context.Context, token, code string) ([]string, error) {
+	if err := g.requireWritable(); err != nil {
+		return nil, err
+	}
+
+	user, err := g.requireLogin(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	totp, err := g.a.GetTOTP(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	if totp == nil {
+		return nil, auth.ErrTOTPNotEnrolled
+	}
+	if totp.Enabled {
+		return nil, auth.ErrTOTPAlreadyEnabled
+	}
+
+	// Recovery codes are not accepted, as there are none yet.
+	if len(code) == 0 {
+		return nil, auth.ErrTOTPRequired
+	}
+	if err := totp.Check(code, time.Now()); err != nil {
+		return nil, err
+	}
+
+	codes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	totp.Enabled = true
+	if err := g.a.SetTOTP(ctx, totp); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication for the user of a login token, given a code from their
+// authenticator app or a recovery code. An enrollment that has not been confirmed is removed without one.
+func (g *Gate) DisableTOTP(ctx context.Context, token, code string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+
+	user, err := g.requireLogin(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	totp, err := g.a.GetTOTP(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if totp == nil {
+		return auth.ErrTOTPNotEnrolled
+	}
+	if totp.Enabled {
+		if len(code) == 0 {
+			return auth.ErrTOTPRequired
+		}
+		if err := totp.Check(code, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return g.a.DeleteTOTP(ctx, user.Username)
+}
+
+// ResetTOTP turns off two-factor authentication for a user on behalf of an admin user, for when they
+// have lost their authenticator app and recovery codes.
+func (g *Gate) ResetTOTP(ctx context.Context, token, username string) error {
+	if err := g.requireWritable(); err != nil {
+		return err
+	}
+	if err := g.requireAdmin(ctx, token); err != nil {
+		return err
+	}
+
+	if len(username) == 0 {
+		return auth.ErrUsernameEmpty
+	}
+	totp, err := g.a.GetTOTP(ctx, username)
+	if err != nil {
+		return err
+	}
+	if totp == nil {
+		return auth.ErrTOTPNotEnrolled
+	}
+
+	return g.a.DeleteTOTP(ctx, username)
+}
+
+// checkTOTP returns nil if the user has not enabled two-factor authentication or code is valid, the
+// code is then stored as used. Like failed logins, it is stored even while the registry is read-only.
+func (g *Gate) checkTOTP(ctx context.Context, username, code string) error {
+	totp, err := g.a.GetTOTP(ctx, username)
+	if err == auth.ErrNotSupported {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if totp == nil || !totp.Enabled {
+		return nil
+	}
+
+	if len(code) == 0 {
+		return auth.ErrTOTPRequired
+	}
+	if err := totp.Check(code, time.Now()); err != nil {
+		return err
+	}
+	return g.a.SetTOTP(ctx, totp)
+}
+
+// isAdmin reports whether a user may act as an admin. When admins must use two-factor authentication,
+// those with a password must have enabled it, those without one log in through an identity provider.
+// If the Auth cannot store two-factor authentication, no one may act as an admin.
+func (g *Gate) isAdmin(ctx context.Context, user *auth.User) (bool, error) {
+	if user == nil || user.Disabled || !user.Admin {
+		return false, nil
+	}
+	if !g.requireAdminTOTP {
+		return true, nil
+	}
+
+	totp, err := g.a.GetTOTP(ctx, user.Username)
+	if err == auth.ErrNotSupported {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if totp != nil && totp.Enabled {
+		return true, nil
+	}
+
+	hash, err := g.a.GetPasswordHash(ctx, user.Username)
+	if err != nil {
+		return false, err
+	}
+	return len(hash) == 0, nil
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/auth/oidc"
 	"github.com/deejross/dep-registry/binstore"
 	"github.com/deejross/dep-registry/config"
 	"github.com/deejross/dep-registry/gate"
@@ -14,10 +20,100 @@ import (
 	"github.com/deejross/dep-registry/web"
 )
 
+// commands maps the first argument to the command it runs, serve is used if it is not a command.
+var commands = map[string]func(args []string){
+	"serve":   serve,
+	"fsck":    fsck,
+	"backup":  runBackup,
+	"restore": runRestore,
+	"migrate": runMigrate,
+}
+
 func main() {
+	args := os.Args[1:]
+	command := serve
+
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			command = cmd
+			args = args[1:]
+		}
+	}
+
+	command(args)
+}
+
+// serve runs the registry, the optional argument is the name of a JSON config file.
+func serve(args []string) {
+	cfg := loadConfig(args)
+	sm := openStoreManager(cfg)
+	if cfg.ReadOnly {
+		log.Println("Starting in read-only mode")
+	} else if n, err := sm.Recover(context.Background(), cfg.RecoverAfter); err != nil {
+		log.Fatalln("While recovering interrupted operations:", err)
+	} else if n > 0 {
+		log.Println("Recovered", n, "interrupted operations")
+	}
+
+	tm := openTokenManager(cfg)
+	a := openAuth(cfg, tm)
+
+	gate := gate.NewGate(a, sm, tm)
+	gate.SetReadOnly(cfg.ReadOnly)
+	gate.SetLockoutPolicy(lockoutPolicy(cfg))
+	gate.SetTOTPIssuer(cfg.TOTPIssuer)
+	if cfg.RequireAdmin2FA {
+		if _, err := a.GetTOTP(context.Background(), ""); err == auth.ErrNotSupported {
+			log.Fatalln("require_admin_2fa needs an auth backend that can store two-factor authentication")
+		}
+	}
+	gate.SetRequireAdminTOTP(cfg.RequireAdmin2FA)
+
+	if multi := binstore.FindMulti(sm.BinStore()); multi != nil && cfg.RepairEvery > 0 {
+		go repairReplicas(multi, gate.ReadOnly, cfg.RepairEvery)
+	}
+
+	router := web.NewRouter(gate)
+	router.SetTimeouts(web.Timeouts{
+		Read:  cfg.ReadTimeout,
+		Write: cfg.WriteTimeout,
+		Admin: cfg.AdminTimeout,
+	})
+	if len(cfg.OIDCIssuer) > 0 {
+		router.SetOIDC(openOIDC(cfg))
+	}
+	log.Println(http.ListenAndServe(":"+cfg.Port, router))
+}
+
+// repairReplicas copies binaries to the replicas missing them every interval, unless the registry is read-only.
+func repairReplicas(multi *binstore.MultiBinStore, readOnly func() bool, every time.Duration) {
+	for range time.Tick(every) {
+		if readOnly() {
+			continue
+		}
+
+		report, err := multi.Repair(context.Background())
+		if err != nil {
+			log.Println("While repairing replicas:", err)
+			continue
+		}
+		if report.Copied > 0 || len(report.Failed) > 0 {
+			log.Println("Repaired replicas: copied", report.Copied, "binaries, failed by replica", report.Failed)
+		}
+	}
+}
+
+// commandContext returns a context cancelled when the process is interrupted, so a command
+// stops between operations and rolls back the one in progress instead of leaving it half done.
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// loadConfig loads the config file named by the first argument if given, then the environment.
+func loadConfig(args []string) *config.Config {
 	cfg := &config.Config{}
-	if len(os.Args) > 1 {
-		name := os.Args[1]
+	if len(args) > 0 {
+		name := args[0]
 		cfg2, err := config.FromFile(cfg, name)
 		if err != nil {
 			log.Println("While loading config:", err, ", using default values")
@@ -30,6 +126,11 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	return cfg
+}
+
+// openStoreManager creates the BinStore and MetaStore from the config.
+func openStoreManager(cfg *config.Config) *storemanager.StoreManager {
 	bs, err := binstore.Resolve(cfg.BinStorePath)
 	if err != nil {
 		log.Fatalln("While creating binstore:", err)
@@ -39,16 +140,117 @@ func main() {
 	if err != nil {
 		log.Fatalln("While creating metastore:", err)
 	}
+	if cfg.CacheSize > 0 {
+		ms = metastore.NewCachedMetaStore(ms, cfg.CacheSize, cfg.CacheTTL)
+	}
+
+	return storemanager.NewStoreManager(bs, ms)
+}
 
-	sm := storemanager.NewStoreManager(bs, ms)
+// lockoutPolicy returns the LockoutPolicy set by the config, negative values turn off what they set.
+func lockoutPolicy(cfg *config.Config) auth.LockoutPolicy {
+	p := auth.DefaultLockoutPolicy
+	p.MaxFailures = cfg.LoginMaxFailures
+	p.MaxIPFailures = cfg.LoginIPMaxFailures
+	p.Delay = cfg.LoginDelay
+	p.Lockout = cfg.LoginLockout
+
+	if p.MaxFailures < 0 {
+		p.MaxFailures = 0
+	}
+	if p.MaxIPFailures < 0 {
+		p.MaxIPFailures = 0
+	}
+	if p.Delay < 0 {
+		p.Delay = 0
+	}
+	if p.MaxDelay < p.Delay {
+		p.MaxDelay = p.Delay
+	}
+	return p
+}
+
+// openTokenManager creates the TokenManager from the config. The signing_keys files sign tokens if given,
+// the signing_key secret then only verifies tokens signed before switching to them.
+func openTokenManager(cfg *config.Config) *auth.TokenManager {
 	tm := auth.NewTokenManager([]byte(cfg.SigningKey), cfg.TokenTTL)
+	tm.SetRefreshTTL(cfg.RefreshTTL)
+	if len(cfg.SigningKeys) == 0 {
+		return tm
+	}
+
+	keys := []*auth.SigningKey{}
+	for _, name := range cfg.SigningKeys {
+		key, err := auth.LoadSigningKey(name)
+		if os.IsNotExist(err) && name == config.DefaultSigningKeyFile {
+			key, err = generateSigningKey(name)
+		}
+		if err != nil {
+			log.Fatalln("While loading signing keys:", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(cfg.SigningKey) > 0 {
+		keys = append(keys, auth.NewHMACKey([]byte(cfg.SigningKey)))
+	}
+
+	if err := tm.SetKeys(keys...); err != nil {
+		log.Fatalln("While loading signing keys:", err)
+	}
+	return tm
+}
+
+// generateSigningKey generates an Ed25519 signing key and writes it to a new file.
+func generateSigningKey(name string) (*auth.SigningKey, error) {
+	key, data, err := auth.GenerateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	log.Println("Generated signing key", key.ID, "in", name)
+	return key, nil
+}
 
-	a, err := auth.Resolve(cfg.AuthPath)
+// openAuth creates the Auth from the config.
+func openAuth(cfg *config.Config, tm *auth.TokenManager) auth.Auth {
+	a, err := auth.Resolve(cfg.AuthPath, tm)
 	if err != nil {
 		log.Fatalln("While creating auth:", err)
 	}
+	if cfg.CacheSize > 0 {
+		a = auth.NewCachedAuth(a, cfg.CacheSize, cfg.CacheTTL)
+	}
 
-	gate := gate.NewGate(a, sm, tm)
-	router := web.NewRouter(gate)
-	log.Println(http.ListenAndServe(":"+cfg.Port, router))
+	return a
+}
+
+// openOIDC creates the OpenID Connect login Provider from the config.
+func openOIDC(cfg *config.Config) *oidc.Provider {
+	p, err := oidc.NewProvider(oidc.Config{
+		Issuer:        cfg.OIDCIssuer,
+		ClientID:      cfg.OIDCClientID,
+		ClientSecret:  cfg.OIDCClientSecret,
+		RedirectURL:   cfg.OIDCRedirectURL,
+		Scopes:        strings.Fields(cfg.OIDCScopes),
+		UsernameClaim: cfg.OIDCUsernameClaim,
+		GroupsClaim:   cfg.OIDCGroupsClaim,
+		AdminGroup:    cfg.OIDCAdminGroup,
+	})
+	if err != nil {
+		log.Fatalln("While creating OIDC provider:", err)
+	}
+
+	return p
 }
@@ -1,15 +1,39 @@
 package metastore
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/schema"
 	"github.com/deejross/dep-registry/util"
 )
 
-var boltMetaBucket = []byte("dep-reg-metastore")
+// The MetaStore bucket holds a nested bucket per Import under boltImportsBucket, plus secondary
+// indexes across all Imports:
+//
+//	imports/<import url>/import           Import
+//	imports/<import url>/versions/<seq>   Version, seq keeps versions in the order they were added
+//	imports/<import url>/names/<name>     seq of the named Version
+//	published/<unix nano><url>\x00<name>  index of Versions by publish time
+//	digests/<digest>\x00<url>\x00<name>   index of Versions by digest
+var (
+	boltMetaBucket      = []byte("dep-reg-metastore")
+	boltImportsBucket   = []byte("imports")
+	boltPublishedBucket = []byte("published")
+	boltDigestsBucket   = []byte("digests")
+	boltVersionsBucket  = []byte("versions")
+	boltNamesBucket     = []byte("names")
+	boltImportKey       = []byte("import")
+
+	// boltOrgsBucket holds each Organization under its name.
+	boltOrgsBucket = []byte("dep-reg-orgs")
+)
 
 // BoltDB MetaStore implementation.
 type BoltDB struct {
@@ -23,10 +47,8 @@ func NewBoltMetaStore(address string) (MetaStore, error) {
 		return nil, err
 	}
 
-	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(boltMetaBucket)
-		return err
-	}); err != nil {
+	if err := schema.Migrate(db, string(boltMetaBucket), boltMetaMigrations); err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -35,273 +57,602 @@ func NewBoltMetaStore(address string) (MetaStore, error) {
 	}, nil
 }
 
-// AddImportIfNotExists adds an Import if it doesn't exist.
-func (s *BoltDB) AddImportIfNotExists(m *models.Import) error {
-	key := []byte(m.ImportURL)
+// boltMetaMigrations upgrade the MetaStore bucket, append new migrations to the end.
+var boltMetaMigrations = []schema.Migration{
+	schema.CreateBuckets(boltMetaBucket),
+	migrateNestedLayout,
+	schema.CreateBuckets(boltOrgsBucket),
+}
+
+// migrateNestedLayout creates the nested Import buckets and indexes, moving anything stored in the flat layout.
+func migrateNestedLayout(tx *bolt.Tx) error {
+	b := tx.Bucket(boltMetaBucket)
+	if err := migrateFlatLayout(b); err != nil {
+		return err
+	}
+
+	for _, name := range [][]byte{boltImportsBucket, boltPublishedBucket, boltDigestsBucket} {
+		if _, err := b.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateFlatLayout moves Imports and Versions stored by earlier releases, which kept every
+// Import under its URL and all of its Versions as one list under <url>:versions, into nested buckets.
+func migrateFlatLayout(b *bolt.Bucket) error {
+	imports := map[string][]byte{}
+	versions := map[string][]byte{}
+
+	if err := b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		key := string(k)
+		if strings.HasSuffix(key, ":versions") {
+			versions[strings.TrimSuffix(key, ":versions")] = append([]byte{}, v...)
+		} else {
+			imports[key] = append([]byte{}, v...)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if len(imports) == 0 && len(versions) == 0 {
+		return nil
+	}
+
+	for _, name := range [][]byte{boltImportsBucket, boltPublishedBucket, boltDigestsBucket} {
+		if _, err := b.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
+	for url, val := range imports {
+		ib, err := createImportBucket(b, url)
+		if err != nil {
+			return err
+		}
+		if err := ib.Put(boltImportKey, val); err != nil {
+			return err
+		}
+
+		if list, ok := versions[url]; ok {
+			vs := []*models.Version{}
+			if err := json.Unmarshal(list, &vs); err != nil {
+				return err
+			}
+			for _, v := range vs {
+				if err := putVersion(b, ib, v); err != nil && err != util.ErrAlreadyExists {
+					return err
+				}
+			}
+		}
+
+		if err := b.Delete([]byte(url)); err != nil {
+			return err
+		}
+	}
+
+	// Versions without an Import cannot be reached through the MetaStore interface.
+	for url := range versions {
+		if err := b.Delete([]byte(url + ":versions")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importBucket returns the bucket of an Import, or nil if the Import does not exist.
+func importBucket(b *bolt.Bucket, url string) *bolt.Bucket {
+	return b.Bucket(boltImportsBucket).Bucket([]byte(url))
+}
+
+// createImportBucket creates the bucket of an Import along with its nested buckets.
+func createImportBucket(b *bolt.Bucket, url string) (*bolt.Bucket, error) {
+	ib, err := b.Bucket(boltImportsBucket).CreateBucketIfNotExists([]byte(url))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ib.CreateBucketIfNotExists(boltVersionsBucket); err != nil {
+		return nil, err
+	}
+	if _, err := ib.CreateBucketIfNotExists(boltNamesBucket); err != nil {
+		return nil, err
+	}
+	return ib, nil
+}
+
+// putVersion adds a new Version to the Import bucket ib and to the indexes.
+func putVersion(b, ib *bolt.Bucket, v *models.Version) error {
+	names := ib.Bucket(boltNamesBucket)
+	if names.Get([]byte(v.Name)) != nil {
+		return util.ErrAlreadyExists
+	}
+
+	versions := ib.Bucket(boltVersionsBucket)
+	seq, err := versions.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+
+	val, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := versions.Put(key, val); err != nil {
+		return err
+	}
+	if err := names.Put([]byte(v.Name), key); err != nil {
+		return err
+	}
+
+	return indexVersion(b, v, true)
+}
+
+// getVersion returns the key and value of the named Version in the Import bucket ib, or nil if not found.
+func getVersion(ib *bolt.Bucket, name string) ([]byte, *models.Version, error) {
+	key := ib.Bucket(boltNamesBucket).Get([]byte(name))
+	if key == nil {
+		return nil, nil, nil
+	}
+
+	v := &models.Version{}
+	if err := json.Unmarshal(ib.Bucket(boltVersionsBucket).Get(key), v); err != nil {
+		return nil, nil, err
+	}
+
+	return key, v, nil
+}
+
+// indexVersion adds or removes a Version from the secondary indexes.
+func indexVersion(b *bolt.Bucket, v *models.Version, add bool) error {
+	suffix := []byte(v.ImportURL + "\x00" + v.Name)
+	entries := map[string][]byte{}
+
+	if !v.Published.IsZero() {
+		key := make([]byte, 8, 8+len(suffix))
+		binary.BigEndian.PutUint64(key, uint64(v.Published.UnixNano()))
+		entries[string(boltPublishedBucket)] = append(key, suffix...)
+	}
+	if len(v.Digest) > 0 {
+		entries[string(boltDigestsBucket)] = append([]byte(v.Digest+"\x00"), suffix...)
+	}
+
+	for bucket, key := range entries {
+		idx := b.Bucket([]byte(bucket))
+		var err error
+		if add {
+			err = idx.Put(key, []byte{})
+		} else {
+			err = idx.Delete(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddImportIfNotExists adds an Import if it doesn't exist.
+func (s *BoltDB) AddImportIfNotExists(ctx context.Context, m *models.Import) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltMetaBucket)
-		if b.Get(key) != nil {
+		if importBucket(b, m.ImportURL) != nil {
 			return nil
 		}
 
+		ib, err := createImportBucket(b, m.ImportURL)
+		if err != nil {
+			return err
+		}
+
 		val, err := json.Marshal(m)
 		if err != nil {
 			return err
 		}
 
-		return b.Put(key, val)
+		return ib.Put(boltImportKey, val)
 	})
 }
 
 // UpdateImport updates an existing Import.
-func (s *BoltDB) UpdateImport(m *models.Import) error {
-	key := []byte(m.ImportURL)
-
-	return s.db.Update(func(tx *bolt.Tx) error {
+func (s *BoltDB) UpdateImport(ctx context.Context, m *models.Import) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltMetaBucket)
+		ib, err := createImportBucket(b, m.ImportURL)
+		if err != nil {
+			return err
+		}
+
 		val, err := json.Marshal(m)
 		if err != nil {
 			return err
 		}
 
-		return b.Put(key, val)
+		return ib.Put(boltImportKey, val)
 	})
 }
 
 // AddVersion adds a new version to an import.
-func (s *BoltDB) AddVersion(v *models.Version) error {
-	key := []byte(v.ImportURL + ":versions")
-
-	return s.db.Update(func(tx *bolt.Tx) error {
+func (s *BoltDB) AddVersion(ctx context.Context, v *models.Version) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltMetaBucket)
-		versionsB := b.Get(key)
-		var versions []*models.Version
+		ib := importBucket(b, v.ImportURL)
+		if ib == nil {
+			return util.ErrNotFound
+		}
 
-		if versionsB == nil {
-			versions = []*models.Version{}
-		} else {
-			err := json.Unmarshal(versionsB, versions)
-			if err != nil {
-				return err
-			}
+		return putVersion(b, ib, v)
+	})
+}
+
+// UpdateVersion updates an existing Version.
+func (s *BoltDB) UpdateVersion(ctx context.Context, v *models.Version) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMetaBucket)
+		ib := importBucket(b, v.ImportURL)
+		if ib == nil {
+			return util.ErrNotFound
 		}
 
-		for _, ver := range versions {
-			if ver.Name == v.Name {
-				return util.ErrAlreadyExists
-			}
+		key, old, err := getVersion(ib, v.Name)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return util.ErrNotFound
 		}
 
-		versions = append(versions, v)
+		if err := indexVersion(b, old, false); err != nil {
+			return err
+		}
 
-		val, err := json.Marshal(versions)
+		val, err := json.Marshal(v)
 		if err != nil {
 			return err
 		}
+		if err := ib.Bucket(boltVersionsBucket).Put(key, val); err != nil {
+			return err
+		}
 
-		return b.Put(key, val)
+		return indexVersion(b, v, true)
 	})
 }
 
 // GetImport gets an Import.
-func (s *BoltDB) GetImport(url string) (*models.Import, error) {
-	key := []byte(url)
-	var imp *models.Import
+func (s *BoltDB) GetImport(ctx context.Context, url string) (*models.Import, error) {
+	imp := &models.Import{}
 
-	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(boltMetaBucket)
-		val := b.Get(key)
-
-		if val == nil {
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		ib := importBucket(tx.Bucket(boltMetaBucket), url)
+		if ib == nil {
 			return util.ErrNotFound
 		}
 
-		err := json.Unmarshal(val, imp)
-		return err
+		return json.Unmarshal(ib.Get(boltImportKey), imp)
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return imp, err
+	return imp, nil
 }
 
-// GetVersions gets a list of Versions for an Import.
-func (s *BoltDB) GetVersions(m *models.Import) ([]*models.Version, error) {
-	key := []byte(m.ImportURL + ":versions")
-	var v []*models.Version
+// ListImports gets all Imports.
+func (s *BoltDB) ListImports(ctx context.Context) ([]*models.Import, error) {
+	imports := []*models.Import{}
 
-	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(boltMetaBucket)
-		val := b.Get(key)
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMetaBucket).Bucket(boltImportsBucket)
+		return b.ForEach(func(k, val []byte) error {
+			m := &models.Import{}
+			if err := json.Unmarshal(b.Bucket(k).Get(boltImportKey), m); err != nil {
+				return err
+			}
+			imports = append(imports, m)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		if val == nil {
+	return imports, nil
+}
+
+// GetVersions gets a list of Versions for an Import.
+func (s *BoltDB) GetVersions(ctx context.Context, m *models.Import) ([]*models.Version, error) {
+	versions := []*models.Version{}
+
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		ib := importBucket(tx.Bucket(boltMetaBucket), m.ImportURL)
+		if ib == nil {
 			return util.ErrNotFound
 		}
 
-		err := json.Unmarshal(val, v)
-		return err
+		return ib.Bucket(boltVersionsBucket).ForEach(func(k, val []byte) error {
+			v := &models.Version{}
+			if err := json.Unmarshal(val, v); err != nil {
+				return err
+			}
+			versions = append(versions, v)
+			return nil
+		})
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return v, err
+	return versions, nil
 }
 
-// DisableImport disables an import and all its versions.
-func (s *BoltDB) DisableImport(url string) error {
-	key := []byte(url)
+// VersionsByDigest gets all Versions, across all Imports, whose binary has the given digest.
+func (s *BoltDB) VersionsByDigest(ctx context.Context, digest string) ([]*models.Version, error) {
+	prefix := []byte(digest + "\x00")
+	return s.scanIndex(ctx, boltDigestsBucket, prefix, len(prefix), true)
+}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
+// VersionsPublishedSince gets all Versions, across all Imports, published at or after t in publish order.
+func (s *BoltDB) VersionsPublishedSince(ctx context.Context, t time.Time) ([]*models.Version, error) {
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, uint64(t.UnixNano()))
+	return s.scanIndex(ctx, boltPublishedBucket, start, len(start), false)
+}
+
+// scanIndex returns the Versions referenced by index entries from seek onwards, stopping at the
+// first entry that does not start with seek if prefixOnly is set. Each entry ends with the URL
+// and name of the Version after headerLen bytes.
+func (s *BoltDB) scanIndex(ctx context.Context, index, seek []byte, headerLen int, prefixOnly bool) ([]*models.Version, error) {
+	versions := []*models.Version{}
+
+	err := s.view(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltMetaBucket)
-		mB := b.Get(key)
-		m := &models.Import{}
-		if mB == nil {
-			return nil
-		}
+		c := b.Bucket(index).Cursor()
 
-		if err := json.Unmarshal(mB, m); err != nil {
-			return err
-		}
+		for k, _ := c.Seek(seek); k != nil; k, _ = c.Next() {
+			if prefixOnly && !bytes.HasPrefix(k, seek) {
+				break
+			}
 
-		m.Disabled = true
-		mB, err := json.Marshal(m)
-		if err != nil {
-			return err
+			fields := bytes.SplitN(k[headerLen:], []byte("\x00"), 2)
+			if len(fields) != 2 {
+				continue
+			}
+
+			ib := importBucket(b, string(fields[0]))
+			if ib == nil {
+				continue
+			}
+
+			_, v, err := getVersion(ib, string(fields[1]))
+			if err != nil {
+				return err
+			}
+			if v != nil {
+				versions = append(versions, v)
+			}
 		}
-		return b.Put(key, mB)
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// DisableImport disables an import and all its versions.
+func (s *BoltDB) DisableImport(ctx context.Context, url string) error {
+	return s.setImportDisabled(ctx, url, true)
 }
 
 // DisableVersion disables a version.
-func (s *BoltDB) DisableVersion(m *models.Import, v *models.Version) error {
-	key := []byte(v.ImportURL + ":versions")
+func (s *BoltDB) DisableVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	return s.setVersionDisabled(ctx, v, true)
+}
+
+// EnableImport enables an import and all its versions.
+func (s *BoltDB) EnableImport(ctx context.Context, url string) error {
+	return s.setImportDisabled(ctx, url, false)
+}
+
+// EnableVersion enables a version.
+func (s *BoltDB) EnableVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	return s.setVersionDisabled(ctx, v, false)
+}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
+// DeleteImport deletes an import and all its versions.
+func (s *BoltDB) DeleteImport(ctx context.Context, url string) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltMetaBucket)
-		versionsB := b.Get(key)
-		versions := []*models.Version{}
-		if versionsB == nil {
+		ib := importBucket(b, url)
+		if ib == nil {
 			return nil
 		}
 
-		if err := json.Unmarshal(versionsB, versions); err != nil {
-			return err
-		}
-
-		for _, ver := range versions {
-			if v.Name == ver.Name {
-				ver.Disabled = true
-				break
+		if err := ib.Bucket(boltVersionsBucket).ForEach(func(k, val []byte) error {
+			v := &models.Version{}
+			if err := json.Unmarshal(val, v); err != nil {
+				return err
 			}
-		}
-
-		versionsB, err := json.Marshal(m)
-		if err != nil {
+			return indexVersion(b, v, false)
+		}); err != nil {
 			return err
 		}
-		return b.Put(key, versionsB)
+
+		return b.Bucket(boltImportsBucket).DeleteBucket([]byte(url))
 	})
 }
 
-// EnableImport enables an import and all its versions.
-func (s *BoltDB) EnableImport(url string) error {
-	key := []byte(url)
-
-	return s.db.Update(func(tx *bolt.Tx) error {
+// DeleteVersion deletes a version.
+func (s *BoltDB) DeleteVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
 		b := tx.Bucket(boltMetaBucket)
-		mB := b.Get(key)
-		m := &models.Import{}
-		if mB == nil {
+		ib := importBucket(b, v.ImportURL)
+		if ib == nil {
 			return nil
 		}
 
-		if err := json.Unmarshal(mB, m); err != nil {
+		key, ver, err := getVersion(ib, v.Name)
+		if err != nil || ver == nil {
 			return err
 		}
 
-		m.Disabled = false
-		mB, err := json.Marshal(m)
-		if err != nil {
+		if err := indexVersion(b, ver, false); err != nil {
+			return err
+		}
+		if err := ib.Bucket(boltNamesBucket).Delete([]byte(v.Name)); err != nil {
 			return err
 		}
-		return b.Put(key, mB)
+		return ib.Bucket(boltVersionsBucket).Delete(key)
 	})
 }
 
-// EnableVersion enables a version.
-func (s *BoltDB) EnableVersion(m *models.Import, v *models.Version) error {
-	key := []byte(v.ImportURL + ":versions")
+// AddOrganization adds an Organization, util.ErrAlreadyExists if one has the same name.
+func (s *BoltDB) AddOrganization(ctx context.Context, o *models.Organization) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltOrgsBucket)
+		if b.Get([]byte(o.Name)) != nil {
+			return util.ErrAlreadyExists
+		}
+		return putOrganization(b, o)
+	})
+}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(boltMetaBucket)
-		versionsB := b.Get(key)
-		versions := []*models.Version{}
-		if versionsB == nil {
-			return nil
+// UpdateOrganization updates an existing Organization.
+func (s *BoltDB) UpdateOrganization(ctx context.Context, o *models.Organization) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltOrgsBucket)
+		if b.Get([]byte(o.Name)) == nil {
+			return util.ErrNotFound
 		}
+		return putOrganization(b, o)
+	})
+}
 
-		if err := json.Unmarshal(versionsB, versions); err != nil {
-			return err
+// GetOrganization gets an Organization.
+func (s *BoltDB) GetOrganization(ctx context.Context, name string) (*models.Organization, error) {
+	o := &models.Organization{}
+
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltOrgsBucket).Get([]byte(name))
+		if val == nil {
+			return util.ErrNotFound
 		}
+		return json.Unmarshal(val, o)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		for _, ver := range versions {
-			if v.Name == ver.Name {
-				ver.Disabled = false
-				break
+	return o, nil
+}
+
+// ListOrganizations lists all Organizations sorted by name.
+func (s *BoltDB) ListOrganizations(ctx context.Context) ([]*models.Organization, error) {
+	orgs := []*models.Organization{}
+
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOrgsBucket).ForEach(func(k, val []byte) error {
+			o := &models.Organization{}
+			if err := json.Unmarshal(val, o); err != nil {
+				return err
 			}
-		}
+			orgs = append(orgs, o)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		versionsB, err := json.Marshal(m)
-		if err != nil {
-			return err
-		}
-		return b.Put(key, versionsB)
+	return orgs, nil
+}
+
+// DeleteOrganization deletes an Organization, its Imports are kept.
+func (s *BoltDB) DeleteOrganization(ctx context.Context, name string) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOrgsBucket).Delete([]byte(name))
 	})
 }
 
-// DeleteImport deletes an import and all its versions.
-func (s *BoltDB) DeleteImport(url string) error {
-	key := []byte(url)
+func putOrganization(b *bolt.Bucket, o *models.Organization) error {
+	val, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(o.Name), val)
+}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(boltMetaBucket)
-		if err := b.Delete(key); err != nil {
+func (s *BoltDB) setImportDisabled(ctx context.Context, url string, disabled bool) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		ib := importBucket(tx.Bucket(boltMetaBucket), url)
+		if ib == nil {
+			return nil
+		}
+
+		m := &models.Import{}
+		if err := json.Unmarshal(ib.Get(boltImportKey), m); err != nil {
 			return err
 		}
 
-		key = append(key, []byte(":versions")...)
-		return b.Delete(key)
+		m.Disabled = disabled
+		val, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return ib.Put(boltImportKey, val)
 	})
 }
 
-// DeleteVersion deletes a version.
-func (s *BoltDB) DeleteVersion(m *models.Import, v *models.Version) error {
-	key := []byte(v.ImportURL + ":versions")
-
-	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(boltMetaBucket)
-		versionsB := b.Get(key)
-		var versions []*models.Version
-
-		if versionsB == nil {
-			versions = []*models.Version{}
-		} else {
-			err := json.Unmarshal(versionsB, versions)
-			if err != nil {
-				return err
-			}
+func (s *BoltDB) setVersionDisabled(ctx context.Context, v *models.Version, disabled bool) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		ib := importBucket(tx.Bucket(boltMetaBucket), v.ImportURL)
+		if ib == nil {
+			return nil
 		}
 
-		newVersions := []*models.Version{}
-		for _, ver := range versions {
-			if ver.Name == v.Name {
-				continue
-			}
-			newVersions = append(newVersions, ver)
+		key, ver, err := getVersion(ib, v.Name)
+		if err != nil || ver == nil {
+			return err
 		}
 
-		val, err := json.Marshal(newVersions)
+		ver.Disabled = disabled
+		val, err := json.Marshal(ver)
 		if err != nil {
 			return err
 		}
-
-		return b.Put(key, val)
+		return ib.Bucket(boltVersionsBucket).Put(key, val)
 	})
 }
+
+// Close the BoltDB file.
+func (s *BoltDB) Close() error {
+	return s.db.Close()
+}
+
+// update runs fn in a read-write transaction unless ctx is already done.
+func (s *BoltDB) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(fn)
+}
+
+// view runs fn in a read-only transaction unless ctx is already done.
+func (s *BoltDB) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.View(fn)
+}
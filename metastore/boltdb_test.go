@@ -0,0 +1,135 @@
+package metastore
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/deejross/dep-registry/models"
+)
+
+func TestBoltMigrateFlatLayout(t *testing.T) {
+	ctx := context.Background()
+
+	name := filepath.Join(t.TempDir(), "metastore.bolt")
+	m := models.NewImport("example.com/pkg")
+	v := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+
+	db, err := bolt.Open(name, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		mB, _ := json.Marshal(m)
+		vB, _ := json.Marshal([]*models.Version{v})
+		if err := b.Put([]byte(m.ImportURL), mB); err != nil {
+			return err
+		}
+		return b.Put([]byte(m.ImportURL+":versions"), vB)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := NewBoltMetaStore("boltdb://" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetImport(ctx, m.ImportURL); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := s.GetVersions(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].BinID != v.BinID {
+		t.Fatal("Expected migrated version, got", versions)
+	}
+
+	if err := s.(*BoltDB).db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).ForEach(func(k, val []byte) error {
+			if val != nil {
+				t.Fatal("Expected old key to be removed:", string(k))
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltIndexes(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewBoltMetaStore("boltdb://" + filepath.Join(t.TempDir(), "metastore.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := s.(*BoltDB)
+
+	m := models.NewImport("example.com/pkg")
+	if err := s.AddImportIfNotExists(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().UTC()
+	names := []string{"1.0.0", "1.1.0", "2.0.0"}
+	for i, name := range names {
+		v := models.NewVersion(m, name, models.ArchTarGz)
+		v.Published = start.Add(time.Duration(i) * time.Hour)
+		v.Digest = "sha256:same"
+		if name == "2.0.0" {
+			v.Digest = "sha256:other"
+		}
+		if err := s.AddVersion(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since, err := bs.VersionsPublishedSince(ctx, start.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(since) != 2 || since[0].Name != "1.1.0" || since[1].Name != "2.0.0" {
+		t.Fatal("Expected 1.1.0 and 2.0.0, got", since)
+	}
+
+	same, err := bs.VersionsByDigest(ctx, "sha256:same")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(same) != 2 {
+		t.Fatal("Expected 2 versions with digest sha256:same, got", len(same))
+	}
+
+	if err := s.DeleteVersion(ctx, m, &models.Version{ImportURL: m.ImportURL, Name: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	same, err = bs.VersionsByDigest(ctx, "sha256:same")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(same) != 1 || same[0].Name != "1.1.0" {
+		t.Fatal("Expected deleted version to be removed from the index, got", same)
+	}
+
+	if err := s.DeleteImport(ctx, m.ImportURL); err != nil {
+		t.Fatal(err)
+	}
+	since, err = bs.VersionsPublishedSince(ctx, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(since) != 0 {
+		t.Fatal("Expected deleted import to be removed from the index, got", since)
+	}
+}
@@ -0,0 +1,219 @@
+package metastore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// Cached wraps another MetaStore, caching Imports and Versions read from it. Entries are
+// invalidated by writes made through the Cached MetaStore, writes made by other processes
+// are seen once the entries expire.
+type Cached struct {
+	meta  MetaStore
+	cache *util.LRU
+}
+
+// cachedImport and cachedVersions are the cached results of GetImport and GetVersions.
+type cachedImport struct {
+	m   *models.Import
+	err error
+}
+
+type cachedVersions struct {
+	versions []*models.Version
+	err      error
+}
+
+// NewCachedMetaStore creates a new Cached MetaStore around meta holding up to size entries, each for up to ttl.
+func NewCachedMetaStore(meta MetaStore, size int, ttl time.Duration) *Cached {
+	return &Cached{
+		meta:  meta,
+		cache: util.NewLRU(size, ttl),
+	}
+}
+
+func importKey(url string) string {
+	return "import:" + url
+}
+
+func versionsKey(url string) string {
+	return "versions:" + url
+}
+
+// invalidate removes the cached Import and Versions of the given import URLs.
+func (s *Cached) invalidate(urls ...string) {
+	keys := make([]string, 0, len(urls)*2)
+	for _, url := range urls {
+		keys = append(keys, importKey(url), versionsKey(url))
+	}
+	s.cache.Remove(keys...)
+}
+
+// AddImportIfNotExists adds an Import if it doesn't exist.
+func (s *Cached) AddImportIfNotExists(ctx context.Context, m *models.Import) error {
+	defer s.invalidate(m.ImportURL)
+	return s.meta.AddImportIfNotExists(ctx, m)
+}
+
+// UpdateImport updates an import.
+func (s *Cached) UpdateImport(ctx context.Context, m *models.Import) error {
+	defer s.invalidate(m.ImportURL)
+	return s.meta.UpdateImport(ctx, m)
+}
+
+// AddVersion adds a Version to an import.
+func (s *Cached) AddVersion(ctx context.Context, v *models.Version) error {
+	defer s.invalidate(v.ImportURL)
+	return s.meta.AddVersion(ctx, v)
+}
+
+// UpdateVersion updates an existing Version.
+func (s *Cached) UpdateVersion(ctx context.Context, v *models.Version) error {
+	defer s.invalidate(v.ImportURL)
+	return s.meta.UpdateVersion(ctx, v)
+}
+
+// GetImport gets an Import.
+func (s *Cached) GetImport(ctx context.Context, url string) (*models.Import, error) {
+	key := importKey(url)
+	if val, ok := s.cache.Get(key); ok {
+		entry := val.(*cachedImport)
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		c := copyImport(entry.m)
+		return &c, nil
+	}
+
+	gen := s.cache.Generation()
+	m, err := s.meta.GetImport(ctx, url)
+	if err != nil && err != util.ErrNotFound {
+		return nil, err
+	}
+
+	entry := &cachedImport{err: err}
+	if m != nil {
+		c := copyImport(m)
+		entry.m = &c
+	}
+	s.cache.Add(key, entry, gen)
+
+	return m, err
+}
+
+// ListImports gets all Imports, it is not cached.
+func (s *Cached) ListImports(ctx context.Context) ([]*models.Import, error) {
+	return s.meta.ListImports(ctx)
+}
+
+// GetVersions gets a list of Versions for an Import.
+func (s *Cached) GetVersions(ctx context.Context, m *models.Import) ([]*models.Version, error) {
+	key := versionsKey(m.ImportURL)
+	if val, ok := s.cache.Get(key); ok {
+		entry := val.(*cachedVersions)
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return copyVersions(entry.versions), nil
+	}
+
+	gen := s.cache.Generation()
+	versions, err := s.meta.GetVersions(ctx, m)
+	if err != nil && err != util.ErrNotFound {
+		return nil, err
+	}
+
+	s.cache.Add(key, &cachedVersions{versions: copyVersions(versions), err: err}, gen)
+	return versions, err
+}
+
+// DisableImport disables an import and all its versions.
+func (s *Cached) DisableImport(ctx context.Context, url string) error {
+	defer s.invalidate(url)
+	return s.meta.DisableImport(ctx, url)
+}
+
+// DisableVersion disables a version.
+func (s *Cached) DisableVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	defer s.invalidate(m.ImportURL, v.ImportURL)
+	return s.meta.DisableVersion(ctx, m, v)
+}
+
+// EnableImport enables an import and all its versions.
+func (s *Cached) EnableImport(ctx context.Context, url string) error {
+	defer s.invalidate(url)
+	return s.meta.EnableImport(ctx, url)
+}
+
+// EnableVersion enables a version.
+func (s *Cached) EnableVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	defer s.invalidate(m.ImportURL, v.ImportURL)
+	return s.meta.EnableVersion(ctx, m, v)
+}
+
+// DeleteImport deletes an import and all its versions.
+func (s *Cached) DeleteImport(ctx context.Context, url string) error {
+	defer s.invalidate(url)
+	return s.meta.DeleteImport(ctx, url)
+}
+
+// DeleteVersion deletes a version.
+func (s *Cached) DeleteVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	defer s.invalidate(m.ImportURL, v.ImportURL)
+	return s.meta.DeleteVersion(ctx, m, v)
+}
+
+// AddOrganization adds an Organization, Organizations are not cached.
+func (s *Cached) AddOrganization(ctx context.Context, o *models.Organization) error {
+	return s.meta.AddOrganization(ctx, o)
+}
+
+// UpdateOrganization updates an existing Organization.
+func (s *Cached) UpdateOrganization(ctx context.Context, o *models.Organization) error {
+	return s.meta.UpdateOrganization(ctx, o)
+}
+
+// GetOrganization gets an Organization.
+func (s *Cached) GetOrganization(ctx context.Context, name string) (*models.Organization, error) {
+	return s.meta.GetOrganization(ctx, name)
+}
+
+// ListOrganizations lists all Organizations sorted by name.
+func (s *Cached) ListOrganizations(ctx context.Context) ([]*models.Organization, error) {
+	return s.meta.ListOrganizations(ctx)
+}
+
+// DeleteOrganization deletes an Organization, its Imports are kept.
+func (s *Cached) DeleteOrganization(ctx context.Context, name string) error {
+	return s.meta.DeleteOrganization(ctx, name)
+}
+
+// Purge removes every entry from the cache.
+func (s *Cached) Purge() {
+	s.cache.Purge()
+}
+
+// Close the wrapped MetaStore if it can be closed.
+func (s *Cached) Close() error {
+	if c, ok := s.meta.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func copyVersions(versions []*models.Version) []*models.Version {
+	if versions == nil {
+		return nil
+	}
+
+	copies := make([]*models.Version, len(versions))
+	for i, v := range versions {
+		c := *v
+		copies[i] = &c
+	}
+	return copies
+}
@@ -0,0 +1,107 @@
+package metastore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/models"
+)
+
+// countingMetaStore counts reads of Imports and Versions.
+type countingMetaStore struct {
+	MetaStore
+	imports  int
+	versions int
+}
+
+func (s *countingMetaStore) GetImport(ctx context.Context, url string) (*models.Import, error) {
+	s.imports++
+	return s.MetaStore.GetImport(ctx, url)
+}
+
+func (s *countingMetaStore) GetVersions(ctx context.Context, m *models.Import) ([]*models.Version, error) {
+	s.versions++
+	return s.MetaStore.GetVersions(ctx, m)
+}
+
+func TestCachedReadsThrough(t *testing.T) {
+	ctx := context.Background()
+
+	inner := &countingMetaStore{MetaStore: NewMemoryMetaStore()}
+	s := NewCachedMetaStore(inner, 10, time.Minute)
+
+	m := models.NewImport("example.com/pkg")
+	if err := s.AddImportIfNotExists(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddVersion(ctx, models.NewVersion(m, "1.0.0", models.ArchTarGz)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		got, err := s.GetImport(ctx, m.ImportURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Description = "changed by caller"
+
+		versions, err := s.GetVersions(ctx, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions[0].Disabled = true
+	}
+	if inner.imports != 1 || inner.versions != 1 {
+		t.Fatal("Expected 1 read of each, got", inner.imports, inner.versions)
+	}
+
+	got, _ := s.GetImport(ctx, m.ImportURL)
+	versions, _ := s.GetVersions(ctx, m)
+	if len(got.Description) > 0 || versions[0].Disabled {
+		t.Fatal("Expected cached entries not to be changed by callers")
+	}
+
+	if err := s.DisableVersion(ctx, m, versions[0]); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := s.GetVersions(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !versions[0].Disabled || inner.versions != 2 {
+		t.Fatal("Expected disabled version to be read again")
+	}
+
+	m.Description = "updated"
+	if err := s.UpdateImport(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.GetImport(ctx, m.ImportURL); got.Description != "updated" {
+		t.Fatal("Expected updated import, got", got)
+	}
+}
+
+func TestCachedExpires(t *testing.T) {
+	ctx := context.Background()
+
+	inner := &countingMetaStore{MetaStore: NewMemoryMetaStore()}
+	s := NewCachedMetaStore(inner, 10, time.Millisecond)
+
+	m := models.NewImport("example.com/pkg")
+	if err := inner.AddImportIfNotExists(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	s.GetImport(ctx, m.ImportURL)
+
+	// Written by another process, seen once the entry expires.
+	m.Description = "updated"
+	if err := inner.UpdateImport(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if got, _ := s.GetImport(ctx, m.ImportURL); got.Description != "updated" {
+		t.Fatal("Expected updated import after expiry, got", got)
+	}
+}
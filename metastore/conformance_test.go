@@ -0,0 +1,59 @@
+package metastore_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/metastore"
+	"github.com/deejross/dep-registry/metastore/metastoretest"
+)
+
+func resolve(t *testing.T, path string) metastore.MetaStore {
+	s, err := metastore.Resolve(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBoltConformance(t *testing.T) {
+	metastoretest.Run(t, func(t *testing.T) metastore.MetaStore {
+		return resolve(t, "boltdb://"+filepath.Join(t.TempDir(), "metastore.bolt"))
+	})
+}
+
+func TestMemoryConformance(t *testing.T) {
+	metastoretest.Run(t, func(t *testing.T) metastore.MetaStore {
+		return resolve(t, "memory://")
+	})
+}
+
+func TestCachedConformance(t *testing.T) {
+	metastoretest.Run(t, func(t *testing.T) metastore.MetaStore {
+		return metastore.NewCachedMetaStore(resolve(t, "memory://"), 100, time.Minute)
+	})
+}
+
+func TestPostgresConformance(t *testing.T) {
+	address := os.Getenv("GOREG_TEST_POSTGRES")
+	if len(address) == 0 {
+		t.Skip("GOREG_TEST_POSTGRES not set")
+	}
+
+	db, err := sql.Open("postgres", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	metastoretest.Run(t, func(t *testing.T) metastore.MetaStore {
+		s := resolve(t, address)
+		if _, err := db.Exec(`TRUNCATE imports, versions, organizations`); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,318 @@
+package metastore
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// Memory MetaStore implementation, contents are lost when the process exits.
+// Objects are copied on the way in and out so callers never share state with the store.
+type Memory struct {
+	mu       sync.RWMutex
+	imports  map[string]models.Import
+	versions map[string][]models.Version
+	orgs     map[string]models.Organization
+}
+
+// NewMemoryMetaStore creates a new Memory MetaStore.
+func NewMemoryMetaStore() MetaStore {
+	return &Memory{
+		imports:  map[string]models.Import{},
+		versions: map[string][]models.Version{},
+		orgs:     map[string]models.Organization{},
+	}
+}
+
+// AddImportIfNotExists adds an Import if it doesn't exist.
+func (s *Memory) AddImportIfNotExists(ctx context.Context, m *models.Import) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.imports[m.ImportURL]; ok {
+		return nil
+	}
+
+	s.imports[m.ImportURL] = copyImport(m)
+	return nil
+}
+
+// UpdateImport updates an existing Import.
+func (s *Memory) UpdateImport(ctx context.Context, m *models.Import) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.imports[m.ImportURL] = copyImport(m)
+	return nil
+}
+
+// AddVersion adds a new version to an import.
+func (s *Memory) AddVersion(ctx context.Context, v *models.Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.imports[v.ImportURL]; !ok {
+		return util.ErrNotFound
+	}
+
+	versions := s.versions[v.ImportURL]
+	for _, ver := range versions {
+		if ver.Name == v.Name {
+			return util.ErrAlreadyExists
+		}
+	}
+
+	s.versions[v.ImportURL] = append(versions, *v)
+	return nil
+}
+
+// UpdateVersion updates an existing Version.
+func (s *Memory) UpdateVersion(ctx context.Context, v *models.Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := s.versions[v.ImportURL]
+	for i := range versions {
+		if versions[i].Name == v.Name {
+			versions[i] = *v
+			return nil
+		}
+	}
+
+	return util.ErrNotFound
+}
+
+// GetImport gets an Import.
+func (s *Memory) GetImport(ctx context.Context, url string) (*models.Import, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, ok := s.imports[url]
+	if !ok {
+		return nil, util.ErrNotFound
+	}
+
+	m = copyImport(&m)
+	return &m, nil
+}
+
+// ListImports gets all Imports.
+func (s *Memory) ListImports(ctx context.Context) ([]*models.Import, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	urls := make([]string, 0, len(s.imports))
+	for url := range s.imports {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	imports := make([]*models.Import, len(urls))
+	for i, url := range urls {
+		m := s.imports[url]
+		m = copyImport(&m)
+		imports[i] = &m
+	}
+
+	return imports, nil
+}
+
+// GetVersions gets a list of Versions for an Import.
+func (s *Memory) GetVersions(ctx context.Context, m *models.Import) ([]*models.Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.imports[m.ImportURL]; !ok {
+		return nil, util.ErrNotFound
+	}
+
+	versions := s.versions[m.ImportURL]
+	list := make([]*models.Version, len(versions))
+	for i := range versions {
+		v := versions[i]
+		list[i] = &v
+	}
+
+	return list, nil
+}
+
+// DisableImport disables an import and all its versions.
+func (s *Memory) DisableImport(ctx context.Context, url string) error {
+	return s.setImportDisabled(url, true)
+}
+
+// DisableVersion disables a version.
+func (s *Memory) DisableVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	return s.setVersionDisabled(v, true)
+}
+
+// EnableImport enables an import and all its versions.
+func (s *Memory) EnableImport(ctx context.Context, url string) error {
+	return s.setImportDisabled(url, false)
+}
+
+// EnableVersion enables a version.
+func (s *Memory) EnableVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	return s.setVersionDisabled(v, false)
+}
+
+// DeleteImport deletes an import and all its versions.
+func (s *Memory) DeleteImport(ctx context.Context, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.imports, url)
+	delete(s.versions, url)
+	return nil
+}
+
+// DeleteVersion deletes a version.
+func (s *Memory) DeleteVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := s.versions[v.ImportURL]
+	newVersions := []models.Version{}
+	for _, ver := range versions {
+		if ver.Name == v.Name {
+			continue
+		}
+		newVersions = append(newVersions, ver)
+	}
+
+	s.versions[v.ImportURL] = newVersions
+	return nil
+}
+
+// AddOrganization adds an Organization, util.ErrAlreadyExists if one has the same name.
+func (s *Memory) AddOrganization(ctx context.Context, o *models.Organization) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orgs[o.Name]; ok {
+		return util.ErrAlreadyExists
+	}
+
+	s.orgs[o.Name] = copyOrganization(o)
+	return nil
+}
+
+// UpdateOrganization updates an existing Organization.
+func (s *Memory) UpdateOrganization(ctx context.Context, o *models.Organization) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orgs[o.Name]; !ok {
+		return util.ErrNotFound
+	}
+
+	s.orgs[o.Name] = copyOrganization(o)
+	return nil
+}
+
+// GetOrganization gets an Organization.
+func (s *Memory) GetOrganization(ctx context.Context, name string) (*models.Organization, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	o, ok := s.orgs[name]
+	if !ok {
+		return nil, util.ErrNotFound
+	}
+
+	o = copyOrganization(&o)
+	return &o, nil
+}
+
+// ListOrganizations lists all Organizations sorted by name.
+func (s *Memory) ListOrganizations(ctx context.Context) ([]*models.Organization, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.orgs))
+	for name := range s.orgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	orgs := make([]*models.Organization, len(names))
+	for i, name := range names {
+		o := s.orgs[name]
+		o = copyOrganization(&o)
+		orgs[i] = &o
+	}
+
+	return orgs, nil
+}
+
+// DeleteOrganization deletes an Organization, its Imports are kept.
+func (s *Memory) DeleteOrganization(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.orgs, name)
+	return nil
+}
+
+func (s *Memory) setImportDisabled(url string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.imports[url]
+	if !ok {
+		return nil
+	}
+
+	m.Disabled = disabled
+	s.imports[url] = m
+	return nil
+}
+
+func (s *Memory) setVersionDisabled(v *models.Version, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := s.versions[v.ImportURL]
+	for i := range versions {
+		if versions[i].Name == v.Name {
+			versions[i].Disabled = disabled
+			break
+		}
+	}
+
+	return nil
+}
+
+// copyImport returns a copy of m that does not share its Owners, Readers and Grants slices.
+func copyImport(m *models.Import) models.Import {
+	c := *m
+	if m.Owners != nil {
+		c.Owners = append([]string{}, m.Owners...)
+	}
+	if m.Readers != nil {
+		c.Readers = append([]string{}, m.Readers...)
+	}
+	if m.Grants != nil {
+		c.Grants = append([]models.Grant{}, m.Grants...)
+	}
+	return c
+}
+
+// copyOrganization returns a copy of o that shares none of its slices.
+func copyOrganization(o *models.Organization) models.Organization {
+	c := *o
+	c.Prefixes = append([]string{}, o.Prefixes...)
+	if o.Owners != nil {
+		c.Owners = append([]string{}, o.Owners...)
+	}
+	if o.Readers != nil {
+		c.Readers = append([]string{}, o.Readers...)
+	}
+	if o.Grants != nil {
+		c.Grants = append([]models.Grant{}, o.Grants...)
+	}
+	return c
+}
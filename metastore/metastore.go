@@ -1,39 +1,64 @@
 package metastore
 
-import "github.com/deejross/dep-registry/models"
+import (
+	"context"
+
+	"github.com/deejross/dep-registry/models"
+)
 
 // MetaStore represents a metadata store.
 type MetaStore interface {
 	// AddUpdateImport adds an Import if it doesn't exist.
-	AddImportIfNotExists(m *models.Import) error
+	AddImportIfNotExists(ctx context.Context, m *models.Import) error
 
 	// UpdateImport updates an import.
-	UpdateImport(m *models.Import) error
+	UpdateImport(ctx context.Context, m *models.Import) error
 
 	// AddVersion adds a Version to an import.
-	AddVersion(v *models.Version) error
+	AddVersion(ctx context.Context, v *models.Version) error
+
+	// UpdateVersion updates an existing Version.
+	UpdateVersion(ctx context.Context, v *models.Version) error
 
 	// GetImport gets an Import.
-	GetImport(url string) (*models.Import, error)
+	GetImport(ctx context.Context, url string) (*models.Import, error)
+
+	// ListImports gets all Imports.
+	ListImports(ctx context.Context) ([]*models.Import, error)
 
 	// GetVersions gets a list of Versions for an Import.
-	GetVersions(m *models.Import) ([]*models.Version, error)
+	GetVersions(ctx context.Context, m *models.Import) ([]*models.Version, error)
 
 	// DisableImport disables an import and all its versions.
-	DisableImport(url string) error
+	DisableImport(ctx context.Context, url string) error
 
 	// DisableVersion disables a version.
-	DisableVersion(m *models.Import, v *models.Version) error
+	DisableVersion(ctx context.Context, m *models.Import, v *models.Version) error
 
 	// EnableImport enables an import and all its versions.
-	EnableImport(url string) error
+	EnableImport(ctx context.Context, url string) error
 
 	// EnableVersion enables a version.
-	EnableVersion(m *models.Import, v *models.Version) error
+	EnableVersion(ctx context.Context, m *models.Import, v *models.Version) error
 
 	// DeleteImport deletes an import and all its versions.
-	DeleteImport(url string) error
+	DeleteImport(ctx context.Context, url string) error
 
 	// DeleteVersion deletes a version.
-	DeleteVersion(m *models.Import, v *models.Version) error
+	DeleteVersion(ctx context.Context, m *models.Import, v *models.Version) error
+
+	// AddOrganization adds an Organization, util.ErrAlreadyExists if one has the same name.
+	AddOrganization(ctx context.Context, o *models.Organization) error
+
+	// UpdateOrganization updates an existing Organization.
+	UpdateOrganization(ctx context.Context, o *models.Organization) error
+
+	// GetOrganization gets an Organization.
+	GetOrganization(ctx context.Context, name string) (*models.Organization, error)
+
+	// ListOrganizations lists all Organizations sorted by name.
+	ListOrganizations(ctx context.Context) ([]*models.Organization, error)
+
+	// DeleteOrganization deletes an Organization, its Imports are kept.
+	DeleteOrganization(ctx context.Context, name string) error
 }
@@ -0,0 +1,555 @@
+// Package metastoretest provides a conformance suite that every MetaStore backend must pass.
+package metastoretest
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/metastore"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// Run the conformance suite. newStore must return a new, empty MetaStore each time it is called.
+func Run(t *testing.T, newStore func(t *testing.T) metastore.MetaStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s metastore.MetaStore)
+	}{
+		{"AddGetImport", testAddGetImport},
+		{"AddImportIfNotExists", testAddImportIfNotExists},
+		{"UpdateImport", testUpdateImport},
+		{"ImportNotFound", testImportNotFound},
+		{"ListImports", testListImports},
+		{"AddGetVersions", testAddGetVersions},
+		{"AddVersionDuplicate", testAddVersionDuplicate},
+		{"AddVersionImportNotFound", testAddVersionImportNotFound},
+		{"UpdateVersion", testUpdateVersion},
+		{"UpdateVersionNotFound", testUpdateVersionNotFound},
+		{"GetVersionsEmpty", testGetVersionsEmpty},
+		{"EnableDisableImport", testEnableDisableImport},
+		{"EnableDisableVersion", testEnableDisableVersion},
+		{"DeleteImport", testDeleteImport},
+		{"DeleteVersion", testDeleteVersion},
+		{"ReturnedObjectsAreCopies", testReturnedObjectsAreCopies},
+		{"ConcurrentAddVersion", testConcurrentAddVersion},
+		{"ConcurrentAddVersionDuplicate", testConcurrentAddVersionDuplicate},
+		{"Organizations", testOrganizations},
+	}
+
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			fn(t, newStore(t))
+		})
+	}
+}
+
+func newImport(t *testing.T, s metastore.MetaStore, url string) *models.Import {
+	ctx := context.Background()
+
+	m := models.NewImport(url)
+	m.Description = "A package"
+	m.Owners = []string{"owner"}
+	m.Readers = []string{"reader"}
+	m.Grants = []models.Grant{{Team: "payments", Role: models.RolePublisher}}
+
+	if err := s.AddImportIfNotExists(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func addVersions(t *testing.T, s metastore.MetaStore, m *models.Import, names ...string) []*models.Version {
+	ctx := context.Background()
+
+	versions := []*models.Version{}
+	for _, name := range names {
+		v := models.NewVersion(m, name, models.ArchTarGz)
+		v.Digest = "sha256:" + name
+		v.Size = int64(len(name))
+		v.Encoding, v.StoredSize = models.EncodingGzip, int64(len(name))/2
+		if err := s.AddVersion(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func getVersions(t *testing.T, s metastore.MetaStore, m *models.Import) []*models.Version {
+	ctx := context.Background()
+
+	versions, err := s.GetVersions(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+func testAddGetImport(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+
+	got, err := s.GetImport(ctx, m.ImportURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ImportURL != m.ImportURL || got.Name != m.Name || got.Description != m.Description {
+		t.Fatal("Expected", m, "got", got)
+	}
+	if len(got.Owners) != 1 || got.Owners[0] != "owner" || len(got.Readers) != 1 || got.Readers[0] != "reader" {
+		t.Fatal("Expected owners and readers to be stored, got", got.Owners, got.Readers)
+	}
+	if len(got.Grants) != 1 || got.Grants[0] != m.Grants[0] {
+		t.Fatal("Expected grants to be stored, got", got.Grants)
+	}
+}
+
+func testAddImportIfNotExists(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+
+	m2 := models.NewImport(m.ImportURL)
+	m2.Description = "Something else"
+	if err := s.AddImportIfNotExists(ctx, m2); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetImport(ctx, m.ImportURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Description != m.Description {
+		t.Fatal("Expected existing Import to be kept, got description", got.Description)
+	}
+}
+
+func testUpdateImport(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+	m.Description = "Updated"
+	m.Private = true
+
+	if err := s.UpdateImport(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetImport(ctx, m.ImportURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Description != "Updated" || !got.Private {
+		t.Fatal("Expected Import to be updated, got", got)
+	}
+}
+
+func testImportNotFound(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	if _, err := s.GetImport(ctx, "example.com/none"); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+	if _, err := s.GetVersions(ctx, models.NewImport("example.com/none")); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+}
+
+func testListImports(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	imports, err := s.ListImports(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != 0 {
+		t.Fatal("Expected no Imports, got", len(imports))
+	}
+
+	newImport(t, s, "example.com/b")
+	newImport(t, s, "example.com/a")
+	addVersions(t, s, newImport(t, s, "example.com/c"), "1.0.0")
+
+	imports, err = s.ListImports(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != 3 {
+		t.Fatal("Expected 3 Imports, got", len(imports))
+	}
+	for i, url := range []string{"example.com/a", "example.com/b", "example.com/c"} {
+		if imports[i].ImportURL != url || len(imports[i].Owners) != 1 {
+			t.Fatal("Expected Imports ordered by URL, got", imports[i].ImportURL, "at", i)
+		}
+	}
+}
+
+func testAddGetVersions(t *testing.T, s metastore.MetaStore) {
+	m := newImport(t, s, "example.com/pkg")
+	added := addVersions(t, s, m, "1.0.0", "1.1.0", "0.9.0")
+
+	versions := getVersions(t, s, m)
+	if len(versions) != len(added) {
+		t.Fatal("Expected", len(added), "versions, got", len(versions))
+	}
+
+	for i, v := range versions {
+		if v.Name != added[i].Name || v.BinID != added[i].BinID || v.ImportURL != m.ImportURL || v.ArchiveType != models.ArchTarGz {
+			t.Fatal("Expected versions in the order they were added, got", v, "at", i)
+		}
+		if v.Digest != added[i].Digest {
+			t.Fatal("Expected digest", added[i].Digest, "got", v.Digest)
+		}
+		if v.Size != added[i].Size || v.Encoding != added[i].Encoding || v.StoredSize != added[i].StoredSize {
+			t.Fatal("Expected size", added[i].Size, "stored as", added[i].Encoding, added[i].StoredSize, "got", v.Size, v.Encoding, v.StoredSize)
+		}
+		if d := v.Published.Sub(added[i].Published); d > time.Millisecond || d < -time.Millisecond {
+			t.Fatal("Expected publish time", added[i].Published, "got", v.Published)
+		}
+	}
+}
+
+func testAddVersionDuplicate(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+	addVersions(t, s, m, "1.0.0")
+
+	if err := s.AddVersion(ctx, models.NewVersion(m, "1.0.0", models.ArchTarGz)); err != util.ErrAlreadyExists {
+		t.Fatal("Expected ErrAlreadyExists, got", err)
+	}
+
+	if versions := getVersions(t, s, m); len(versions) != 1 {
+		t.Fatal("Expected 1 version, got", len(versions))
+	}
+}
+
+func testAddVersionImportNotFound(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := models.NewImport("example.com/none")
+	if err := s.AddVersion(ctx, models.NewVersion(m, "1.0.0", models.ArchTarGz)); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+}
+
+func testUpdateVersion(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+	added := addVersions(t, s, m, "1.0.0", "1.1.0")
+
+	v := *added[0]
+	v.State = models.StatePending
+	v.StateSince = time.Now().UTC()
+	v.Digest = "sha256:updated"
+	if err := s.UpdateVersion(ctx, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := getVersions(t, s, m)
+	if len(versions) != 2 || versions[0].Name != "1.0.0" {
+		t.Fatal("Expected update to keep the order of versions, got", versions)
+	}
+	if versions[0].State != models.StatePending || versions[0].Digest != "sha256:updated" {
+		t.Fatal("Expected Version to be updated, got", versions[0])
+	}
+	if d := versions[0].StateSince.Sub(v.StateSince); d > time.Millisecond || d < -time.Millisecond {
+		t.Fatal("Expected state time", v.StateSince, "got", versions[0].StateSince)
+	}
+	if versions[1].State != models.StateCommitted || versions[1].Digest != added[1].Digest {
+		t.Fatal("Expected other Version to be unchanged, got", versions[1])
+	}
+}
+
+func testUpdateVersionNotFound(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+	if err := s.UpdateVersion(ctx, models.NewVersion(m, "1.0.0", models.ArchTarGz)); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+
+	other := models.NewImport("example.com/none")
+	if err := s.UpdateVersion(ctx, models.NewVersion(other, "1.0.0", models.ArchTarGz)); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+}
+
+func testGetVersionsEmpty(t *testing.T, s metastore.MetaStore) {
+	m := newImport(t, s, "example.com/pkg")
+
+	versions := getVersions(t, s, m)
+	if len(versions) != 0 {
+		t.Fatal("Expected no versions, got", len(versions))
+	}
+}
+
+func testEnableDisableImport(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+
+	if err := s.DisableImport(ctx, m.ImportURL); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetImport(ctx, m.ImportURL); err != nil || !got.Disabled {
+		t.Fatal("Expected Import to be disabled, got", got, err)
+	}
+
+	if err := s.EnableImport(ctx, m.ImportURL); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetImport(ctx, m.ImportURL); err != nil || got.Disabled {
+		t.Fatal("Expected Import to be enabled, got", got, err)
+	}
+
+	if err := s.DisableImport(ctx, "example.com/none"); err != nil {
+		t.Fatal("Expected disabling an unknown Import to succeed, got", err)
+	}
+}
+
+func testEnableDisableVersion(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+	added := addVersions(t, s, m, "1.0.0", "1.1.0")
+
+	if err := s.DisableVersion(ctx, m, added[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := getVersions(t, s, m)
+	if !versions[0].Disabled || versions[1].Disabled {
+		t.Fatal("Expected only 1.0.0 to be disabled")
+	}
+
+	if err := s.EnableVersion(ctx, m, added[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	versions = getVersions(t, s, m)
+	if versions[0].Disabled {
+		t.Fatal("Expected 1.0.0 to be enabled")
+	}
+
+	if err := s.DisableVersion(ctx, m, models.NewVersion(m, "2.0.0", models.ArchTarGz)); err != nil {
+		t.Fatal("Expected disabling an unknown Version to succeed, got", err)
+	}
+}
+
+func testDeleteImport(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+	addVersions(t, s, m, "1.0.0")
+	other := newImport(t, s, "example.com/other")
+	addVersions(t, s, other, "1.0.0")
+
+	if err := s.DeleteImport(ctx, m.ImportURL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetImport(ctx, m.ImportURL); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+	if _, err := s.GetVersions(ctx, m); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+
+	// Re-creating the Import must not bring back its old versions.
+	newImport(t, s, m.ImportURL)
+	if versions := getVersions(t, s, m); len(versions) != 0 {
+		t.Fatal("Expected no versions, got", len(versions))
+	}
+
+	if versions := getVersions(t, s, other); len(versions) != 1 {
+		t.Fatal("Expected other Import to keep its version, got", len(versions))
+	}
+
+	if err := s.DeleteImport(ctx, "example.com/none"); err != nil {
+		t.Fatal("Expected deleting an unknown Import to succeed, got", err)
+	}
+}
+
+func testDeleteVersion(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+	added := addVersions(t, s, m, "1.0.0", "1.1.0")
+
+	if err := s.DeleteVersion(ctx, m, added[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := getVersions(t, s, m)
+	if len(versions) != 1 || versions[0].Name != "1.1.0" {
+		t.Fatal("Expected only 1.1.0 to remain, got", versions)
+	}
+
+	if err := s.DeleteVersion(ctx, m, added[0]); err != nil {
+		t.Fatal("Expected deleting an unknown Version to succeed, got", err)
+	}
+}
+
+func testReturnedObjectsAreCopies(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+	addVersions(t, s, m, "1.0.0")
+
+	got, err := s.GetImport(ctx, m.ImportURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Owners[0] = "someone-else"
+	got.Grants[0].Role = models.RoleOwner
+	got.Disabled = true
+
+	versions := getVersions(t, s, m)
+	versions[0].Disabled = true
+
+	got, err = s.GetImport(ctx, m.ImportURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Owners[0] != "owner" || got.Grants[0].Role != models.RolePublisher || got.Disabled {
+		t.Fatal("Expected modifying a returned Import not to change the store")
+	}
+	if getVersions(t, s, m)[0].Disabled {
+		t.Fatal("Expected modifying a returned Version not to change the store")
+	}
+}
+
+func testConcurrentAddVersion(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+	count := 20
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- s.AddVersion(ctx, models.NewVersion(m, "1.0."+strconv.Itoa(i), models.ArchTarGz))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if versions := getVersions(t, s, m); len(versions) != count {
+		t.Fatal("Expected", count, "versions, got", len(versions))
+	}
+}
+
+func testConcurrentAddVersionDuplicate(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	m := newImport(t, s, "example.com/pkg")
+	count := 20
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.AddVersion(ctx, models.NewVersion(m, "1.0.0", models.ArchTarGz))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else if err != util.ErrAlreadyExists {
+			t.Fatal("Expected ErrAlreadyExists, got", err)
+		}
+	}
+
+	if succeeded != 1 {
+		t.Fatal("Expected exactly 1 AddVersion to succeed, got", succeeded)
+	}
+}
+
+func testOrganizations(t *testing.T, s metastore.MetaStore) {
+	ctx := context.Background()
+
+	if _, err := s.GetOrganization(ctx, "payments"); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+	if err := s.UpdateOrganization(ctx, &models.Organization{Name: "payments"}); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+
+	o := &models.Organization{
+		Name:     "payments",
+		Prefixes: []string{"git.example.com/payments"},
+		Private:  true,
+		Owners:   []string{"owner"},
+		Grants:   []models.Grant{{Team: "devs", Role: models.RolePublisher}},
+	}
+	if err := s.AddOrganization(ctx, o); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddOrganization(ctx, o); err != util.ErrAlreadyExists {
+		t.Fatal("Expected ErrAlreadyExists, got", err)
+	}
+	if err := s.AddOrganization(ctx, &models.Organization{Name: "billing", Prefixes: []string{"git.example.com/billing"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetOrganization(ctx, "payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Prefixes) != 1 || !got.Private || got.Owners[0] != "owner" || got.Grants[0] != o.Grants[0] {
+		t.Fatal("Expected the Organization as added, got", got)
+	}
+
+	got.Prefixes[0] = "git.example.com/other"
+	got.Grants[0].Role = models.RoleOwner
+	if again, err := s.GetOrganization(ctx, "payments"); err != nil || again.Prefixes[0] != o.Prefixes[0] || again.Grants[0] != o.Grants[0] {
+		t.Fatal("Expected modifying a returned Organization not to change the store, got", again, err)
+	}
+
+	got.Readers = []string{"reader"}
+	if err := s.UpdateOrganization(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+
+	orgs, err := s.ListOrganizations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 2 || orgs[0].Name != "billing" || orgs[1].Name != "payments" {
+		t.Fatal("Expected Organizations ordered by name, got", orgs)
+	}
+	if len(orgs[1].Readers) != 1 || orgs[1].Prefixes[0] != "git.example.com/other" {
+		t.Fatal("Expected the Organization to be updated, got", orgs[1])
+	}
+
+	if err := s.DeleteOrganization(ctx, "payments"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetOrganization(ctx, "payments"); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+}
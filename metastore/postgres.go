@@ -0,0 +1,441 @@
+package metastore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+	"github.com/lib/pq"
+)
+
+// postgresMigrations are applied in order, each in its own transaction. The index of a
+// migration is its schema version, so existing migrations must never be changed or reordered.
+var postgresMigrations = []string{
+	`CREATE TABLE imports (
+		import_url  TEXT PRIMARY KEY,
+		name        TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		project_url TEXT NOT NULL DEFAULT '',
+		disabled    BOOLEAN NOT NULL DEFAULT FALSE,
+		private     BOOLEAN NOT NULL DEFAULT FALSE,
+		owners      TEXT[] NOT NULL DEFAULT '{}',
+		readers     TEXT[] NOT NULL DEFAULT '{}'
+	);
+	CREATE TABLE versions (
+		seq          BIGSERIAL,
+		import_url   TEXT NOT NULL REFERENCES imports (import_url) ON DELETE CASCADE,
+		name         TEXT NOT NULL,
+		bin_id       TEXT NOT NULL,
+		archive_type TEXT NOT NULL DEFAULT '',
+		disabled     BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (import_url, name)
+	);
+	CREATE INDEX versions_import_seq_idx ON versions (import_url, seq);
+	CREATE UNIQUE INDEX versions_bin_id_idx ON versions (bin_id);`,
+	`ALTER TABLE versions ADD COLUMN digest TEXT NOT NULL DEFAULT '', ADD COLUMN published TIMESTAMPTZ;
+	CREATE INDEX versions_digest_idx ON versions (digest);
+	CREATE INDEX versions_published_idx ON versions (published);`,
+	`ALTER TABLE versions ADD COLUMN state TEXT NOT NULL DEFAULT '';
+	CREATE INDEX versions_state_idx ON versions (state) WHERE state <> '';`,
+	`ALTER TABLE imports ADD COLUMN grants JSONB NOT NULL DEFAULT '[]';`,
+	`CREATE TABLE organizations (
+		name TEXT PRIMARY KEY,
+		data JSONB NOT NULL
+	);`,
+	`ALTER TABLE versions ADD COLUMN size BIGINT NOT NULL DEFAULT 0;`,
+	`ALTER TABLE versions ADD COLUMN encoding TEXT NOT NULL DEFAULT '', ADD COLUMN stored_size BIGINT NOT NULL DEFAULT 0;`,
+	`ALTER TABLE versions ADD COLUMN state_since TIMESTAMPTZ;`,
+}
+
+// Postgres MetaStore implementation.
+type Postgres struct {
+	db *sql.DB
+}
+
+// NewPostgresMetaStore creates a new Postgres interface, applying any outstanding schema migrations.
+func NewPostgresMetaStore(address string) (MetaStore, error) {
+	db, err := sql.Open("postgres", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migratePostgres(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Postgres{
+		db: db,
+	}, nil
+}
+
+// migratePostgres brings the database schema up to date.
+func migratePostgres(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		// Serialize migrations between registry instances starting at the same time.
+		if _, err := tx.Exec(`LOCK TABLE schema_migrations IN EXCLUSIVE MODE`); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		version := 0
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if version > len(postgresMigrations) {
+			tx.Rollback()
+			return errors.New("Database schema version " + strconv.Itoa(version) + " is newer than this build supports")
+		}
+		if version == len(postgresMigrations) {
+			return tx.Rollback()
+		}
+
+		if _, err := tx.Exec(postgresMigrations[version]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+// AddImportIfNotExists adds an Import if it doesn't exist.
+func (s *Postgres) AddImportIfNotExists(ctx context.Context, m *models.Import) error {
+	grants, err := grantsJSON(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `INSERT INTO imports (import_url, name, description, project_url, disabled, private, owners, readers, grants)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (import_url) DO NOTHING`,
+		m.ImportURL, m.Name, m.Description, m.ProjectURL, m.Disabled, m.Private, pq.Array(m.Owners), pq.Array(m.Readers), grants)
+	return err
+}
+
+// UpdateImport updates an existing Import.
+func (s *Postgres) UpdateImport(ctx context.Context, m *models.Import) error {
+	grants, err := grantsJSON(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `INSERT INTO imports (import_url, name, description, project_url, disabled, private, owners, readers, grants)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (import_url) DO UPDATE SET
+		name = EXCLUDED.name, description = EXCLUDED.description, project_url = EXCLUDED.project_url,
+		disabled = EXCLUDED.disabled, private = EXCLUDED.private, owners = EXCLUDED.owners, readers = EXCLUDED.readers,
+		grants = EXCLUDED.grants`,
+		m.ImportURL, m.Name, m.Description, m.ProjectURL, m.Disabled, m.Private, pq.Array(m.Owners), pq.Array(m.Readers), grants)
+	return err
+}
+
+// grantsJSON encodes the Grants of m for the grants column.
+func grantsJSON(m *models.Import) ([]byte, error) {
+	if len(m.Grants) == 0 {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(m.Grants)
+}
+
+// AddVersion adds a new version to an import.
+func (s *Postgres) AddVersion(ctx context.Context, v *models.Version) error {
+	published := pq.NullTime{Time: v.Published, Valid: !v.Published.IsZero()}
+	stateSince := pq.NullTime{Time: v.StateSince, Valid: !v.StateSince.IsZero()}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO versions (import_url, name, bin_id, archive_type, disabled, digest, published, state, size, encoding, stored_size,
+		state_since)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		v.ImportURL, v.Name, v.BinID, string(v.ArchiveType), v.Disabled, v.Digest, published, string(v.State), v.Size,
+		string(v.Encoding), v.StoredSize, stateSince)
+
+	if err, ok := err.(*pq.Error); ok {
+		switch err.Code.Name() {
+		case "unique_violation":
+			return util.ErrAlreadyExists
+		case "foreign_key_violation":
+			return util.ErrNotFound
+		}
+	}
+
+	return err
+}
+
+// UpdateVersion updates an existing Version.
+func (s *Postgres) UpdateVersion(ctx context.Context, v *models.Version) error {
+	published := pq.NullTime{Time: v.Published, Valid: !v.Published.IsZero()}
+	stateSince := pq.NullTime{Time: v.StateSince, Valid: !v.StateSince.IsZero()}
+	res, err := s.db.ExecContext(ctx, `UPDATE versions SET bin_id = $3, archive_type = $4, disabled = $5, digest = $6, published = $7, state = $8, size = $9,
+		encoding = $10, stored_size = $11, state_since = $12
+		WHERE import_url = $1 AND name = $2`,
+		v.ImportURL, v.Name, v.BinID, string(v.ArchiveType), v.Disabled, v.Digest, published, string(v.State), v.Size,
+		string(v.Encoding), v.StoredSize, stateSince)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return util.ErrNotFound
+	}
+
+	return nil
+}
+
+const importColumns = `import_url, name, description, project_url, disabled, private, owners, readers, grants`
+
+// scanImport reads an Import from a row selected with importColumns.
+func scanImport(row interface {
+	Scan(dest ...interface{}) error
+}) (*models.Import, error) {
+	m := &models.Import{}
+	owners := pq.StringArray{}
+	readers := pq.StringArray{}
+	grants := []byte{}
+
+	if err := row.Scan(&m.ImportURL, &m.Name, &m.Description, &m.ProjectURL, &m.Disabled, &m.Private, &owners, &readers, &grants); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(grants, &m.Grants); err != nil {
+		return nil, err
+	}
+	if len(m.Grants) == 0 {
+		m.Grants = nil
+	}
+
+	if len(owners) > 0 {
+		m.Owners = owners
+	}
+	if len(readers) > 0 {
+		m.Readers = readers
+	}
+
+	return m, nil
+}
+
+// GetImport gets an Import.
+func (s *Postgres) GetImport(ctx context.Context, url string) (*models.Import, error) {
+	m, err := scanImport(s.db.QueryRowContext(ctx, `SELECT `+importColumns+` FROM imports WHERE import_url = $1`, url))
+	if err == sql.ErrNoRows {
+		return nil, util.ErrNotFound
+	}
+	return m, err
+}
+
+// ListImports gets all Imports.
+func (s *Postgres) ListImports(ctx context.Context) ([]*models.Import, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+importColumns+` FROM imports ORDER BY import_url`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	imports := []*models.Import{}
+	for rows.Next() {
+		m, err := scanImport(rows)
+		if err != nil {
+			return nil, err
+		}
+		imports = append(imports, m)
+	}
+
+	return imports, rows.Err()
+}
+
+// GetVersions gets a list of Versions for an Import.
+func (s *Postgres) GetVersions(ctx context.Context, m *models.Import) ([]*models.Version, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	exists := false
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM imports WHERE import_url = $1)`, m.ImportURL).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, util.ErrNotFound
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT import_url, name, bin_id, archive_type, disabled, digest, published, state, size, encoding, stored_size, state_since
+		FROM versions WHERE import_url = $1 ORDER BY seq`, m.ImportURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []*models.Version{}
+	for rows.Next() {
+		v := &models.Version{}
+		archiveType := ""
+		state := ""
+		encoding := ""
+		published := pq.NullTime{}
+		stateSince := pq.NullTime{}
+		if err := rows.Scan(&v.ImportURL, &v.Name, &v.BinID, &archiveType, &v.Disabled, &v.Digest, &published, &state, &v.Size,
+			&encoding, &v.StoredSize, &stateSince); err != nil {
+			return nil, err
+		}
+		v.Encoding = models.Encoding(encoding)
+		v.ArchiveType = models.ArchType(archiveType)
+		v.State = models.VersionState(state)
+		if published.Valid {
+			v.Published = published.Time.UTC()
+		}
+		if stateSince.Valid {
+			v.StateSince = stateSince.Time.UTC()
+		}
+		versions = append(versions, v)
+	}
+
+	return versions, rows.Err()
+}
+
+// DisableImport disables an import and all its versions.
+func (s *Postgres) DisableImport(ctx context.Context, url string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE imports SET disabled = TRUE WHERE import_url = $1`, url)
+	return err
+}
+
+// DisableVersion disables a version.
+func (s *Postgres) DisableVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE versions SET disabled = TRUE WHERE import_url = $1 AND name = $2`, m.ImportURL, v.Name)
+	return err
+}
+
+// EnableImport enables an import and all its versions.
+func (s *Postgres) EnableImport(ctx context.Context, url string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE imports SET disabled = FALSE WHERE import_url = $1`, url)
+	return err
+}
+
+// EnableVersion enables a version.
+func (s *Postgres) EnableVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE versions SET disabled = FALSE WHERE import_url = $1 AND name = $2`, m.ImportURL, v.Name)
+	return err
+}
+
+// DeleteImport deletes an import and all its versions.
+func (s *Postgres) DeleteImport(ctx context.Context, url string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM imports WHERE import_url = $1`, url)
+	return err
+}
+
+// DeleteVersion deletes a version.
+func (s *Postgres) DeleteVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM versions WHERE import_url = $1 AND name = $2`, m.ImportURL, v.Name)
+	return err
+}
+
+// AddOrganization adds an Organization, util.ErrAlreadyExists if one has the same name.
+func (s *Postgres) AddOrganization(ctx context.Context, o *models.Organization) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `INSERT INTO organizations (name, data) VALUES ($1, $2)`, o.Name, data)
+	if err, ok := err.(*pq.Error); ok && err.Code.Name() == "unique_violation" {
+		return util.ErrAlreadyExists
+	}
+	return err
+}
+
+// UpdateOrganization updates an existing Organization.
+func (s *Postgres) UpdateOrganization(ctx context.Context, o *models.Organization) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, `UPDATE organizations SET data = $2 WHERE name = $1`, o.Name, data)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return util.ErrNotFound
+	}
+
+	return nil
+}
+
+// GetOrganization gets an Organization.
+func (s *Postgres) GetOrganization(ctx context.Context, name string) (*models.Organization, error) {
+	data := []byte{}
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM organizations WHERE name = $1`, name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, util.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	o := &models.Organization{}
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// ListOrganizations lists all Organizations sorted by name.
+func (s *Postgres) ListOrganizations(ctx context.Context) ([]*models.Organization, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM organizations ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []*models.Organization{}
+	for rows.Next() {
+		data := []byte{}
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		o := &models.Organization{}
+		if err := json.Unmarshal(data, o); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+
+	return orgs, rows.Err()
+}
+
+// DeleteOrganization deletes an Organization, its Imports are kept.
+func (s *Postgres) DeleteOrganization(ctx context.Context, name string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM organizations WHERE name = $1`, name)
+	return err
+}
+
+// Close the database connections.
+func (s *Postgres) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,124 @@
+package metastore
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// Set GOREG_TEST_POSTGRES to the connection string of a disposable database to run these tests,
+// for example postgres://postgres@localhost/goreg_test?sslmode=disable.
+var postgresAddress = os.Getenv("GOREG_TEST_POSTGRES")
+var pg *Postgres
+var pgImport = models.NewImport("example.com/pkg")
+
+func skipWithoutPostgres(t *testing.T) {
+	if len(postgresAddress) == 0 {
+		t.Skip("GOREG_TEST_POSTGRES not set")
+	}
+}
+
+func TestNewPostgresMetaStore(t *testing.T) {
+	skipWithoutPostgres(t)
+
+	s, err := NewPostgresMetaStore(postgresAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg = s.(*Postgres)
+
+	if _, err := pg.db.Exec(`DROP TABLE IF EXISTS versions, imports, organizations, schema_migrations`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migratePostgres(pg.db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Migrations must be safe to run again.
+	if err := migratePostgres(pg.db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostgresAddImport(t *testing.T) {
+	ctx := context.Background()
+
+	skipWithoutPostgres(t)
+
+	pgImport.Owners = []string{"owner"}
+	if err := pg.AddImportIfNotExists(ctx, pgImport); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := pg.GetImport(ctx, pgImport.ImportURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Owners) != 1 || m.Owners[0] != "owner" {
+		t.Fatal("Expected owners to be [owner], got", m.Owners)
+	}
+
+	if _, err := pg.GetImport(ctx, "example.com/none"); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+}
+
+func TestPostgresAddVersion(t *testing.T) {
+	ctx := context.Background()
+
+	skipWithoutPostgres(t)
+
+	for _, name := range []string{"1.0.0", "1.1.0"} {
+		if err := pg.AddVersion(ctx, models.NewVersion(pgImport, name, models.ArchTarGz)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pg.AddVersion(ctx, models.NewVersion(pgImport, "1.0.0", models.ArchTarGz)); err != util.ErrAlreadyExists {
+		t.Fatal("Expected ErrAlreadyExists, got", err)
+	}
+
+	versions, err := pg.GetVersions(ctx, pgImport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[1].Name != "1.1.0" {
+		t.Fatal("Expected versions 1.0.0 and 1.1.0 in order, got", versions)
+	}
+}
+
+func TestPostgresDisableVersion(t *testing.T) {
+	ctx := context.Background()
+
+	skipWithoutPostgres(t)
+
+	v := &models.Version{ImportURL: pgImport.ImportURL, Name: "1.0.0"}
+	if err := pg.DisableVersion(ctx, pgImport, v); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := pg.GetVersions(ctx, pgImport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !versions[0].Disabled {
+		t.Fatal("Expected version to be disabled")
+	}
+}
+
+func TestPostgresDeleteImport(t *testing.T) {
+	ctx := context.Background()
+
+	skipWithoutPostgres(t)
+
+	if err := pg.DeleteImport(ctx, pgImport.ImportURL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pg.GetVersions(ctx, pgImport); err != util.ErrNotFound {
+		t.Fatal("Expected ErrNotFound, got", err)
+	}
+}
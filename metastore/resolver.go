@@ -15,6 +15,10 @@ func Resolve(path string) (MetaStore, error) {
 	switch parts[0] {
 	case "boltdb":
 		return NewBoltMetaStore(path)
+	case "postgres", "postgresql":
+		return NewPostgresMetaStore(path)
+	case "memory":
+		return NewMemoryMetaStore(), nil
 	default:
 		return nil, errors.New("Unknown backend: " + parts[0])
 	}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/migrate"
+)
+
+// runMigrate copies the registry into other backends:
+// migrate [-auth dst] [-metastore dst] [-binstore dst] [-final] [-verify] [config file].
+// Backends without a destination are not migrated. Exits with status 1 if any binary did not match its digest.
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	authPath := flags.String("auth", "", "connection string of the Auth to copy users into")
+	metaPath := flags.String("metastore", "", "connection string of the MetaStore to copy imports and versions into")
+	binPath := flags.String("binstore", "", "connection string of the BinStore to copy binaries into")
+	final := flags.Bool("final", false, "also remove what was deleted from the source, run with the registry read-only")
+	verify := flags.Bool("verify", false, "verify the digest of binaries already copied")
+	flags.Parse(args)
+
+	cfg := loadConfig(flags.Args())
+	for _, paths := range [][2]string{{*authPath, cfg.AuthPath}, {*metaPath, cfg.MetaStorePath}, {*binPath, cfg.BinStorePath}} {
+		if paths[0] == paths[1] {
+			log.Fatalln("Source and destination are the same:", paths[0])
+		}
+	}
+
+	tm := auth.NewTokenManager([]byte(cfg.SigningKey), cfg.TokenTTL)
+	sm := openStoreManager(cfg)
+	src := &migrate.Registry{
+		Auth: openAuth(cfg, tm),
+		Meta: sm.MetaStore(),
+		Bin:  sm.BinStore(),
+	}
+
+	dst, err := migrate.Resolve(*authPath, *metaPath, *binPath, tm)
+	if err != nil {
+		log.Fatalln("While opening destination:", err)
+	}
+	defer dst.Close()
+
+	ctx, stop := commandContext()
+	defer stop()
+
+	report, err := migrate.Run(ctx, src, dst, migrate.Options{
+		Final:  *final,
+		Verify: *verify,
+	})
+	if err != nil {
+		log.Fatalln("While migrating:", err)
+	}
+
+	for _, name := range report.Mismatched {
+		fmt.Println("binary does not match digest, not copied:", name)
+	}
+	fmt.Println("copied", report.Users, "users,", report.Imports, "imports,", report.Versions, "versions and", report.Binaries, "binaries, deleted", report.Deleted, "and skipped", report.Skipped)
+
+	if len(report.Mismatched) > 0 {
+		dst.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,862 @@
+// Package migrate copies a registry from one set of backends to another while it is running.
+//
+// Run copies whatever the destination is missing, so it can be run repeatedly: the first pass
+// copies everything, an interrupted pass resumes where it stopped, and later passes catch up
+// with changes made in the meantime. A final pass, run after the source has been put into
+// read-only mode, also removes what was deleted from the source, leaving an exact copy.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/binstore"
+	"github.com/deejross/dep-registry/metastore"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// ErrEncodingMismatch indicates the destination BinStore stores binaries differently than the source, for
+// example compressed, which the MetaStore records. Migrate the MetaStore along with the BinStore.
+var ErrEncodingMismatch = errors.New("Destination BinStore stores binaries differently, migrate the MetaStore along with it")
+
+// Registry is a set of backends. A nil backend in the destination is not migrated.
+type Registry struct {
+	Auth auth.Auth
+	Meta metastore.MetaStore
+	Bin  binstore.BinStore
+}
+
+// Resolve the backends given by the non-empty connection strings.
+func Resolve(authPath, metaPath, binPath string, tm *auth.TokenManager) (*Registry, error) {
+	r := &Registry{}
+	var err error
+
+	if len(authPath) > 0 {
+		if r.Auth, err = auth.Resolve(authPath, tm); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if len(metaPath) > 0 {
+		if r.Meta, err = metastore.Resolve(metaPath); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if len(binPath) > 0 {
+		if r.Bin, err = binstore.Resolve(binPath); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Close the backends that hold resources that can be closed.
+func (r *Registry) Close() error {
+	var first error
+	for _, backend := range []interface{}{r.Auth, r.Meta, r.Bin} {
+		if c, ok := backend.(io.Closer); ok {
+			if err := c.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Options control what Run does.
+type Options struct {
+	// Final removes users, Imports, Versions and binaries missing from the source.
+	// The source should be read-only, or changes made during the pass may be lost.
+	Final bool `json:"final"`
+
+	// Verify the digest of binaries already in the destination, not only of those copied.
+	Verify bool `json:"verify"`
+}
+
+// Report counts what Run changed in the destination.
+type Report struct {
+	Users         int `json:"users"`
+	AccessTokens  int `json:"access_tokens"`
+	RevokedTokens int `json:"revoked_tokens"`
+	Teams         int `json:"teams"`
+	Organizations int `json:"organizations"`
+	Imports       int `json:"imports"`
+	Versions      int `json:"versions"`
+	Binaries      int `json:"binaries"`
+	Deleted       int `json:"deleted"`
+
+	// Skipped Versions were deleted from the source while being copied.
+	Skipped int `json:"skipped"`
+
+	// Mismatched lists Versions whose binary in the source does not match their digest.
+	// They are not copied.
+	Mismatched []string `json:"mismatched"`
+}
+
+// Run copies the source into the backends set in dst. Binaries are copied before the Versions that
+// refer to them, so the destination is consistent at every point. Only committed Versions are copied.
+func Run(ctx context.Context, src, dst *Registry, opts Options) (*Report, error) {
+	if dst.Auth == nil && dst.Meta == nil && dst.Bin == nil {
+		return nil, errors.New("Nothing to migrate, no destination given")
+	}
+
+	report := &Report{Mismatched: []string{}}
+
+	if dst.Auth != nil {
+		if err := copyUsers(ctx, src.Auth, dst.Auth, opts, report); err != nil {
+			return report, err
+		}
+		if err := copyRevokedTokens(ctx, src.Auth, dst.Auth, report); err != nil {
+			return report, err
+		}
+		if err := copyTeams(ctx, src.Auth, dst.Auth, opts, report); err != nil {
+			return report, err
+		}
+	}
+
+	if dst.Meta == nil && dst.Bin == nil {
+		return report, nil
+	}
+
+	c := &copier{src: src, dst: dst, opts: opts, report: report, referenced: map[string]bool{}}
+	if err := c.run(ctx); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// copyUsers adds or updates every user of src in dst along with their password hash.
+func copyUsers(ctx context.Context, src, dst auth.Auth, opts Options, report *Report) error {
+	users, err := src.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	found := map[string]bool{}
+	for _, user := range users {
+		found[user.Username] = true
+
+		hash, err := src.GetPasswordHash(ctx, user.Username)
+		if err == auth.ErrUserDoesNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		changed, err := copyUser(ctx, dst, user, hash)
+		if err != nil {
+			return err
+		}
+		if changed {
+			report.Users++
+		}
+
+		if err := copyAccessTokens(ctx, src, dst, user.Username, opts, report); err != nil {
+			return err
+		}
+		if err := copyTOTP(ctx, src, dst, user.Username, opts); err != nil {
+			return err
+		}
+		if err := copyIdentities(ctx, src, dst, user.Username, opts); err != nil {
+			return err
+		}
+	}
+
+	if !opts.Final {
+		return nil
+	}
+
+	existing, err := dst.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, user := range existing {
+		if found[user.Username] {
+			continue
+		}
+		if err := dst.DeleteUser(ctx, user.Username); err != nil {
+			return err
+		}
+		report.Deleted++
+	}
+
+	return nil
+}
+
+// copyAccessTokens adds or updates the personal access tokens of a user in dst, with Final it also
+// deletes those missing from src. A source that cannot store tokens is treated as having none.
+func copyAccessTokens(ctx context.Context, src, dst auth.Auth, username string, opts Options, report *Report) error {
+	tokens, err := src.ListAccessTokens(ctx, username)
+	if err == auth.ErrNotSupported {
+		tokens = nil
+	} else if err != nil {
+		return err
+	}
+	if len(tokens) == 0 && !opts.Final {
+		return nil
+	}
+
+	existing, err := dst.ListAccessTokens(ctx, username)
+	if err == auth.ErrNotSupported && len(tokens) == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	found := map[string]*auth.AccessToken{}
+	for _, t := range existing {
+		found[t.ID] = t
+	}
+
+	for _, t := range tokens {
+		e, ok := found[t.ID]
+		delete(found, t.ID)
+		if ok && sameJSON(e, t) {
+			continue
+		}
+
+		if ok {
+			err = dst.UpdateAccessToken(ctx, t)
+		} else {
+			err = dst.AddAccessToken(ctx, t)
+		}
+		if err != nil {
+			return err
+		}
+		report.AccessTokens++
+	}
+
+	if !opts.Final {
+		return nil
+	}
+	for id := range found {
+		if err := dst.DeleteAccessToken(ctx, id); err != nil {
+			return err
+		}
+		report.Deleted++
+	}
+
+	return nil
+}
+
+// copyRevokedTokens adds the revocations of src missing from dst, so logged out tokens stay revoked.
+// Revocations are never removed, they expire with their tokens.
+func copyRevokedTokens(ctx context.Context, src, dst auth.Auth, report *Report) error {
+	tokens, err := src.ListRevokedTokens(ctx)
+	if err == auth.ErrNotSupported {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, t := range tokens {
+		revoked, err := dst.TokenRevoked(ctx, t.ID)
+		if err != nil {
+			return err
+		}
+		if revoked {
+			continue
+		}
+
+		if err := dst.RevokeToken(ctx, t); err != nil {
+			return err
+		}
+		report.RevokedTokens++
+	}
+
+	return nil
+}
+
+// copyTeams adds or updates every team of src in dst, with Final it also deletes those missing from src.
+// A source that cannot store teams is treated as having none.
+func copyTeams(ctx context.Context, src, dst auth.Auth, opts Options, report *Report) error {
+	teams, err := src.ListTeams(ctx)
+	if err == auth.ErrNotSupported {
+		teams = nil
+	} else if err != nil {
+		return err
+	}
+	if len(teams) == 0 && !opts.Final {
+		return nil
+	}
+
+	existing, err := dst.ListTeams(ctx)
+	if err == auth.ErrNotSupported && len(teams) == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	found := map[string]*auth.Team{}
+	for _, t := range existing {
+		found[t.Name] = t
+	}
+
+	for _, t := range teams {
+		e, ok := found[t.Name]
+		delete(found, t.Name)
+		if ok && e.Description == t.Description && sameStrings(e.Members, t.Members) {
+			continue
+		}
+
+		if ok {
+			err = dst.UpdateTeam(ctx, t)
+		} else {
+			err = dst.AddTeam(ctx, t)
+		}
+		if err != nil {
+			return err
+		}
+		report.Teams++
+	}
+
+	if !opts.Final {
+		return nil
+	}
+	for name := range found {
+		if err := dst.DeleteTeam(ctx, name); err != nil {
+			return err
+		}
+		report.Deleted++
+	}
+
+	return nil
+}
+
+// copyOrganizations adds or updates every Organization of src in dst, with Final it also deletes those missing from src.
+func copyOrganizations(ctx context.Context, src, dst metastore.MetaStore, opts Options, report *Report) error {
+	orgs, err := src.ListOrganizations(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing, err := dst.ListOrganizations(ctx)
+	if err != nil {
+		return err
+	}
+
+	found := map[string]*models.Organization{}
+	for _, o := range existing {
+		found[o.Name] = o
+	}
+
+	for _, o := range orgs {
+		e, ok := found[o.Name]
+		delete(found, o.Name)
+		if ok && sameOrganization(e, o) {
+			continue
+		}
+
+		if ok {
+			err = dst.UpdateOrganization(ctx, o)
+		} else {
+			err = dst.AddOrganization(ctx, o)
+		}
+		if err != nil {
+			return err
+		}
+		report.Organizations++
+	}
+
+	if !opts.Final {
+		return nil
+	}
+	for name := range found {
+		if err := dst.DeleteOrganization(ctx, name); err != nil {
+			return err
+		}
+		report.Deleted++
+	}
+
+	return nil
+}
+
+// sameOrganization reports whether two Organizations have the same fields.
+func sameOrganization(a, b *models.Organization) bool {
+	return a.Name == b.Name &&
+		a.Description == b.Description &&
+		a.Private == b.Private &&
+		sameStrings(a.Prefixes, b.Prefixes) &&
+		sameStrings(a.Owners, b.Owners) &&
+		sameStrings(a.Readers, b.Readers) &&
+		sameGrants(a.Grants, b.Grants)
+}
+
+// copyTOTP sets the two-factor authentication enrollment of a user in dst, with Final it also removes
+// one missing from src. A source that cannot store enrollments is treated as having none.
+func copyTOTP(ctx context.Context, src, dst auth.Auth, username string, opts Options) error {
+	totp, err := src.GetTOTP(ctx, username)
+	if err == auth.ErrNotSupported {
+		totp = nil
+	} else if err != nil {
+		return err
+	}
+	if totp == nil && !opts.Final {
+		return nil
+	}
+
+	existing, err := dst.GetTOTP(ctx, username)
+	if err == auth.ErrNotSupported && totp == nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if totp == nil {
+		if existing == nil {
+			return nil
+		}
+		return dst.DeleteTOTP(ctx, username)
+	}
+	if existing != nil && sameJSON(existing, totp) {
+		return nil
+	}
+	return dst.SetTOTP(ctx, totp)
+}
+
+// copyIdentities links the external identities of a user in dst, with Final it also unlinks those missing
+// from src. A source that cannot store identities is treated as having none.
+func copyIdentities(ctx context.Context, src, dst auth.Auth, username string, opts Options) error {
+	var identities []*auth.Identity
+	if ids := auth.FindIdentityStore(src); ids != nil {
+		var err error
+		if identities, err = ids.ListIdentities(ctx, username); err != nil {
+			return err
+		}
+	}
+	if len(identities) == 0 && !opts.Final {
+		return nil
+	}
+
+	dstIDs := auth.FindIdentityStore(dst)
+	if dstIDs == nil {
+		if len(identities) == 0 {
+			return nil
+		}
+		return auth.ErrNotSupported
+	}
+	existing, err := dstIDs.ListIdentities(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	found := map[string]*auth.Identity{}
+	for _, i := range existing {
+		found[i.Issuer+"\x00"+i.Subject] = i
+	}
+
+	for _, i := range identities {
+		e, ok := found[i.Issuer+"\x00"+i.Subject]
+		delete(found, i.Issuer+"\x00"+i.Subject)
+		if ok && sameJSON(e, i) {
+			continue
+		}
+		if err := dstIDs.SetIdentity(ctx, i); err != nil {
+			return err
+		}
+	}
+
+	if !opts.Final {
+		return nil
+	}
+	for _, i := range found {
+		if err := dstIDs.DeleteIdentity(ctx, i.Issuer, i.Subject); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameJSON reports whether two values, such as personal access tokens, encode to the same JSON.
+func sameJSON(a, b interface{}) bool {
+	ab, errA := json.Marshal(a)
+	bb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ab, bb)
+}
+
+// copyUser adds or updates a user in dst and sets their password hash, returns false if they were already the same.
+func copyUser(ctx context.Context, dst auth.Auth, user *auth.User, hash []byte) (bool, error) {
+	existing, err := dst.GetUser(ctx, user.Username)
+	if err == auth.ErrUserDoesNotExist {
+		if err := dst.AddUser(ctx, user); err != nil {
+			return false, err
+		}
+	} else if err != nil {
+		return false, err
+	} else if *existing != *user {
+		if err := dst.UpdateUser(ctx, user); err != nil {
+			return false, err
+		}
+	} else {
+		existingHash, err := dst.GetPasswordHash(ctx, user.Username)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(existingHash, hash) {
+			return false, nil
+		}
+	}
+
+	if len(hash) == 0 {
+		return true, nil
+	}
+	return true, dst.SetPasswordHash(ctx, user.Username, hash)
+}
+
+// copier copies Imports, Versions and binaries.
+type copier struct {
+	src    *Registry
+	dst    *Registry
+	opts   Options
+	report *Report
+
+	// stored are the BinIDs in the destination BinStore.
+	stored map[string]bool
+
+	// referenced are the BinIDs of the Versions in the source.
+	referenced map[string]bool
+}
+
+func (c *copier) run(ctx context.Context) error {
+	if c.dst.Bin != nil {
+		ids, err := c.dst.Bin.List(ctx)
+		if err != nil {
+			return err
+		}
+
+		c.stored = map[string]bool{}
+		for _, id := range ids {
+			c.stored[id] = true
+		}
+	}
+
+	if c.dst.Meta != nil {
+		if err := copyOrganizations(ctx, c.src.Meta, c.dst.Meta, c.opts, c.report); err != nil {
+			return err
+		}
+	}
+
+	imports, err := c.src.Meta.ListImports(ctx)
+	if err != nil {
+		return err
+	}
+
+	found := map[string]bool{}
+	for _, m := range imports {
+		found[m.ImportURL] = true
+		if err := c.copyImport(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	if !c.opts.Final {
+		return nil
+	}
+
+	if c.dst.Meta != nil {
+		existing, err := c.dst.Meta.ListImports(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range existing {
+			if found[m.ImportURL] {
+				continue
+			}
+			if err := c.dst.Meta.DeleteImport(ctx, m.ImportURL); err != nil {
+				return err
+			}
+			c.report.Deleted++
+		}
+	}
+
+	if c.dst.Bin != nil {
+		for id := range c.stored {
+			if c.referenced[id] {
+				continue
+			}
+			if err := c.dst.Bin.Delete(ctx, &models.Version{BinID: id}); err != nil {
+				return err
+			}
+			c.report.Deleted++
+		}
+	}
+
+	return nil
+}
+
+// copyImport copies an Import and its committed Versions.
+func (c *copier) copyImport(ctx context.Context, m *models.Import) error {
+	versions, err := c.src.Meta.GetVersions(ctx, m)
+	if err == util.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]*models.Version{}
+	if c.dst.Meta != nil {
+		if err := c.copyImportFields(ctx, m); err != nil {
+			return err
+		}
+
+		list, err := c.dst.Meta.GetVersions(ctx, m)
+		if err != nil && err != util.ErrNotFound {
+			return err
+		}
+		for _, v := range list {
+			existing[v.Name] = v
+		}
+	}
+
+	found := map[string]bool{}
+	for _, v := range versions {
+		// Versions still being added or deleted are picked up by a later pass.
+		if v.State != models.StateCommitted {
+			if _, ok := existing[v.Name]; ok {
+				found[v.Name] = true
+			}
+			continue
+		}
+		found[v.Name] = true
+		c.referenced[v.BinID] = true
+
+		ok, err := c.copyBinary(ctx, existing[v.Name], v)
+		if err != nil {
+			return err
+		}
+		if !ok || c.dst.Meta == nil {
+			continue
+		}
+
+		if err := c.copyVersion(ctx, existing[v.Name], v); err != nil {
+			return err
+		}
+	}
+
+	if !c.opts.Final || c.dst.Meta == nil {
+		return nil
+	}
+
+	for name, v := range existing {
+		if found[name] {
+			continue
+		}
+		if err := c.dst.Meta.DeleteVersion(ctx, m, v); err != nil {
+			return err
+		}
+		c.report.Deleted++
+	}
+
+	return nil
+}
+
+// copyImportFields adds the Import to the destination or updates it if it has changed.
+func (c *copier) copyImportFields(ctx context.Context, m *models.Import) error {
+	existing, err := c.dst.Meta.GetImport(ctx, m.ImportURL)
+	if err == util.ErrNotFound {
+		if err := c.dst.Meta.AddImportIfNotExists(ctx, m); err != nil {
+			return err
+		}
+		c.report.Imports++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if sameImport(existing, m) {
+		return nil
+	}
+	if err := c.dst.Meta.UpdateImport(ctx, m); err != nil {
+		return err
+	}
+	c.report.Imports++
+	return nil
+}
+
+// copyVersion adds the Version to the destination or updates it if it has changed.
+func (c *copier) copyVersion(ctx context.Context, existing, v *models.Version) error {
+	if existing == nil {
+		if err := c.dst.Meta.AddVersion(ctx, v); err != nil {
+			return err
+		}
+		c.report.Versions++
+		return nil
+	}
+
+	if sameVersion(existing, v) {
+		return nil
+	}
+	if err := c.dst.Meta.UpdateVersion(ctx, v); err != nil {
+		return err
+	}
+	c.report.Versions++
+	return nil
+}
+
+// copyBinary copies the binary of a Version to the destination BinStore if it is missing, verifying
+// its digest, and sets how the destination stores it. existing is the Version in the destination MetaStore,
+// if any. Returns false if the Version should not be copied because its binary is not available.
+func (c *copier) copyBinary(ctx context.Context, existing, v *models.Version) (bool, error) {
+	if c.dst.Bin == nil {
+		return true, nil
+	}
+
+	if c.stored[v.BinID] {
+		// How the destination stores the binary is recorded by its Version there. Without a destination
+		// MetaStore, binaries are only copied if they are stored as in the source.
+		known := c.dst.Meta == nil || (existing != nil && existing.BinID == v.BinID)
+		if known && c.dst.Meta != nil {
+			v.Encoding, v.StoredSize = existing.Encoding, existing.StoredSize
+		}
+		if known && !c.opts.Verify {
+			return true, nil
+		}
+		if known {
+			ok, err := verifyBinary(ctx, c.dst.Bin, v)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+
+		// The copy in the destination is corrupt or stored in an unknown way, replace it.
+		if err := c.dst.Bin.Delete(ctx, v); err != nil {
+			return false, err
+		}
+		delete(c.stored, v.BinID)
+	}
+
+	reader, err := c.src.Bin.Get(ctx, v)
+	if err == util.ErrNotFound {
+		c.report.Skipped++
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// The binary is hashed as it is stored, rollbacks must complete even if ctx is done. The destination
+	// sets how it stores the binary on a copy of the Version, which still says how the source does.
+	cleanup := context.WithoutCancel(ctx)
+	h := sha256.New()
+	stored := *v
+	stored.Encoding, stored.StoredSize = models.EncodingIdentity, 0
+	err = c.dst.Bin.Add(ctx, &stored, io.TeeReader(util.NewContextReader(ctx, reader), h))
+	if err != nil {
+		if err != util.ErrAlreadyExists {
+			c.dst.Bin.Delete(cleanup, &stored)
+		}
+		return false, err
+	}
+
+	if !matchesDigest(v, h) {
+		if err := c.dst.Bin.Delete(cleanup, &stored); err != nil {
+			return false, err
+		}
+		c.report.Mismatched = append(c.report.Mismatched, v.ImportURL+" "+v.Name)
+		return false, nil
+	}
+	if c.dst.Meta == nil && (stored.Encoding != v.Encoding || stored.StoredSize != v.StoredSize) {
+		c.dst.Bin.Delete(cleanup, &stored)
+		return false, ErrEncodingMismatch
+	}
+	v.Encoding, v.StoredSize = stored.Encoding, stored.StoredSize
+	c.stored[v.BinID] = true
+	c.report.Binaries++
+
+	return true, nil
+}
+
+// verifyBinary reads the binary of a Version and reports whether it matches the Version's digest.
+func verifyBinary(ctx context.Context, bin binstore.BinStore, v *models.Version) (bool, error) {
+	reader, err := bin.Get(ctx, v)
+	if err != nil {
+		return false, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, util.NewContextReader(ctx, reader)); err != nil {
+		return false, err
+	}
+	return matchesDigest(v, h), nil
+}
+
+// matchesDigest reports whether h, which has hashed the binary of a Version, matches the Version's digest.
+// Binaries of Versions without a digest always match.
+func matchesDigest(v *models.Version, h hash.Hash) bool {
+	return len(v.Digest) == 0 || v.Digest == "sha256:"+hex.EncodeToString(h.Sum(nil))
+}
+
+// sameImport reports whether two Imports have the same fields.
+func sameImport(a, b *models.Import) bool {
+	return a.ImportURL == b.ImportURL &&
+		a.Name == b.Name &&
+		a.Description == b.Description &&
+		a.ProjectURL == b.ProjectURL &&
+		a.Disabled == b.Disabled &&
+		a.Private == b.Private &&
+		sameStrings(a.Owners, b.Owners) &&
+		sameStrings(a.Readers, b.Readers) &&
+		sameGrants(a.Grants, b.Grants)
+}
+
+// sameGrants reports whether two lists of Grants are equal.
+func sameGrants(a, b []models.Grant) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameVersion reports whether two Versions have the same fields.
+func sameVersion(a, b *models.Version) bool {
+	return a.ImportURL == b.ImportURL &&
+		a.Name == b.Name &&
+		a.BinID == b.BinID &&
+		a.ArchiveType == b.ArchiveType &&
+		a.Disabled == b.Disabled &&
+		a.Digest == b.Digest &&
+		a.Size == b.Size &&
+		a.Encoding == b.Encoding &&
+		a.StoredSize == b.StoredSize &&
+		a.Published.Equal(b.Published) &&
+		a.State == b.State &&
+		a.StateSince.Equal(b.StateSince)
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
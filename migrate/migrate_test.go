@@ -0,0 +1,256 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/binstore"
+	"github.com/deejross/dep-registry/metastore"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/storemanager"
+	"github.com/deejross/dep-registry/util"
+)
+
+var tm = auth.NewTokenManager([]byte("secret"), time.Hour)
+
+func newRegistry() *Registry {
+	return &Registry{
+		Auth: auth.NewMemoryAuth(tm),
+		Meta: metastore.NewMemoryMetaStore(),
+		Bin:  binstore.NewMemoryBinStore(),
+	}
+}
+
+func add(t *testing.T, r *Registry, url, name string) *models.Version {
+	ctx := context.Background()
+
+	m := models.NewImport(url)
+	v := models.NewVersion(m, name, models.ArchTarGz)
+	if err := storemanager.NewStoreManager(r.Bin, r.Meta).Add(ctx, m, v, bytes.NewReader([]byte(url+" "+name))); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func run(t *testing.T, src, dst *Registry, opts Options) *Report {
+	ctx := context.Background()
+
+	report, err := Run(ctx, src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func expectVersions(t *testing.T, r *Registry, url string, names ...string) {
+	ctx := context.Background()
+
+	versions, err := storemanager.NewStoreManager(r.Bin, r.Meta).GetVersions(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != len(names) {
+		t.Fatal("Expected versions", names, "got", versions)
+	}
+
+	for i, v := range versions {
+		if v.Name != names[i] {
+			t.Fatal("Expected versions", names, "got", versions)
+		}
+
+		reader, err := r.Bin.Get(ctx, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(reader)
+		if string(data) != url+" "+v.Name {
+			t.Fatal("Unexpected binary for", v.Name, string(data))
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+
+	src := newRegistry()
+	dst := newRegistry()
+
+	if err := src.Auth.AddUser(ctx, &auth.User{Username: "admin", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Auth.SetPassword(ctx, "admin", "password"); err != nil {
+		t.Fatal(err)
+	}
+	pat, secret, err := auth.NewAccessToken("admin", "ci", []auth.Scope{auth.ScopePublish}, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Auth.AddAccessToken(ctx, pat); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Auth.RevokeToken(ctx, &auth.RevokedToken{ID: "logged-out", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Auth.AddTeam(ctx, &auth.Team{Name: "payments", Members: []string{"admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	totp, err := auth.NewTOTP("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Auth.SetTOTP(ctx, totp); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.FindIdentityStore(src.Auth).SetIdentity(ctx, &auth.Identity{Issuer: "https://idp.example.com", Subject: "1001", Username: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Meta.AddOrganization(ctx, &models.Organization{Name: "example", Prefixes: []string{"example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	add(t, src, "example.com/a", "1.0.0")
+	add(t, src, "example.com/a", "1.1.0")
+	add(t, src, "example.com/b", "1.0.0")
+
+	report := run(t, src, dst, Options{})
+	if report.Users != 1 || report.AccessTokens != 1 || report.RevokedTokens != 1 || report.Teams != 1 || report.Organizations != 1 || report.Imports != 2 || report.Versions != 3 || report.Binaries != 3 {
+		t.Fatal("Unexpected report", report)
+	}
+	if _, err := dst.Auth.Login(ctx, "admin", "password"); err != nil {
+		t.Fatal("Expected copied user to log in, got", err)
+	}
+	if copied, err := dst.Auth.GetAccessToken(ctx, pat.ID); err != nil || copied.Check(secret) != nil {
+		t.Fatal("Expected copied access token to be accepted, got", copied, err)
+	}
+	if revoked, err := dst.Auth.TokenRevoked(ctx, "logged-out"); err != nil || !revoked {
+		t.Fatal("Expected the revocation to be copied, got", revoked, err)
+	}
+	if copied, err := dst.Auth.GetTOTP(ctx, "admin"); err != nil || copied == nil || copied.Secret != totp.Secret {
+		t.Fatal("Expected the two-factor enrollment to be copied, got", copied, err)
+	}
+	if copied, err := auth.FindIdentityStore(dst.Auth).GetIdentity(ctx, "https://idp.example.com", "1001"); err != nil || copied == nil || copied.Username != "admin" {
+		t.Fatal("Expected the identity to be copied, got", copied, err)
+	}
+	if team, err := dst.Auth.GetTeam(ctx, "payments"); err != nil || !team.HasMember("admin") {
+		t.Fatal("Expected the team to be copied, got", team, err)
+	}
+	if org, err := dst.Meta.GetOrganization(ctx, "example"); err != nil || len(org.Prefixes) != 1 {
+		t.Fatal("Expected the organization to be copied, got", org, err)
+	}
+	expectVersions(t, dst, "example.com/a", "1.0.0", "1.1.0")
+	expectVersions(t, dst, "example.com/b", "1.0.0")
+
+	// Nothing has changed, so a second pass copies nothing.
+	report = run(t, src, dst, Options{Verify: true})
+	if report.Users != 0 || report.AccessTokens != 0 || report.RevokedTokens != 0 || report.Teams != 0 || report.Organizations != 0 || report.Imports != 0 || report.Versions != 0 || report.Binaries != 0 {
+		t.Fatal("Expected nothing to be copied, got", report)
+	}
+
+	// Catch up with changes, deletions are only copied by the final pass.
+	add(t, src, "example.com/a", "1.2.0")
+	sm := storemanager.NewStoreManager(src.Bin, src.Meta)
+	if err := sm.DisableVersion(ctx, "example.com/a", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.DeleteImport(ctx, "example.com/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Auth.DeleteAccessToken(ctx, pat.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Auth.DeleteTOTP(ctx, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.FindIdentityStore(src.Auth).DeleteIdentity(ctx, "https://idp.example.com", "1001"); err != nil {
+		t.Fatal(err)
+	}
+
+	report = run(t, src, dst, Options{})
+	if report.Versions != 2 || report.Binaries != 1 || report.Deleted != 0 {
+		t.Fatal("Unexpected report", report)
+	}
+	expectVersions(t, dst, "example.com/a", "1.0.0", "1.1.0", "1.2.0")
+	expectVersions(t, dst, "example.com/b", "1.0.0")
+
+	v, err := storemanager.NewStoreManager(dst.Bin, dst.Meta).GetVersion(ctx, "example.com/a", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Disabled {
+		t.Fatal("Expected disabled version to be copied")
+	}
+
+	report = run(t, src, dst, Options{Final: true})
+	if report.Deleted != 3 {
+		t.Fatal("Expected the import and binary of example.com/b and the access token to be deleted, got", report)
+	}
+	if _, err := dst.Auth.GetAccessToken(ctx, pat.ID); err != auth.ErrAccessTokenDoesNotExist {
+		t.Fatal("Expected the revoked access token to be deleted, got", err)
+	}
+	if copied, err := dst.Auth.GetTOTP(ctx, "admin"); err != nil || copied != nil {
+		t.Fatal("Expected the removed two-factor enrollment to be removed, got", copied, err)
+	}
+	if copied, err := auth.FindIdentityStore(dst.Auth).GetIdentity(ctx, "https://idp.example.com", "1001"); err != nil || copied != nil {
+		t.Fatal("Expected the unlinked identity to be unlinked, got", copied, err)
+	}
+	if _, err := dst.Meta.GetImport(ctx, "example.com/b"); err == nil {
+		t.Fatal("Expected example.com/b to be deleted")
+	}
+	ids, err := dst.Bin.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Fatal("Expected 3 binaries, got", ids)
+	}
+}
+
+func TestRunMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	src := newRegistry()
+	dst := newRegistry()
+
+	v := add(t, src, "example.com/a", "1.0.0")
+	add(t, src, "example.com/a", "1.1.0")
+
+	if err := src.Bin.Delete(ctx, v); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Bin.Add(ctx, v, bytes.NewReader([]byte("corrupt"))); err != nil {
+		t.Fatal(err)
+	}
+
+	report := run(t, src, dst, Options{})
+	if len(report.Mismatched) != 1 || report.Mismatched[0] != "example.com/a 1.0.0" {
+		t.Fatal("Expected 1.0.0 to mismatch, got", report.Mismatched)
+	}
+	expectVersions(t, dst, "example.com/a", "1.1.0")
+
+	// The mismatched binary is removed from the destination once stored.
+	if _, err := dst.Bin.Get(ctx, v); err != util.ErrNotFound {
+		t.Fatal("Expected the mismatched binary to be rolled back, got", err)
+	}
+}
+
+func TestRunPartial(t *testing.T) {
+	ctx := context.Background()
+
+	src := newRegistry()
+	add(t, src, "example.com/a", "1.0.0")
+
+	// Only the BinStore is migrated, the MetaStore is shared.
+	dst := &Registry{Bin: binstore.NewMemoryBinStore()}
+	report := run(t, src, dst, Options{})
+	if report.Binaries != 1 || report.Versions != 0 {
+		t.Fatal("Unexpected report", report)
+	}
+	expectVersions(t, &Registry{Meta: src.Meta, Bin: dst.Bin}, "example.com/a", "1.0.0")
+
+	if _, err := Run(ctx, src, &Registry{}, Options{}); err == nil {
+		t.Fatal("Expected an error without a destination")
+	}
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"errors"
+	"time"
 
 	"github.com/deejross/dep-registry/util"
 )
@@ -15,6 +16,21 @@ const (
 
 	// ArchZip is a zip archive.
 	ArchZip ArchType = "zip"
+
+	// StateCommitted indicates the binary of a Version has been stored.
+	StateCommitted VersionState = ""
+
+	// StatePending indicates the binary of a Version is being stored.
+	StatePending VersionState = "pending"
+
+	// StateDeleting indicates the binary of a Version is being deleted.
+	StateDeleting VersionState = "deleting"
+
+	// EncodingIdentity indicates the binary of a Version is stored as given.
+	EncodingIdentity Encoding = ""
+
+	// EncodingGzip indicates the binary of a Version is stored with gzip compression.
+	EncodingGzip Encoding = "gzip"
 )
 
 var (
@@ -23,11 +39,70 @@ var (
 
 	// ErrVersionNotFound indicates that the given version was not found for the Import.
 	ErrVersionNotFound = errors.New("Version not found")
+
+	// ErrInvalidGrant indicates a Grant names both or neither of a user and a team, or an unknown role.
+	ErrInvalidGrant = errors.New("Grant must name either a user or a team, and a role of reader, publisher, maintainer or owner")
+)
+
+// Role is what a user or team may do with an Import, each role includes those below it.
+type Role string
+
+const (
+	// RoleReader may download, even if the Import is private.
+	RoleReader Role = "reader"
+
+	// RolePublisher may publish Versions.
+	RolePublisher Role = "publisher"
+
+	// RoleMaintainer may disable, enable and delete Versions and disable and enable the Import.
+	RoleMaintainer Role = "maintainer"
+
+	// RoleOwner may delete the Import and grant roles on it.
+	RoleOwner Role = "owner"
 )
 
+// roleLevels orders the roles, the empty Role is below all of them.
+var roleLevels = map[Role]int{
+	RoleReader:     1,
+	RolePublisher:  2,
+	RoleMaintainer: 3,
+	RoleOwner:      4,
+}
+
+// Valid reports whether the Role is one of the known roles.
+func (r Role) Valid() bool {
+	return roleLevels[r] > 0
+}
+
+// Includes reports whether the Role allows everything other does.
+func (r Role) Includes(other Role) bool {
+	return roleLevels[r] >= roleLevels[other]
+}
+
+// Grant gives a role on an Import to a user or a team.
+type Grant struct {
+	User string `json:"user,omitempty"`
+	Team string `json:"team,omitempty"`
+	Role Role   `json:"role"`
+}
+
+// Validate returns ErrInvalidGrant if the Grant names both or neither of a user and a team, or an unknown role.
+func (g Grant) Validate() error {
+	if (len(g.User) == 0) == (len(g.Team) == 0) || !g.Role.Valid() {
+		return ErrInvalidGrant
+	}
+	return nil
+}
+
 // ArchType represents an archive type.
 type ArchType string
 
+// VersionState represents the state of a Version's binary.
+type VersionState string
+
+// Encoding represents how a Version's binary is stored, which is set by the BinStore storing it.
+type Encoding string
+
 // Import object.
 type Import struct {
 	ImportURL   string   `json:"import_url,omitempty"`
@@ -38,6 +113,29 @@ type Import struct {
 	Private     bool     `json:"private,omitempty"`
 	Owners      []string `json:"owners,omitempty"`
 	Readers     []string `json:"readers,omitempty"`
+	Grants      []Grant  `json:"grants,omitempty"`
+}
+
+// SetGrant gives the user or team of g its role, replacing the role they had.
+func (m *Import) SetGrant(g Grant) {
+	for i := range m.Grants {
+		if m.Grants[i].User == g.User && m.Grants[i].Team == g.Team {
+			m.Grants[i].Role = g.Role
+			return
+		}
+	}
+	m.Grants = append(m.Grants, g)
+}
+
+// RemoveGrant removes the role of the user or team of g, returns false if they had none.
+func (m *Import) RemoveGrant(g Grant) bool {
+	for i := range m.Grants {
+		if m.Grants[i].User == g.User && m.Grants[i].Team == g.Team {
+			m.Grants = append(m.Grants[:i], m.Grants[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
 // NewImport creates a new Import object.
@@ -50,11 +148,18 @@ func NewImport(url string) *Import {
 
 // Version object.
 type Version struct {
-	ImportURL   string   `json:"import_url,omitempty"`
-	Name        string   `json:"name,omitempty"`
-	BinID       string   `json:"bin_id,omitempty"`
-	ArchiveType ArchType `json:"archive_type,omitempty"`
-	Disabled    bool     `json:"disabled,omitempty"`
+	ImportURL   string       `json:"import_url,omitempty"`
+	Name        string       `json:"name,omitempty"`
+	BinID       string       `json:"bin_id,omitempty"`
+	ArchiveType ArchType     `json:"archive_type,omitempty"`
+	Disabled    bool         `json:"disabled,omitempty"`
+	Digest      string       `json:"digest,omitempty"`
+	Size        int64        `json:"size,omitempty"`
+	Encoding    Encoding     `json:"encoding,omitempty"`
+	StoredSize  int64        `json:"stored_size,omitempty"`
+	Published   time.Time    `json:"published"`
+	State       VersionState `json:"state,omitempty"`
+	StateSince  time.Time    `json:"state_since"`
 }
 
 // NewVersion creates a new Version object.
@@ -64,5 +169,6 @@ func NewVersion(m *Import, name string, archive ArchType) *Version {
 		Name:        name,
 		BinID:       util.UUID4(),
 		ArchiveType: archive,
+		Published:   time.Now().UTC(),
 	}
 }
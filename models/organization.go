@@ -0,0 +1,102 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrOrganizationNameEmpty indicates the given organization name was empty.
+	ErrOrganizationNameEmpty = errors.New("Organization name cannot be empty")
+
+	// ErrInvalidPrefix indicates an import path prefix was empty.
+	ErrInvalidPrefix = errors.New("Prefix cannot be empty")
+
+	// ErrPrefixClaimed indicates an import path prefix is already claimed by another organization.
+	ErrPrefixClaimed = errors.New("Prefix is already claimed by another organization")
+)
+
+// Organization claims import path prefixes, new Imports below them can only be created by users with
+// at least the publisher role in the Organization, and start with its Owners, Readers, Grants and visibility.
+type Organization struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Prefixes    []string `json:"prefixes"`
+	Private     bool     `json:"private,omitempty"`
+	Owners      []string `json:"owners,omitempty"`
+	Readers     []string `json:"readers,omitempty"`
+	Grants      []Grant  `json:"grants,omitempty"`
+}
+
+// NormalizePrefix returns a prefix without the trailing slash or /* it may be given with.
+func NormalizePrefix(prefix string) (string, error) {
+	prefix = strings.TrimSuffix(strings.TrimSpace(prefix), "*")
+	prefix = strings.TrimRight(prefix, "/")
+	if len(prefix) == 0 {
+		return "", ErrInvalidPrefix
+	}
+	return prefix, nil
+}
+
+// Validate checks the name and Grants of the Organization, and normalizes and sorts its Prefixes.
+func (o *Organization) Validate() error {
+	if len(o.Name) == 0 {
+		return ErrOrganizationNameEmpty
+	}
+
+	seen := map[string]bool{}
+	prefixes := []string{}
+	for _, p := range o.Prefixes {
+		p, err := NormalizePrefix(p)
+		if err != nil {
+			return err
+		}
+		if !seen[p] {
+			seen[p] = true
+			prefixes = append(prefixes, p)
+		}
+	}
+	sort.Strings(prefixes)
+	o.Prefixes = prefixes
+
+	for _, g := range o.Grants {
+		if err := g.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Claim returns the longest of the Prefixes the import URL is below, or the empty string if there is none.
+func (o *Organization) Claim(url string) string {
+	claim := ""
+	for _, p := range o.Prefixes {
+		if (url == p || strings.HasPrefix(url, p+"/")) && len(p) > len(claim) {
+			claim = p
+		}
+	}
+	return claim
+}
+
+// NewImport returns a copy of m with the Owners, Readers, Grants and visibility of the Organization.
+func (o *Organization) NewImport(m *Import) *Import {
+	c := *m
+	c.Private = o.Private
+	c.Owners = append([]string{}, o.Owners...)
+	c.Readers = append([]string{}, o.Readers...)
+	c.Grants = append([]Grant{}, o.Grants...)
+	return &c
+}
+
+// FindOrganization returns the Organization claiming the longest prefix of the import URL, or nil if none claims it.
+func FindOrganization(orgs []*Organization, url string) *Organization {
+	var found *Organization
+	longest := ""
+	for _, o := range orgs {
+		if claim := o.Claim(url); len(claim) > len(longest) {
+			found, longest = o, claim
+		}
+	}
+	return found
+}
@@ -0,0 +1,83 @@
+// Package schema tracks the schema version of BoltDB stores and migrates them on open.
+package schema
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+var boltSchemaBucket = []byte("dep-reg-schema")
+
+// Migration upgrades a store by one schema version.
+type Migration func(tx *bolt.Tx) error
+
+// Version returns the schema version of the named store, 0 if it has never been migrated.
+func Version(db *bolt.DB, store string) (int, error) {
+	version := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = getVersion(tx, store)
+		return err
+	})
+	return version, err
+}
+
+// Migrate runs the migrations of the named store that have not been applied yet, in order and in a
+// single transaction, so a failed migration leaves the store as it was. The schema version of a store
+// is the number of migrations applied, so migrations must never be removed or reordered. Returns an
+// error without changing anything if the store has a newer schema version than len(migrations).
+func Migrate(db *bolt.DB, store string, migrations []Migration) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		version, err := getVersion(tx, store)
+		if err != nil {
+			return err
+		}
+
+		if version > len(migrations) {
+			return errors.New("Schema version " + strconv.Itoa(version) + " of " + store + " is newer than this build supports, upgrade the registry")
+		}
+		if version == len(migrations) {
+			return nil
+		}
+
+		for _, migration := range migrations[version:] {
+			if err := migration(tx); err != nil {
+				return err
+			}
+		}
+
+		b, err := tx.CreateBucketIfNotExists(boltSchemaBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(store), []byte(strconv.Itoa(len(migrations))))
+	})
+}
+
+func getVersion(tx *bolt.Tx, store string) (int, error) {
+	b := tx.Bucket(boltSchemaBucket)
+	if b == nil {
+		return 0, nil
+	}
+
+	val := b.Get([]byte(store))
+	if val == nil {
+		return 0, nil
+	}
+
+	return strconv.Atoi(string(val))
+}
+
+// CreateBuckets returns a Migration that creates the named top level buckets if they do not exist.
+func CreateBuckets(names ...[]byte) Migration {
+	return func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
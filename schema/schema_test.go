@@ -0,0 +1,120 @@
+package schema
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+var testBucket = []byte("test")
+
+func openDB(t *testing.T) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "schema.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func expectVersion(t *testing.T, db *bolt.DB, expected int) {
+	version, err := Version(db, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != expected {
+		t.Fatal("Expected schema version", expected, "got", version)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := openDB(t)
+	expectVersion(t, db, 0)
+
+	runs := []int{}
+	migrations := []Migration{
+		CreateBuckets(testBucket),
+		func(tx *bolt.Tx) error {
+			runs = append(runs, 2)
+			return tx.Bucket(testBucket).Put([]byte("key"), []byte("value"))
+		},
+	}
+
+	if err := Migrate(db, "test", migrations); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, db, 2)
+
+	// Applied migrations are not run again.
+	if err := Migrate(db, "test", migrations); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 {
+		t.Fatal("Expected migration 2 to run once, ran", len(runs), "times")
+	}
+
+	migrations = append(migrations, func(tx *bolt.Tx) error {
+		runs = append(runs, 3)
+		return nil
+	})
+	if err := Migrate(db, "test", migrations); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, db, 3)
+	if len(runs) != 2 || runs[1] != 3 {
+		t.Fatal("Expected only migration 3 to run, got", runs)
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	db := openDB(t)
+	migrations := []Migration{CreateBuckets(testBucket), CreateBuckets([]byte("other"))}
+	if err := Migrate(db, "test", migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(db, "test", migrations[:1]); err == nil {
+		t.Fatal("Expected an error migrating a newer schema")
+	}
+	expectVersion(t, db, 2)
+}
+
+func TestMigrateRollback(t *testing.T) {
+	db := openDB(t)
+	failed := errors.New("failed")
+	migrations := []Migration{
+		CreateBuckets(testBucket),
+		func(tx *bolt.Tx) error { return failed },
+	}
+
+	if err := Migrate(db, "test", migrations); err != failed {
+		t.Fatal("Expected migration error, got", err)
+	}
+	expectVersion(t, db, 0)
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(testBucket) != nil {
+			t.Fatal("Expected the first migration to be rolled back")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateStoresIndependent(t *testing.T) {
+	db := openDB(t)
+	if err := Migrate(db, "test", []Migration{CreateBuckets(testBucket)}); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := Version(db, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Fatal("Expected schema version 0 for another store, got", version)
+	}
+}
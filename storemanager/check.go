@@ -0,0 +1,173 @@
+package storemanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+// CheckOptions control what Check does.
+type CheckOptions struct {
+	// Verify the digest of every committed Version against its binary.
+	Verify bool `json:"verify"`
+
+	// Repair deletes orphaned binaries and disables Versions whose binary is missing or corrupt.
+	Repair bool `json:"repair"`
+}
+
+// CheckReport lists the inconsistencies found by Check.
+type CheckReport struct {
+	// Orphans are the BinIDs of binaries that no Version refers to.
+	Orphans []string `json:"orphans"`
+
+	// Dangling are committed Versions whose binary is missing.
+	Dangling []*models.Version `json:"dangling"`
+
+	// Corrupt are committed Versions whose binary does not match their digest.
+	Corrupt []*models.Version `json:"corrupt"`
+
+	// Checked is the number of committed Versions checked.
+	Checked int `json:"checked"`
+
+	// Repaired indicates the inconsistencies have been repaired.
+	Repaired bool `json:"repaired"`
+}
+
+// Check walks the BinStore and MetaStore looking for orphaned binaries, Versions with a missing
+// binary and, if opts.Verify is set, binaries that do not match their digest. Versions that are
+// still being added or deleted are left alone, as is their binary.
+func (s *StoreManager) Check(ctx context.Context, opts CheckOptions) (*CheckReport, error) {
+	// Binaries are listed before Versions: a Version is always added before its binary,
+	// so a binary being added while Check runs is never mistaken for an orphan.
+	ids, err := s.bin.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := map[string]bool{}
+	for _, id := range ids {
+		stored[id] = true
+	}
+
+	imports, err := s.meta.ListImports(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CheckReport{
+		Orphans:  []string{},
+		Dangling: []*models.Version{},
+		Corrupt:  []*models.Version{},
+	}
+	referenced := map[string]bool{}
+	broken := map[*models.Version]*models.Import{}
+
+	for _, m := range imports {
+		versions, err := s.meta.GetVersions(ctx, m)
+		if err == util.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range versions {
+			referenced[v.BinID] = true
+			if v.State != models.StateCommitted {
+				continue
+			}
+			report.Checked++
+
+			if !stored[v.BinID] {
+				// The Version may have been committed since the binaries were listed.
+				ok, err := s.exists(ctx, v)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					report.Dangling = append(report.Dangling, v)
+					broken[v] = m
+					continue
+				}
+			}
+
+			if opts.Verify && len(v.Digest) > 0 {
+				ok, err := s.verify(ctx, v)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					report.Corrupt = append(report.Corrupt, v)
+					broken[v] = m
+				}
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if !referenced[id] {
+			report.Orphans = append(report.Orphans, id)
+		}
+	}
+
+	if !opts.Repair {
+		return report, nil
+	}
+
+	for _, id := range report.Orphans {
+		if err := s.bin.Delete(ctx, &models.Version{BinID: id}); err != nil {
+			return report, err
+		}
+	}
+	for v, m := range broken {
+		if v.Disabled {
+			continue
+		}
+		if err := s.meta.DisableVersion(ctx, m, v); err != nil {
+			return report, err
+		}
+	}
+
+	report.Repaired = true
+	return report, nil
+}
+
+// exists reports whether the binary of a Version is stored.
+func (s *StoreManager) exists(ctx context.Context, v *models.Version) (bool, error) {
+	reader, err := s.bin.Get(ctx, v)
+	if err == util.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if c, ok := reader.(io.Closer); ok {
+		c.Close()
+	}
+	return true, nil
+}
+
+// verify reports whether the binary of a Version matches its digest.
+func (s *StoreManager) verify(ctx context.Context, v *models.Version) (bool, error) {
+	reader, err := s.bin.Get(ctx, v)
+	if err == util.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, util.NewContextReader(ctx, reader)); err != nil {
+		return false, err
+	}
+
+	return v.Digest == "sha256:"+hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -1,14 +1,32 @@
 package storemanager
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
+	"time"
 
 	"github.com/deejross/dep-registry/binstore"
 	"github.com/deejross/dep-registry/metastore"
 	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
 )
 
+// ErrDigestMismatch indicates a binary does not match the digest of its Version.
+var ErrDigestMismatch = errors.New("Binary does not match digest")
+
+// ErrBinaryExists indicates a binary is already stored under the BinID of a Version being added, for example
+// one left behind by an interrupted restore.
+var ErrBinaryExists = errors.New("Binary already stored under this BinID, fsck -repair deletes it if orphaned")
+
 // StoreManager is the high-level manager of BinStore and MetaStore and provides transactional operations.
+//
+// Versions are added in the pending state before their binary is written and deleted in the
+// deleting state after their binary is removed, so a crash part way through leaves a record
+// that Recover can use to complete or undo the operation. Versions that are not committed are
+// never returned to callers.
 type StoreManager struct {
 	bin  binstore.BinStore
 	meta metastore.MetaStore
@@ -23,44 +41,171 @@ func NewStoreManager(bin binstore.BinStore, meta metastore.MetaStore) *StoreMana
 }
 
 // Add a new Version.
-func (s *StoreManager) Add(m *models.Import, v *models.Version, reader io.Reader) error {
-	if err := s.meta.AddImportIfNotExists(m); err != nil {
+func (s *StoreManager) Add(ctx context.Context, m *models.Import, v *models.Version, reader io.Reader) error {
+	if err := s.meta.AddImportIfNotExists(ctx, m); err != nil {
+		return err
+	}
+
+	return s.addVersion(ctx, m, v, reader, "")
+}
+
+// Restore an Import and one of its Versions, as previously returned by ListImports and
+// GetVersions, keeping their fields. If the Version has a digest, the binary must match it.
+// The Import is updated if it already exists, the Version must not, util.ErrAlreadyExists is
+// returned if it does and ErrBinaryExists if only its binary does.
+func (s *StoreManager) Restore(ctx context.Context, m *models.Import, v *models.Version, reader io.Reader) error {
+	if err := s.RestoreImport(ctx, m); err != nil {
+		return err
+	}
+
+	return s.addVersion(ctx, m, v, reader, v.Digest)
+}
+
+// RestoreImport adds an Import or updates it if it already exists, keeping its fields.
+func (s *StoreManager) RestoreImport(ctx context.Context, m *models.Import) error {
+	if err := s.meta.AddImportIfNotExists(ctx, m); err != nil {
+		return err
+	}
+
+	return s.meta.UpdateImport(ctx, m)
+}
+
+// addVersion adds a Version to an existing Import and stores its binary. If digest is given,
+// the Version is rolled back unless the binary matches it.
+func (s *StoreManager) addVersion(ctx context.Context, m *models.Import, v *models.Version, reader io.Reader, digest string) error {
+	v.State, v.StateSince = models.StatePending, time.Now().UTC()
+	// Set by the BinStore if it encodes the binary, a restored Version may still say how another BinStore did.
+	v.Encoding, v.StoredSize = models.EncodingIdentity, 0
+	if err := s.meta.AddVersion(ctx, v); err != nil {
+		return err
+	}
+
+	// Rollbacks must complete even if ctx is done, the client giving up is a common reason for them.
+	cleanup := context.WithoutCancel(ctx)
+
+	h := sha256.New()
+	size := new(countWriter)
+	if err := s.bin.Add(ctx, v, io.TeeReader(reader, io.MultiWriter(h, size))); err != nil {
+		// A binary already stored under this BinID does not belong to this Version, leave it be.
+		if err == util.ErrAlreadyExists {
+			err = ErrBinaryExists
+		} else {
+			s.bin.Delete(cleanup, v)
+		}
+		s.meta.DeleteVersion(cleanup, m, v)
 		return err
 	}
-	if err := s.meta.AddVersion(v); err != nil {
+
+	v.Digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	v.Size = int64(*size)
+	if len(digest) > 0 && v.Digest != digest {
+		s.bin.Delete(cleanup, v)
+		s.meta.DeleteVersion(cleanup, m, v)
+		return ErrDigestMismatch
+	}
+
+	v.State, v.StateSince = models.StateCommitted, time.Now().UTC()
+	if err := s.meta.UpdateVersion(ctx, v); err != nil {
+		s.bin.Delete(cleanup, v)
+		s.meta.DeleteVersion(cleanup, m, v)
 		return err
 	}
-	return s.bin.Add(v, reader)
+
+	return nil
+}
+
+// BinStore returns the BinStore being managed.
+func (s *StoreManager) BinStore() binstore.BinStore {
+	return s.bin
+}
+
+// MetaStore returns the MetaStore being managed.
+func (s *StoreManager) MetaStore() metastore.MetaStore {
+	return s.meta
+}
+
+// ListImports lists all Imports.
+func (s *StoreManager) ListImports(ctx context.Context) ([]*models.Import, error) {
+	return s.meta.ListImports(ctx)
 }
 
 // Get an Import.
-func (s *StoreManager) Get(url string) (*models.Import, error) {
-	return s.meta.GetImport(url)
+func (s *StoreManager) Get(ctx context.Context, url string) (*models.Import, error) {
+	return s.meta.GetImport(ctx, url)
+}
+
+// UpdateImport updates the fields of an existing Import.
+func (s *StoreManager) UpdateImport(ctx context.Context, m *models.Import) error {
+	if _, err := s.meta.GetImport(ctx, m.ImportURL); err != nil {
+		return err
+	}
+
+	return s.meta.UpdateImport(ctx, m)
+}
+
+// ListOrganizations lists all Organizations.
+func (s *StoreManager) ListOrganizations(ctx context.Context) ([]*models.Organization, error) {
+	return s.meta.ListOrganizations(ctx)
+}
+
+// GetOrganization gets an Organization.
+func (s *StoreManager) GetOrganization(ctx context.Context, name string) (*models.Organization, error) {
+	return s.meta.GetOrganization(ctx, name)
+}
+
+// AddOrganization adds an Organization.
+func (s *StoreManager) AddOrganization(ctx context.Context, o *models.Organization) error {
+	return s.meta.AddOrganization(ctx, o)
+}
+
+// UpdateOrganization updates an existing Organization.
+func (s *StoreManager) UpdateOrganization(ctx context.Context, o *models.Organization) error {
+	return s.meta.UpdateOrganization(ctx, o)
+}
+
+// DeleteOrganization deletes an Organization.
+func (s *StoreManager) DeleteOrganization(ctx context.Context, name string) error {
+	return s.meta.DeleteOrganization(ctx, name)
 }
 
 // GetVersions gets a list of Versions.
-func (s *StoreManager) GetVersions(url string) ([]*models.Version, error) {
-	m, err := s.meta.GetImport(url)
+func (s *StoreManager) GetVersions(ctx context.Context, url string) ([]*models.Version, error) {
+	m, err := s.meta.GetImport(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.meta.GetVersions(m)
+	return s.committedVersions(ctx, m)
 }
 
-// GetVersion gets a Version.
-func (s *StoreManager) GetVersion(url string, versionName string) (*models.Version, error) {
-	m, err := s.meta.GetImport(url)
+// committedVersions gets the Versions of an Import whose binaries have been stored.
+func (s *StoreManager) committedVersions(ctx context.Context, m *models.Import) ([]*models.Version, error) {
+	versions, err := s.meta.GetVersions(ctx, m)
 	if err != nil {
 		return nil, err
 	}
 
-	versions, err := s.meta.GetVersions(m)
+	committed := []*models.Version{}
+	for _, v := range versions {
+		if v.State == models.StateCommitted {
+			committed = append(committed, v)
+		}
+	}
+
+	return committed, nil
+}
+
+// GetVersion gets a Version.
+func (s *StoreManager) GetVersion(ctx context.Context, url string, versionName string) (*models.Version, error) {
+	versions, err := s.GetVersions(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
 	if len(versionName) == 0 {
+		if len(versions) == 0 {
+			return nil, models.ErrVersionNotFound
+		}
 		return versions[len(versions)-1], nil
 	}
 
@@ -74,23 +219,23 @@ func (s *StoreManager) GetVersion(url string, versionName string) (*models.Versi
 }
 
 // GetVersionBinary downloads the binary for the version.
-func (s *StoreManager) GetVersionBinary(v *models.Version) (io.Reader, error) {
-	return s.bin.Get(v)
+func (s *StoreManager) GetVersionBinary(ctx context.Context, v *models.Version) (io.Reader, error) {
+	return s.bin.Get(ctx, v)
 }
 
 // DisableImport disables an import and all its versions.
-func (s *StoreManager) DisableImport(url string) error {
-	return s.meta.DisableImport(url)
+func (s *StoreManager) DisableImport(ctx context.Context, url string) error {
+	return s.meta.DisableImport(ctx, url)
 }
 
 // DisableVersion disables a version.
-func (s *StoreManager) DisableVersion(url, version string) error {
-	m, err := s.meta.GetImport(url)
+func (s *StoreManager) DisableVersion(ctx context.Context, url, version string) error {
+	m, err := s.meta.GetImport(ctx, url)
 	if err != nil {
 		return err
 	}
 
-	versions, err := s.meta.GetVersions(m)
+	versions, err := s.committedVersions(ctx, m)
 	if err != nil {
 		return err
 	}
@@ -104,25 +249,25 @@ func (s *StoreManager) DisableVersion(url, version string) error {
 	}
 
 	if v != nil {
-		return s.meta.DisableVersion(m, v)
+		return s.meta.DisableVersion(ctx, m, v)
 	}
 
 	return nil
 }
 
 // EnableImport enables an import and all its versions.
-func (s *StoreManager) EnableImport(url string) error {
-	return s.meta.EnableImport(url)
+func (s *StoreManager) EnableImport(ctx context.Context, url string) error {
+	return s.meta.EnableImport(ctx, url)
 }
 
 // EnableVersion enables a version.
-func (s *StoreManager) EnableVersion(url, version string) error {
-	m, err := s.meta.GetImport(url)
+func (s *StoreManager) EnableVersion(ctx context.Context, url, version string) error {
+	m, err := s.meta.GetImport(ctx, url)
 	if err != nil {
 		return err
 	}
 
-	versions, err := s.meta.GetVersions(m)
+	versions, err := s.committedVersions(ctx, m)
 	if err != nil {
 		return err
 	}
@@ -136,34 +281,104 @@ func (s *StoreManager) EnableVersion(url, version string) error {
 	}
 
 	if v != nil {
-		return s.meta.EnableVersion(m, v)
+		return s.meta.EnableVersion(ctx, m, v)
 	}
 
 	return nil
 }
 
 // DeleteImport deletes an import and all its versions.
-func (s *StoreManager) DeleteImport(url string) error {
-	versions, err := s.GetVersions(url)
+func (s *StoreManager) DeleteImport(ctx context.Context, url string) error {
+	m, err := s.meta.GetImport(ctx, url)
 	if err != nil {
 		return err
 	}
 
-	if err := s.meta.DeleteImport(url); err != nil {
+	versions, err := s.meta.GetVersions(ctx, m)
+	if err != nil {
 		return err
 	}
 
 	for _, v := range versions {
-		s.bin.Delete(v)
+		if err := s.DeleteVersion(ctx, m, v); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return s.meta.DeleteImport(ctx, url)
 }
 
 // DeleteVersion deletes a version.
-func (s *StoreManager) DeleteVersion(m *models.Import, v *models.Version) error {
-	if err := s.meta.DeleteVersion(m, v); err != nil {
+func (s *StoreManager) DeleteVersion(ctx context.Context, m *models.Import, v *models.Version) error {
+	state, since := v.State, v.StateSince
+	v.State, v.StateSince = models.StateDeleting, time.Now().UTC()
+	if err := s.meta.UpdateVersion(ctx, v); err != nil {
+		v.State, v.StateSince = state, since
 		return err
 	}
-	return s.bin.Delete(v)
+
+	if err := s.bin.Delete(ctx, v); err != nil {
+		v.State, v.StateSince = state, since
+		s.meta.UpdateVersion(context.WithoutCancel(ctx), v)
+		return err
+	}
+
+	return s.meta.DeleteVersion(ctx, m, v)
+}
+
+// Recover completes or undoes operations that were interrupted, for example by a crash.
+// Versions still being added are removed along with any part of their binary, and Versions
+// being deleted are deleted. Only Versions that entered their state more than olderThan ago are
+// touched, so when several registry instances share their stores, olderThan must exceed the longest upload.
+// Returns the number of Versions that were recovered.
+func (s *StoreManager) Recover(ctx context.Context, olderThan time.Duration) (int, error) {
+	imports, err := s.meta.ListImports(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	count := 0
+
+	for _, m := range imports {
+		versions, err := s.meta.GetVersions(ctx, m)
+		if err == util.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+
+		for _, v := range versions {
+			if v.State == models.StateCommitted {
+				continue
+			}
+			// Versions stored before StateSince was recorded entered their state when published.
+			since := v.StateSince
+			if since.IsZero() {
+				since = v.Published
+			}
+			if since.After(cutoff) {
+				continue
+			}
+
+			if err := s.bin.Delete(ctx, v); err != nil {
+				return count, err
+			}
+			if err := s.meta.DeleteVersion(ctx, m, v); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// countWriter counts the bytes written to it.
+type countWriter int64
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	*w += countWriter(len(p))
+	return len(p), nil
 }
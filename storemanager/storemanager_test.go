@@ -0,0 +1,412 @@
+package storemanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/binstore"
+	"github.com/deejross/dep-registry/metastore"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/util"
+)
+
+var errFailed = errors.New("Failed")
+
+// failingBinStore fails Add or Delete on demand.
+type failingBinStore struct {
+	binstore.BinStore
+	failAdd    bool
+	failDelete bool
+
+	// afterList, if set, runs once List has listed the binaries.
+	afterList func()
+}
+
+func (s *failingBinStore) Add(ctx context.Context, v *models.Version, reader io.Reader) error {
+	if s.failAdd {
+		// Store part of the binary before failing, like a write interrupted by a full disk.
+		s.BinStore.Add(ctx, v, io.LimitReader(reader, 2))
+		return errFailed
+	}
+	return s.BinStore.Add(ctx, v, reader)
+}
+
+func (s *failingBinStore) Delete(ctx context.Context, v *models.Version) error {
+	if s.failDelete {
+		return errFailed
+	}
+	return s.BinStore.Delete(ctx, v)
+}
+
+func (s *failingBinStore) List(ctx context.Context) ([]string, error) {
+	ids, err := s.BinStore.List(ctx)
+	if s.afterList != nil {
+		s.afterList()
+	}
+	return ids, err
+}
+
+func newTestStoreManager() (*StoreManager, *failingBinStore, metastore.MetaStore) {
+	bin := &failingBinStore{BinStore: binstore.NewMemoryBinStore()}
+	meta := metastore.NewMemoryMetaStore()
+	return NewStoreManager(bin, meta), bin, meta
+}
+
+func TestAddCommits(t *testing.T) {
+	ctx := context.Background()
+
+	sm, _, _ := newTestStoreManager()
+	m := models.NewImport("example.com/pkg")
+	v := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+
+	if err := sm.Add(ctx, m, v, bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := sm.GetVersion(ctx, m.ImportURL, "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != models.StateCommitted {
+		t.Fatal("Expected committed version, got state", got.State)
+	}
+	if got.Digest != "sha256:0eb3e36bfb24dcd9bb1d1bece1531216b59539a8fde17ee80224af0653c92aa3" {
+		t.Fatal("Unexpected digest", got.Digest)
+	}
+	if got.Size != 7 {
+		t.Fatal("Expected the size of the binary, got", got.Size)
+	}
+}
+
+func TestAddRollsBack(t *testing.T) {
+	ctx := context.Background()
+
+	sm, bin, meta := newTestStoreManager()
+	m := models.NewImport("example.com/pkg")
+	v := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+
+	bin.failAdd = true
+	if err := sm.Add(ctx, m, v, bytes.NewReader([]byte("archive"))); err != errFailed {
+		t.Fatal("Expected errFailed, got", err)
+	}
+
+	versions, err := meta.GetVersions(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Fatal("Expected version metadata to be rolled back, got", versions)
+	}
+	if _, err := bin.Get(ctx, v); err != util.ErrNotFound {
+		t.Fatal("Expected partial binary to be removed, got", err)
+	}
+
+	bin.failAdd = false
+	if err := sm.Add(ctx, m, v, bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal("Expected the version to be publishable again, got", err)
+	}
+}
+
+// cancellingReader cancels a context after its first read, like a client disconnecting part way through an upload.
+type cancellingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	defer r.cancel()
+	return r.r.Read(p[:1])
+}
+
+func TestAddCancelledRollsBack(t *testing.T) {
+	// The BoltDB MetaStore refuses work once the context is done, so the rollback must not use it.
+	meta, err := metastore.Resolve("boltdb://" + filepath.Join(t.TempDir(), "metastore.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := NewStoreManager(binstore.NewMemoryBinStore(), meta)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := models.NewImport("example.com/pkg")
+	v := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+	reader := &cancellingReader{r: bytes.NewReader([]byte("archive")), cancel: cancel}
+	if err := sm.Add(ctx, m, v, reader); err != context.Canceled {
+		t.Fatal("Expected context.Canceled, got", err)
+	}
+
+	versions, err := meta.GetVersions(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Fatal("Expected version metadata to be rolled back, got", versions)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+
+	sm, bin, _ := newTestStoreManager()
+	m := models.NewImport("example.com/pkg")
+	m.Description = "restored"
+	v := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+	v.Disabled = true
+	v.Digest = "sha256:0eb3e36b0f7e5b2e8a3bf2e8e5fc5e7b5e0d63d5a0f51a3b8d1a3f4ab8c52aa3"
+
+	if err := sm.Restore(ctx, m, v, bytes.NewReader([]byte("tampered"))); err != ErrDigestMismatch {
+		t.Fatal("Expected ErrDigestMismatch, got", err)
+	}
+	if _, err := sm.GetVersion(ctx, m.ImportURL, "1.0.0"); err != models.ErrVersionNotFound {
+		t.Fatal("Expected mismatched version to be rolled back, got", err)
+	}
+	if _, err := bin.Get(ctx, v); err != util.ErrNotFound {
+		t.Fatal("Expected mismatched binary to be deleted, got", err)
+	}
+
+	v.Digest = ""
+	if err := sm.Restore(ctx, m, v, bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := sm.GetVersion(ctx, m.ImportURL, "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Disabled || got.BinID != v.BinID || !got.Published.Equal(v.Published) {
+		t.Fatal("Expected restored version to keep its fields, got", got)
+	}
+	if imp, err := sm.Get(ctx, m.ImportURL); err != nil || imp.Description != "restored" {
+		t.Fatal("Expected restored import, got", imp, err)
+	}
+
+	if err := sm.Restore(ctx, m, v, bytes.NewReader([]byte("archive"))); err != util.ErrAlreadyExists {
+		t.Fatal("Expected ErrAlreadyExists, got", err)
+	}
+}
+
+func TestDeleteVersionRollsBack(t *testing.T) {
+	ctx := context.Background()
+
+	sm, bin, _ := newTestStoreManager()
+	m := models.NewImport("example.com/pkg")
+	v := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+	if err := sm.Add(ctx, m, v, bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+
+	bin.failDelete = true
+	if err := sm.DeleteImport(ctx, m.ImportURL); err != errFailed {
+		t.Fatal("Expected errFailed, got", err)
+	}
+
+	got, err := sm.GetVersion(ctx, m.ImportURL, "1.0.0")
+	if err != nil {
+		t.Fatal("Expected version to remain after a failed delete, got", err)
+	}
+	if _, err := sm.GetVersionBinary(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+
+	bin.failDelete = false
+	if err := sm.DeleteImport(ctx, m.ImportURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bin.Get(ctx, v); err != util.ErrNotFound {
+		t.Fatal("Expected binary to be deleted, got", err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	ctx := context.Background()
+
+	sm, bin, meta := newTestStoreManager()
+	m := models.NewImport("example.com/pkg")
+	if err := meta.AddImportIfNotExists(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+	pending.State = models.StatePending
+	deleting := models.NewVersion(m, "1.1.0", models.ArchTarGz)
+	deleting.State = models.StateDeleting
+	committed := models.NewVersion(m, "1.2.0", models.ArchTarGz)
+
+	for _, v := range []*models.Version{pending, deleting, committed} {
+		if err := meta.AddVersion(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+		if err := bin.Add(ctx, v, bytes.NewReader([]byte("archive"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := sm.GetVersion(ctx, m.ImportURL, "1.0.0"); err != models.ErrVersionNotFound {
+		t.Fatal("Expected pending version to be hidden, got", err)
+	}
+
+	n, err := sm.Recover(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatal("Expected 2 versions to be recovered, got", n)
+	}
+
+	versions, err := meta.GetVersions(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Name != "1.2.0" {
+		t.Fatal("Expected only the committed version to remain, got", versions)
+	}
+	for _, v := range []*models.Version{pending, deleting} {
+		if _, err := bin.Get(ctx, v); err != util.ErrNotFound {
+			t.Fatal("Expected binary of", v.Name, "to be deleted, got", err)
+		}
+	}
+}
+
+func TestRecoverRestoreInProgress(t *testing.T) {
+	ctx := context.Background()
+
+	sm, _, meta := newTestStoreManager()
+	m := models.NewImport("example.com/pkg")
+	v := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+	v.Published = time.Now().Add(-time.Hour).UTC()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- sm.Restore(ctx, m, v, pr)
+	}()
+
+	// Once the first write is read the Version has been added and its binary is being stored.
+	if _, err := pw.Write([]byte("arch")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := sm.Recover(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatal("Expected the restore in progress to be left alone, got", n, "recovered")
+	}
+
+	pw.Write([]byte("ive"))
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := meta.GetVersions(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].State != models.StateCommitted || !versions[0].Published.Equal(v.Published) {
+		t.Fatal("Expected the restored version to keep its publish time, got", versions)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+
+	sm, bin, meta := newTestStoreManager()
+	m := models.NewImport("example.com/pkg")
+
+	good := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+	dangling := models.NewVersion(m, "1.1.0", models.ArchTarGz)
+	corrupt := models.NewVersion(m, "1.2.0", models.ArchTarGz)
+	for _, v := range []*models.Version{good, dangling, corrupt} {
+		if err := sm.Add(ctx, m, v, bytes.NewReader([]byte("archive"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orphan := &models.Version{BinID: "orphan"}
+	if err := bin.Add(ctx, orphan, bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+	bin.Delete(ctx, dangling)
+	bin.Delete(ctx, corrupt)
+	bin.Add(ctx, corrupt, bytes.NewReader([]byte("tampered")))
+
+	report, err := sm.Check(ctx, CheckOptions{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 3 {
+		t.Fatal("Expected 3 versions to be checked, got", report.Checked)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0] != "orphan" {
+		t.Fatal("Expected orphan, got", report.Orphans)
+	}
+	if len(report.Dangling) != 1 || report.Dangling[0].Name != "1.1.0" {
+		t.Fatal("Expected 1.1.0 to be dangling, got", report.Dangling)
+	}
+	if len(report.Corrupt) != 1 || report.Corrupt[0].Name != "1.2.0" {
+		t.Fatal("Expected 1.2.0 to be corrupt, got", report.Corrupt)
+	}
+	if report.Repaired {
+		t.Fatal("Expected a dry run")
+	}
+	if _, err := bin.Get(ctx, orphan); err != nil {
+		t.Fatal("Expected dry run to keep the orphan, got", err)
+	}
+
+	if _, err := sm.Check(ctx, CheckOptions{Verify: true, Repair: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bin.Get(ctx, orphan); err != util.ErrNotFound {
+		t.Fatal("Expected orphan to be deleted, got", err)
+	}
+
+	versions, err := meta.GetVersions(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range versions {
+		if v.Disabled != (v.Name != "1.0.0") {
+			t.Fatal("Expected only broken versions to be disabled, got", v.Name, v.Disabled)
+		}
+	}
+}
+
+func TestCheckConcurrentAdd(t *testing.T) {
+	ctx := context.Background()
+
+	sm, bin, meta := newTestStoreManager()
+	m := models.NewImport("example.com/pkg")
+	v := models.NewVersion(m, "1.0.0", models.ArchTarGz)
+
+	// The Version is committed after the binaries are listed, before the Versions are.
+	bin.afterList = func() {
+		bin.afterList = nil
+		if err := sm.Add(ctx, m, v, bytes.NewReader([]byte("archive"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := sm.Check(ctx, CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 1 || len(report.Dangling) != 0 {
+		t.Fatal("Expected the new version not to be dangling, got", report.Dangling)
+	}
+
+	versions, err := meta.GetVersions(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Disabled {
+		t.Fatal("Expected the new version to be left enabled, got", versions)
+	}
+}
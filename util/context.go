@@ -0,0 +1,34 @@
+package util
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// contextReader fails reads once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// NewContextReader returns a Reader that reads from r until ctx is done, after which reads fail with ctx.Err().
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ReadAll reads from r until EOF, failing with ctx.Err() if ctx is done first.
+func ReadAll(ctx context.Context, r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(NewContextReader(ctx, r))
+	if err != nil {
+		return nil, err
+	}
+	return data, ctx.Err()
+}
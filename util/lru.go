@@ -0,0 +1,125 @@
+package util
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRU is a size-bounded cache that evicts the least recently used entry when full
+// and expires entries after a time-to-live. It is safe for concurrent use.
+type LRU struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+	gen     uint64
+}
+
+type lruEntry struct {
+	key     string
+	val     interface{}
+	expires time.Time
+}
+
+// NewLRU creates a new LRU holding up to size entries, each for up to ttl. Entries do not expire if ttl is 0.
+func NewLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// Get the value of key, returns false if it is not cached or has expired.
+func (c *LRU) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*lruEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return entry.val, true
+}
+
+// Generation returns a value that changes whenever an entry is removed. Take it before reading
+// the value to cache and pass it to Add, so a value read before a concurrent write is not cached.
+func (c *LRU) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// Add a value to the cache unless an entry has been removed since gen was returned by Generation.
+func (c *LRU) Add(key string, val interface{}, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen || c.size <= 0 {
+		return
+	}
+
+	entry := &lruEntry{
+		key:     key,
+		val:     val,
+		expires: time.Now().Add(c.ttl),
+	}
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Remove keys from the cache.
+func (c *LRU) Remove(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Purge removes every entry from the cache.
+func (c *LRU) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+// Len returns the number of entries in the cache, including any that have expired but not been removed.
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
@@ -0,0 +1,59 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRU(2, 0)
+	c.Add("a", 1, c.Generation())
+	c.Add("b", 2, c.Generation())
+
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("Expected a to be cached")
+	}
+	c.Add("c", 3, c.Generation())
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("Expected b to be evicted")
+	}
+	if val, ok := c.Get("a"); !ok || val.(int) != 1 {
+		t.Fatal("Expected a to be kept, got", val)
+	}
+	if c.Len() != 2 {
+		t.Fatal("Expected 2 entries, got", c.Len())
+	}
+}
+
+func TestLRUExpires(t *testing.T) {
+	c := NewLRU(10, time.Millisecond)
+	c.Add("a", 1, c.Generation())
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("Expected a to expire")
+	}
+}
+
+func TestLRUGeneration(t *testing.T) {
+	c := NewLRU(10, time.Minute)
+	gen := c.Generation()
+
+	// A value read before a concurrent write must not be cached.
+	c.Remove("a")
+	c.Add("a", "stale", gen)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("Expected stale value not to be cached")
+	}
+
+	c.Add("a", "fresh", c.Generation())
+	if val, ok := c.Get("a"); !ok || val.(string) != "fresh" {
+		t.Fatal("Expected fresh value, got", val)
+	}
+
+	c.Purge()
+	if _, ok := c.Get("a"); ok || c.Len() != 0 {
+		t.Fatal("Expected cache to be empty after Purge")
+	}
+}
@@ -1,32 +1,238 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/auth/oidc"
+	"github.com/deejross/dep-registry/migrate"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/storemanager"
+	"github.com/deejross/dep-registry/util"
 )
 
-// Login and generate a token.
+// Login and generate a token, users with two-factor authentication enabled also give their code as otp.
 func (r *Router) Login(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Read)
+	defer cancel()
+
 	username, password, ok := req.BasicAuth()
 	if !ok {
 		r.WriteError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	token, err := r.gate.Login(username, password)
+	tokens, err := r.gate.Login(ctx, username, password, req.FormValue("otp"), remoteIP(req))
+	if err == auth.ErrTooManyAttempts {
+		r.WriteError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
 	if err != nil {
 		r.WriteError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": token,
-	})
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// Refresh exchanges the refresh token given by refresh_token for new tokens.
+func (r *Router) Refresh(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Read)
+	defer cancel()
+
+	if req.Method != "POST" {
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use POST to refresh a token")
+		return
+	}
+
+	tokens, err := r.gate.Refresh(ctx, req.FormValue("refresh_token"))
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// Logout revokes the token of the request and the refresh token given by refresh_token, either may be missing.
+func (r *Router) Logout(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Write)
+	defer cancel()
+
+	if req.Method != "POST" {
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use POST to log out")
+		return
+	}
+
+	if err := r.gate.Logout(ctx, r.GetToken(req), req.FormValue("refresh_token")); err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	r.WriteOK(w)
+}
+
+// JWKS returns the public keys that verify login tokens, for other services to verify them.
+func (r *Router) JWKS(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	json.NewEncoder(w).Encode(r.gate.JWKS())
+}
+
+// OIDC handles the OpenID Connect login flows. A browser is sent to login, which redirects it to the
+// identity provider and back to callback. A CLI starts with device and polls token until the user has logged in.
+func (r *Router) OIDC(w http.ResponseWriter, req *http.Request, action string) {
+	if r.oidc == nil {
+		r.WriteError(w, http.StatusNotFound, "OIDC login is not configured")
+		return
+	}
+
+	switch action {
+	case "login":
+		r.OIDCLogin(w, req)
+	case "callback":
+		r.OIDCCallback(w, req)
+	case "device":
+		r.OIDCDevice(w, req)
+	case "token":
+		r.OIDCToken(w, req)
+	default:
+		r.WriteError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// OIDCLogin redirects the browser to the identity provider. Users with two-factor authentication enabled
+// give their code as otp, it is checked once they are back.
+func (r *Router) OIDCLogin(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Read)
+	defer cancel()
+
+	ar, err := r.oidc.NewAuthRequest(req.FormValue("otp"))
+	if err != nil {
+		r.WriteError(w, 500, err.Error())
+		return
+	}
+
+	u, err := r.oidc.AuthCodeURL(ctx, ar)
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	http.SetCookie(w, r.oidc.Cookie(ar))
+	http.Redirect(w, req, u, http.StatusFound)
+}
+
+// OIDCCallback completes the login the identity provider redirected the browser back from and generates tokens.
+func (r *Router) OIDCCallback(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Read)
+	defer cancel()
+
+	q := req.URL.Query()
+	if e := q.Get("error"); len(e) > 0 {
+		r.WriteError(w, http.StatusUnauthorized, (&oidc.Error{Code: e, Description: q.Get("error_description")}).Error())
+		return
+	}
+
+	c, err := req.Cookie(oidc.CookieName)
+	if err != nil {
+		r.WriteError(w, http.StatusUnauthorized, oidc.ErrInvalidState.Error())
+		return
+	}
+	ar, err := oidc.ParseCookie(c)
+	if err != nil {
+		r.WriteError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	login, err := r.oidc.Exchange(ctx, ar, q.Get("state"), q.Get("code"))
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	// The login has been used, remove it from the browser.
+	c = r.oidc.Cookie(ar)
+	c.Value = ""
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+
+	r.loginExternal(ctx, w, req, login, ar.OTP)
+}
+
+// OIDCDevice starts a device code login, returning the code the user enters at the identity provider.
+func (r *Router) OIDCDevice(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Read)
+	defer cancel()
+
+	if req.Method != "POST" {
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use POST to start a device login")
+		return
+	}
+
+	da, err := r.oidc.StartDevice(ctx)
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(da)
+}
+
+// OIDCToken generates tokens once the user has completed the device code login given by device_code,
+// users with two-factor authentication enabled also give their code as otp. Until then, a 400 with the
+// error authorization_pending or slow_down is returned.
+func (r *Router) OIDCToken(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Read)
+	defer cancel()
+
+	if req.Method != "POST" {
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use POST to poll a device login")
+		return
+	}
+
+	login, err := r.oidc.PollDevice(ctx, req.FormValue("device_code"))
+	if oauthErr, ok := err.(*oidc.Error); ok {
+		r.WriteError(w, 400, oauthErr.Code)
+		return
+	}
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	r.loginExternal(ctx, w, req, login, req.FormValue("otp"))
 }
 
-// GetToken gets the token from the Request.
+// loginExternal writes the tokens the Gate generates for a user the identity provider logged in.
+func (r *Router) loginExternal(ctx context.Context, w http.ResponseWriter, req *http.Request, login *auth.ExternalLogin, otp string) {
+	tokens, err := r.gate.LoginExternal(ctx, login, otp, remoteIP(req))
+	if err == auth.ErrTooManyAttempts {
+		r.WriteError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// GetToken gets the token from the Request. Personal access tokens may also be given as the password
+// of basic auth, for clients that do not support bearer tokens.
 func (r *Router) GetToken(req *http.Request) string {
+	if _, password, ok := req.BasicAuth(); ok && strings.HasPrefix(password, auth.AccessTokenPrefix) {
+		return password
+	}
+
 	a := req.Header.Get("Authorization")
 	expected := "Bearer"
 	if len(a) > len(expected)+2 {
@@ -35,38 +241,407 @@ func (r *Router) GetToken(req *http.Request) string {
 	return ""
 }
 
+// remoteIP returns the IP address of the client of a request.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
 // GetBinary gets the binary for the given version, or latest version if version string is empty.
 func (r *Router) GetBinary(w http.ResponseWriter, req *http.Request, importURL, version string) {
+	ctx, cancel := requestContext(req, r.timeouts.Read)
+	defer cancel()
+
 	token := r.GetToken(req)
-	reader, err := r.gate.GetVersionBinary(token, importURL, version)
+	reader, err := r.gate.GetVersionBinary(ctx, token, importURL, version)
 	if err != nil {
-		r.WriteError(w, 401, err.Error())
+		r.WriteGateError(w, err)
+		return
+	}
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
 	}
 
+	// The content type is detected from the first 512 bytes, binaries may be shorter.
 	buf := make([]byte, 512)
-	_, err = reader.Read(buf)
-	if err != nil {
+	n, err := io.ReadFull(reader, buf)
+	if err == context.DeadlineExceeded {
+		r.WriteGateError(w, err)
+		return
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		r.WriteError(w, 500, err.Error())
+		return
 	}
 
-	ctype := http.DetectContentType(buf)
-	w.Header().Add("Content-Type", ctype)
-	w.Write(buf)
+	w.Header().Add("Content-Type", http.DetectContentType(buf[:n]))
+	w.Write(buf[:n])
 	io.Copy(w, reader)
 }
 
+// AccessTokenRequest describes a personal access token to create.
+type AccessTokenRequest struct {
+	Name      string       `json:"name"`
+	Scopes    []auth.Scope `json:"scopes"`
+	Prefix    string       `json:"prefix,omitempty"`
+	ExpiresAt time.Time    `json:"expires_at,omitempty"`
+}
+
+// AccessTokens lists the personal access tokens of the user with a GET and creates one with a POST.
+// A DELETE revokes the token with the given ID.
+func (r *Router) AccessTokens(w http.ResponseWriter, req *http.Request, id string) {
+	ctx, cancel := requestContext(req, r.timeouts.Write)
+	defer cancel()
+
+	token := r.GetToken(req)
+
+	switch {
+	case req.Method == "GET" && len(id) == 0:
+		tokens, err := r.gate.ListAccessTokens(ctx, token)
+		if err != nil {
+			r.WriteGateError(w, err)
+			return
+		}
+
+		for i, t := range tokens {
+			tokens[i] = withoutHash(t)
+		}
+		json.NewEncoder(w).Encode(tokens)
+	case req.Method == "POST" && len(id) == 0:
+		atr := &AccessTokenRequest{}
+		if err := json.NewDecoder(req.Body).Decode(atr); err != nil {
+			r.WriteError(w, 400, "Invalid request: "+err.Error())
+			return
+		}
+
+		pat, secret, err := r.gate.CreateAccessToken(ctx, token, atr.Name, atr.Scopes, atr.Prefix, atr.ExpiresAt)
+		if err == auth.ErrAccessTokenNameEmpty || err == auth.ErrInvalidScope {
+			r.WriteError(w, 400, err.Error())
+			return
+		}
+		if err != nil {
+			r.WriteGateError(w, err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			Token string `json:"token"`
+			*auth.AccessToken
+		}{secret, withoutHash(pat)})
+	case req.Method == "DELETE" && len(id) > 0:
+		if err := r.gate.RevokeAccessToken(ctx, token, id); err == auth.ErrAccessTokenDoesNotExist {
+			r.WriteError(w, http.StatusNotFound, err.Error())
+		} else if err != nil {
+			r.WriteGateError(w, err)
+		} else {
+			r.WriteOK(w)
+		}
+	default:
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use GET to list, POST to create or DELETE to revoke access tokens")
+	}
+}
+
+// TOTP manages two-factor authentication for the user of the request. A POST enrolls them, returning the
+// secret and otpauth URI for their authenticator app, which is enabled by a POST to confirm with a code,
+// returning their recovery codes. A DELETE with a code or recovery code turns it off.
+func (r *Router) TOTP(w http.ResponseWriter, req *http.Request, action string) {
+	ctx, cancel := requestContext(req, r.timeouts.Write)
+	defer cancel()
+
+	token := r.GetToken(req)
+
+	switch {
+	case req.Method == "POST" && len(action) == 0:
+		enrollment, err := r.gate.EnrollTOTP(ctx, token)
+		if err != nil {
+			r.writeTOTPError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(enrollment)
+	case req.Method == "POST" && action == "confirm":
+		codes, err := r.gate.ConfirmTOTP(ctx, token, req.FormValue("code"))
+		if err != nil {
+			r.writeTOTPError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+	case req.Method == "DELETE" && len(action) == 0:
+		if err := r.gate.DisableTOTP(ctx, token, req.FormValue("code")); err != nil {
+			r.writeTOTPError(w, err)
+			return
+		}
+		r.WriteOK(w)
+	default:
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use POST to enroll, POST to confirm or DELETE to disable two-factor authentication")
+	}
+}
+
+// writeTOTPError writes an error returned by the two-factor authentication methods of the Gate.
+func (r *Router) writeTOTPError(w http.ResponseWriter, err error) {
+	if err == auth.ErrNotSupported || err == auth.ErrTOTPNotEnrolled || err == auth.ErrTOTPAlreadyEnabled || err == auth.ErrUsernameEmpty {
+		r.WriteError(w, 400, err.Error())
+		return
+	}
+	r.WriteGateError(w, err)
+}
+
+// ResetTOTP turns off two-factor authentication for the user given by username with a DELETE, for users
+// who have lost their authenticator app and recovery codes.
+func (r *Router) ResetTOTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	if req.Method != "DELETE" {
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use DELETE to reset two-factor authentication")
+		return
+	}
+
+	if err := r.gate.ResetTOTP(ctx, r.GetToken(req), req.URL.Query().Get("username")); err != nil {
+		r.writeTOTPError(w, err)
+		return
+	}
+
+	r.WriteOK(w)
+}
+
+// IdentityRequest describes an external identity to link to a user.
+type IdentityRequest struct {
+	Issuer   string `json:"issuer"`
+	Subject  string `json:"subject"`
+	Username string `json:"username"`
+}
+
+// Identities lists the external identities linked to the user given by username with a GET. A POST links
+// an identity to a user, so they can log in with it, and a DELETE unlinks the identity given by issuer and subject.
+func (r *Router) Identities(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	token := r.GetToken(req)
+	q := req.URL.Query()
+
+	var err error
+	switch req.Method {
+	case "GET":
+		var identities []*auth.Identity
+		identities, err = r.gate.ListIdentities(ctx, token, q.Get("username"))
+		if err == nil {
+			json.NewEncoder(w).Encode(identities)
+			return
+		}
+	case "POST":
+		body := &IdentityRequest{}
+		if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+			r.WriteError(w, 400, "Invalid request: "+err.Error())
+			return
+		}
+		err = r.gate.LinkIdentity(ctx, token, body.Issuer, body.Subject, body.Username)
+	case "DELETE":
+		err = r.gate.UnlinkIdentity(ctx, token, q.Get("issuer"), q.Get("subject"))
+	default:
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use GET to list, POST to link or DELETE to unlink identities")
+		return
+	}
+
+	if err == auth.ErrNotSupported || err == auth.ErrIdentityEmpty || err == auth.ErrUsernameEmpty || err == auth.ErrUserDoesNotExist {
+		r.WriteError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+	r.WriteOK(w)
+}
+
+// withoutHash returns a copy of a personal access token without its hash, which is never sent to clients.
+func withoutHash(t *auth.AccessToken) *auth.AccessToken {
+	c := *t
+	c.Hash = ""
+	return &c
+}
+
+// Teams lists the teams with a GET and adds one with a POST, or with a name gets it with a GET and
+// deletes it with a DELETE. With a name and member, a PUT adds the user to the team and a DELETE removes them.
+func (r *Router) Teams(w http.ResponseWriter, req *http.Request, name, member string) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	token := r.GetToken(req)
+
+	var result interface{}
+	var err error
+	switch {
+	case len(member) > 0 && req.Method == "PUT":
+		err = r.gate.AddTeamMember(ctx, token, name, member)
+	case len(member) > 0 && req.Method == "DELETE":
+		err = r.gate.RemoveTeamMember(ctx, token, name, member)
+	case len(member) > 0:
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use PUT to add or DELETE to remove team members")
+		return
+	case len(name) > 0 && req.Method == "GET":
+		result, err = r.gate.GetTeam(ctx, token, name)
+	case len(name) > 0 && req.Method == "DELETE":
+		err = r.gate.DeleteTeam(ctx, token, name)
+	case len(name) == 0 && req.Method == "GET":
+		result, err = r.gate.ListTeams(ctx, token)
+	case len(name) == 0 && req.Method == "POST":
+		team := &auth.Team{}
+		if err := json.NewDecoder(req.Body).Decode(team); err != nil {
+			r.WriteError(w, 400, "Invalid request: "+err.Error())
+			return
+		}
+		err = r.gate.AddTeam(ctx, token, team)
+	default:
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use GET to list, POST to add or DELETE to delete teams")
+		return
+	}
+
+	switch err {
+	case nil:
+	case auth.ErrTeamDoesNotExist, auth.ErrUserDoesNotExist:
+		r.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	case auth.ErrTeamAlreadyExists, auth.ErrTeamNameEmpty, auth.ErrNotSupported:
+		r.WriteError(w, 400, err.Error())
+		return
+	default:
+		r.WriteGateError(w, err)
+		return
+	}
+
+	if result == nil {
+		r.WriteOK(w)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// Organizations lists, adds, gets, updates and deletes Organizations, and claims and releases their prefixes.
+func (r *Router) Organizations(w http.ResponseWriter, req *http.Request, name, prefix string) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	token := r.GetToken(req)
+
+	var result interface{}
+	var err error
+	switch {
+	case len(prefix) > 0 && req.Method == "PUT":
+		err = r.gate.ClaimPrefix(ctx, token, name, prefix)
+	case len(prefix) > 0 && req.Method == "DELETE":
+		err = r.gate.ReleasePrefix(ctx, token, name, prefix)
+	case len(prefix) > 0:
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use PUT to claim or DELETE to release prefixes")
+		return
+	case len(name) > 0 && req.Method == "GET":
+		result, err = r.gate.GetOrganization(ctx, token, name)
+	case len(name) > 0 && req.Method == "PUT":
+		org := &models.Organization{}
+		if err := json.NewDecoder(req.Body).Decode(org); err != nil {
+			r.WriteError(w, 400, "Invalid request: "+err.Error())
+			return
+		}
+		org.Name = name
+		err = r.gate.UpdateOrganization(ctx, token, org)
+	case len(name) > 0 && req.Method == "DELETE":
+		err = r.gate.DeleteOrganization(ctx, token, name)
+	case len(name) == 0 && req.Method == "GET":
+		result, err = r.gate.ListOrganizations(ctx, token)
+	case len(name) == 0 && req.Method == "POST":
+		org := &models.Organization{}
+		if err := json.NewDecoder(req.Body).Decode(org); err != nil {
+			r.WriteError(w, 400, "Invalid request: "+err.Error())
+			return
+		}
+		err = r.gate.AddOrganization(ctx, token, org)
+	default:
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use GET to list, POST to add, PUT to update or DELETE to delete organizations")
+		return
+	}
+
+	switch err {
+	case nil:
+	case util.ErrNotFound, auth.ErrTeamDoesNotExist, auth.ErrUserDoesNotExist:
+		r.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	case util.ErrAlreadyExists, models.ErrPrefixClaimed, models.ErrOrganizationNameEmpty, models.ErrInvalidPrefix, models.ErrInvalidGrant:
+		r.WriteError(w, 400, err.Error())
+		return
+	default:
+		r.WriteGateError(w, err)
+		return
+	}
+
+	if result == nil {
+		r.WriteOK(w)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// Grants lists the roles granted on an Import with a GET. A POST with a Grant gives its user or team
+// the role, and a DELETE with user or team removes their role.
+func (r *Router) Grants(w http.ResponseWriter, req *http.Request, importURL string) {
+	ctx, cancel := requestContext(req, r.timeouts.Write)
+	defer cancel()
+
+	token := r.GetToken(req)
+
+	var err error
+	switch req.Method {
+	case "GET":
+		var grants []models.Grant
+		grants, err = r.gate.GetGrants(ctx, token, importURL)
+		if err == nil {
+			json.NewEncoder(w).Encode(grants)
+			return
+		}
+	case "POST":
+		grant := models.Grant{}
+		if err := json.NewDecoder(req.Body).Decode(&grant); err != nil {
+			r.WriteError(w, 400, "Invalid request: "+err.Error())
+			return
+		}
+		err = r.gate.SetGrant(ctx, token, importURL, grant)
+	case "DELETE":
+		q := req.URL.Query()
+		err = r.gate.RemoveGrant(ctx, token, importURL, models.Grant{User: q.Get("user"), Team: q.Get("team")})
+	default:
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use GET to list, POST to set or DELETE to remove roles")
+		return
+	}
+
+	switch err {
+	case nil:
+		r.WriteOK(w)
+	case util.ErrNotFound, auth.ErrTeamDoesNotExist, auth.ErrUserDoesNotExist:
+		r.WriteError(w, http.StatusNotFound, err.Error())
+	case models.ErrInvalidGrant, auth.ErrNotSupported:
+		r.WriteError(w, 400, err.Error())
+	default:
+		r.WriteGateError(w, err)
+	}
+}
+
 // DeleteDisableImport decides if an import should be deleted or disabled.
 func (r *Router) DeleteDisableImport(w http.ResponseWriter, req *http.Request, importURL string, delete bool) {
+	ctx, cancel := requestContext(req, r.timeouts.Write)
+	defer cancel()
+
 	token := r.GetToken(req)
 	if delete {
-		if err := r.gate.DeleteImport(token, importURL); err != nil {
-			r.WriteError(w, 401, err.Error())
+		if err := r.gate.DeleteImport(ctx, token, importURL); err != nil {
+			r.WriteGateError(w, err)
 		} else {
 			r.WriteOK(w)
 		}
 	} else {
-		if err := r.gate.DisableImport(token, importURL); err != nil {
-			r.WriteError(w, 401, err.Error())
+		if err := r.gate.DisableImport(ctx, token, importURL); err != nil {
+			r.WriteGateError(w, err)
 		} else {
 			r.WriteOK(w)
 		}
@@ -75,18 +650,223 @@ func (r *Router) DeleteDisableImport(w http.ResponseWriter, req *http.Request, i
 
 // DeleteDisableVersion decides if a version should be deleted or disabled.
 func (r *Router) DeleteDisableVersion(w http.ResponseWriter, req *http.Request, importURL, version string, delete bool) {
+	ctx, cancel := requestContext(req, r.timeouts.Write)
+	defer cancel()
+
 	token := r.GetToken(req)
 	if delete {
-		if err := r.gate.DeleteVersion(token, importURL, version); err != nil {
-			r.WriteError(w, 401, err.Error())
+		if err := r.gate.DeleteVersion(ctx, token, importURL, version); err != nil {
+			r.WriteGateError(w, err)
 		} else {
 			r.WriteOK(w)
 		}
 	} else {
-		if err := r.gate.DisableVersion(token, importURL, version); err != nil {
-			r.WriteError(w, 401, err.Error())
+		if err := r.gate.DisableVersion(ctx, token, importURL, version); err != nil {
+			r.WriteGateError(w, err)
 		} else {
 			r.WriteOK(w)
 		}
 	}
 }
+
+// Check the stores for inconsistencies. Nothing is changed unless repair=true is given with a POST.
+func (r *Router) Check(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	token := r.GetToken(req)
+	opts := storemanager.CheckOptions{
+		Verify: req.URL.Query().Get("verify") == "true",
+		Repair: req.Method == "POST" && req.URL.Query().Get("repair") == "true",
+	}
+
+	report, err := r.gate.Check(ctx, token, opts)
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// Backup downloads a backup archive of the registry.
+func (r *Router) Backup(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	token := r.GetToken(req)
+	aw := &archiveWriter{w: w}
+
+	if _, err := r.gate.Backup(ctx, token, aw); err != nil {
+		if !aw.started {
+			r.WriteGateError(w, err)
+			return
+		}
+		// The status has already been sent, the truncated archive will fail to extract.
+		log.Println("While writing backup:", err)
+	}
+}
+
+// archiveWriter sends the headers of an archive download before the first write.
+type archiveWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (a *archiveWriter) Write(p []byte) (int, error) {
+	if !a.started {
+		a.started = true
+		a.w.Header().Set("Content-Type", "application/gzip")
+		a.w.Header().Set("Content-Disposition", `attachment; filename="dep-registry-`+time.Now().UTC().Format("20060102-150405")+`.tar.gz"`)
+	}
+	return a.w.Write(p)
+}
+
+// MigrateRequest gives the backends to copy the registry into, backends left empty are not migrated.
+type MigrateRequest struct {
+	AuthPath      string `json:"auth_path,omitempty"`
+	MetaStorePath string `json:"metastore_path,omitempty"`
+	BinStorePath  string `json:"binstore_path,omitempty"`
+	migrate.Options
+}
+
+// Migrate copies the registry into other backends, returning once the pass is complete.
+func (r *Router) Migrate(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	if req.Method != "POST" {
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use POST to migrate")
+		return
+	}
+
+	token := r.GetToken(req)
+	mr := &MigrateRequest{}
+	if err := json.NewDecoder(req.Body).Decode(mr); err != nil {
+		r.WriteError(w, 400, "Invalid request: "+err.Error())
+		return
+	}
+
+	report, err := r.gate.Migrate(ctx, token, mr.AuthPath, mr.MetaStorePath, mr.BinStorePath, mr.Options)
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// ReadOnly reports whether the registry is in read-only mode, a POST with enabled=true or false changes it.
+func (r *Router) ReadOnly(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	if req.Method == "POST" {
+		token := r.GetToken(req)
+		if err := r.gate.ChangeReadOnly(ctx, token, req.URL.Query().Get("enabled") == "true"); err != nil {
+			r.WriteGateError(w, err)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{
+		"read_only": r.gate.ReadOnly(),
+	})
+}
+
+// Sessions revokes every login and refresh token of the user given by username with a DELETE.
+func (r *Router) Sessions(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	if req.Method != "DELETE" {
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use DELETE to revoke sessions")
+		return
+	}
+
+	if err := r.gate.RevokeSessions(ctx, r.GetToken(req), req.URL.Query().Get("username")); err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	r.WriteOK(w)
+}
+
+// Lockouts lists the users and IP addresses with failed logins, a DELETE with username or ip forgets
+// their failed logins, lifting any lockout.
+func (r *Router) Lockouts(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	token := r.GetToken(req)
+
+	switch req.Method {
+	case "GET":
+		attempts, err := r.gate.ListLoginAttempts(ctx, token)
+		if err == auth.ErrNotSupported {
+			r.WriteError(w, 400, err.Error())
+			return
+		}
+		if err != nil {
+			r.WriteGateError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(attempts)
+	case "DELETE":
+		q := req.URL.Query()
+		err := r.gate.ClearLoginAttempts(ctx, token, q.Get("username"), q.Get("ip"))
+		if err == auth.ErrNotSupported || err == auth.ErrUsernameEmpty {
+			r.WriteError(w, 400, err.Error())
+			return
+		}
+		if err != nil {
+			r.WriteGateError(w, err)
+			return
+		}
+		r.WriteOK(w)
+	default:
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use GET to list or DELETE to clear lockouts")
+	}
+}
+
+// Cache returns the counters of the binary cache, a DELETE purges the BinIDs given by id, or every entry.
+func (r *Router) Cache(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	token := r.GetToken(req)
+
+	if req.Method == "DELETE" {
+		if err := r.gate.PurgeCache(ctx, token, req.URL.Query()["id"]...); err != nil {
+			r.WriteGateError(w, err)
+			return
+		}
+	}
+
+	stats, err := r.gate.CacheStats(ctx, token)
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(stats)
+}
+
+// Repair copies binaries to the replicas of the BinStore that are missing them.
+func (r *Router) Repair(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := requestContext(req, r.timeouts.Admin)
+	defer cancel()
+
+	if req.Method != "POST" {
+		r.WriteError(w, http.StatusMethodNotAllowed, "Use POST to repair")
+		return
+	}
+
+	report, err := r.gate.Repair(ctx, r.GetToken(req))
+	if err != nil {
+		r.WriteGateError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
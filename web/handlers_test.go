@@ -0,0 +1,85 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/deejross/dep-registry/auth"
+	"github.com/deejross/dep-registry/binstore"
+	"github.com/deejross/dep-registry/gate"
+	"github.com/deejross/dep-registry/metastore"
+	"github.com/deejross/dep-registry/models"
+	"github.com/deejross/dep-registry/storemanager"
+)
+
+// newRouter returns a Router with the public import example.com, whose version 1.0.0 is short
+// and 2.0.0 is longer than the bytes used to detect the content type.
+func newRouter(t *testing.T) (*Router, []byte) {
+	ctx := context.Background()
+	tm := auth.NewTokenManager([]byte("super-secret-key"), time.Minute)
+	a := auth.NewMemoryAuth(tm)
+	g := gate.NewGate(a, storemanager.NewStoreManager(binstore.NewMemoryBinStore(), metastore.NewMemoryMetaStore()), tm)
+
+	if err := a.AddUser(ctx, &auth.User{Username: "owner"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetPassword(ctx, "owner", "password"); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := g.Login(ctx, "owner", "password", "", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := bytes.Repeat([]byte("0123456789"), 100)
+	for version, content := range map[string][]byte{"1.0.0": []byte("archive"), "2.0.0": long} {
+		m := models.NewImport("example.com")
+		m.Owners = []string{"owner"}
+		v := models.NewVersion(m, version, models.ArchTarGz)
+		if err := g.Add(ctx, tokens.Token, m, v, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return NewRouter(g), long
+}
+
+func getBinary(r *Router, importURL, version string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/projects/"+url.PathEscape(importURL)+"/"+version, nil)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestGetBinary(t *testing.T) {
+	r, long := newRouter(t)
+
+	w := getBinary(r, "example.com", "1.0.0")
+	if w.Code != http.StatusOK || w.Body.String() != "archive" {
+		t.Fatal("Expected only the bytes of a short binary, got", w.Code, w.Body.String())
+	}
+	if ctype := w.Header().Get("Content-Type"); len(ctype) == 0 {
+		t.Fatal("Expected a content type")
+	}
+
+	w = getBinary(r, "example.com", "2.0.0")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), long) {
+		t.Fatal("Expected the whole binary, got", w.Code, w.Body.Len(), "bytes")
+	}
+}
+
+func TestGetBinaryErrors(t *testing.T) {
+	r, _ := newRouter(t)
+
+	if w := getBinary(r, "example.org", "1.0.0"); w.Code != http.StatusUnauthorized {
+		t.Fatal("Expected a 401 for a missing import, got", w.Code, w.Body.String())
+	}
+	if w := getBinary(r, "example.com", "9.9.9"); w.Code != http.StatusUnauthorized {
+		t.Fatal("Expected a 401 for a missing version, got", w.Code, w.Body.String())
+	}
+}
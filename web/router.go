@@ -1,17 +1,34 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/deejross/dep-registry/auth/oidc"
 	"github.com/deejross/dep-registry/gate"
 )
 
 // Router object.
 type Router struct {
-	gate *gate.Gate
+	gate     *gate.Gate
+	timeouts Timeouts
+	oidc     *oidc.Provider
+}
+
+// Timeouts bound how long each kind of request may run, zero means no limit.
+type Timeouts struct {
+	// Read covers logins and downloads.
+	Read time.Duration
+
+	// Write covers disabling and deleting Imports and Versions.
+	Write time.Duration
+
+	// Admin covers the admin API, such as fsck, backup and migrate.
+	Admin time.Duration
 }
 
 // NewRouter returns a new Router.
@@ -21,11 +38,23 @@ func NewRouter(gate *gate.Gate) *Router {
 	}
 }
 
+// SetTimeouts sets how long each kind of request may run.
+func (r *Router) SetTimeouts(timeouts Timeouts) {
+	r.timeouts = timeouts
+}
+
+// SetOIDC enables logging in through an OpenID Connect identity provider.
+func (r *Router) SetOIDC(p *oidc.Provider) {
+	r.oidc = p
+}
+
 // ServeHTTP handles the routing.
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if strings.HasPrefix(req.URL.Path, "/api/v1/") {
 		path := strings.Split(req.URL.Path[8:], "/")
 		r.API(w, req, path)
+	} else if req.URL.Path == "/.well-known/jwks.json" {
+		r.JWKS(w, req)
 	} else {
 		r.Static(w, req)
 	}
@@ -40,6 +69,15 @@ func (r *Router) WriteError(w http.ResponseWriter, status int, err string) {
 	json.NewEncoder(w).Encode(errM)
 }
 
+// WriteGateError writes an error returned by the Gate, requests that ran out of time are reported as such.
+func (r *Router) WriteGateError(w http.ResponseWriter, err error) {
+	if err == context.DeadlineExceeded {
+		r.WriteError(w, http.StatusGatewayTimeout, "Request timed out")
+		return
+	}
+	r.WriteError(w, 401, err.Error())
+}
+
 // WriteOK writes an OK message to the response.
 func (r *Router) WriteOK(w http.ResponseWriter) {
 	okM := map[string]string{
@@ -57,8 +95,86 @@ func (r *Router) API(w http.ResponseWriter, req *http.Request, path []string) {
 			switch path[1] {
 			case "login":
 				r.Login(w, req)
+			case "refresh":
+				r.Refresh(w, req)
+			case "logout":
+				r.Logout(w, req)
+			case "oidc":
+				action := ""
+				if len(path) > 2 {
+					action = path[2]
+				}
+				r.OIDC(w, req, action)
+			case "tokens":
+				id := ""
+				if len(path) > 2 {
+					id = path[2]
+				}
+				r.AccessTokens(w, req, id)
+			case "2fa":
+				action := ""
+				if len(path) > 2 {
+					action = path[2]
+				}
+				r.TOTP(w, req, action)
+			}
+		}
+	case "admin":
+		if len(path) > 1 {
+			switch path[1] {
+			case "fsck":
+				r.Check(w, req)
+			case "backup":
+				r.Backup(w, req)
+			case "migrate":
+				r.Migrate(w, req)
+			case "readonly":
+				r.ReadOnly(w, req)
+			case "cache":
+				r.Cache(w, req)
+			case "repair":
+				r.Repair(w, req)
+			case "sessions":
+				r.Sessions(w, req)
+			case "lockouts":
+				r.Lockouts(w, req)
+			case "2fa":
+				r.ResetTOTP(w, req)
+			case "identities":
+				r.Identities(w, req)
 			}
 		}
+	case "teams":
+		name, member := "", ""
+		if len(path) > 1 {
+			name = path[1]
+		}
+		if len(path) > 3 && path[2] == "members" {
+			member = path[3]
+		}
+		r.Teams(w, req, name, member)
+	case "orgs":
+		name, prefix := "", ""
+		if len(path) > 1 {
+			name = path[1]
+		}
+		if len(path) > 3 && path[2] == "prefixes" {
+			var err error
+			if prefix, err = url.PathUnescape(path[3]); err != nil {
+				r.WriteError(w, 400, "Invalid prefix: "+err.Error())
+				return
+			}
+		}
+		r.Organizations(w, req, name, prefix)
+	case "grants":
+		if len(path) > 1 {
+			importURL, err := url.PathUnescape(path[1])
+			if err != nil {
+				r.WriteError(w, 400, "Invalid URL: "+err.Error())
+				return
+			}
+			r.Grants(w, req, importURL)
+		}
 	case "projects":
 		if len(path) > 1 {
 			importURL, err := url.PathUnescape(path[1])
@@ -93,6 +209,15 @@ func (r *Router) API(w http.ResponseWriter, req *http.Request, path []string) {
 	}
 }
 
+// requestContext returns the context of a request, cancelled once timeout has passed if it is set.
+// The context is also cancelled when the client disconnects.
+func requestContext(req *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(req.Context())
+	}
+	return context.WithTimeout(req.Context(), timeout)
+}
+
 // Static handles static requests.
 func (r *Router) Static(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusNotFound)